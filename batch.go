@@ -0,0 +1,237 @@
+package golsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/vikramcse/go-lsm/internal/kv"
+)
+
+var errCorruptBatch = errors.New("corrupt write batch")
+
+// batch is a group of writes that is logged as a single WAL record and
+// applied to the memtables together. The entries get consecutive sequence
+// numbers starting at seq. The encoding is the WAL record payload:
+//
+//	[first sequence number (uint64)][entry count (uint32)]
+//	for each entry: [kind (uint8)][column family (uint32)]
+//	                [key length (uint32)][key][value length (uint32)][value]
+//
+// The column family is only present when the kind has batchColumnFamilyFlag
+// set; entries without it belong to the default column family, so batches
+// written before column families existed decode unchanged.
+type batch struct {
+	seq     uint64
+	entries []batchEntry
+}
+
+const batchColumnFamilyFlag = 0x80
+
+type batchEntry struct {
+	kind  kv.Kind
+	cf    uint32
+	key   []byte
+	value []byte
+}
+
+func (b *batch) put(cf uint32, key, value []byte) {
+	b.entries = append(b.entries, batchEntry{kind: kv.KindSet, cf: cf, key: key, value: value})
+}
+
+// putWithExpiry records a put of value that expires at expiry, in Unix
+// nanoseconds
+func (b *batch) putWithExpiry(cf uint32, key, value []byte, expiry int64) {
+	b.entries = append(b.entries, batchEntry{kind: kv.KindSetTTL, cf: cf, key: key, value: kv.EncodeExpiring(expiry, value)})
+}
+
+func (b *batch) delete(cf uint32, key []byte) {
+	b.entries = append(b.entries, batchEntry{kind: kv.KindDelete, cf: cf, key: key})
+}
+
+func (b *batch) merge(cf uint32, key, operand []byte) {
+	b.entries = append(b.entries, batchEntry{kind: kv.KindMerge, cf: cf, key: key, value: operand})
+}
+
+// deleteRange records a range deletion; the end key is stored as the value
+func (b *batch) deleteRange(cf uint32, start, end []byte) {
+	b.entries = append(b.entries, batchEntry{kind: kv.KindRangeDelete, cf: cf, key: start, value: end})
+}
+
+// apply inserts the entries into the memtables of their column families,
+// as returned by mems, with their sequence numbers. Entries for which mems
+// returns nil are skipped. It fails if a merge operand meets a damaged
+// entry.
+func (b *batch) apply(mems func(cf uint32) *MemTable, cmp Comparator) error {
+	for i, e := range b.entries {
+		seq := b.seq + uint64(i)
+		mem := mems(e.cf)
+		if mem == nil {
+			continue
+		}
+		switch e.kind {
+		case kv.KindRangeDelete:
+			mem.AddRangeTombstone(kv.RangeTombstone{Start: e.key, End: e.value, Seq: seq})
+		case kv.KindMerge:
+			if err := mem.merge(cmp, e.key, seq, e.value); err != nil {
+				return err
+			}
+		default:
+			mem.Put(e.key, kv.Entry{Kind: e.kind, Seq: seq, Value: e.value})
+		}
+	}
+	return nil
+}
+
+// lastSeq returns the sequence number of the last entry in the batch
+func (b *batch) lastSeq() uint64 {
+	return b.seq + uint64(len(b.entries)) - 1
+}
+
+func (b *batch) encode() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, b.seq)
+	binary.Write(buf, binary.LittleEndian, uint32(len(b.entries)))
+
+	for _, e := range b.entries {
+		if e.cf != 0 {
+			buf.WriteByte(byte(e.kind) | batchColumnFamilyFlag)
+			binary.Write(buf, binary.LittleEndian, e.cf)
+		} else {
+			buf.WriteByte(byte(e.kind))
+		}
+		binary.Write(buf, binary.LittleEndian, uint32(len(e.key)))
+		buf.Write(e.key)
+		binary.Write(buf, binary.LittleEndian, uint32(len(e.value)))
+		buf.Write(e.value)
+	}
+
+	return buf.Bytes()
+}
+
+func decodeBatch(data []byte) (*batch, error) {
+	buf := bytes.NewReader(data)
+	b := &batch{}
+
+	var count uint32
+	if err := binary.Read(buf, binary.LittleEndian, &b.seq); err != nil {
+		return nil, errCorruptBatch
+	}
+	if err := binary.Read(buf, binary.LittleEndian, &count); err != nil {
+		return nil, errCorruptBatch
+	}
+
+	for i := uint32(0); i < count; i++ {
+		kind, err := buf.ReadByte()
+		if err != nil {
+			return nil, errCorruptBatch
+		}
+		var cf uint32
+		if kind&batchColumnFamilyFlag != 0 {
+			kind &^= batchColumnFamilyFlag
+			if err := binary.Read(buf, binary.LittleEndian, &cf); err != nil {
+				return nil, errCorruptBatch
+			}
+		}
+		key, err := readLengthPrefixed(buf)
+		if err != nil {
+			return nil, errCorruptBatch
+		}
+		value, err := readLengthPrefixed(buf)
+		if err != nil {
+			return nil, errCorruptBatch
+		}
+		b.entries = append(b.entries, batchEntry{kind: kv.Kind(kind), cf: cf, key: key, value: value})
+	}
+
+	return b, nil
+}
+
+// readLengthPrefixed reads a uint32 length followed by that many bytes
+func readLengthPrefixed(buf *bytes.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(buf, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	if int64(n) > int64(buf.Len()) {
+		return nil, errors.New("length exceeds remaining data")
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(buf, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteBatch is a group of writes, to one or several column families, that
+// Write applies atomically: they are logged as a single WAL record, so after
+// a crash either all of them are recovered or none is. A nil column family
+// stands for the default one. The batch copies the keys and values given to
+// it.
+type WriteBatch struct {
+	entries []batchEntry
+	cfs     []*ColumnFamily // column family of each entry
+}
+
+// Put records setting the value for key in cf
+func (wb *WriteBatch) Put(cf *ColumnFamily, key, value []byte) {
+	wb.add(cf, kv.KindSet, key, value)
+}
+
+// Delete records removing key from cf
+func (wb *WriteBatch) Delete(cf *ColumnFamily, key []byte) {
+	wb.add(cf, kv.KindDelete, key, nil)
+}
+
+// DeleteRange records removing every key in [start, end) from cf
+func (wb *WriteBatch) DeleteRange(cf *ColumnFamily, start, end []byte) {
+	wb.add(cf, kv.KindRangeDelete, start, end)
+}
+
+// Merge records merging operand into the value of key in cf
+func (wb *WriteBatch) Merge(cf *ColumnFamily, key, operand []byte) {
+	wb.add(cf, kv.KindMerge, key, operand)
+}
+
+// Count returns the number of writes in the batch
+func (wb *WriteBatch) Count() int {
+	return len(wb.entries)
+}
+
+func (wb *WriteBatch) add(cf *ColumnFamily, kind kv.Kind, key, value []byte) {
+	wb.entries = append(wb.entries, batchEntry{
+		kind:  kind,
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+	})
+	wb.cfs = append(wb.cfs, cf)
+}
+
+// Write applies the writes of wb atomically. Nothing is written when one of
+// them is invalid: a write to a column family of another DB, an empty range
+// deletion, or a merge into a column family without a MergeOperator.
+func (db *DB) Write(wb *WriteBatch) error {
+	b := &batch{entries: make([]batchEntry, 0, len(wb.entries))}
+	for i, e := range wb.entries {
+		cf := wb.cfs[i]
+		if cf == nil {
+			cf = db.def
+		}
+		if cf.db != db {
+			return ErrUnknownColumnFamily
+		}
+		switch {
+		case e.kind == kv.KindRangeDelete && cf.opts.Comparator.Compare(e.key, e.value) >= 0:
+			return ErrInvalidRange
+		case e.kind == kv.KindMerge && cf.opts.MergeOperator == nil:
+			return ErrNoMergeOperator
+		}
+		e.cf = cf.id
+		b.entries = append(b.entries, e)
+	}
+	if len(b.entries) == 0 {
+		return nil
+	}
+	return db.write(b)
+}
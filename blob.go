@@ -0,0 +1,386 @@
+package golsm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vikramcse/go-lsm/internal/blob"
+	"github.com/vikramcse/go-lsm/internal/kv"
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+// Values of at least Options.BlobThreshold bytes are written to a blob file
+// when their memtable is flushed, and the table stores a KindBlob entry
+// referencing the value instead. Each table writes at most one blob file,
+// numbered like the table. Compactions copy the references, so a blob file
+// outlives the table that wrote it for as long as a live table references
+// it.
+//
+// Every table records in its properties how many bytes of each blob file it
+// references. A blob file whose referenced bytes drop below BlobGCRatio of
+// its size is rewritten: the tables referencing it are rewritten in place,
+// and the values they reference are copied to a new blob file on the way.
+
+// BlobFileInfo describes a blob file referenced by live tables
+type BlobFileInfo struct {
+	FileNum   uint64
+	Size      uint64 // bytes in the file
+	LiveBytes uint64 // bytes of values referenced by live tables
+}
+
+// propBlobRefs lists the blob files a table references, as
+// <file number>:<bytes> pairs separated by commas
+const propBlobRefs = "golsm.blob.refs"
+
+// encodeBlobRefs formats the referenced bytes per blob file for propBlobRefs
+func encodeBlobRefs(refs map[uint64]uint64) string {
+	nums := make([]uint64, 0, len(refs))
+	for num := range refs {
+		nums = append(nums, num)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+
+	pairs := make([]string, len(nums))
+	for i, num := range nums {
+		pairs[i] = fmt.Sprintf("%d:%d", num, refs[num])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// decodeBlobRefs parses a propBlobRefs property
+func decodeBlobRefs(s string) (map[uint64]uint64, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	refs := make(map[uint64]uint64)
+	for _, pair := range strings.Split(s, ",") {
+		num, bytes, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid blob reference %q", pair)
+		}
+		fileNum, err := strconv.ParseUint(num, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if refs[fileNum], err = strconv.ParseUint(bytes, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// blobSet holds the blob files referenced by the open tables of a DB. A blob
+// file is opened on its first read and closed when no open table references
+// it. Once no live table references it either, it is removed.
+type blobSet struct {
+	fs  vfs.FS
+	dir string
+
+	mu    sync.Mutex
+	files map[uint64]*blobFile
+}
+
+type blobFile struct {
+	reader   *blob.Reader // nil until the first read
+	refs     int          // open tables referencing the file
+	obsolete bool         // no live table references the file
+}
+
+func newBlobSet(fs vfs.FS, dir string) *blobSet {
+	return &blobSet{fs: fs, dir: dir, files: make(map[uint64]*blobFile)}
+}
+
+// ref records an open table referencing the blob file
+func (s *blobSet) ref(fileNum uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.files[fileNum]
+	if f == nil {
+		f = &blobFile{}
+		s.files[fileNum] = f
+	}
+	f.refs++
+}
+
+// unref drops a table's reference, closing the blob file when it was the
+// last one and removing it if it is obsolete
+func (s *blobSet) unref(fileNum uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.files[fileNum]
+	if f.refs--; f.refs > 0 {
+		return nil
+	}
+	delete(s.files, fileNum)
+
+	var err error
+	if f.reader != nil {
+		err = f.reader.Close()
+	}
+	if f.obsolete {
+		s.fs.Remove(blobFileName(s.dir, fileNum))
+	}
+	return err
+}
+
+// read returns the value referenced by an encoded blob handle. The blob file
+// must be referenced by an open table.
+func (s *blobSet) read(encoded []byte) ([]byte, error) {
+	h, err := blob.DecodeHandle(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	f := s.files[h.FileNum]
+	if f == nil {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w: blob file %d is not referenced by its table", blob.ErrCorrupt, h.FileNum)
+	}
+	if f.reader == nil {
+		if f.reader, err = blob.NewReader(s.fs, blobFileName(s.dir, h.FileNum)); err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+	}
+	reader := f.reader
+	s.mu.Unlock()
+
+	return reader.Read(h)
+}
+
+// setLive marks the blob files not in live obsolete, so that they are
+// removed once no open table references them
+func (s *blobSet) setLive(live map[uint64]uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for fileNum, f := range s.files {
+		_, ok := live[fileNum]
+		f.obsolete = !ok
+	}
+}
+
+// liveBlobBytes returns the bytes referenced per blob file by tables
+func liveBlobBytes(tables []*table) map[uint64]uint64 {
+	live := make(map[uint64]uint64)
+	for _, t := range tables {
+		for fileNum, bytes := range t.blobRefs {
+			live[fileNum] += bytes
+		}
+	}
+	return live
+}
+
+// removeOrphanBlobFiles removes the blob files no live table references,
+// left behind by a crash before the table writing them was installed.
+// db.mu must be held.
+func (db *DB) removeOrphanBlobFiles() error {
+	nums, err := listFileNums(db.fs, db.dir, BlobFilePrefix, ".blob")
+	if err != nil {
+		return err
+	}
+	live := liveBlobBytes(db.allTables())
+	for _, num := range nums {
+		if _, ok := live[num]; !ok {
+			db.fs.Remove(blobFileName(db.dir, num))
+		}
+	}
+	return nil
+}
+
+// BlobFiles returns the blob files referenced by live tables, ordered by
+// file number
+func (db *DB) BlobFiles() ([]BlobFileInfo, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+	return db.blobFiles()
+}
+
+// blobFiles returns the blob files referenced by live tables. db.mu must be
+// held.
+func (db *DB) blobFiles() ([]BlobFileInfo, error) {
+	var files []BlobFileInfo
+	for fileNum, bytes := range liveBlobBytes(db.allTables()) {
+		info, err := db.fs.Stat(blobFileName(db.dir, fileNum))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, BlobFileInfo{FileNum: fileNum, Size: uint64(info.Size()), LiveBytes: bytes})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].FileNum < files[j].FileNum })
+	return files, nil
+}
+
+// CollectBlobGarbage rewrites the blob files in which less than
+// Options.BlobGCRatio of the bytes are referenced by live tables. Compactions
+// call it once they are done, as they are what drops references.
+func (db *DB) CollectBlobGarbage() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	db.mu.Unlock()
+
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	return db.collectBlobGarbage()
+}
+
+// collectBlobGarbage rewrites the tables referencing blob files below the
+// garbage collection ratio, which moves their values to new blob files.
+// db.compactMu must be held.
+func (db *DB) collectBlobGarbage() error {
+	db.mu.Lock()
+	files, err := db.blobFiles()
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	rewrite := make(map[uint64]bool)
+	for _, f := range files {
+		if float64(f.LiveBytes) < db.opts.BlobGCRatio*float64(f.Size) {
+			rewrite[f.FileNum] = true
+		}
+	}
+	var inputs []*table
+	var owners []*ColumnFamily // column family of each input
+	for _, cf := range db.cfs {
+		for _, t := range cf.tables {
+			for fileNum := range t.blobRefs {
+				if rewrite[fileNum] {
+					t.ref()
+					inputs = append(inputs, t)
+					owners = append(owners, cf)
+					break
+				}
+			}
+		}
+	}
+	db.mu.Unlock()
+
+	defer func() {
+		for _, t := range inputs {
+			t.unref()
+		}
+	}()
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	outputs := make([]*table, 0, len(inputs))
+	for i, t := range inputs {
+		out, err := db.rewriteBlobTable(owners[i], t, rewrite)
+		if err != nil {
+			for _, out := range outputs {
+				out.obsolete.Store(true)
+				out.unref()
+			}
+			return err
+		}
+		outputs = append(outputs, out)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.installBlobRewrite(inputs, outputs)
+}
+
+// rewriteBlobTable copies t, a table of cf, to a new table at the same level,
+// reading the values it references in the blob files of rewrite so that they
+// are written to the new table's blob file
+func (db *DB) rewriteBlobTable(cf *ColumnFamily, t *table, rewrite map[uint64]bool) (*table, error) {
+	db.mu.Lock()
+	fileNum := db.allocFileNum()
+	db.mu.Unlock()
+
+	builder, err := newTableBuilder(db.dir, fileNum, t.meta.level, cf)
+	if err != nil {
+		return nil, err
+	}
+
+	it := t.newIterator()
+	for it.First(); it.Valid(); it.Next() {
+		value := it.Value()
+		kind, seq, userValue, err := kv.DecodeValue(value)
+		if err != nil {
+			builder.abandon()
+			return nil, err
+		}
+		if kind == kv.KindBlob {
+			h, err := blob.DecodeHandle(userValue)
+			if err != nil {
+				builder.abandon()
+				return nil, err
+			}
+			if rewrite[h.FileNum] {
+				if userValue, err = db.opts.blobs.read(userValue); err != nil {
+					builder.abandon()
+					return nil, err
+				}
+				value = kv.EncodeValue(kv.KindSet, seq, userValue)
+			}
+		}
+		if err := builder.add(it.Key(), value); err != nil {
+			builder.abandon()
+			return nil, err
+		}
+	}
+	if err := it.Error(); err != nil {
+		builder.abandon()
+		return nil, err
+	}
+	for _, rd := range t.rangeDels {
+		builder.addRangeTombstone(rd)
+	}
+	return builder.finish()
+}
+
+// installBlobRewrite replaces each input with the output rewritten from it,
+// in place, and persists the new table list. db.mu must be held.
+func (db *DB) installBlobRewrite(inputs, outputs []*table) error {
+	replacement := make(map[*table]*table, len(inputs))
+	for i, t := range inputs {
+		replacement[t] = outputs[i]
+	}
+
+	prevTables := make([][]*table, len(db.cfs))
+	for i, cf := range db.cfs {
+		tables := make([]*table, len(cf.tables))
+		for j, t := range cf.tables {
+			tables[j] = t
+			if out, ok := replacement[t]; ok {
+				tables[j] = out
+			}
+		}
+		prevTables[i] = cf.tables
+		cf.tables = tables
+	}
+	if err := db.saveManifest(); err != nil {
+		for i, cf := range db.cfs {
+			cf.tables = prevTables[i]
+		}
+		for _, t := range outputs {
+			t.obsolete.Store(true)
+			t.unref()
+		}
+		return err
+	}
+
+	for _, t := range inputs {
+		t.obsolete.Store(true)
+		t.unref()
+	}
+	return nil
+}
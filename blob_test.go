@@ -0,0 +1,129 @@
+package golsm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+// bigValue returns a value of size bytes tagged with tag
+func bigValue(tag string, size int) string {
+	return tag + strings.Repeat("v", size-len(tag))
+}
+
+func TestBlobValues(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := &Options{FS: fs, BlobThreshold: 100}
+	db, err := Open("/db", opts)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		db.Put([]byte(fmt.Sprintf("big%02d", i)), []byte(bigValue(fmt.Sprint(i), 1000)))
+		db.Put([]byte(fmt.Sprintf("small%02d", i)), []byte("small"))
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	// Only the large values left the table
+	files, err := db.BlobFiles()
+	if err != nil {
+		t.Fatalf("BlobFiles failed: %v", err)
+	}
+	if len(files) != 1 || files[0].LiveBytes != 50*1000 {
+		t.Fatalf("Expected one blob file with 50000 live bytes, got %+v", files)
+	}
+	if props := db.TableProperties(); props[0].DataSize > 10000 {
+		t.Errorf("Expected the table to hold references only, got %d bytes of data", props[0].DataSize)
+	}
+
+	check := func() {
+		t.Helper()
+		expectValue(t, db, "big07", bigValue("7", 1000))
+		expectValue(t, db, "small07", "small")
+		entries := collect(t, db, ReadOptions{Prefix: []byte("big")})
+		if len(entries) != 50 || entries[42] != "big42="+bigValue("42", 1000) {
+			t.Errorf("Expected the iterator to resolve the blob values, got %d entries", len(entries))
+		}
+	}
+	check()
+
+	// References survive compactions and a reopen
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	check()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if db, err = Open("/db", opts); err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+	check()
+}
+
+func TestBlobGarbageCollection(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := Open("/db", &Options{FS: fs, BlobThreshold: 100})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		db.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(bigValue("old", 500)))
+	}
+	db.Flush()
+	files, _ := db.BlobFiles()
+	if len(files) != 1 {
+		t.Fatalf("Expected one blob file, got %+v", files)
+	}
+	first := blobFileName("/db", files[0].FileNum)
+
+	// Overwriting most keys leaves a quarter of the first file live once
+	// the compaction drops the old entries
+	for i := 0; i < 15; i++ {
+		db.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(bigValue("new", 500)))
+	}
+	db.Flush()
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		t.Fatalf("NewSnapshot failed: %v", err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	files, _ = db.BlobFiles()
+	for _, f := range files {
+		if float64(f.LiveBytes) < 0.5*float64(f.Size) {
+			t.Errorf("Expected blob file %d to be rewritten, %d of %d bytes live", f.FileNum, f.LiveBytes, f.Size)
+		}
+		if blobFileName("/db", f.FileNum) == first {
+			t.Errorf("Expected the first blob file to be replaced")
+		}
+	}
+
+	// The snapshot still reads the old tables and their blob file
+	if _, err := fs.Stat(first); err != nil {
+		t.Errorf("Expected the blob file to stay while the snapshot uses it, got %v", err)
+	}
+	if value, err := snap.Get([]byte("key03")); err != nil || string(value) != bigValue("new", 500) {
+		t.Errorf("Expected the snapshot to read key03, got %q (err %v)", value, err)
+	}
+	snap.Release()
+	if _, err := fs.Stat(first); err == nil {
+		t.Errorf("Expected the blob file to be removed once released")
+	}
+
+	expectValue(t, db, "key03", bigValue("new", 500))
+	expectValue(t, db, "key17", bigValue("old", 500))
+	if n := len(collect(t, db, ReadOptions{})); n != 20 {
+		t.Errorf("Expected 20 keys, got %d", n)
+	}
+}
@@ -0,0 +1,513 @@
+// Command sstdump prints the contents of SSTable files: the footer, the
+// metadata and key range of every block, the index entries and, optionally,
+// every key-value pair.
+//
+// Usage:
+//
+//	sstdump [flags] file.sst...
+//
+// Flags:
+//
+//	-entries      print the key-value pairs of every data block
+//	-format=text  print keys and values as quoted text, or as hex with -format=hex
+//	-internal     decode values written by the DB into kind, sequence number and value
+//	-json         print one JSON document per file instead of text
+//	-verify       check every block instead of dumping, and exit with status 1
+//	              when corruption is found
+//
+// Tables are read with the comparator recorded in their properties. Only the
+// built-in comparators are known to sstdump: tables written with another one
+// are still dumped, but -verify does not check the order of their keys.
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/vikramcse/go-lsm/internal/kv"
+	"github.com/vikramcse/go-lsm/internal/sstable"
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+// comparators are the comparators sstdump can order keys with, by name
+var comparators = map[string]kv.Comparator{
+	kv.Bytewise.Name(): kv.Bytewise,
+}
+
+// tableComparator returns the comparator filename was written with, and
+// false when sstdump does not know it. The comparator returned then only
+// carries the recorded name, so that the table can be opened.
+func tableComparator(filename string) (kv.Comparator, bool, error) {
+	props, err := sstable.ReadProperties(vfs.Default, filename)
+	if err != nil {
+		return nil, false, err
+	}
+	if props == nil {
+		return kv.Bytewise, true, nil
+	}
+	if cmp, ok := comparators[props.Comparator]; ok {
+		return cmp, true, nil
+	}
+	return unknownComparator{props.Comparator}, false, nil
+}
+
+// unknownComparator stands in for a comparator sstdump does not know.
+// Dumping reads blocks in file order and never compares keys, so it only
+// needs the name.
+type unknownComparator struct {
+	name string
+}
+
+func (c unknownComparator) Name() string {
+	return c.name
+}
+
+func (unknownComparator) Compare(a, b []byte) int {
+	panic("sstdump: keys compared with an unknown comparator")
+}
+
+func (unknownComparator) Separator(prevLast, first []byte) []byte {
+	return first
+}
+
+// tableDump is everything sstdump reports about a file. It is printed as
+// JSON as is, and drives the text output.
+type tableDump struct {
+	File            string      `json:"file"`
+	Footer          footerDump  `json:"footer"`
+	Index           []indexDump `json:"index"`
+	IndexPartitions []indexDump `json:"index_partitions,omitempty"`
+	Blocks          []blockDump `json:"blocks"`
+	RangeDeletions  []entryDump `json:"range_deletions,omitempty"`
+	PartitionBlocks []blockDump `json:"index_partition_blocks,omitempty"`
+	IndexBlock      *blockDump  `json:"index_block,omitempty"`
+	RangeDelBlock   *blockDump  `json:"range_del_block,omitempty"`
+	PropsBlock      *blockDump  `json:"properties_block,omitempty"`
+	Properties      *propsDump  `json:"properties,omitempty"`
+	TotalEntries    int         `json:"total_entries"`
+}
+
+type footerDump struct {
+	Version        uint32     `json:"version"`
+	CreatedAt      string     `json:"created_at"`
+	Compression    string     `json:"compression"`
+	IndexHandle    handleDump `json:"index_handle"`
+	FilterHandle   handleDump `json:"filter_handle"`
+	RangeDelHandle handleDump `json:"range_del_handle"`
+	PropsHandle    handleDump `json:"properties_handle"`
+}
+
+type propsDump struct {
+	NumEntries        uint64            `json:"num_entries"`
+	NumRangeDeletions uint64            `json:"num_range_deletions"`
+	NumDataBlocks     uint64            `json:"num_data_blocks"`
+	RawKeySize        uint64            `json:"raw_key_size"`
+	RawValueSize      uint64            `json:"raw_value_size"`
+	DataSize          uint64            `json:"data_size"`
+	SmallestKey       string            `json:"smallest_key"`
+	LargestKey        string            `json:"largest_key"`
+	Compression       string            `json:"compression"`
+	BlockSize         uint64            `json:"block_size"`
+	Comparator        string            `json:"comparator"`
+	User              map[string]string `json:"user,omitempty"`
+}
+
+type handleDump struct {
+	Offset uint64 `json:"offset"`
+	Size   uint64 `json:"size"`
+}
+
+type indexDump struct {
+	Key    string     `json:"key"`
+	Handle handleDump `json:"handle"`
+}
+
+type blockDump struct {
+	Type       string      `json:"type"`
+	Offset     uint64      `json:"offset"`
+	Size       uint32      `json:"size"`
+	KeyCount   uint32      `json:"key_count"`
+	CRC        string      `json:"crc"`
+	Compressed bool        `json:"compressed"`
+	FirstKey   string      `json:"first_key,omitempty"`
+	LastKey    string      `json:"last_key,omitempty"`
+	Entries    []entryDump `json:"entries,omitempty"`
+}
+
+type entryDump struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Kind  string `json:"kind,omitempty"`
+	Seq   uint64 `json:"seq,omitempty"`
+}
+
+type options struct {
+	entries  bool
+	hex      bool
+	internal bool
+	json     bool
+	verify   bool
+}
+
+func main() {
+	var opts options
+	var format string
+	flag.BoolVar(&opts.entries, "entries", false, "print the key-value pairs of every data block")
+	flag.StringVar(&format, "format", "text", "key and value format: text or hex")
+	flag.BoolVar(&opts.internal, "internal", false, "decode values written by the DB into kind, sequence number and value")
+	flag.BoolVar(&opts.json, "json", false, "print JSON instead of text")
+	flag.BoolVar(&opts.verify, "verify", false, "verify every block instead of dumping")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: sstdump [flags] file.sst...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch format {
+	case "text":
+	case "hex":
+		opts.hex = true
+	default:
+		log.Fatalf("Unknown format %q, expected text or hex", format)
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, filename := range flag.Args() {
+		if opts.verify {
+			ok, err := verifyTable(os.Stdout, filename, opts)
+			if err != nil {
+				log.Printf("%s: %v", filename, err)
+			}
+			failed = failed || !ok
+			continue
+		}
+
+		dump, err := dumpTable(filename, opts)
+		if err != nil {
+			log.Printf("%s: %v", filename, err)
+			failed = true
+			continue
+		}
+
+		if opts.json {
+			err = printJSON(os.Stdout, dump)
+		} else {
+			err = printText(os.Stdout, dump, opts)
+		}
+		if err != nil {
+			log.Fatalf("Failed to write output: %v", err)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// dumpTable reads everything sstdump reports about filename
+func dumpTable(filename string, opts options) (*tableDump, error) {
+	cmp, _, err := tableComparator(filename)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := sstable.NewReaderWithOptions(vfs.Default, filename, sstable.ReaderOptions{Comparator: cmp})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	format := quote
+	if opts.hex {
+		format = hex.EncodeToString
+	}
+
+	footer := reader.Footer()
+	dump := &tableDump{
+		File: filename,
+		Footer: footerDump{
+			Version:        footer.Version,
+			CreatedAt:      time.Unix(footer.CreatedAt, 0).UTC().Format(time.RFC3339),
+			Compression:    footer.CompressionType.String(),
+			IndexHandle:    toHandleDump(footer.IndexHandle),
+			FilterHandle:   toHandleDump(footer.FilterHandle),
+			RangeDelHandle: toHandleDump(footer.RangeDelHandle),
+			PropsHandle:    toHandleDump(footer.PropertiesHandle),
+		},
+	}
+
+	index, err := reader.IndexEntries()
+	if err != nil {
+		return nil, fmt.Errorf("index: %w", err)
+	}
+	for _, partition := range reader.IndexPartitions() {
+		dump.IndexPartitions = append(dump.IndexPartitions, indexDump{
+			Key:    format(partition.Key),
+			Handle: toHandleDump(partition.BlockHandle),
+		})
+
+		metadata, err := reader.BlockMetadataAt(partition.BlockHandle.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("index partition at offset %d: %w", partition.BlockHandle.Offset, err)
+		}
+		dump.PartitionBlocks = append(dump.PartitionBlocks, toBlockDump(partition.BlockHandle.Offset, metadata))
+	}
+
+	for _, entry := range index {
+		dump.Index = append(dump.Index, indexDump{
+			Key:    format(entry.Key),
+			Handle: toHandleDump(entry.BlockHandle),
+		})
+
+		metadata, block, err := reader.ReadBlock(entry.BlockHandle)
+		if err != nil {
+			return nil, fmt.Errorf("data block at offset %d: %w", entry.BlockHandle.Offset, err)
+		}
+
+		bd := toBlockDump(entry.BlockHandle.Offset, metadata)
+		entries := block.Entries()
+		if len(entries) > 0 {
+			bd.FirstKey = format(entries[0].Key)
+			bd.LastKey = format(entries[len(entries)-1].Key)
+		}
+		if opts.entries {
+			for _, e := range entries {
+				bd.Entries = append(bd.Entries, toEntryDump(e, opts.internal, format))
+			}
+		}
+		dump.TotalEntries += len(entries)
+		dump.Blocks = append(dump.Blocks, bd)
+	}
+
+	if footer.RangeDelHandle.Size > 0 {
+		metadata, block, err := reader.ReadBlock(footer.RangeDelHandle)
+		if err != nil {
+			return nil, fmt.Errorf("range deletion block: %w", err)
+		}
+		bd := toBlockDump(footer.RangeDelHandle.Offset, metadata)
+		dump.RangeDelBlock = &bd
+		for _, e := range block.Entries() {
+			dump.RangeDeletions = append(dump.RangeDeletions, toEntryDump(e, opts.internal, format))
+		}
+	}
+
+	if footer.PropertiesHandle.Size > 0 {
+		metadata, err := reader.BlockMetadataAt(footer.PropertiesHandle.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("properties block: %w", err)
+		}
+		bd := toBlockDump(footer.PropertiesHandle.Offset, metadata)
+		dump.PropsBlock = &bd
+	}
+	if props := reader.Properties(); props != nil {
+		dump.Properties = &propsDump{
+			NumEntries:        props.NumEntries,
+			NumRangeDeletions: props.NumRangeDeletions,
+			NumDataBlocks:     props.NumDataBlocks,
+			RawKeySize:        props.RawKeySize,
+			RawValueSize:      props.RawValueSize,
+			DataSize:          props.DataSize,
+			SmallestKey:       format(props.SmallestKey),
+			LargestKey:        format(props.LargestKey),
+			Compression:       props.Compression.String(),
+			BlockSize:         props.BlockSize,
+			Comparator:        props.Comparator,
+			User:              props.User,
+		}
+	}
+
+	metadata, err := reader.BlockMetadataAt(footer.IndexHandle.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("index block: %w", err)
+	}
+	bd := toBlockDump(footer.IndexHandle.Offset, metadata)
+	dump.IndexBlock = &bd
+
+	return dump, nil
+}
+
+// verifyTable verifies filename and prints the report. It returns false
+// when the table could not be verified or is corrupt.
+func verifyTable(w io.Writer, filename string, opts options) (bool, error) {
+	// Verify reports why the properties of a damaged table cannot be read;
+	// its keys are then checked with the default comparator
+	cmp, known, err := tableComparator(filename)
+	if err != nil {
+		cmp, known = kv.Bytewise, true
+	}
+	if !known {
+		log.Printf("%s: comparator %s is unknown to sstdump, key order is not checked", filename, cmp.Name())
+	}
+	report, err := sstable.VerifyWithOptions(vfs.Default, filename, sstable.VerifyOptions{
+		Comparator:   cmp,
+		SkipKeyOrder: !known,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if opts.json {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return report.OK(), enc.Encode(report)
+	}
+
+	status := "ok"
+	if !report.OK() {
+		status = "CORRUPT"
+	}
+	fmt.Fprintf(w, "%s: %s, %d data blocks, %d entries, %d range deletions\n",
+		filename, status, report.DataBlocks, report.Entries, report.RangeDeletions)
+	for _, c := range report.Corruptions {
+		where := c.BlockKind + " block"
+		if c.BlockKind == sstable.FooterKind {
+			where = c.BlockKind
+		}
+		fmt.Fprintf(w, "  %s at offset %d: %s\n", where, c.Offset, c.Reason)
+	}
+	return report.OK(), nil
+}
+
+func toHandleDump(h sstable.BlockHandle) handleDump {
+	return handleDump{Offset: h.Offset, Size: h.Size}
+}
+
+func toBlockDump(offset uint64, m sstable.BlockMetadata) blockDump {
+	return blockDump{
+		Type:       m.Type.String(),
+		Offset:     offset,
+		Size:       m.Size,
+		KeyCount:   m.KeyCount,
+		CRC:        fmt.Sprintf("%08x", m.CRC),
+		Compressed: m.Compressed,
+	}
+}
+
+// toEntryDump formats an entry, splitting engine values into their parts
+// when internal is set and the value decodes
+func toEntryDump(e sstable.Entry, internal bool, format func([]byte) string) entryDump {
+	ed := entryDump{Key: format(e.Key), Value: format(e.Value)}
+	if !internal {
+		return ed
+	}
+
+	kind, seq, value, err := kv.DecodeValue(e.Value)
+	if err != nil {
+		ed.Kind = "INVALID"
+		return ed
+	}
+	ed.Kind, ed.Seq, ed.Value = kind.String(), seq, format(value)
+	return ed
+}
+
+func quote(b []byte) string {
+	return strconv.Quote(string(b))
+}
+
+func printJSON(w io.Writer, dump *tableDump) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dump)
+}
+
+func printText(w io.Writer, dump *tableDump, opts options) error {
+	p := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, format, args...)
+	}
+
+	f := dump.Footer
+	p("file: %s\n", dump.File)
+	p("footer:\n")
+	p("  version:          %d\n", f.Version)
+	p("  created at:       %s\n", f.CreatedAt)
+	p("  compression:      %s\n", f.Compression)
+	p("  index handle:     offset=%d size=%d\n", f.IndexHandle.Offset, f.IndexHandle.Size)
+	p("  filter handle:    offset=%d size=%d\n", f.FilterHandle.Offset, f.FilterHandle.Size)
+	p("  range del handle: offset=%d size=%d\n", f.RangeDelHandle.Offset, f.RangeDelHandle.Size)
+	p("  props handle:     offset=%d size=%d\n", f.PropsHandle.Offset, f.PropsHandle.Size)
+
+	if props := dump.Properties; props != nil {
+		p("properties:\n")
+		p("  entries:          %d\n", props.NumEntries)
+		p("  range deletions:  %d\n", props.NumRangeDeletions)
+		p("  data blocks:      %d\n", props.NumDataBlocks)
+		p("  raw key size:     %d\n", props.RawKeySize)
+		p("  raw value size:   %d\n", props.RawValueSize)
+		p("  data size:        %d\n", props.DataSize)
+		p("  key range:        [%s, %s]\n", props.SmallestKey, props.LargestKey)
+		p("  compression:      %s\n", props.Compression)
+		p("  block size:       %d\n", props.BlockSize)
+		p("  comparator:       %s\n", props.Comparator)
+
+		names := make([]string, 0, len(props.User))
+		for name := range props.User {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p("  %s: %s\n", name, props.User[name])
+		}
+	}
+
+	if len(dump.IndexPartitions) > 0 {
+		p("index partitions: %d\n", len(dump.IndexPartitions))
+		for i, entry := range dump.IndexPartitions {
+			p("  [%d] %s -> offset=%d size=%d\n", i, entry.Key, entry.Handle.Offset, entry.Handle.Size)
+		}
+	}
+	p("index: %d entries\n", len(dump.Index))
+	for i, entry := range dump.Index {
+		p("  [%d] %s -> offset=%d size=%d\n", i, entry.Key, entry.Handle.Offset, entry.Handle.Size)
+	}
+
+	blocks := dump.Blocks
+	if dump.RangeDelBlock != nil {
+		blocks = append(blocks, *dump.RangeDelBlock)
+	}
+	if dump.PropsBlock != nil {
+		blocks = append(blocks, *dump.PropsBlock)
+	}
+	blocks = append(blocks, dump.PartitionBlocks...)
+	if dump.IndexBlock != nil {
+		blocks = append(blocks, *dump.IndexBlock)
+	}
+	p("blocks: %d\n", len(blocks))
+	for _, b := range blocks {
+		p("  %-10s offset=%d size=%d keys=%d crc=%s compressed=%v", b.Type, b.Offset, b.Size, b.KeyCount, b.CRC, b.Compressed)
+		if b.FirstKey != "" {
+			p(" range=[%s, %s]", b.FirstKey, b.LastKey)
+		}
+		p("\n")
+		for _, e := range b.Entries {
+			p("    %s\n", formatEntry(e))
+		}
+	}
+
+	if len(dump.RangeDeletions) > 0 {
+		p("range deletions: %d\n", len(dump.RangeDeletions))
+		for _, e := range dump.RangeDeletions {
+			p("    %s\n", formatEntry(e))
+		}
+	}
+
+	p("total entries: %d\n\n", dump.TotalEntries)
+	return nil
+}
+
+func formatEntry(e entryDump) string {
+	if e.Kind != "" {
+		return fmt.Sprintf("%s => %s (%s seq=%d)", e.Key, e.Value, e.Kind, e.Seq)
+	}
+	return fmt.Sprintf("%s => %s", e.Key, e.Value)
+}
@@ -0,0 +1,169 @@
+package golsm
+
+import "errors"
+
+// DefaultColumnFamilyName is the name of the column family every DB has,
+// which the methods of DB read and write
+const DefaultColumnFamilyName = "default"
+
+var (
+	// ErrColumnFamilyExists is returned by CreateColumnFamily for a name
+	// that is taken
+	ErrColumnFamilyExists = errors.New("column family already exists")
+
+	// ErrInvalidColumnFamilyName is returned by CreateColumnFamily for an
+	// empty name
+	ErrInvalidColumnFamilyName = errors.New("column family name must not be empty")
+
+	// ErrUnknownColumnFamily is returned by Write for a batch holding
+	// writes to a column family of another DB
+	ErrUnknownColumnFamily = errors.New("column family does not belong to the db")
+)
+
+// ColumnFamily is a keyspace of a DB with memtables, tables and options of
+// its own. Column families are flushed and compacted independently, but
+// share the WAL, so a WriteBatch can update several of them atomically, and
+// sequence numbers, so a Snapshot covers all of them. A WAL file is only
+// removed once every column family has flushed the writes it holds, so a
+// column family that is rarely written keeps older WAL files around until
+// its memtable fills up or is flushed.
+type ColumnFamily struct {
+	db   *DB
+	id   uint32
+	name string
+	opts *Options // the DB's options, configured by the column family's
+
+	// Guarded by db.mu
+	mem        *MemTable
+	memLogNum  uint64          // oldest WAL that may hold writes of mem
+	memBackend MemTableBackend // backend of mem
+	tables     []*table        // in read order, replaced rather than modified in place
+}
+
+// Name returns the name of the column family
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// CreateColumnFamily adds a column family configured by opts, which may be
+// nil for the default options. It is recorded in the manifest right away.
+func (db *DB) CreateColumnFamily(name string, opts *ColumnFamilyOptions) (*ColumnFamily, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if name == "" {
+		return nil, ErrInvalidColumnFamilyName
+	}
+	if db.columnFamilyByName(name) != nil {
+		return nil, ErrColumnFamilyExists
+	}
+
+	cf := db.addColumnFamily(db.nextColumnFamilyID(), name, opts)
+	cf.mem = cf.newMemTable()
+	cf.memLogNum = db.logNum
+	if err := db.saveManifest(); err != nil {
+		db.cfs = db.cfs[:len(db.cfs)-1]
+		cf.mem.Release()
+		return nil, err
+	}
+	return cf, nil
+}
+
+// ColumnFamily returns the column family called name, or nil if the DB has
+// none
+func (db *DB) ColumnFamily(name string) *ColumnFamily {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.columnFamilyByName(name)
+}
+
+// ColumnFamilies returns the column families of the DB, the default one
+// first
+func (db *DB) ColumnFamilies() []*ColumnFamily {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]*ColumnFamily(nil), db.cfs...)
+}
+
+// addColumnFamily adds a column family without a memtable. db.mu must be
+// held.
+func (db *DB) addColumnFamily(id uint32, name string, opts *ColumnFamilyOptions) *ColumnFamily {
+	cf := &ColumnFamily{db: db, id: id, name: name, opts: db.opts}
+	if id != 0 {
+		cf.opts = db.opts.withColumnFamilyOptions(opts)
+	}
+	db.cfs = append(db.cfs, cf)
+	return cf
+}
+
+// columnFamilyByName returns the column family called name, or nil. db.mu
+// must be held.
+func (db *DB) columnFamilyByName(name string) *ColumnFamily {
+	for _, cf := range db.cfs {
+		if cf.name == name {
+			return cf
+		}
+	}
+	return nil
+}
+
+// columnFamilyByID returns the column family numbered id, or nil. db.mu must
+// be held.
+func (db *DB) columnFamilyByID(id uint32) *ColumnFamily {
+	for _, cf := range db.cfs {
+		if cf.id == id {
+			return cf
+		}
+	}
+	return nil
+}
+
+// nextColumnFamilyID returns an unused column family number. db.mu must be
+// held.
+func (db *DB) nextColumnFamilyID() uint32 {
+	var id uint32
+	for _, cf := range db.cfs {
+		id = max(id, cf.id+1)
+	}
+	return id
+}
+
+// allTables returns the tables of every column family. db.mu must be held.
+func (db *DB) allTables() []*table {
+	var tables []*table
+	for _, cf := range db.cfs {
+		tables = append(tables, cf.tables...)
+	}
+	return tables
+}
+
+// newMemTable creates an empty memtable to become the active one. db.mu must
+// be held.
+func (cf *ColumnFamily) newMemTable() *MemTable {
+	cf.memBackend = cf.memTableBackend()
+	return cf.opts.newMemTable(cf.memBackend)
+}
+
+// memTableBackend returns the backend for new memtables, which load sessions
+// override. db.mu must be held.
+func (cf *ColumnFamily) memTableBackend() MemTableBackend {
+	if cf.db.loads > 0 {
+		return VectorBackend
+	}
+	return cf.opts.MemTableBackend
+}
+
+// logNum returns the number of the oldest WAL holding writes of the column
+// family that are not flushed yet. db.mu must be held.
+func (cf *ColumnFamily) logNum() uint64 {
+	logNum := cf.memLogNum
+	for _, imm := range cf.db.imm {
+		if imm.cf == cf {
+			logNum = min(logNum, imm.logNum)
+		}
+	}
+	return logNum
+}
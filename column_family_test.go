@@ -0,0 +1,302 @@
+package golsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+func collectColumnFamily(t *testing.T, cf *ColumnFamily, opts ReadOptions) []string {
+	t.Helper()
+
+	it, err := cf.NewIterator(opts)
+	if err != nil {
+		t.Fatalf("NewIterator failed: %v", err)
+	}
+	defer it.Close()
+
+	var result []string
+	for it.Next() {
+		result = append(result, string(it.Key())+"="+string(it.Value()))
+	}
+	if err := it.Error(); err != nil {
+		t.Fatalf("Iterator failed: %v", err)
+	}
+	return result
+}
+
+func TestColumnFamilies(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := Open("/db", &Options{FS: fs})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+
+	users, err := db.CreateColumnFamily("users", nil)
+	if err != nil {
+		t.Fatalf("CreateColumnFamily failed: %v", err)
+	}
+	if _, err := db.CreateColumnFamily("users", nil); !errors.Is(err, ErrColumnFamilyExists) {
+		t.Errorf("Expected ErrColumnFamilyExists, got %v", err)
+	}
+	if _, err := db.CreateColumnFamily(DefaultColumnFamilyName, nil); !errors.Is(err, ErrColumnFamilyExists) {
+		t.Errorf("Expected ErrColumnFamilyExists for the default column family, got %v", err)
+	}
+	if _, err := db.CreateColumnFamily("", nil); !errors.Is(err, ErrInvalidColumnFamilyName) {
+		t.Errorf("Expected ErrInvalidColumnFamilyName, got %v", err)
+	}
+
+	// Column families are separate keyspaces
+	db.Put([]byte("k"), []byte("default"))
+	users.Put([]byte("k"), []byte("users"))
+	users.Put([]byte("u1"), []byte("alice"))
+	expectValue(t, db, "k", "default")
+	expectEntries(t, collectColumnFamily(t, users, ReadOptions{}), "k=users", "u1=alice")
+
+	// A batch writes to several column families at once
+	wb := &WriteBatch{}
+	wb.Put(nil, []byte("a"), []byte("1"))
+	wb.Delete(users, []byte("k"))
+	wb.Put(users, []byte("u2"), []byte("bob"))
+	if err := db.Write(wb); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	expectEntries(t, collect(t, db, ReadOptions{}), "a=1", "k=default")
+	expectEntries(t, collectColumnFamily(t, users, ReadOptions{}), "u1=alice", "u2=bob")
+
+	// An invalid write leaves the whole batch unapplied
+	other, err := Open("/other", &Options{FS: fs})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer other.Close()
+	otherUsers, err := other.CreateColumnFamily("users", nil)
+	if err != nil {
+		t.Fatalf("CreateColumnFamily failed: %v", err)
+	}
+	for _, tc := range []struct {
+		add      func(wb *WriteBatch)
+		expected error
+	}{
+		{func(wb *WriteBatch) { wb.Put(otherUsers, []byte("u3"), []byte("carol")) }, ErrUnknownColumnFamily},
+		{func(wb *WriteBatch) { wb.DeleteRange(users, []byte("z"), []byte("a")) }, ErrInvalidRange},
+		{func(wb *WriteBatch) { wb.Merge(users, []byte("u1"), []byte("x")) }, ErrNoMergeOperator},
+	} {
+		wb := &WriteBatch{}
+		wb.Put(users, []byte("u4"), []byte("dave"))
+		tc.add(wb)
+		if err := db.Write(wb); !errors.Is(err, tc.expected) {
+			t.Errorf("Expected %v, got %v", tc.expected, err)
+		}
+	}
+	if _, err := users.Get([]byte("u4")); err != ErrNotFound {
+		t.Errorf("Expected the invalid batches to write nothing, got %v", err)
+	}
+
+	// Flushing a column family leaves the others in their memtables
+	if err := users.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if n := len(users.TableProperties()); n != 1 {
+		t.Errorf("Expected 1 users table, got %d", n)
+	}
+	if n := len(db.TableProperties()); n != 0 {
+		t.Errorf("Expected no default table, got %d", n)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	db, err = Open("/db", &Options{FS: fs})
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+
+	var names []string
+	for _, cf := range db.ColumnFamilies() {
+		names = append(names, cf.Name())
+	}
+	if fmt.Sprint(names) != "[default users]" {
+		t.Errorf("Expected the default and users column families, got %v", names)
+	}
+	if db.ColumnFamily("events") != nil {
+		t.Errorf("Expected no events column family")
+	}
+	users = db.ColumnFamily("users")
+	expectEntries(t, collect(t, db, ReadOptions{}), "a=1", "k=default")
+	expectEntries(t, collectColumnFamily(t, users, ReadOptions{}), "u1=alice", "u2=bob")
+}
+
+func TestColumnFamilyOptions(t *testing.T) {
+	db, err := Open("/db", &Options{
+		FS: vfs.NewMem(),
+		ColumnFamilies: map[string]*ColumnFamilyOptions{
+			"users": {MemTableBackend: BTreeBackend, Compression: SnappyCompression},
+			"events": {
+				CompactionStyle:       FIFOCompaction,
+				FIFOMaxTableFilesSize: 50 * 1024,
+				L0CompactionTrigger:   2,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	users, events := db.ColumnFamily("users"), db.ColumnFamily("events")
+	if users == nil || events == nil {
+		t.Fatalf("Expected Open to create the configured column families")
+	}
+	db.mu.Lock()
+	backend := users.memBackend
+	db.mu.Unlock()
+	if backend != BTreeBackend {
+		t.Errorf("Expected the users memtable to use the B-tree backend, got %d", backend)
+	}
+
+	for i := 0; i < 100; i++ {
+		value := bytes.Repeat([]byte("profile"), 20)
+		db.Put([]byte(fmt.Sprintf("user%03d", i)), value)
+		users.Put([]byte(fmt.Sprintf("user%03d", i)), value)
+	}
+	db.Flush()
+	if p := users.TableProperties()[0]; p.Compression != SnappyCompression {
+		t.Errorf("Expected snappy users tables, got %v", p.Compression)
+	}
+	if p := db.TableProperties()[0]; p.Compression != NoCompression {
+		t.Errorf("Expected uncompressed default tables, got %v", p.Compression)
+	}
+	if u, d := users.TableProperties()[0].DataSize, db.TableProperties()[0].DataSize; u >= d/2 {
+		t.Errorf("Expected compression to shrink the users table, got %d bytes against %d", u, d)
+	}
+
+	// FIFO compaction never merges tables and deletes the oldest ones
+	// beyond the size limit, about 20KB per table here
+	rng := rand.New(rand.NewSource(1))
+	for batch := 0; batch < 5; batch++ {
+		for i := 0; i < 20; i++ {
+			value := make([]byte, 1000)
+			rng.Read(value)
+			events.Put([]byte(fmt.Sprintf("event%d-%02d", batch, i)), value)
+		}
+		if err := events.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+	}
+	if err := events.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	props := events.TableProperties()
+	if len(props) != 2 {
+		t.Fatalf("Expected the 2 newest events tables to fit the limit, got %d", len(props))
+	}
+	for _, p := range props {
+		if p.Level != 0 {
+			t.Errorf("Expected FIFO tables to stay in level 0, got level %d", p.Level)
+		}
+	}
+	if _, err := events.Get([]byte("event0-00")); err != ErrNotFound {
+		t.Errorf("Expected the oldest events to be deleted, got %v", err)
+	}
+	if _, err := events.Get([]byte("event4-19")); err != nil {
+		t.Errorf("Expected the newest events to stay, got %v", err)
+	}
+}
+
+func TestColumnFamiliesRecoverSharedWAL(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.NewMem())
+	opts := &Options{
+		FS:         fs,
+		SyncWrites: true,
+		ColumnFamilies: map[string]*ColumnFamilyOptions{
+			"counters": {MergeOperator: Uint64AddOperator},
+		},
+	}
+	db, err := Open("/db", opts)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	counters := db.ColumnFamily("counters")
+
+	db.Put([]byte("a"), []byte("1"))
+	counters.Merge([]byte("hits"), uint64Value(1))
+
+	// The flushed operand must not be replayed again from the WAL, which
+	// stays for the unflushed write of the default column family
+	if err := counters.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	counters.Merge([]byte("hits"), uint64Value(2))
+	wb := &WriteBatch{}
+	wb.Put(nil, []byte("b"), []byte("2"))
+	wb.Merge(counters, []byte("hits"), uint64Value(3))
+	if err := db.Write(wb); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	fs.Crash()
+	db.Close()
+	fs.Restart()
+
+	db, err = Open("/db", opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+
+	expectEntries(t, collect(t, db, ReadOptions{}), "a=1", "b=2")
+	value, err := db.ColumnFamily("counters").Get([]byte("hits"))
+	if err != nil || !bytes.Equal(value, uint64Value(6)) {
+		t.Errorf("Expected hits=6, got %v (err %v)", value, err)
+	}
+	if logs, _ := listFileNums(fs, "/db", WALFilePrefix, ".log"); len(logs) != 1 {
+		t.Errorf("Expected the replayed WAL files to be removed, got %v", logs)
+	}
+}
+
+func TestSnapshotCoversColumnFamilies(t *testing.T) {
+	db, err := Open("/db", &Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	users, err := db.CreateColumnFamily("users", nil)
+	if err != nil {
+		t.Fatalf("CreateColumnFamily failed: %v", err)
+	}
+	db.Put([]byte("a"), []byte("1"))
+	users.Put([]byte("u1"), []byte("alice"))
+
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		t.Fatalf("NewSnapshot failed: %v", err)
+	}
+	defer snap.Release()
+
+	db.Put([]byte("a"), []byte("2"))
+	users.Put([]byte("u1"), []byte("bob"))
+	users.Put([]byte("u2"), []byte("carol"))
+	events, err := db.CreateColumnFamily("events", nil)
+	if err != nil {
+		t.Fatalf("CreateColumnFamily failed: %v", err)
+	}
+	events.Put([]byte("e1"), []byte("x"))
+
+	if value, err := snap.Get([]byte("a")); err != nil || string(value) != "1" {
+		t.Errorf("Expected a=1 in the snapshot, got %q (err %v)", value, err)
+	}
+	if value, err := snap.GetFrom(users, []byte("u1")); err != nil || string(value) != "alice" {
+		t.Errorf("Expected u1=alice in the snapshot, got %q (err %v)", value, err)
+	}
+	expectEntries(t, collectColumnFamily(t, users, ReadOptions{Snapshot: snap}), "u1=alice")
+	expectEntries(t, collectColumnFamily(t, events, ReadOptions{Snapshot: snap}))
+	expectEntries(t, collectColumnFamily(t, users, ReadOptions{}), "u1=bob", "u2=carol")
+}
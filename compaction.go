@@ -0,0 +1,383 @@
+package golsm
+
+import (
+	"sort"
+
+	"github.com/vikramcse/go-lsm/internal/kv"
+)
+
+// Tables are organised in two levels. Level 0 holds the tables written by
+// flushes, which may overlap each other. Level 1 is the bottom level: its
+// tables cover disjoint key ranges.
+//
+// A compaction merges every level 0 table with the level 1 tables they
+// overlap and writes the result back to level 1. As level 1 is the bottom
+// level, nothing older can be shadowed by the compaction output, so it drops
+// deletions, expired entries, entries covered by range tombstones and the
+// range tombstones themselves. Input tables that a range tombstone deletes
+// entirely are dropped without being read, and so are tables whose entries
+// have all expired.
+//
+// Column families using FIFOCompaction keep all their tables in level 0 and
+// are never merged; their oldest tables are deleted instead once the tables
+// take too much space.
+const (
+	numLevels   = 2
+	bottomLevel = numLevels - 1
+)
+
+// Compact compacts all tables of the default column family into the bottom
+// level, dropping every deleted entry
+func (db *DB) Compact() error {
+	return db.def.Compact()
+}
+
+// Compact compacts all tables of the column family into the bottom level,
+// dropping every deleted entry. With FIFOCompaction it only deletes the
+// oldest tables beyond the size limit.
+func (cf *ColumnFamily) Compact() error {
+	db := cf.db
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	db.mu.Unlock()
+
+	return db.compact(cf, true)
+}
+
+// needsCompaction reports whether level 0 has reached the compaction
+// trigger or, with FIFOCompaction, whether the tables exceed the size limit.
+// db.mu must be held.
+func (cf *ColumnFamily) needsCompaction() bool {
+	if cf.opts.CompactionStyle == FIFOCompaction {
+		return cf.tablesSize() > uint64(cf.opts.FIFOMaxTableFilesSize)
+	}
+	return len(cf.levelTables(0)) >= cf.opts.L0CompactionTrigger
+}
+
+// tablesSize returns the total size of the tables. db.mu must be held.
+func (cf *ColumnFamily) tablesSize() uint64 {
+	var size uint64
+	for _, t := range cf.tables {
+		size += t.meta.size
+	}
+	return size
+}
+
+// compact runs a compaction of all tables of cf, or of level 0 and the
+// overlapping level 1 tables if level 0 has reached its trigger
+func (db *DB) compact(cf *ColumnFamily, all bool) error {
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+
+	if err := db.dropExpiredTables(cf); err != nil {
+		return err
+	}
+	if cf.opts.CompactionStyle == FIFOCompaction {
+		return db.dropOldestTables(cf)
+	}
+
+	db.mu.Lock()
+	inputs := cf.pickCompaction(all)
+	for _, t := range inputs {
+		t.ref()
+	}
+	var filter *entryFilter
+	if cf.opts.CompactionFilterFactory != nil {
+		ctx := CompactionFilterContext{Manual: all, OutputLevel: bottomLevel}
+		if f := cf.opts.CompactionFilterFactory(ctx); f != nil {
+			filter = &entryFilter{filter: f, blobs: cf.opts.blobs, pinnedSeq: db.pinnedSeq()}
+		}
+	}
+	db.mu.Unlock()
+
+	defer func() {
+		for _, t := range inputs {
+			t.unref()
+		}
+	}()
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	outputs, err := db.runCompaction(cf, inputs, filter)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	err = db.installCompaction(cf, inputs, outputs)
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The compaction may have dropped the last references to blob values
+	return db.collectBlobGarbage()
+}
+
+// pickCompaction returns the input tables of the next compaction. db.mu
+// must be held.
+func (cf *ColumnFamily) pickCompaction(all bool) []*table {
+	if all {
+		return append([]*table(nil), cf.tables...)
+	}
+	if !cf.needsCompaction() {
+		return nil
+	}
+
+	inputs := cf.levelTables(0)
+	smallest, largest := inputs[0].meta.smallest, inputs[0].meta.largest
+	for _, t := range inputs[1:] {
+		if cf.opts.Comparator.Compare(t.meta.smallest, smallest) < 0 {
+			smallest = t.meta.smallest
+		}
+		if cf.opts.Comparator.Compare(t.meta.largest, largest) > 0 {
+			largest = t.meta.largest
+		}
+	}
+
+	for _, t := range cf.levelTables(bottomLevel) {
+		if t.overlaps(smallest, largest) {
+			inputs = append(inputs, t)
+		}
+	}
+	return inputs
+}
+
+// runCompaction merges the inputs into new bottom level tables of cf,
+// passing the entries through filter unless it is nil
+func (db *DB) runCompaction(cf *ColumnFamily, inputs []*table, filter *entryFilter) ([]*table, error) {
+	opts := cf.opts
+	var rangeDels []kv.RangeTombstone
+	for _, t := range inputs {
+		rangeDels = append(rangeDels, t.rangeDels...)
+	}
+
+	var children []internalIterator
+	var levels []int // level of the table each child reads
+	for _, t := range inputs {
+		if coveredTable(opts.Comparator, t, rangeDels) {
+			continue
+		}
+		children = append(children, t.newIterator())
+		levels = append(levels, t.meta.level)
+	}
+
+	var outputs []*table
+	var builder *tableBuilder
+	abandon := func() {
+		if builder != nil {
+			builder.abandon()
+		}
+		for _, t := range outputs {
+			t.obsolete.Store(true)
+			t.unref()
+		}
+	}
+
+	// Expiries are checked against the time the compaction started; blob
+	// values are only read as bases of merge operands
+	r := entryResolver{blobs: opts.blobs, now: opts.now().UnixNano()}
+
+	merged := newMergingIterator(opts.Comparator, children)
+	for merged.First(); merged.Valid(); merged.Next() {
+		kind, seq, userValue, err := kv.DecodeValue(merged.Value())
+		if err != nil {
+			abandon()
+			return nil, err
+		}
+		if kind == kv.KindDelete || coveredEntry(opts.Comparator, merged.Key(), seq, rangeDels) {
+			continue
+		}
+		if kind == kv.KindSetTTL {
+			expiry, _, err := kv.DecodeExpiring(userValue)
+			if err != nil {
+				abandon()
+				return nil, err
+			}
+			if expiry <= r.now {
+				continue
+			}
+		}
+
+		// Every older entry of the key is among the inputs, so merge
+		// operands can be combined into a plain value. Operands the
+		// operator rejects are kept with their base instead, so that
+		// reading the key reports the error rather than the compaction.
+		value, unmerged := merged.Value(), false
+		if kind == kv.KindMerge {
+			m, err := addVersions(opts.MergeOperator, r, merged.Key(), merged.versions(), func(seq uint64) bool {
+				return coveredEntry(opts.Comparator, merged.Key(), seq, rangeDels)
+			})
+			if err != nil {
+				abandon()
+				return nil, err
+			}
+			if userValue, err := m.finish(); err == nil {
+				value = kv.EncodeValue(kv.KindSet, seq, userValue)
+			} else {
+				value, unmerged = kv.EncodeValue(kv.KindMerge, seq, m.unmerged()), true
+			}
+		}
+		if filter != nil && !unmerged {
+			if value, err = filter.apply(levels[merged.source], merged.Key(), value); err != nil {
+				abandon()
+				return nil, err
+			}
+			if value == nil {
+				continue
+			}
+		}
+
+		if builder == nil {
+			db.mu.Lock()
+			fileNum := db.allocFileNum()
+			db.mu.Unlock()
+
+			if builder, err = newTableBuilder(db.dir, fileNum, bottomLevel, cf); err != nil {
+				abandon()
+				return nil, err
+			}
+		}
+		if err := builder.add(merged.Key(), value); err != nil {
+			abandon()
+			return nil, err
+		}
+
+		if builder.dataSize >= uint64(opts.TargetFileSize) {
+			t, err := builder.finish()
+			builder = nil
+			if err != nil {
+				abandon()
+				return nil, err
+			}
+			outputs = append(outputs, t)
+		}
+	}
+	if err := merged.Error(); err != nil {
+		abandon()
+		return nil, err
+	}
+
+	if builder != nil {
+		t, err := builder.finish()
+		builder = nil
+		if err != nil {
+			abandon()
+			return nil, err
+		}
+		outputs = append(outputs, t)
+	}
+	return outputs, nil
+}
+
+// installCompaction replaces the inputs with the outputs in the tables of cf
+// and persists the new table list. db.mu must be held.
+func (db *DB) installCompaction(cf *ColumnFamily, inputs, outputs []*table) error {
+	isInput := make(map[*table]bool, len(inputs))
+	for _, t := range inputs {
+		isInput[t] = true
+	}
+
+	var level0, bottom []*table
+	for _, t := range cf.tables {
+		switch {
+		case isInput[t]:
+		case t.meta.level == 0:
+			level0 = append(level0, t)
+		default:
+			bottom = append(bottom, t)
+		}
+	}
+	bottom = append(bottom, outputs...)
+	sort.Slice(bottom, func(i, j int) bool {
+		return cf.opts.Comparator.Compare(bottom[i].meta.smallest, bottom[j].meta.smallest) < 0
+	})
+
+	prevTables := cf.tables
+	cf.tables = append(level0, bottom...)
+	if err := db.saveManifest(); err != nil {
+		cf.tables = prevTables
+		for _, t := range outputs {
+			t.obsolete.Store(true)
+			t.unref()
+		}
+		return err
+	}
+
+	// Drop the DB's references; the files go once readers are done with them
+	for _, t := range inputs {
+		t.obsolete.Store(true)
+		t.unref()
+	}
+	return nil
+}
+
+// dropOldestTables deletes the tables of cf last in read order, which hold
+// the oldest entries, while the tables take more than FIFOMaxTableFilesSize
+// bytes. db.compactMu must be held.
+func (db *DB) dropOldestTables(cf *ColumnFamily) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	kept := cf.tables
+	size := cf.tablesSize()
+	for len(kept) > 0 && size > uint64(cf.opts.FIFOMaxTableFilesSize) {
+		size -= kept[len(kept)-1].meta.size
+		kept = kept[:len(kept)-1]
+	}
+	dropped := cf.tables[len(kept):]
+	if len(dropped) == 0 {
+		return nil
+	}
+
+	prevTables := cf.tables
+	cf.tables = kept
+	if err := db.saveManifest(); err != nil {
+		cf.tables = prevTables
+		return err
+	}
+	for _, t := range dropped {
+		t.obsolete.Store(true)
+		t.unref()
+	}
+	return nil
+}
+
+// levelTables returns the tables of level in read order. db.mu must be held.
+func (cf *ColumnFamily) levelTables(level int) []*table {
+	var tables []*table
+	for _, t := range cf.tables {
+		if t.meta.level == level {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+// coveredTable reports whether a single range tombstone deletes every entry
+// of t, so the table can be dropped without reading it
+func coveredTable(cmp Comparator, t *table, rangeDels []kv.RangeTombstone) bool {
+	for _, rd := range rangeDels {
+		if rd.Seq > t.meta.largestSeq &&
+			cmp.Compare(rd.Start, t.meta.smallest) <= 0 &&
+			cmp.Compare(t.meta.largest, rd.End) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// coveredEntry reports whether a range tombstone deletes the entry for key
+// written at seq
+func coveredEntry(cmp Comparator, key []byte, seq uint64, rangeDels []kv.RangeTombstone) bool {
+	for _, rd := range rangeDels {
+		if rd.Covers(cmp, key, seq) {
+			return true
+		}
+	}
+	return false
+}
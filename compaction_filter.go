@@ -0,0 +1,100 @@
+package golsm
+
+import (
+	"fmt"
+
+	"github.com/vikramcse/go-lsm/internal/kv"
+)
+
+// FilterDecision is what a CompactionFilter does with an entry
+type FilterDecision int
+
+const (
+	// FilterKeep writes the entry unchanged
+	FilterKeep FilterDecision = iota
+	// FilterRemove drops the entry, as if its key was deleted
+	FilterRemove
+	// FilterChangeValue writes the entry with the value the filter returned
+	FilterChangeValue
+)
+
+// CompactionFilterContext describes the compaction a CompactionFilter is
+// created for
+type CompactionFilterContext struct {
+	// Manual is true for compactions started by DB.Compact, which compact
+	// every table, and false for those triggered by level 0
+	Manual bool
+
+	// OutputLevel is the level the compaction writes its tables to
+	OutputLevel int
+}
+
+// CompactionFilter sees the entries compactions rewrite and may drop them or
+// change their values, to remove data that is no longer wanted or to rewrite
+// it in a new format without a pass over the whole DB.
+//
+// A compaction only passes the newest entry of each key to the filter, once
+// merge operands are combined and deletions are dropped, and leaves out the
+// entries a snapshot can still read, as well as those whose operands the
+// MergeOperator rejects: their keys keep their values until the
+// snapshots are released and a later compaction rewrites them.
+type CompactionFilter interface {
+	// Name identifies the filter in errors
+	Name() string
+
+	// Filter decides what happens to the entry for key read from a table of
+	// level. With FilterChangeValue the returned value replaces value,
+	// which must not be retained after Filter returns. An error fails the
+	// compaction.
+	Filter(level int, key, value []byte) (FilterDecision, []byte, error)
+}
+
+// entryFilter applies a CompactionFilter to the encoded entries of a
+// compaction
+type entryFilter struct {
+	filter    CompactionFilter
+	blobs     *blobSet
+	pinnedSeq uint64 // newest sequence number a snapshot reads, 0 if none
+}
+
+// apply returns the encoded entry to write in place of value, read from a
+// table of level, or nil to drop it. The filter sees the user value: blob
+// values are read from their files and expiring values without their
+// expiry, which a changed value keeps.
+func (f *entryFilter) apply(level int, key, value []byte) ([]byte, error) {
+	kind, seq, userValue, err := kv.DecodeValue(value)
+	if err != nil {
+		return nil, err
+	}
+	if seq <= f.pinnedSeq {
+		return value, nil
+	}
+
+	var expiry int64
+	switch kind {
+	case kv.KindBlob:
+		userValue, err = f.blobs.read(userValue)
+	case kv.KindSetTTL:
+		expiry, userValue, err = kv.DecodeExpiring(userValue)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	decision, newValue, err := f.filter.Filter(level, key, userValue)
+	if err != nil {
+		return nil, fmt.Errorf("compaction filter %s: %w", f.filter.Name(), err)
+	}
+	switch decision {
+	case FilterKeep:
+		return value, nil
+	case FilterRemove:
+		return nil, nil
+	case FilterChangeValue:
+		if kind == kv.KindSetTTL {
+			return kv.EncodeValue(kv.KindSetTTL, seq, kv.EncodeExpiring(expiry, newValue)), nil
+		}
+		return kv.EncodeValue(kv.KindSet, seq, newValue), nil
+	}
+	return nil, fmt.Errorf("compaction filter %s: unknown decision %d", f.filter.Name(), decision)
+}
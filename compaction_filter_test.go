@@ -0,0 +1,116 @@
+package golsm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+// tenantFilter removes the keys of a deleted tenant and upgrades values
+// from the v1 to the v2 encoding
+type tenantFilter struct {
+	ctx    CompactionFilterContext
+	levels map[string]int // level each key was read from
+	err    error
+}
+
+func (f *tenantFilter) Name() string {
+	return "tenantFilter"
+}
+
+func (f *tenantFilter) Filter(level int, key, value []byte) (FilterDecision, []byte, error) {
+	if f.err != nil {
+		return FilterKeep, nil, f.err
+	}
+	f.levels[string(key)] = level
+	switch {
+	case bytes.HasPrefix(key, []byte("deleted/")):
+		return FilterRemove, nil, nil
+	case bytes.HasPrefix(value, []byte("v1:")):
+		return FilterChangeValue, append([]byte("v2:"), value[3:]...), nil
+	}
+	return FilterKeep, nil, nil
+}
+
+func TestCompactionFilter(t *testing.T) {
+	var filters []*tenantFilter
+	var filterErr error
+	db, err := Open("/db", &Options{
+		FS: vfs.NewMem(),
+		CompactionFilterFactory: func(ctx CompactionFilterContext) CompactionFilter {
+			f := &tenantFilter{ctx: ctx, levels: make(map[string]int), err: filterErr}
+			filters = append(filters, f)
+			return f
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("deleted/a"), []byte("v1:a"))
+	db.Put([]byte("live/a"), []byte("v1:a"))
+	db.Flush()
+	db.Compact()
+	db.Put([]byte("deleted/b"), []byte("v2:b"))
+	db.Put([]byte("live/b"), []byte("v2:b"))
+	db.Delete([]byte("live/gone"))
+	db.Flush()
+
+	// Only the current entries are filtered, with the level they come from
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	expectEntries(t, collect(t, db, ReadOptions{}), "live/a=v2:a", "live/b=v2:b")
+	f := filters[len(filters)-1]
+	if !f.ctx.Manual || f.ctx.OutputLevel != bottomLevel {
+		t.Errorf("Expected a manual compaction into level %d, got %+v", bottomLevel, f.ctx)
+	}
+	if len(f.levels) != 3 || f.levels["live/a"] != 1 || f.levels["live/b"] != 0 {
+		t.Errorf("Expected live/a from level 1 and live/b from level 0, got %v", f.levels)
+	}
+
+	// An error fails the compaction and leaves the tables as they are
+	db.Put([]byte("deleted/c"), []byte("c"))
+	db.Flush()
+	filterErr = errors.New("tenant lookup failed")
+	if err := db.Compact(); err == nil {
+		t.Errorf("Expected the filter error to fail the compaction")
+	}
+	expectValue(t, db, "deleted/c", "c")
+}
+
+func TestCompactionFilterSkipsSnapshots(t *testing.T) {
+	db, err := Open("/db", &Options{
+		FS: vfs.NewMem(),
+		CompactionFilterFactory: func(ctx CompactionFilterContext) CompactionFilter {
+			return &tenantFilter{ctx: ctx, levels: make(map[string]int)}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("deleted/a"), []byte("a"))
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		t.Fatalf("NewSnapshot failed: %v", err)
+	}
+	db.Put([]byte("deleted/b"), []byte("b"))
+	db.Flush()
+
+	// The entry the snapshot reads stays until it is released
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	expectEntries(t, collect(t, db, ReadOptions{}), "deleted/a=a")
+
+	snap.Release()
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	expectEntries(t, collect(t, db, ReadOptions{}))
+}
@@ -1,3 +1,12 @@
 package golsm
 
-const SSTableFilePrefix = "sst_"
+import "github.com/vikramcse/go-lsm/internal/sstable"
+
+const (
+	SSTableFilePrefix = sstable.FilePrefix
+	WALFilePrefix     = "wal_"
+	BlobFilePrefix    = "blob_"
+	ManifestFileName  = "MANIFEST"
+	LostDirName       = "lost" // Repair moves damaged files here
+	LockFileName      = "LOCK" // Locked while the DB is open
+)
@@ -0,0 +1,164 @@
+package golsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+const crashTestKeys = 100
+
+func crashTestKey(i int) string {
+	return fmt.Sprintf("key%03d", i)
+}
+
+// crashTestOp is a random operation of the crash test along with its effect
+// on the expected content of the DB
+type crashTestOp struct {
+	name  string
+	run   func(db *DB) error
+	apply func(model map[string]string)
+}
+
+func randomCrashTestOp(rng *rand.Rand, seq int) crashTestOp {
+	switch n := rng.Intn(100); {
+	case n < 70:
+		key := crashTestKey(rng.Intn(crashTestKeys))
+		value := fmt.Sprintf("%d-%s", seq, bytes.Repeat([]byte("v"), rng.Intn(100)))
+		return crashTestOp{
+			name:  "put " + key,
+			run:   func(db *DB) error { return db.Put([]byte(key), []byte(value)) },
+			apply: func(model map[string]string) { model[key] = value },
+		}
+	case n < 85:
+		key := crashTestKey(rng.Intn(crashTestKeys))
+		return crashTestOp{
+			name:  "delete " + key,
+			run:   func(db *DB) error { return db.Delete([]byte(key)) },
+			apply: func(model map[string]string) { delete(model, key) },
+		}
+	case n < 90:
+		i := rng.Intn(crashTestKeys - 1)
+		j := i + 1 + rng.Intn(10)
+		start, end := crashTestKey(i), crashTestKey(j)
+		return crashTestOp{
+			name: "delete range " + start + " " + end,
+			run:  func(db *DB) error { return db.DeleteRange([]byte(start), []byte(end)) },
+			apply: func(model map[string]string) {
+				for key := range model {
+					if key >= start && key < end {
+						delete(model, key)
+					}
+				}
+			},
+		}
+	case n < 95:
+		return crashTestOp{
+			name:  "flush",
+			run:   func(db *DB) error { return db.Flush() },
+			apply: func(model map[string]string) {},
+		}
+	default:
+		return crashTestOp{
+			name:  "compact",
+			run:   func(db *DB) error { return db.Compact() },
+			apply: func(model map[string]string) {},
+		}
+	}
+}
+
+// randomFault returns a fault that fails or crashes somewhere in the middle
+// of the crash test
+func randomFault(rng *rand.Rand) vfs.Fault {
+	ops := []vfs.Op{vfs.OpWrite, vfs.OpSync, vfs.OpCreate, vfs.OpRename, vfs.OpRemove, vfs.OpSyncDir}
+	f := vfs.Fault{
+		Op:    ops[rng.Intn(len(ops))],
+		After: rng.Intn(20),
+		Torn:  rng.Intn(2) == 0,
+		Crash: rng.Intn(4) != 0,
+	}
+	if f.Op == vfs.OpWrite || f.Op == vfs.OpSync {
+		f.After = rng.Intn(400)
+	}
+	return f
+}
+
+// TestCrashRecovery runs random writes with synced WAL writes against a
+// filesystem that fails or crashes at a random point, then crashes it,
+// reopens the DB and checks that every acknowledged write survived. The
+// operation that failed may or may not have been applied.
+func TestCrashRecovery(t *testing.T) {
+	for seed := int64(1); seed <= 50; seed++ {
+		t.Run(fmt.Sprintf("seed%d", seed), func(t *testing.T) {
+			testCrashRecovery(t, seed)
+		})
+	}
+}
+
+func testCrashRecovery(t *testing.T, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	fs := vfs.NewFaultFS(vfs.NewMem())
+	opts := &Options{
+		FS:                  fs,
+		SyncWrites:          true,
+		MemTableSize:        2 * 1024,
+		L0CompactionTrigger: 2,
+		TargetFileSize:      4 * 1024,
+	}
+
+	db, err := Open("/db", opts)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	fault := randomFault(rng)
+	fs.Inject(fault)
+
+	acked := make(map[string]string)
+	maybe := acked
+	for i := 0; i < 500; i++ {
+		op := randomCrashTestOp(rng, i)
+		if err := op.run(db); err != nil {
+			if !errors.Is(err, vfs.ErrInjected) && !errors.Is(err, vfs.ErrCrashed) {
+				t.Fatalf("%s: unexpected error %v", op.name, err)
+			}
+			maybe = make(map[string]string)
+			for key, value := range acked {
+				maybe[key] = value
+			}
+			op.apply(maybe)
+			break
+		}
+		op.apply(acked)
+	}
+
+	fs.Crash()
+	db.Close()
+	fs.Restart()
+
+	db, err = Open("/db", &Options{FS: fs})
+	if err != nil {
+		t.Fatalf("Failed to reopen db after %+v: %v", fault, err)
+	}
+	defer db.Close()
+
+	for i := 0; i < crashTestKeys; i++ {
+		key := crashTestKey(i)
+		value, err := db.Get([]byte(key))
+		if err != nil && err != ErrNotFound {
+			t.Fatalf("Get %s failed: %v", key, err)
+		}
+
+		ackedValue, ackedOK := acked[key]
+		maybeValue, maybeOK := maybe[key]
+		found := err == nil
+		if (found == ackedOK && string(value) == ackedValue) || (found == maybeOK && string(value) == maybeValue) {
+			continue
+		}
+		t.Fatalf("After %+v, key %s: expected %q (present %v), got %q (present %v)",
+			fault, key, ackedValue, ackedOK, value, found)
+	}
+}
@@ -0,0 +1,643 @@
+package golsm
+
+import (
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/vikramcse/go-lsm/internal/sstable"
+	"github.com/vikramcse/go-lsm/internal/wal"
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+var (
+	ErrNotFound     = errors.New("key not found")
+	ErrClosed       = errors.New("db closed")
+	ErrInvalidRange = errors.New("invalid range: start must be less than end")
+
+	// ErrUnorderedMemTable is returned by NewIterator and Scan while a
+	// memtable with an unordered backend, such as HashBackend, holds data
+	// the iterator would have to read
+	ErrUnorderedMemTable = errors.New("range iteration is not supported by an unordered memtable backend")
+
+	// ErrComparatorMismatch is returned by Open when the tables of the DB
+	// were written with another comparator than Options.Comparator
+	ErrComparatorMismatch = sstable.ErrComparatorMismatch
+)
+
+// DB is a key-value store built as a log-structured merge tree.
+//
+// Writes are appended to the WAL and applied to the active memtable of their
+// column family. Once the memtable is full it is switched to the list of
+// immutable memtables, a new memtable and WAL take its place, and a
+// background goroutine flushes the immutable memtable to an SSTable. Writers
+// only wait for the flusher when too many immutable memtables pile up.
+//
+// Reads consult the active memtable, then the immutable memtables from the
+// newest to the oldest, then the SSTables: level 0 from the newest to the
+// oldest, then level 1. Level 0 tables are compacted into level 1 in the
+// background once there are enough of them.
+//
+// The methods of DB read and write the default column family.
+type DB struct {
+	dir  string
+	opts *Options
+	fs   vfs.FS
+	lock io.Closer // held on the LOCK file while the DB is open
+
+	mu        sync.Mutex
+	cond      *sync.Cond // broadcast whenever imm, bgErr or closed change
+	compactMu sync.Mutex // serializes compactions
+
+	cfs     []*ColumnFamily // the default column family first
+	def     *ColumnFamily
+	log     *wal.Writer
+	logNum  uint64
+	logNums []uint64       // WAL files not removed yet, oldest first
+	imm     []*immMemTable // waiting to be flushed, oldest first
+
+	loads     int // load sessions that have not ended
+	snapshots map[*Snapshot]struct{}
+
+	nextFileNum uint64
+	lastSeq     uint64
+	bgErr       error // sticky error from the background flusher or compactions
+	closed      bool
+	compacting  bool // whether the compaction goroutine is running
+	flushDone   chan struct{}
+}
+
+// immMemTable is a full memtable waiting to be flushed, along with the oldest
+// WAL holding its writes
+type immMemTable struct {
+	cf     *ColumnFamily
+	mem    *MemTable
+	logNum uint64
+}
+
+// Open opens the DB in dir, creating it if it does not exist. Writes found in
+// WAL files that were not flushed before the last shutdown are replayed and
+// flushed to new SSTables.
+func Open(dir string, opts *Options) (*DB, error) {
+	opts = opts.withDefaults()
+	if err := opts.FS.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	opts.blobs = newBlobSet(opts.FS, dir)
+
+	// Only one DB at a time may use dir
+	lock, err := opts.FS.Lock(filepath.Join(dir, LockFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		dir:       dir,
+		opts:      opts,
+		fs:        opts.FS,
+		lock:      lock,
+		flushDone: make(chan struct{}),
+	}
+	db.cond = sync.NewCond(&db.mu)
+
+	m, err := readManifest(db.fs, dir)
+	if errors.Is(err, os.ErrNotExist) {
+		m, err = newManifest(), nil
+	}
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	db.nextFileNum = m.nextFileNum
+	db.lastSeq = m.lastSeq
+
+	for _, meta := range m.columnFamilies {
+		db.addColumnFamily(meta.id, meta.name, opts.ColumnFamilies[meta.name])
+	}
+	db.def = db.cfs[0]
+	for _, meta := range m.tables {
+		cf := db.columnFamilyByID(meta.cf)
+		if cf == nil {
+			db.closeTables()
+			lock.Close()
+			return nil, errCorruptManifest
+		}
+		t, err := openTable(cf.opts, dir, meta)
+		if err != nil {
+			db.closeTables()
+			lock.Close()
+			return nil, err
+		}
+		cf.tables = append(cf.tables, t)
+	}
+	for _, name := range slices.Sorted(maps.Keys(opts.ColumnFamilies)) {
+		if name != "" && db.columnFamilyByName(name) == nil {
+			db.addColumnFamily(db.nextColumnFamilyID(), name, opts.ColumnFamilies[name])
+		}
+	}
+
+	if err := db.recoverLogs(m); err != nil {
+		db.closeTables()
+		lock.Close()
+		return nil, err
+	}
+	if err := db.removeOrphanBlobFiles(); err != nil {
+		db.closeTables()
+		lock.Close()
+		return nil, err
+	}
+
+	go db.flushLoop()
+	return db, nil
+}
+
+// recoverLogs replays the WAL files holding writes that the manifest m does
+// not cover into a memtable per column family, flushes them, and starts a
+// fresh WAL. A column family only gets the writes of the WAL files from its
+// own log number on, as those of the older ones are in its tables. A torn
+// record ends the replay of its log; everything before it is kept.
+func (db *DB) recoverLogs(m *manifest) error {
+	logNums, err := listFileNums(db.fs, db.dir, WALFilePrefix, ".log")
+	if err != nil {
+		return err
+	}
+
+	// File numbers are only persisted with the manifest, so a crash can
+	// leave WAL files numbered past the recorded counter. Never reuse them.
+	if len(logNums) > 0 && logNums[len(logNums)-1] >= db.nextFileNum {
+		db.nextFileNum = logNums[len(logNums)-1] + 1
+	}
+
+	mems := make(map[uint32]*MemTable)
+	for _, cf := range db.cfs {
+		mems[cf.id] = cf.opts.newMemTable(cf.opts.MemTableBackend)
+		defer mems[cf.id].Release()
+	}
+
+	var replayed []uint64
+	for _, logNum := range logNums {
+		if logNum < m.logNum {
+			// Left behind by a crash after its memtables were flushed
+			db.fs.Remove(walFileName(db.dir, logNum))
+			continue
+		}
+		replayTo := func(id uint32) *MemTable {
+			if logNum < m.columnFamilyLogNum(id) {
+				return nil
+			}
+			return mems[id]
+		}
+		if _, _, err := db.replayLog(logNum, replayTo); err != nil {
+			return err
+		}
+		replayed = append(replayed, logNum)
+	}
+
+	for _, cf := range db.cfs {
+		if mems[cf.id].Empty() {
+			continue
+		}
+		t, err := db.writeTable(cf, mems[cf.id], db.allocFileNum())
+		if err != nil {
+			return err
+		}
+		cf.tables = append([]*table{t}, cf.tables...)
+	}
+
+	db.logNum = db.allocFileNum()
+	if db.log, err = wal.NewWriter(db.fs, walFileName(db.dir, db.logNum)); err != nil {
+		return err
+	}
+	db.logNums = []uint64{db.logNum}
+	for _, cf := range db.cfs {
+		cf.mem = cf.newMemTable()
+		cf.memLogNum = db.logNum
+	}
+	if err := db.saveManifest(); err != nil {
+		return err
+	}
+
+	for _, logNum := range replayed {
+		db.fs.Remove(walFileName(db.dir, logNum))
+	}
+	return nil
+}
+
+// replayLog applies the batches of a WAL file to the memtables returned by
+// mems for the column families of their entries. It returns the number of
+// batches replayed and whether the replay stopped at a damaged record.
+func (db *DB) replayLog(logNum uint64, mems func(cf uint32) *MemTable) (int, bool, error) {
+	reader, err := wal.NewReader(db.fs, walFileName(db.dir, logNum))
+	if err != nil {
+		return 0, false, err
+	}
+	defer reader.Close()
+
+	records := 0
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records, false, nil
+		}
+		if errors.Is(err, wal.ErrCorruptRecord) {
+			return records, true, nil
+		}
+		if err != nil {
+			return records, false, err
+		}
+
+		// A record that passed its CRC but does not decode is damage too
+		b, err := decodeBatch(record)
+		if err != nil {
+			return records, true, nil
+		}
+		records++
+		if len(b.entries) == 0 {
+			continue
+		}
+		if err := b.apply(mems, db.opts.Comparator); err != nil {
+			return records, false, err
+		}
+		if b.lastSeq() > db.lastSeq {
+			db.lastSeq = b.lastSeq()
+		}
+	}
+}
+
+// Put sets the value for key
+func (db *DB) Put(key, value []byte) error {
+	return db.def.Put(key, value)
+}
+
+// Put sets the value for key in the column family
+func (cf *ColumnFamily) Put(key, value []byte) error {
+	b := &batch{}
+	b.put(cf.id, key, value)
+	return cf.db.write(b)
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (db *DB) Delete(key []byte) error {
+	return db.def.Delete(key)
+}
+
+// Delete removes key from the column family
+func (cf *ColumnFamily) Delete(key []byte) error {
+	b := &batch{}
+	b.delete(cf.id, key)
+	return cf.db.write(b)
+}
+
+// DeleteRange removes every key in [start, end)
+func (db *DB) DeleteRange(start, end []byte) error {
+	return db.def.DeleteRange(start, end)
+}
+
+// DeleteRange removes every key in [start, end) from the column family
+func (cf *ColumnFamily) DeleteRange(start, end []byte) error {
+	if cf.opts.Comparator.Compare(start, end) >= 0 {
+		return ErrInvalidRange
+	}
+
+	b := &batch{}
+	b.deleteRange(cf.id, start, end)
+	return cf.db.write(b)
+}
+
+// write logs b to the WAL and applies it to the active memtables of its
+// column families
+func (db *DB) write(b *batch) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	var cfs []*ColumnFamily
+	for _, e := range b.entries {
+		cf := db.columnFamilyByID(e.cf)
+		if cf == nil {
+			return ErrUnknownColumnFamily
+		}
+		if !slices.Contains(cfs, cf) {
+			cfs = append(cfs, cf)
+		}
+	}
+	if err := db.makeRoomForWrite(cfs); err != nil {
+		return err
+	}
+
+	b.seq = db.lastSeq + 1
+	if err := db.log.AddRecord(b.encode()); err != nil {
+		return err
+	}
+	if db.opts.SyncWrites {
+		if err := db.log.Sync(); err != nil {
+			return err
+		}
+	}
+
+	// The batch is logged by now, so its sequence numbers are used even
+	// if applying it fails
+	err := b.apply(db.activeMemTable, db.opts.Comparator)
+	db.lastSeq = b.lastSeq()
+	return err
+}
+
+// activeMemTable returns the active memtable of the column family numbered
+// id, or nil if there is none. db.mu must be held.
+func (db *DB) activeMemTable(id uint32) *MemTable {
+	if cf := db.columnFamilyByID(id); cf != nil {
+		return cf.mem
+	}
+	return nil
+}
+
+// makeRoomForWrite switches the active memtables of cfs that are full to the
+// immutable list, slowing down or stalling the caller while too many
+// immutable memtables are waiting for the flusher. db.mu must be held.
+func (db *DB) makeRoomForWrite(cfs []*ColumnFamily) error {
+	allowDelay := true
+	for {
+		var full []*ColumnFamily
+		for _, cf := range cfs {
+			if !cf.mem.Empty() && cf.mem.ShouldFlush(cf.opts.MemTableSize) {
+				full = append(full, cf)
+			}
+		}
+
+		switch {
+		case db.bgErr != nil:
+			return db.bgErr
+		case db.closed:
+			return ErrClosed
+		case allowDelay && len(db.imm) >= db.opts.SlowdownImmutableMemTables:
+			// Delay a single write rather than stalling it outright, which
+			// spreads the wait over many writes
+			db.mu.Unlock()
+			time.Sleep(time.Millisecond)
+			db.mu.Lock()
+			allowDelay = false
+		case len(full) == 0:
+			return nil
+		case len(db.imm) >= db.opts.MaxImmutableMemTables:
+			db.cond.Wait()
+		default:
+			if err := db.rotateMemTables(full...); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// rotateMemTables moves the active memtables of cfs to the immutable list
+// and starts new memtables and a new WAL, which all column families write
+// to from then on. db.mu must be held.
+func (db *DB) rotateMemTables(cfs ...*ColumnFamily) error {
+	logNum := db.allocFileNum()
+	log, err := wal.NewWriter(db.fs, walFileName(db.dir, logNum))
+	if err != nil {
+		return err
+	}
+	// Synced writes to the new WAL are only durable once its directory
+	// entry is
+	if err := db.fs.Sync(db.dir); err != nil {
+		log.Close()
+		return err
+	}
+	if err := db.log.Close(); err != nil {
+		log.Close()
+		return err
+	}
+
+	for _, cf := range cfs {
+		cf.mem.Seal()
+		db.imm = append(db.imm, &immMemTable{cf: cf, mem: cf.mem, logNum: cf.memLogNum})
+		cf.mem = cf.newMemTable()
+		cf.memLogNum = logNum
+	}
+	// Column families without unflushed writes no longer need the older
+	// WALs; the others keep them until their memtables are flushed
+	for _, cf := range db.cfs {
+		if cf.mem.Empty() {
+			cf.memLogNum = logNum
+		}
+	}
+	db.log = log
+	db.logNum = logNum
+	db.logNums = append(db.logNums, logNum)
+	db.cond.Broadcast()
+	return nil
+}
+
+// nonEmptyColumnFamilies returns the column families whose active memtable
+// holds data. db.mu must be held.
+func (db *DB) nonEmptyColumnFamilies() []*ColumnFamily {
+	var cfs []*ColumnFamily
+	for _, cf := range db.cfs {
+		if !cf.mem.Empty() {
+			cfs = append(cfs, cf)
+		}
+	}
+	return cfs
+}
+
+// Get returns the value for key, or ErrNotFound
+func (db *DB) Get(key []byte) ([]byte, error) {
+	return db.def.Get(key)
+}
+
+// Get returns the value for key in the column family, or ErrNotFound
+func (cf *ColumnFamily) Get(key []byte) ([]byte, error) {
+	db := cf.db
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil, ErrClosed
+	}
+	rs := cf.currentReadState()
+	db.mu.Unlock()
+	defer rs.release()
+
+	return rs.get(key)
+}
+
+// Flush switches the active memtables of all column families to the
+// immutable list and waits until every immutable memtable has been written
+// to an SSTable
+func (db *DB) Flush() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if cfs := db.nonEmptyColumnFamilies(); len(cfs) > 0 {
+		if err := db.rotateMemTables(cfs...); err != nil {
+			return err
+		}
+	}
+	for len(db.imm) > 0 && db.bgErr == nil {
+		db.cond.Wait()
+	}
+	return db.bgErr
+}
+
+// Flush switches the active memtable of the column family to the immutable
+// list and waits until its immutable memtables have been written to
+// SSTables
+func (cf *ColumnFamily) Flush() error {
+	db := cf.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if !cf.mem.Empty() {
+		if err := db.rotateMemTables(cf); err != nil {
+			return err
+		}
+	}
+	for db.hasImmutable(cf) && db.bgErr == nil {
+		db.cond.Wait()
+	}
+	return db.bgErr
+}
+
+// hasImmutable reports whether immutable memtables of cf wait to be flushed.
+// db.mu must be held.
+func (db *DB) hasImmutable(cf *ColumnFamily) bool {
+	for _, imm := range db.imm {
+		if imm.cf == cf {
+			return true
+		}
+	}
+	return false
+}
+
+// Close flushes all memtables and closes the DB
+func (db *DB) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+
+	var err error
+	if cfs := db.nonEmptyColumnFamilies(); len(cfs) > 0 && db.bgErr == nil {
+		err = db.rotateMemTables(cfs...)
+	}
+	db.closed = true
+	db.cond.Broadcast()
+	db.mu.Unlock()
+
+	// The flusher drains the immutable memtables before it exits, and a
+	// running compaction stops once it is done
+	<-db.flushDone
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for db.compacting {
+		db.cond.Wait()
+	}
+	db.releaseMemTables()
+
+	if err == nil {
+		err = db.bgErr
+	}
+	if logErr := db.log.Close(); err == nil {
+		err = logErr
+	}
+	if tableErr := db.closeTables(); err == nil {
+		err = tableErr
+	}
+	if lockErr := db.lock.Close(); err == nil {
+		err = lockErr
+	}
+	return err
+}
+
+// releaseMemTables returns the memory of the memtables the DB still holds to
+// the WriteBufferManager: the new empty ones after a clean close, and those
+// left unflushed by a background error. db.mu must be held.
+func (db *DB) releaseMemTables() {
+	for _, imm := range db.imm {
+		imm.mem.Release()
+	}
+	for _, cf := range db.cfs {
+		cf.mem.Release()
+	}
+}
+
+// closeTables drops the DB's references to its tables. Tables still used by
+// iterators or snapshots are closed when those are released.
+func (db *DB) closeTables() error {
+	var err error
+	for _, cf := range db.cfs {
+		for _, t := range cf.tables {
+			if closeErr := t.unref(); err == nil {
+				err = closeErr
+			}
+		}
+		cf.tables = nil
+	}
+	return err
+}
+
+// allocFileNum returns the next unused file number. db.mu must be held.
+func (db *DB) allocFileNum() uint64 {
+	num := db.nextFileNum
+	db.nextFileNum++
+	return num
+}
+
+// minUnflushedLogNum returns the number of the oldest WAL that holds writes
+// not yet flushed to an SSTable. db.mu must be held.
+func (db *DB) minUnflushedLogNum() uint64 {
+	logNum := db.logNum
+	for _, cf := range db.cfs {
+		logNum = min(logNum, cf.logNum())
+	}
+	return logNum
+}
+
+// removeObsoleteLogs removes the WAL files whose writes have all been
+// flushed. db.mu must be held.
+func (db *DB) removeObsoleteLogs() {
+	minLogNum := db.minUnflushedLogNum()
+	for len(db.logNums) > 0 && db.logNums[0] < minLogNum {
+		db.fs.Remove(walFileName(db.dir, db.logNums[0]))
+		db.logNums = db.logNums[1:]
+	}
+}
+
+// saveManifest persists the current column families and their tables, along
+// with the oldest WAL each still has unflushed writes in. db.mu must be
+// held.
+func (db *DB) saveManifest() error {
+	m := &manifest{
+		nextFileNum: db.nextFileNum,
+		lastSeq:     db.lastSeq,
+		logNum:      db.minUnflushedLogNum(),
+	}
+	for _, cf := range db.cfs {
+		m.columnFamilies = append(m.columnFamilies, columnFamilyMeta{id: cf.id, name: cf.name, logNum: cf.logNum()})
+		for _, t := range cf.tables {
+			m.tables = append(m.tables, t.meta)
+		}
+	}
+	if err := writeManifest(db.fs, db.dir, m); err != nil {
+		return err
+	}
+
+	// Blob files no live table references any more go with their tables
+	db.opts.blobs.setLive(liveBlobBytes(db.allTables()))
+	return nil
+}
@@ -0,0 +1,450 @@
+package golsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+func TestDBPutGetDelete(t *testing.T) {
+	db, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Put([]byte("key1"), []byte("value1")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := db.Put([]byte("key2"), []byte("value2")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	value, err := db.Get([]byte("key1"))
+	if err != nil || string(value) != "value1" {
+		t.Errorf("Expected value1, got %q (err %v)", value, err)
+	}
+
+	if err := db.Delete([]byte("key1")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := db.Get([]byte("key1")); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after delete, got %v", err)
+	}
+
+	// The tombstone must also hide the key once both are in SSTables
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if _, err := db.Get([]byte("key1")); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after flush, got %v", err)
+	}
+	value, err = db.Get([]byte("key2"))
+	if err != nil || string(value) != "value2" {
+		t.Errorf("Expected value2, got %q (err %v)", value, err)
+	}
+}
+
+func TestDBFlushAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{MemTableSize: 4 * 1024}
+
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+
+	const n = 2000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := db.Put(key, []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	// Overwrite a key that has already been flushed
+	if err := db.Put([]byte("key00000"), []byte("updated")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+
+	if len(db.def.tables) < 2 {
+		t.Errorf("Expected several SSTables, got %d", len(db.def.tables))
+	}
+
+	for i := 1; i < n; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key%05d", i)))
+		if err != nil || string(value) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("Key %d: expected value%d, got %q (err %v)", i, i, value, err)
+		}
+	}
+	value, err := db.Get([]byte("key00000"))
+	if err != nil || string(value) != "updated" {
+		t.Errorf("Expected updated, got %q (err %v)", value, err)
+	}
+}
+
+func TestDBRecoverFromWAL(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := Open(dir, &Options{SyncWrites: true})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	if err := db.Put([]byte("key1"), []byte("value1")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := db.Delete([]byte("key1")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := db.Put([]byte("key2"), []byte("value2")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	crash(db)
+
+	db, err = Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Get([]byte("key1")); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for deleted key, got %v", err)
+	}
+	value, err := db.Get([]byte("key2"))
+	if err != nil || string(value) != "value2" {
+		t.Errorf("Expected value2, got %q (err %v)", value, err)
+	}
+
+	// Sequence numbers continue after the replayed writes
+	if db.lastSeq != 3 {
+		t.Errorf("Expected last sequence 3, got %d", db.lastSeq)
+	}
+}
+
+func TestDBConcurrentWritesWithStalls(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{
+		MemTableSize:               1024,
+		SlowdownImmutableMemTables: 1,
+		MaxImmutableMemTables:      1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	const writers, perWriter = 4, 500
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				key := []byte(fmt.Sprintf("w%d-key%04d", w, i))
+				if err := db.Put(key, key); err != nil {
+					t.Errorf("Put failed: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for w := 0; w < writers; w++ {
+		for i := 0; i < perWriter; i++ {
+			key := []byte(fmt.Sprintf("w%d-key%04d", w, i))
+			value, err := db.Get(key)
+			if err != nil || string(value) != string(key) {
+				t.Fatalf("Expected %s, got %q (err %v)", key, value, err)
+			}
+		}
+	}
+}
+
+func TestDBWriteBufferManagerTriggersFlush(t *testing.T) {
+	wbm := NewWriteBufferManager(2 * 1024)
+	db, err := Open(t.TempDir(), &Options{WriteBufferManager: wbm})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 200; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%03d", i)), make([]byte, 64)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	// The default memtable size would never have been reached
+	if len(db.def.tables) < 2 {
+		t.Errorf("Expected the shared budget to trigger flushes, got %d tables", len(db.def.tables))
+	}
+	if wbm.MemoryUsage() != 0 {
+		t.Errorf("Expected flushed memtables to release memory, usage %d", wbm.MemoryUsage())
+	}
+}
+
+func TestDBReleasesMemTablesOnBackgroundError(t *testing.T) {
+	wbm := NewWriteBufferManager(1 << 20)
+	fs := vfs.NewFaultFS(vfs.NewMem())
+	fs.Inject(vfs.Fault{Op: vfs.OpCreate, Path: SSTableFilePrefix})
+	db, err := Open("/db", &Options{FS: fs, WriteBufferManager: wbm})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+
+	db.Put([]byte("a"), make([]byte, 64))
+	if err := db.Flush(); err == nil {
+		t.Fatalf("Expected the flush to fail")
+	}
+
+	// The flusher gives up on the memtable it could not flush
+	deadline := time.Now().Add(5 * time.Second)
+	for wbm.MemoryUsage() != wbm.MutableMemoryUsage() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if wbm.MemoryUsage() != wbm.MutableMemoryUsage() {
+		t.Errorf("Expected only active memtables to reserve memory, usage %d, mutable %d", wbm.MemoryUsage(), wbm.MutableMemoryUsage())
+	}
+
+	if err := db.Close(); err == nil {
+		t.Errorf("Expected Close to report the background error")
+	}
+	if wbm.MemoryUsage() != 0 {
+		t.Errorf("Expected a closed DB to release all its memory, usage %d", wbm.MemoryUsage())
+	}
+}
+
+// blockingFilter holds up the first compaction that calls it until release
+// is closed
+type blockingFilter struct {
+	once    *sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (f blockingFilter) Name() string {
+	return "blockingFilter"
+}
+
+func (f blockingFilter) Filter(level int, key, value []byte) (FilterDecision, []byte, error) {
+	f.once.Do(func() {
+		close(f.started)
+		<-f.release
+	})
+	return FilterKeep, nil, nil
+}
+
+func TestDBFlushesDuringCompaction(t *testing.T) {
+	filter := blockingFilter{once: &sync.Once{}, started: make(chan struct{}), release: make(chan struct{})}
+	db, err := Open("/db", &Options{
+		FS:                  vfs.NewMem(),
+		L0CompactionTrigger: 2,
+		CompactionFilterFactory: func(CompactionFilterContext) CompactionFilter {
+			return filter
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+	defer close(filter.release)
+
+	db.Put([]byte("a"), []byte("1"))
+	db.Flush()
+	db.Put([]byte("b"), []byte("1"))
+	db.Flush()
+	<-filter.started
+
+	// The compaction is stuck, yet memtables are still flushed
+	flushed := make(chan error, 1)
+	go func() {
+		db.Put([]byte("c"), []byte("1"))
+		flushed <- db.Flush()
+	}()
+	select {
+	case err := <-flushed:
+		if err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Flush waited for the compaction")
+	}
+}
+
+// crash stops the DB without flushing the active memtable, leaving its
+// writes only in the WAL
+func crash(db *DB) {
+	db.mu.Lock()
+	db.closed = true
+	db.cond.Broadcast()
+	db.mu.Unlock()
+	<-db.flushDone
+
+	db.log.Close()
+	db.closeTables()
+	db.lock.Close()
+}
+
+func TestDBOnMemFS(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := &Options{FS: fs, MemTableSize: 4 * 1024}
+
+	db, err := Open("/db", opts)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	putRange(t, db, "key", 1000)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	tables, err := listFileNums(fs, "/db", SSTableFilePrefix, ".sst")
+	if err != nil || len(tables) == 0 {
+		t.Fatalf("Expected tables in the in-memory filesystem, got %v (err %v)", tables, err)
+	}
+
+	db, err = Open("/db", opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+	if n := countKeys(t, db, "key"); n != 1000 {
+		t.Errorf("Expected 1000 keys after reopen, got %d", n)
+	}
+}
+
+func TestDBLocksDir(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+
+	if _, err := Open(dir, nil); err == nil {
+		t.Fatalf("Expected a second Open of the same dir to fail")
+	}
+	if _, err := Repair(dir, nil); err == nil {
+		t.Fatalf("Expected Repair of an open DB to fail")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	db, err = Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen db after close: %v", err)
+	}
+	db.Close()
+}
+
+func TestDBPartitionedIndex(t *testing.T) {
+	opts := &Options{FS: vfs.NewMem(), IndexPartitionSize: 128, BlockCacheSize: 1 << 20}
+	db, err := Open("/db", opts)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	putRange(t, db, "key", 2000)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	db, err = Open("/db", opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+
+	if n := len(db.def.tables[0].reader.IndexPartitions()); n < 2 {
+		t.Errorf("Expected a partitioned index, got %d partitions", n)
+	}
+	for _, i := range []int{0, 999, 1999} {
+		key := fmt.Sprintf("key%04d", i)
+		if value, err := db.Get([]byte(key)); err != nil || string(value) != key {
+			t.Errorf("Expected %s, got %q (err %v)", key, value, err)
+		}
+	}
+	if n := countKeys(t, db, "key"); n != 2000 {
+		t.Errorf("Expected 2000 keys, got %d", n)
+	}
+	if db.opts.blockCache.Size() == 0 {
+		t.Errorf("Expected reads to fill the block cache")
+	}
+}
+
+// reverseComparator orders keys from the largest to the smallest
+type reverseComparator struct{}
+
+func (reverseComparator) Compare(a, b []byte) int                 { return bytes.Compare(b, a) }
+func (reverseComparator) Name() string                            { return "test.ReverseComparator" }
+func (reverseComparator) Separator(prevLast, first []byte) []byte { return first }
+
+func TestDBComparator(t *testing.T) {
+	fs := vfs.NewMem()
+	for _, backend := range []MemTableBackend{SkipListBackend, RedBlackTreeBackend, BTreeBackend} {
+		dir := fmt.Sprintf("/db%d", backend)
+		opts := &Options{FS: fs, Comparator: reverseComparator{}, MemTableBackend: backend, MemTableSize: 4 * 1024}
+		db, err := Open(dir, opts)
+		if err != nil {
+			t.Fatalf("Failed to open db: %v", err)
+		}
+		putRange(t, db, "key", 1000)
+		if err := db.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+		putRange(t, db, "key", 10)
+
+		// Ranges run from the larger key to the smaller one
+		if err := db.DeleteRange([]byte("key0200"), []byte("key0100")); err != nil {
+			t.Fatalf("DeleteRange failed: %v", err)
+		}
+		if err := db.DeleteRange([]byte("key0100"), []byte("key0200")); err != ErrInvalidRange {
+			t.Errorf("Expected ErrInvalidRange, got %v", err)
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatalf("Compact failed: %v", err)
+		}
+
+		var keys []string
+		db.Scan(nil, nil, func(key, value []byte) bool {
+			keys = append(keys, string(key))
+			return true
+		})
+		if len(keys) != 900 || keys[0] != "key0999" || keys[len(keys)-1] != "key0000" {
+			t.Errorf("Expected 900 keys from key0999 down to key0000, got %d", len(keys))
+		}
+		for i := 1; i < len(keys); i++ {
+			if keys[i-1] <= keys[i] {
+				t.Fatalf("Expected keys in reverse order, got %s before %s", keys[i-1], keys[i])
+			}
+		}
+		if _, err := db.Get([]byte("key0150")); err != ErrNotFound {
+			t.Errorf("Expected key0150 to be deleted, got %v", err)
+		}
+		if value, err := db.Get([]byte("key0050")); err != nil || string(value) != "key0050" {
+			t.Errorf("Expected key0050, got %q (err %v)", value, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+
+		if _, err := Open(dir, &Options{FS: fs}); !errors.Is(err, ErrComparatorMismatch) {
+			t.Errorf("Expected ErrComparatorMismatch reopening with the default comparator, got %v", err)
+		}
+	}
+}
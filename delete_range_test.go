@@ -0,0 +1,223 @@
+package golsm
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+func putRange(t *testing.T, db *DB, prefix string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("%s%04d", prefix, i)
+		if err := db.Put([]byte(key), []byte(key)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+}
+
+func countKeys(t *testing.T, db *DB, prefix string) int {
+	t.Helper()
+	return len(collect(t, db, ReadOptions{Prefix: []byte(prefix)}))
+}
+
+func TestDeleteRange(t *testing.T) {
+	db, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	putRange(t, db, "a", 100)
+	putRange(t, db, "b", 100)
+	db.Flush()
+	putRange(t, db, "c", 100)
+
+	// Delete the b keys in the SSTable and half of the c keys in the memtable
+	if err := db.DeleteRange([]byte("b"), []byte("c0050")); err != nil {
+		t.Fatalf("DeleteRange failed: %v", err)
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		if n := countKeys(t, db, "a"); n != 100 {
+			t.Errorf("%s: expected 100 a keys, got %d", stage, n)
+		}
+		if n := countKeys(t, db, "b"); n != 0 {
+			t.Errorf("%s: expected no b keys, got %d", stage, n)
+		}
+		if n := countKeys(t, db, "c"); n != 50 {
+			t.Errorf("%s: expected 50 c keys, got %d", stage, n)
+		}
+		if _, err := db.Get([]byte("b0010")); err != ErrNotFound {
+			t.Errorf("%s: expected ErrNotFound for b0010, got %v", stage, err)
+		}
+		if _, err := db.Get([]byte("c0049")); err != ErrNotFound {
+			t.Errorf("%s: expected ErrNotFound for c0049, got %v", stage, err)
+		}
+		if _, err := db.Get([]byte("c0050")); err != nil {
+			t.Errorf("%s: expected c0050 to survive, got %v", stage, err)
+		}
+	}
+
+	check("memtable")
+	db.Flush()
+	check("flushed")
+
+	// Writes after the deletion are not affected by it
+	db.Put([]byte("b0010"), []byte("new"))
+	if value, err := db.Get([]byte("b0010")); err != nil || string(value) != "new" {
+		t.Errorf("Expected new value after DeleteRange, got %q (err %v)", value, err)
+	}
+	db.Delete([]byte("b0010"))
+
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	check("compacted")
+
+	if err := db.DeleteRange([]byte("b"), []byte("a")); err != ErrInvalidRange {
+		t.Errorf("Expected ErrInvalidRange, got %v", err)
+	}
+}
+
+func TestDeleteRangeCompactionDropsData(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, &Options{L0CompactionTrigger: 100})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+
+	putRange(t, db, "tenant1/", 500)
+	db.Flush()
+	putRange(t, db, "tenant2/", 500)
+	db.Flush()
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	db.DeleteRange([]byte("tenant1/"), []byte("tenant1/\xff"))
+	db.Flush()
+
+	db.mu.Lock()
+	var sizeBefore uint64
+	for _, tbl := range db.def.tables {
+		sizeBefore += tbl.meta.size
+	}
+	db.mu.Unlock()
+
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	db.mu.Lock()
+	var sizeAfter uint64
+	for _, tbl := range db.def.tables {
+		sizeAfter += tbl.meta.size
+		if len(tbl.rangeDels) > 0 {
+			t.Errorf("Expected range tombstones to be dropped at the bottom level")
+		}
+	}
+	db.mu.Unlock()
+
+	if sizeAfter*2 > sizeBefore {
+		t.Errorf("Expected compaction to drop the deleted tenant, size %d -> %d", sizeBefore, sizeAfter)
+	}
+
+	// Obsolete files are removed
+	files, _ := listFileNums(vfs.Default, dir, SSTableFilePrefix, ".sst")
+	if len(files) != len(db.def.tables) {
+		t.Errorf("Expected %d table files, found %d", len(db.def.tables), len(files))
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	db, err = Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+	if n := countKeys(t, db, "tenant1/"); n != 0 {
+		t.Errorf("Expected no tenant1 keys, got %d", n)
+	}
+	if n := countKeys(t, db, "tenant2/"); n != 500 {
+		t.Errorf("Expected 500 tenant2 keys, got %d", n)
+	}
+}
+
+func TestCompactionDropsCoveredTables(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{L0CompactionTrigger: 100})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	putRange(t, db, "k", 100)
+	db.Flush()
+	db.DeleteRange([]byte("a"), []byte("z"))
+	db.Put([]byte("x"), []byte("kept"))
+	db.Flush()
+
+	db.mu.Lock()
+	inputs := append([]*table(nil), db.def.tables...)
+	db.mu.Unlock()
+
+	var rangeDels = inputs[0].rangeDels
+	if !coveredTable(BytewiseComparator, inputs[1], rangeDels) {
+		t.Fatal("Expected the older table to be entirely covered")
+	}
+	if coveredTable(BytewiseComparator, inputs[0], rangeDels) {
+		t.Fatal("Expected the newer table not to be covered by its own tombstone")
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	expectEntries(t, collect(t, db, ReadOptions{}), "x=kept")
+}
+
+func TestIteratorKeepsCompactedTablesAlive(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, &Options{L0CompactionTrigger: 100})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	putRange(t, db, "k", 100)
+	db.Flush()
+
+	it, err := db.NewIterator(ReadOptions{})
+	if err != nil {
+		t.Fatalf("NewIterator failed: %v", err)
+	}
+
+	db.mu.Lock()
+	oldFile := db.def.tables[0].filename
+	db.mu.Unlock()
+
+	db.DeleteRange([]byte("k"), []byte("l"))
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	if _, err := os.Stat(oldFile); err != nil {
+		t.Fatalf("Expected compacted table to stay while an iterator uses it: %v", err)
+	}
+	count := 0
+	for it.Next() {
+		count++
+	}
+	if count != 100 {
+		t.Errorf("Expected the iterator to see 100 keys, got %d", count)
+	}
+
+	it.Close()
+	if _, err := os.Stat(oldFile); !os.IsNotExist(err) {
+		t.Errorf("Expected compacted table to be removed after the iterator closed, got %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package golsm
+
+import "github.com/vikramcse/go-lsm/internal/kv"
+
+// flushLoop runs in the background and writes immutable memtables to level 0
+// SSTables, oldest first, starting compactions of the column families that
+// need one on their own goroutine so that flushes go on while they run.
+// After a close it drains the remaining immutable memtables before exiting.
+func (db *DB) flushLoop() {
+	defer close(db.flushDone)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for {
+		for len(db.imm) == 0 && !db.closed {
+			db.cond.Wait()
+		}
+		if len(db.imm) == 0 {
+			return
+		}
+		if db.bgErr != nil {
+			// The memtables will not be flushed, so a WriteBufferManager
+			// shared with other DBs gets their memory back
+			for _, imm := range db.imm {
+				imm.mem.Release()
+			}
+			return
+		}
+		db.flushOldest()
+		db.maybeScheduleCompaction()
+	}
+}
+
+// maybeScheduleCompaction starts the compaction goroutine if a column family
+// needs a compaction and it is not running yet. db.mu must be held.
+func (db *DB) maybeScheduleCompaction() {
+	if db.compacting || db.closed || db.bgErr != nil || db.compactionCandidate() == nil {
+		return
+	}
+	db.compacting = true
+	go db.compactLoop()
+}
+
+// compactLoop runs the compactions of the column families that need one
+// until none does, setting db.bgErr on failure
+func (db *DB) compactLoop() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer func() {
+		db.compacting = false
+		db.cond.Broadcast()
+	}()
+
+	for !db.closed && db.bgErr == nil {
+		cf := db.compactionCandidate()
+		if cf == nil {
+			return
+		}
+		db.mu.Unlock()
+		err := db.compact(cf, false)
+		db.mu.Lock()
+
+		if err != nil {
+			db.bgErr = err
+			return
+		}
+	}
+}
+
+// compactionCandidate returns the first column family that needs a
+// compaction, or nil. db.mu must be held.
+func (db *DB) compactionCandidate() *ColumnFamily {
+	for _, cf := range db.cfs {
+		if cf.needsCompaction() {
+			return cf
+		}
+	}
+	return nil
+}
+
+// flushOldest writes the oldest immutable memtable to an SSTable of its
+// column family, setting db.bgErr on failure. db.mu must be held; it is
+// released during the write.
+func (db *DB) flushOldest() {
+	imm := db.imm[0]
+	fileNum := db.allocFileNum()
+
+	// The memtable stays in db.imm, and so visible to readers, until
+	// its table has been installed
+	db.mu.Unlock()
+	t, err := db.writeTable(imm.cf, imm.mem, fileNum)
+	db.mu.Lock()
+
+	if err == nil {
+		err = db.installFlushedTable(t)
+	}
+	if err != nil {
+		db.bgErr = err
+		db.cond.Broadcast()
+		return
+	}
+
+	db.removeObsoleteLogs()
+	imm.mem.Release()
+	db.cond.Broadcast()
+}
+
+// installFlushedTable adds the table written from db.imm[0] and removes that
+// memtable from the immutable list. db.mu must be held.
+func (db *DB) installFlushedTable(t *table) error {
+	imm := db.imm[0]
+	cf := imm.cf
+
+	prevTables, prevImm := cf.tables, db.imm
+	cf.tables = append([]*table{t}, cf.tables...)
+	db.imm = db.imm[1:]
+	if err := db.saveManifest(); err != nil {
+		cf.tables, db.imm = prevTables, prevImm
+		t.obsolete.Store(true)
+		t.unref()
+		return err
+	}
+	return nil
+}
+
+// writeTable writes the entries and range tombstones of mem to a new level 0
+// SSTable of cf and opens it
+func (db *DB) writeTable(cf *ColumnFamily, mem *MemTable, fileNum uint64) (*table, error) {
+	builder, err := newTableBuilder(db.dir, fileNum, 0, cf)
+	if err != nil {
+		return nil, err
+	}
+
+	add := func(key []byte, e kv.Entry) bool {
+		err = builder.add(key, e.Encode())
+		return err == nil
+	}
+	if mem.Ordered() {
+		mem.Ascend(add)
+	} else {
+		// Unordered memtables are sorted here, once, instead of on every write
+		mem.AscendSorted(db.opts.Comparator, add)
+	}
+	if err != nil {
+		builder.abandon()
+		return nil, err
+	}
+	for _, t := range mem.RangeTombstones() {
+		builder.addRangeTombstone(t)
+	}
+
+	return builder.finish()
+}
@@ -3,6 +3,7 @@ module github.com/vikramcse/go-lsm
 go 1.23.5
 
 require (
-	github.com/emirpasic/gods v1.18.1 // indirect
-	github.com/huandu/skiplist v1.2.1 // indirect
+	github.com/emirpasic/gods v1.18.1
+	github.com/golang/snappy v1.0.0
+	github.com/huandu/skiplist v1.2.1
 )
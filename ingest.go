@@ -0,0 +1,280 @@
+package golsm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/vikramcse/go-lsm/internal/sstable"
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+// ErrInvalidExternalFile is returned by IngestExternalFile, wrapped with the
+// reason, for files that cannot be added to the DB
+var ErrInvalidExternalFile = errors.New("invalid external file")
+
+// externalFile is a file being ingested
+type externalFile struct {
+	path     string
+	size     uint64
+	smallest []byte
+	largest  []byte
+
+	filename string // name in the DB directory once moved there
+	copied   bool   // whether the file was copied rather than moved
+}
+
+// IngestExternalFile adds SSTables written outside the DB with sstable.Writer
+// to the default column family
+func (db *DB) IngestExternalFile(paths []string) error {
+	return db.def.IngestExternalFile(paths)
+}
+
+// IngestExternalFile adds SSTables written outside the DB with sstable.Writer
+// to the column family. Their values are user values, as Put takes them.
+//
+// Every file is verified first: its blocks, and the order of its keys under
+// the column family's comparator, which it must have been written with. Each
+// file must hold at least one entry and no range deletions, and the files
+// must not overlap each other. They are then moved into the DB directory, or
+// copied when they cannot be moved, which leaves the originals in place, and
+// become visible all at once.
+//
+// All entries of the files get a single new sequence number, so they shadow
+// every earlier write to their keys. A file is placed at the bottom level
+// when no table of the column family overlaps it, and at level 0 otherwise.
+// Memtables of the column family holding keys within the range of a file
+// are flushed first, since reads consult memtables before any table.
+func (cf *ColumnFamily) IngestExternalFile(paths []string) error {
+	db := cf.db
+	files := make([]*externalFile, 0, len(paths))
+	for _, path := range paths {
+		f, err := cf.checkExternalFile(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return cf.opts.Comparator.Compare(files[i].smallest, files[j].smallest) < 0
+	})
+	for i := 1; i < len(files); i++ {
+		if cf.opts.Comparator.Compare(files[i-1].largest, files[i].smallest) >= 0 {
+			return fmt.Errorf("%w: %s overlaps %s", ErrInvalidExternalFile, files[i].path, files[i-1].path)
+		}
+	}
+
+	// The memtables take writes again while they are flushed without the
+	// locks, so they are checked again once compactMu is held
+	for {
+		db.compactMu.Lock()
+		db.mu.Lock()
+		if db.closed || db.bgErr != nil || !cf.memTablesOverlap(files) {
+			break
+		}
+		db.mu.Unlock()
+		db.compactMu.Unlock()
+
+		if err := cf.Flush(); err != nil {
+			return err
+		}
+	}
+	defer db.compactMu.Unlock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.bgErr != nil {
+		return db.bgErr
+	}
+	return cf.ingest(files)
+}
+
+// checkExternalFile verifies the file at path and reads its key range
+func (cf *ColumnFamily) checkExternalFile(path string) (*externalFile, error) {
+	db := cf.db
+	reader, err := sstable.NewReaderWithOptions(db.fs, path, sstable.ReaderOptions{Comparator: cf.opts.Comparator})
+	if err != nil {
+		return nil, err
+	}
+	props := reader.Properties()
+	reader.Close()
+
+	switch {
+	case props == nil:
+		return nil, fmt.Errorf("%w: %s has no properties", ErrInvalidExternalFile, path)
+	case props.NumEntries == 0:
+		return nil, fmt.Errorf("%w: %s is empty", ErrInvalidExternalFile, path)
+	case props.NumRangeDeletions > 0:
+		return nil, fmt.Errorf("%w: %s holds range deletions", ErrInvalidExternalFile, path)
+	}
+
+	report, err := sstable.VerifyWithOptions(db.fs, path, sstable.VerifyOptions{Comparator: cf.opts.Comparator})
+	if err != nil {
+		return nil, err
+	}
+	if !report.OK() {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidExternalFile, report.Err())
+	}
+
+	info, err := db.fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &externalFile{
+		path:     path,
+		size:     uint64(info.Size()),
+		smallest: props.SmallestKey,
+		largest:  props.LargestKey,
+	}, nil
+}
+
+// memTablesOverlap reports whether any memtable of the column family holds
+// keys within the range of one of files. db.mu must be held.
+func (cf *ColumnFamily) memTablesOverlap(files []*externalFile) bool {
+	mems := []*MemTable{cf.mem}
+	for _, imm := range cf.db.imm {
+		if imm.cf == cf {
+			mems = append(mems, imm.mem)
+		}
+	}
+	for _, mem := range mems {
+		for _, f := range files {
+			if mem.overlaps(cf.opts.Comparator, f.smallest, f.largest) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ingest moves files into the DB directory and installs them as tables of
+// the column family. db.mu and db.compactMu must be held, so no compaction
+// changes the levels meanwhile. On failure the files are moved back.
+func (cf *ColumnFamily) ingest(files []*externalFile) error {
+	db := cf.db
+	seq := db.lastSeq + 1
+
+	var added []*table
+	fail := func(err error) error {
+		for _, t := range added {
+			t.unref()
+		}
+		for _, f := range files {
+			if f.filename == "" {
+				continue
+			}
+			if f.copied {
+				db.fs.Remove(f.filename)
+			} else {
+				db.fs.Rename(f.filename, f.path)
+			}
+		}
+		return err
+	}
+
+	for _, f := range files {
+		meta := tableMeta{
+			fileNum:     db.allocFileNum(),
+			level:       cf.ingestLevel(f.smallest, f.largest),
+			cf:          cf.id,
+			size:        f.size,
+			smallest:    f.smallest,
+			largest:     f.largest,
+			smallestSeq: seq,
+			largestSeq:  seq,
+			globalSeq:   seq,
+		}
+		filename := tableFileName(db.dir, meta.fileNum)
+		if err := db.fs.Rename(f.path, filename); err != nil {
+			if err := copyFile(db.fs, f.path, filename); err != nil {
+				db.fs.Remove(filename)
+				return fail(err)
+			}
+			f.copied = true
+		}
+		f.filename = filename
+
+		t, err := openTable(cf.opts, db.dir, meta)
+		if err != nil {
+			return fail(err)
+		}
+		added = append(added, t)
+	}
+
+	// New level 0 tables are the newest; bottom level tables stay ordered
+	// by key range
+	var level0, bottom []*table
+	for _, t := range added {
+		if t.meta.level == 0 {
+			level0 = append(level0, t)
+		}
+	}
+	for _, t := range cf.tables {
+		if t.meta.level == 0 {
+			level0 = append(level0, t)
+		} else {
+			bottom = append(bottom, t)
+		}
+	}
+	for _, t := range added {
+		if t.meta.level != 0 {
+			bottom = append(bottom, t)
+		}
+	}
+	sort.Slice(bottom, func(i, j int) bool {
+		return cf.opts.Comparator.Compare(bottom[i].meta.smallest, bottom[j].meta.smallest) < 0
+	})
+
+	prevTables, prevSeq := cf.tables, db.lastSeq
+	cf.tables = append(level0, bottom...)
+	db.lastSeq = seq
+	if err := db.saveManifest(); err != nil {
+		cf.tables, db.lastSeq = prevTables, prevSeq
+		return fail(err)
+	}
+	return nil
+}
+
+// ingestLevel returns the lowest level a table with the key range
+// [smallest, largest] can be placed at: the level above the first one,
+// from the top, holding a table it overlaps. db.mu must be held.
+func (cf *ColumnFamily) ingestLevel(smallest, largest []byte) int {
+	for level := 0; level < numLevels; level++ {
+		for _, t := range cf.levelTables(level) {
+			if t.overlaps(smallest, largest) {
+				return max(level-1, 0)
+			}
+		}
+	}
+	return bottomLevel
+}
+
+// copyFile copies the file src to dst and syncs it
+func copyFile(fs vfs.FS, src, dst string) error {
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := fs.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
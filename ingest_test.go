@@ -0,0 +1,190 @@
+package golsm
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/vikramcse/go-lsm/internal/sstable"
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+// writeExternalFile writes the keys prefix<from> to prefix<to-1> with the
+// value tag to an SSTable at path
+func writeExternalFile(t *testing.T, fs vfs.FS, path, prefix string, from, to int, tag string) {
+	t.Helper()
+
+	w, err := sstable.NewFileWriterWithOptions(fs, path, sstable.WriterOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for i := from; i < to; i++ {
+		if err := w.Write(fmt.Sprintf("%s%04d", prefix, i), []byte(tag)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+func expectValue(t *testing.T, db *DB, key, expected string) {
+	t.Helper()
+
+	value, err := db.Get([]byte(key))
+	if err != nil || string(value) != expected {
+		t.Errorf("Expected %s=%s, got %q (err %v)", key, expected, value, err)
+	}
+}
+
+func TestIngestExternalFile(t *testing.T) {
+	fs := vfs.NewMem()
+	fs.MkdirAll("/ext", 0755)
+	db, err := Open("/db", &Options{FS: fs})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+
+	// Nothing overlaps the first files, which go to the bottom level
+	writeExternalFile(t, fs, "/ext/a.sst", "a", 0, 100, "ext1")
+	writeExternalFile(t, fs, "/ext/b.sst", "b", 0, 100, "ext1")
+	if err := db.IngestExternalFile([]string{"/ext/b.sst", "/ext/a.sst"}); err != nil {
+		t.Fatalf("IngestExternalFile failed: %v", err)
+	}
+	if _, err := fs.Stat("/ext/a.sst"); err == nil {
+		t.Errorf("Expected the ingested file to be moved")
+	}
+	for _, p := range db.TableProperties() {
+		if p.Level != bottomLevel || p.MinSeq != 1 || p.MaxSeq != 1 {
+			t.Errorf("Expected a bottom level table at seq 1, got level %d at seq %d-%d", p.Level, p.MinSeq, p.MaxSeq)
+		}
+	}
+	expectValue(t, db, "a0042", "ext1")
+
+	// A file overlapping the memtable is ingested after it is flushed, and
+	// shadows the older writes
+	db.Put([]byte("a0010"), []byte("put"))
+	db.Put([]byte("c0000"), []byte("put"))
+	writeExternalFile(t, fs, "/ext/a2.sst", "a", 0, 50, "ext2")
+	if err := db.IngestExternalFile([]string{"/ext/a2.sst"}); err != nil {
+		t.Fatalf("IngestExternalFile failed: %v", err)
+	}
+	props := db.TableProperties()
+	if len(props) != 4 || props[0].Level != 0 || props[0].MinSeq != 4 {
+		t.Errorf("Expected the file to be the newest level 0 table, got %+v", props[0])
+	}
+	expectValue(t, db, "a0010", "ext2")
+	expectValue(t, db, "a0060", "ext1")
+
+	// Later writes shadow the ingested entries
+	db.Delete([]byte("a0020"))
+	if _, err := db.Get([]byte("a0020")); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	// Files overlapping each other are rejected
+	writeExternalFile(t, fs, "/ext/d1.sst", "d", 0, 10, "x")
+	writeExternalFile(t, fs, "/ext/d2.sst", "d", 5, 15, "x")
+	if err := db.IngestExternalFile([]string{"/ext/d1.sst", "/ext/d2.sst"}); !errors.Is(err, ErrInvalidExternalFile) {
+		t.Errorf("Expected ErrInvalidExternalFile, got %v", err)
+	}
+	if _, err := fs.Stat("/ext/d1.sst"); err != nil {
+		t.Errorf("Expected rejected files to stay in place, got %v", err)
+	}
+
+	// The global sequence numbers survive a reopen and a compaction
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if db, err = Open("/db", &Options{FS: fs}); err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 2; i++ {
+		expectValue(t, db, "a0010", "ext2")
+		expectValue(t, db, "a0060", "ext1")
+		expectValue(t, db, "b0099", "ext1")
+		expectValue(t, db, "c0000", "put")
+		if n := len(collect(t, db, ReadOptions{})); n != 200 {
+			t.Errorf("Expected 200 keys, got %d", n)
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatalf("Compact failed: %v", err)
+		}
+	}
+}
+
+func TestIngestExternalFileIntoColumnFamily(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := Open("/db", &Options{FS: fs})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	users, err := db.CreateColumnFamily("users", nil)
+	if err != nil {
+		t.Fatalf("CreateColumnFamily failed: %v", err)
+	}
+
+	// Only the memtable of the column family is flushed, and only its
+	// tables get the file
+	db.Put([]byte("a0010"), []byte("default"))
+	users.Put([]byte("a0010"), []byte("put"))
+	writeExternalFile(t, fs, "/ext.sst", "a", 0, 50, "ext")
+	if err := users.IngestExternalFile([]string{"/ext.sst"}); err != nil {
+		t.Fatalf("IngestExternalFile failed: %v", err)
+	}
+	if n := len(db.TableProperties()); n != 0 {
+		t.Errorf("Expected no default table, got %d", n)
+	}
+	if props := users.TableProperties(); len(props) != 2 || props[0].Level != 0 {
+		t.Errorf("Expected the file to be the newest of 2 users tables, got %+v", props)
+	}
+	expectValue(t, db, "a0010", "default")
+	if _, err := db.Get([]byte("a0020")); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if db, err = Open("/db", &Options{FS: fs}); err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+	users = db.ColumnFamily("users")
+	for _, key := range []string{"a0010", "a0049"} {
+		if value, err := users.Get([]byte(key)); err != nil || string(value) != "ext" {
+			t.Errorf("Expected users %s=ext, got %q (err %v)", key, value, err)
+		}
+	}
+	expectValue(t, db, "a0010", "default")
+}
+
+func TestRepairIngestedFile(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := Open("/db", &Options{FS: fs})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	writeExternalFile(t, fs, "/ext.sst", "a", 0, 100, "ext")
+	if err := db.IngestExternalFile([]string{"/ext.sst"}); err != nil {
+		t.Fatalf("IngestExternalFile failed: %v", err)
+	}
+	db.Close()
+
+	// Repair reads the plain values with the global sequence number from
+	// the old manifest
+	report, err := Repair("/db", &Options{FS: fs})
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if report.Entries != 100 || report.LostEntries != 0 {
+		t.Errorf("Expected 100 entries kept, got %d (%d lost)", report.Entries, report.LostEntries)
+	}
+
+	if db, err = Open("/db", &Options{FS: fs}); err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+	expectValue(t, db, "a0042", "ext")
+}
@@ -0,0 +1,160 @@
+// Package blob implements blob files, which hold large values apart from the
+// SSTables that reference them. Tables then store a small Handle in place of
+// each such value, so compactions copy the handles instead of the values.
+//
+// A blob file is append-only: it is written once, by a single Writer, and
+// never modified afterwards. It is a sequence of records:
+//
+//	[CRC of the value (uint32)][value]
+//
+// Records carry no length; the Handle that references a value holds its
+// offset and size.
+package blob
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+// recordHeaderSize is the number of bytes written before each value
+const recordHeaderSize = 4
+
+// ErrCorrupt is returned for a handle that does not decode, or a value that
+// cannot be read back intact
+var ErrCorrupt = errors.New("corrupt blob")
+
+// Handle references a value stored in a blob file
+type Handle struct {
+	FileNum uint64 // number of the blob file
+	Offset  uint64 // offset of the value's record in the file
+	Size    uint64 // length of the value
+}
+
+// Encode encodes the handle as three uvarints
+func (h Handle) Encode() []byte {
+	buf := make([]byte, 0, 3*binary.MaxVarintLen64)
+	buf = binary.AppendUvarint(buf, h.FileNum)
+	buf = binary.AppendUvarint(buf, h.Offset)
+	return binary.AppendUvarint(buf, h.Size)
+}
+
+// DecodeHandle decodes a handle encoded by Handle.Encode
+func DecodeHandle(data []byte) (Handle, error) {
+	var h Handle
+	for _, field := range []*uint64{&h.FileNum, &h.Offset, &h.Size} {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return Handle{}, ErrCorrupt
+		}
+		*field, data = v, data[n:]
+	}
+	if len(data) != 0 {
+		return Handle{}, ErrCorrupt
+	}
+	return h, nil
+}
+
+// Writer appends values to a new blob file
+type Writer struct {
+	file      vfs.File
+	bufWriter *bufio.Writer
+	fileNum   uint64
+	offset    uint64
+}
+
+// NewWriter creates the blob file numbered fileNum in fs, truncating any
+// existing file with the same name
+func NewWriter(fs vfs.FS, filename string, fileNum uint64) (*Writer, error) {
+	file, err := fs.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{file: file, bufWriter: bufio.NewWriter(file), fileNum: fileNum}, nil
+}
+
+// Add appends value and returns its handle. The value is only durable after
+// Close.
+func (w *Writer) Add(value []byte) (Handle, error) {
+	var header [recordHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[:], crc32.ChecksumIEEE(value))
+	if _, err := w.bufWriter.Write(header[:]); err != nil {
+		return Handle{}, err
+	}
+	if _, err := w.bufWriter.Write(value); err != nil {
+		return Handle{}, err
+	}
+
+	h := Handle{FileNum: w.fileNum, Offset: w.offset, Size: uint64(len(value))}
+	w.offset += recordHeaderSize + uint64(len(value))
+	return h, nil
+}
+
+// Size returns the number of bytes written so far
+func (w *Writer) Size() uint64 {
+	return w.offset
+}
+
+// Close syncs and closes the blob file
+func (w *Writer) Close() error {
+	if err := w.bufWriter.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// Reader reads values from a blob file. It is safe for concurrent use.
+type Reader struct {
+	file vfs.File
+	size uint64
+}
+
+// NewReader opens a blob file for reading
+func NewReader(fs vfs.FS, filename string) (*Reader, error) {
+	file, err := fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Reader{file: file, size: uint64(info.Size())}, nil
+}
+
+// Read returns a copy of the value referenced by h, after checking its CRC
+func (r *Reader) Read(h Handle) ([]byte, error) {
+	if h.Offset > r.size || h.Size+recordHeaderSize > r.size-h.Offset {
+		return nil, fmt.Errorf("%w: value at %d of %d bytes is past the end of the file", ErrCorrupt, h.Offset, h.Size)
+	}
+
+	buf := make([]byte, recordHeaderSize+h.Size)
+	if _, err := r.file.ReadAt(buf, int64(h.Offset)); err != nil {
+		return nil, err
+	}
+	value := buf[recordHeaderSize:]
+	if crc32.ChecksumIEEE(value) != binary.LittleEndian.Uint32(buf) {
+		return nil, fmt.Errorf("%w: CRC mismatch for the value at %d", ErrCorrupt, h.Offset)
+	}
+	return value, nil
+}
+
+// Size returns the size of the file in bytes
+func (r *Reader) Size() uint64 {
+	return r.size
+}
+
+// Close closes the blob file
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,68 @@
+package blob
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+func TestBlobFile(t *testing.T) {
+	fs := vfs.NewMem()
+	w, err := NewWriter(fs, "/000007.blob", 7)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+
+	values := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte("x"), 10000)}
+	var handles []Handle
+	for _, v := range values {
+		h, err := w.Add(v)
+		if err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+		handles = append(handles, h)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	r, err := NewReader(fs, "/000007.blob")
+	if err != nil {
+		t.Fatalf("Failed to open reader: %v", err)
+	}
+	defer r.Close()
+	if r.Size() != w.Size() {
+		t.Errorf("Expected size %d, got %d", w.Size(), r.Size())
+	}
+
+	for i, h := range handles {
+		decoded, err := DecodeHandle(h.Encode())
+		if err != nil || decoded != h {
+			t.Fatalf("Expected handle %+v to round trip, got %+v (err %v)", h, decoded, err)
+		}
+		if decoded.FileNum != 7 {
+			t.Errorf("Expected file number 7, got %d", decoded.FileNum)
+		}
+		value, err := r.Read(decoded)
+		if err != nil || !bytes.Equal(value, values[i]) {
+			t.Errorf("Expected value %d back, got %d bytes (err %v)", i, len(value), err)
+		}
+	}
+
+	// Handles past the end of the file or with the wrong size are caught
+	bad := handles[0]
+	bad.Size++
+	if _, err := r.Read(bad); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt for a wrong size, got %v", err)
+	}
+	bad = handles[2]
+	bad.Offset = r.Size()
+	if _, err := r.Read(bad); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt past the end, got %v", err)
+	}
+	if _, err := DecodeHandle([]byte{0x80}); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt for a truncated handle, got %v", err)
+	}
+}
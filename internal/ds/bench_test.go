@@ -0,0 +1,124 @@
+package ds
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/vikramcse/go-lsm/internal/kv"
+)
+
+// Run with
+//
+//	go test ./internal/ds -run XXX -bench . -benchmem
+//
+// to compare the backends. The B/entry metric of BenchmarkMemory is the heap
+// each backend holds per entry, keys and values excluded.
+
+const benchEntries = 100000
+
+var backends = []struct {
+	name string
+	new  func() MemTableImpl[kv.Entry]
+}{
+	{"SkipList", func() MemTableImpl[kv.Entry] { return NewSkipListMemTable[kv.Entry](kv.Bytewise) }},
+	{"RedBlackTree", func() MemTableImpl[kv.Entry] { return NewRedBlackTreeMemTable[kv.Entry](kv.Bytewise) }},
+	{"BTree", func() MemTableImpl[kv.Entry] { return NewBTreeMemTable[kv.Entry](kv.Bytewise) }},
+	{"Hash", func() MemTableImpl[kv.Entry] { return NewHashMemTable[kv.Entry]() }},
+	{"Vector", func() MemTableImpl[kv.Entry] { return NewVectorMemTable[kv.Entry]() }},
+}
+
+// benchKeys returns n distinct keys in random order
+func benchKeys(n int) [][]byte {
+	keys := make([][]byte, n)
+	for i, j := range rand.New(rand.NewSource(1)).Perm(n) {
+		keys[i] = []byte(fmt.Sprintf("key%016d", j))
+	}
+	return keys
+}
+
+func fill(impl MemTableImpl[kv.Entry], keys [][]byte) {
+	value := make([]byte, 100)
+	for i, key := range keys {
+		impl.Set(key, kv.Entry{Kind: kv.KindSet, Seq: uint64(i), Value: value})
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	keys := benchKeys(benchEntries)
+	for _, backend := range backends {
+		b.Run(backend.name, func(b *testing.B) {
+			b.ReportAllocs()
+			impl := backend.new()
+			value := make([]byte, 100)
+			for i := 0; i < b.N; i++ {
+				if i%benchEntries == 0 {
+					impl = backend.new()
+				}
+				impl.Set(keys[i%benchEntries], kv.Entry{Kind: kv.KindSet, Seq: uint64(i), Value: value})
+			}
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	keys := benchKeys(benchEntries)
+	for _, backend := range backends {
+		b.Run(backend.name, func(b *testing.B) {
+			impl := backend.new()
+			fill(impl, keys)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, ok := impl.Get(keys[i%benchEntries]); !ok {
+					b.Fatalf("Key %s not found", keys[i%benchEntries])
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkScan measures a full scan, which is unordered for the Hash and
+// Vector backends; one op is one entry
+func BenchmarkScan(b *testing.B) {
+	keys := benchKeys(benchEntries)
+	for _, backend := range backends {
+		b.Run(backend.name, func(b *testing.B) {
+			impl := backend.new()
+			fill(impl, keys)
+			b.ReportAllocs()
+			b.ResetTimer()
+			var it Iterator[kv.Entry]
+			for i := 0; i < b.N; i++ {
+				if i%benchEntries == 0 {
+					it = impl.Iterator()
+				}
+				if !it.Next() {
+					b.Fatalf("Iterator ended after %d entries", i%benchEntries)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMemory reports the heap held per entry once a backend is filled
+func BenchmarkMemory(b *testing.B) {
+	keys := benchKeys(benchEntries)
+	for _, backend := range backends {
+		b.Run(backend.name, func(b *testing.B) {
+			var before, after runtime.MemStats
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				impl := backend.new()
+				fill(impl, keys)
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				runtime.KeepAlive(impl)
+			}
+			held := float64(after.HeapAlloc) - float64(before.HeapAlloc)
+			b.ReportMetric(held/benchEntries, "B/entry")
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package ds
+
+import (
+	"sort"
+	"unsafe"
+
+	"github.com/vikramcse/go-lsm/internal/kv"
+)
+
+// btreeDegree is the minimum number of children of an inner node other than
+// the root. Nodes hold up to 2*btreeDegree-1 entries in a single slice, so a
+// search mostly scans contiguous memory.
+const btreeDegree = 16
+
+const btreeMaxItems = 2*btreeDegree - 1
+
+// BTreeMemTable is a B-tree that keeps its entries inline in the nodes
+// rather than behind a pointer each. It supports copy-on-write snapshots:
+// Snapshot shares every node with the tree, and later writes to either copy
+// the nodes they modify instead of changing them in place.
+type BTreeMemTable[V any] struct {
+	cmp  kv.Comparator
+	root *btreeNode[V]
+	len  int64
+	cow  *cowContext // nodes with another context are shared and must be copied to be modified
+}
+
+// cowContext identifies the nodes a tree owns. It is not empty so that
+// every context has its own address.
+type cowContext struct {
+	_ byte
+}
+
+type btreeNode[V any] struct {
+	items    []btreeItem[V]
+	children []*btreeNode[V] // len(items)+1 for inner nodes, nil for leaves
+	cow      *cowContext
+}
+
+type btreeItem[V any] struct {
+	key   []byte
+	value V
+}
+
+// NewBTreeMemTable creates and initializes a new MemTable ordered by cmp
+func NewBTreeMemTable[V any](cmp kv.Comparator) *BTreeMemTable[V] {
+	return &BTreeMemTable[V]{cmp: cmp, cow: new(cowContext)}
+}
+
+func (t *BTreeMemTable[V]) Set(key []byte, value V) {
+	item := btreeItem[V]{key: key, value: value}
+	if t.root == nil {
+		t.root = &btreeNode[V]{cow: t.cow}
+		t.root.items = append(t.root.items, item)
+		t.len++
+		return
+	}
+
+	// Full nodes are split on the way down, so there is always room for a
+	// split child's middle entry in its parent
+	t.root = t.mutable(t.root)
+	if len(t.root.items) >= btreeMaxItems {
+		middle, right := t.split(t.root, btreeMaxItems/2)
+		t.root = &btreeNode[V]{
+			items:    []btreeItem[V]{middle},
+			children: []*btreeNode[V]{t.root, right},
+			cow:      t.cow,
+		}
+	}
+	if !t.insert(t.root, item) {
+		t.len++
+	}
+}
+
+// insert adds item to the subtree of the mutable node n, which is not full.
+// It reports whether item replaced an entry with the same key.
+func (t *BTreeMemTable[V]) insert(n *btreeNode[V], item btreeItem[V]) bool {
+	for {
+		i, found := t.find(n, item.key)
+		if found {
+			n.items[i] = item
+			return true
+		}
+		if len(n.children) == 0 {
+			n.items = insertAt(n.items, i, item)
+			return false
+		}
+
+		if len(n.children[i].items) >= btreeMaxItems {
+			child := t.mutable(n.children[i])
+			n.children[i] = child
+			middle, right := t.split(child, btreeMaxItems/2)
+			n.items = insertAt(n.items, i, middle)
+			n.children = insertAt(n.children, i+1, right)
+
+			switch c := t.cmp.Compare(item.key, middle.key); {
+			case c == 0:
+				n.items[i] = item
+				return true
+			case c > 0:
+				i++
+			}
+		}
+
+		child := t.mutable(n.children[i])
+		n.children[i] = child
+		n = child
+	}
+}
+
+// split moves the entries of the mutable node n after position i, and their
+// children, to a new node, and returns the entry at i along with the new
+// node. n keeps the entries before i.
+func (t *BTreeMemTable[V]) split(n *btreeNode[V], i int) (btreeItem[V], *btreeNode[V]) {
+	middle := n.items[i]
+	right := &btreeNode[V]{cow: t.cow}
+	right.items = append(right.items, n.items[i+1:]...)
+	clear(n.items[i:])
+	n.items = n.items[:i]
+	if len(n.children) > 0 {
+		right.children = append(right.children, n.children[i+1:]...)
+		clear(n.children[i+1:])
+		n.children = n.children[:i+1]
+	}
+	return middle, right
+}
+
+// mutable returns n if the tree owns it, or a copy owned by the tree that
+// replaces it
+func (t *BTreeMemTable[V]) mutable(n *btreeNode[V]) *btreeNode[V] {
+	if n.cow == t.cow {
+		return n
+	}
+	c := &btreeNode[V]{cow: t.cow}
+	c.items = append(make([]btreeItem[V], 0, btreeMaxItems), n.items...)
+	if len(n.children) > 0 {
+		c.children = append(make([]*btreeNode[V], 0, btreeMaxItems+1), n.children...)
+	}
+	return c
+}
+
+// find returns the position of the first entry of n whose key is greater
+// than or equal to key, and whether it is equal
+func (t *BTreeMemTable[V]) find(n *btreeNode[V], key []byte) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool {
+		return t.cmp.Compare(n.items[i].key, key) >= 0
+	})
+	return i, i < len(n.items) && t.cmp.Compare(n.items[i].key, key) == 0
+}
+
+func (t *BTreeMemTable[V]) Get(key []byte) (V, bool) {
+	for n := t.root; n != nil; {
+		i, found := t.find(n, key)
+		if found {
+			return n.items[i].value, true
+		}
+		if len(n.children) == 0 {
+			break
+		}
+		n = n.children[i]
+	}
+	var zero V
+	return zero, false
+}
+
+func (t *BTreeMemTable[V]) Len() int64 {
+	return t.len
+}
+
+// EntryOverhead accounts for the inline entry, assuming nodes are two thirds
+// full on average, and for a share of its node.
+func (t *BTreeMemTable[V]) EntryOverhead() int64 {
+	return int64(unsafe.Sizeof(btreeItem[V]{}))*3/2 + int64(unsafe.Sizeof(btreeNode[V]{}))/btreeDegree
+}
+
+// Snapshot returns a copy-on-write snapshot of the tree in constant time.
+// The snapshot and the tree share their nodes until either is written to,
+// and neither sees the other's later writes.
+func (t *BTreeMemTable[V]) Snapshot() MemTableImpl[V] {
+	// Both get a new context, so neither owns the shared nodes any more
+	snapshot := *t
+	snapshot.cow = new(cowContext)
+	t.cow = new(cowContext)
+	return &snapshot
+}
+
+func (t *BTreeMemTable[V]) Iterator() Iterator[V] {
+	return &btreeIterator[V]{tree: t}
+}
+
+// btreeIterator walks the tree with a stack holding the path from the root
+// to the current entry, which is the entry of the last frame. The position
+// of every other frame is the entry that follows the subtree being walked.
+type btreeIterator[V any] struct {
+	tree    *BTreeMemTable[V]
+	stack   []btreeFrame[V]
+	started bool
+}
+
+type btreeFrame[V any] struct {
+	node *btreeNode[V]
+	i    int
+}
+
+func (it *btreeIterator[V]) Next() bool {
+	if !it.started {
+		it.started = true
+		it.stack = it.stack[:0]
+		if it.tree.root != nil {
+			it.descend(it.tree.root)
+		}
+		return it.settle()
+	}
+	if len(it.stack) == 0 {
+		return false
+	}
+
+	top := &it.stack[len(it.stack)-1]
+	top.i++
+	if len(top.node.children) > 0 {
+		it.descend(top.node.children[top.i])
+	}
+	return it.settle()
+}
+
+func (it *btreeIterator[V]) Seek(key []byte) bool {
+	it.started = true
+	it.stack = it.stack[:0]
+	for n := it.tree.root; n != nil; {
+		i, found := it.tree.find(n, key)
+		it.stack = append(it.stack, btreeFrame[V]{node: n, i: i})
+		if found || len(n.children) == 0 {
+			break
+		}
+		n = n.children[i]
+	}
+	return it.settle()
+}
+
+// descend pushes the path from n to the first entry of its subtree
+func (it *btreeIterator[V]) descend(n *btreeNode[V]) {
+	for {
+		it.stack = append(it.stack, btreeFrame[V]{node: n})
+		if len(n.children) == 0 {
+			return
+		}
+		n = n.children[0]
+	}
+}
+
+// settle pops the frames whose entries are exhausted and reports whether an
+// entry is left
+func (it *btreeIterator[V]) settle() bool {
+	for len(it.stack) > 0 {
+		top := it.stack[len(it.stack)-1]
+		if top.i < len(top.node.items) {
+			return true
+		}
+		it.stack = it.stack[:len(it.stack)-1]
+	}
+	return false
+}
+
+func (it *btreeIterator[V]) Key() []byte {
+	top := it.stack[len(it.stack)-1]
+	return top.node.items[top.i].key
+}
+
+func (it *btreeIterator[V]) Value() V {
+	top := it.stack[len(it.stack)-1]
+	return top.node.items[top.i].value
+}
+
+// insertAt inserts v into s at position i
+func insertAt[T any](s []T, i int, v T) []T {
+	var zero T
+	s = append(s, zero)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
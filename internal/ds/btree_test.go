@@ -0,0 +1,127 @@
+package ds
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/vikramcse/go-lsm/internal/kv"
+)
+
+// expectContents checks that iterating t yields exactly the entries of model
+func expectContents(t *testing.T, tree MemTableImpl[int], model map[string]int) {
+	t.Helper()
+
+	keys := make([]string, 0, len(model))
+	for k := range model {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if tree.Len() != int64(len(keys)) {
+		t.Fatalf("Expected length %d, got %d", len(keys), tree.Len())
+	}
+	it := tree.Iterator()
+	for _, k := range keys {
+		if !it.Next() {
+			t.Fatalf("Iterator ended before key %s", k)
+		}
+		if string(it.Key()) != k || it.Value() != model[k] {
+			t.Fatalf("Expected %s=%d, got %s=%d", k, model[k], it.Key(), it.Value())
+		}
+	}
+	if it.Next() {
+		t.Fatalf("Expected the iterator to end, got key %s", it.Key())
+	}
+}
+
+func TestBTree(t *testing.T) {
+	tree := NewBTreeMemTable[int](kv.Bytewise)
+	model := make(map[string]int)
+
+	// Enough random keys for several levels, with overwrites
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%05d", rng.Intn(10000))
+		tree.Set([]byte(key), i)
+		model[key] = i
+	}
+	expectContents(t, tree, model)
+
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		v, ok := tree.Get([]byte(key))
+		if expected, exists := model[key]; ok != exists || v != expected {
+			t.Fatalf("Expected %s=%d (%v), got %d (%v)", key, expected, exists, v, ok)
+		}
+	}
+
+	testCases := []struct {
+		seek     string
+		expected string
+	}{
+		{"", "key00000"},
+		{"key05000", "key05000"},
+		{"key05000a", "key05001"},
+		{"key09999", "key09999"},
+		{"key1", ""},
+	}
+
+	// Fill the gaps to make every key present
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if _, ok := model[key]; !ok {
+			tree.Set([]byte(key), 0)
+			model[key] = 0
+		}
+	}
+	for _, tc := range testCases {
+		it := tree.Iterator()
+		if !it.Seek([]byte(tc.seek)) {
+			if tc.expected != "" {
+				t.Errorf("Expected seek to %q to find %s, got nothing", tc.seek, tc.expected)
+			}
+			continue
+		}
+		if string(it.Key()) != tc.expected {
+			t.Errorf("Expected seek to %q to find %s, got %s", tc.seek, tc.expected, it.Key())
+		}
+		if tc.expected == "key05000" && (!it.Next() || string(it.Key()) != "key05001") {
+			t.Errorf("Expected key05001 after key05000")
+		}
+	}
+}
+
+func TestBTreeSnapshot(t *testing.T) {
+	tree := NewBTreeMemTable[int](kv.Bytewise)
+	model := make(map[string]int)
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%05d", i*2)
+		tree.Set([]byte(key), i)
+		model[key] = i
+	}
+
+	snapshot := tree.Snapshot()
+	frozen := make(map[string]int, len(model))
+	for k, v := range model {
+		frozen[k] = v
+	}
+
+	// Overwrites and new keys land in shared nodes all over the tree
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		tree.Set([]byte(key), -i)
+		model[key] = -i
+	}
+	expectContents(t, tree, model)
+	expectContents(t, snapshot, frozen)
+
+	// Writes to the snapshot do not reach the tree either
+	snapshot.Set([]byte("extra"), 1)
+	frozen["extra"] = 1
+	expectContents(t, snapshot, frozen)
+	if _, ok := tree.Get([]byte("extra")); ok {
+		t.Errorf("Expected the tree not to see a write to its snapshot")
+	}
+}
@@ -0,0 +1,83 @@
+package ds
+
+import "unsafe"
+
+// hashEntryOverhead approximates the memory of a map slot beyond the key and
+// value themselves: the string header, the tophash byte and the unused slots
+// of a map at its average load factor
+const hashEntryOverhead = 24
+
+// HashMemTable keeps its entries in a Go map, so Set and Get take constant
+// time, but it does not keep them in order: it is Unordered, and its entries
+// must be sorted before they are written to a table. Keys are compared by
+// their bytes, so it only suits comparators under which keys are equal
+// exactly when their bytes are.
+type HashMemTable[V any] struct {
+	m map[string]V
+}
+
+// NewHashMemTable creates and initializes a new MemTable
+func NewHashMemTable[V any]() *HashMemTable[V] {
+	return &HashMemTable[V]{m: make(map[string]V)}
+}
+
+// Unordered marks HashMemTable as an Unordered backend
+func (h *HashMemTable[V]) Unordered() {}
+
+func (h *HashMemTable[V]) Set(key []byte, value V) {
+	// The key is never modified, so the map can use its bytes without a copy
+	h.m[unsafe.String(unsafe.SliceData(key), len(key))] = value
+}
+
+func (h *HashMemTable[V]) Get(key []byte) (V, bool) {
+	v, ok := h.m[string(key)]
+	return v, ok
+}
+
+func (h *HashMemTable[V]) Len() int64 {
+	return int64(len(h.m))
+}
+
+// EntryOverhead accounts for the map slot holding the key and value.
+func (h *HashMemTable[V]) EntryOverhead() int64 {
+	var zero V
+	return hashEntryOverhead + int64(unsafe.Sizeof(zero))
+}
+
+// Iterator returns the entries in no particular order. It collects the keys
+// up front, and its Seek always reports no entry.
+func (h *HashMemTable[V]) Iterator() Iterator[V] {
+	keys := make([]string, 0, len(h.m))
+	for k := range h.m {
+		keys = append(keys, k)
+	}
+	return &hashIterator[V]{m: h.m, keys: keys, pos: -1}
+}
+
+type hashIterator[V any] struct {
+	m    map[string]V
+	keys []string
+	pos  int
+}
+
+func (it *hashIterator[V]) Next() bool {
+	if it.pos < len(it.keys) {
+		it.pos++
+	}
+	return it.pos < len(it.keys)
+}
+
+// Seek finds nothing, as the entries have no order to seek in, and leaves
+// the iterator exhausted
+func (it *hashIterator[V]) Seek(key []byte) bool {
+	it.pos = len(it.keys)
+	return false
+}
+
+func (it *hashIterator[V]) Key() []byte {
+	return unsafe.Slice(unsafe.StringData(it.keys[it.pos]), len(it.keys[it.pos]))
+}
+
+func (it *hashIterator[V]) Value() V {
+	return it.m[it.keys[it.pos]]
+}
@@ -1,8 +1,66 @@
 package ds
 
-// MemTableImpl is the interface that defines the operations required for the MemTable
-type MemTableImpl interface {
-	Set(key string, value interface{})
-	Get(key string) (interface{}, bool)
+// MemTableImpl is the interface that defines the operations required for the
+// MemTable. Keys are ordered by the kv.Comparator the backend was created
+// with, and V is the type of the values. The backend keeps the key slices
+// it is given, so they must not be modified afterwards.
+type MemTableImpl[V any] interface {
+	Set(key []byte, value V)
+	Get(key []byte) (V, bool)
 	Len() int64
+
+	// Iterator returns an iterator over the entries in ascending key order,
+	// or in no particular order for an Unordered backend, which may return
+	// several entries for a key if it is AppendOnly. The backend must
+	// not be modified while the iterator is in use.
+	Iterator() Iterator[V]
+
+	// EntryOverhead returns the approximate number of bytes the backend
+	// spends per entry on top of the key and value bytes themselves
+	// (nodes, pointers, slice headers).
+	EntryOverhead() int64
+}
+
+// Iterator walks the entries of a MemTableImpl in ascending key order.
+// It starts before the first entry, so Next or Seek must be called first.
+type Iterator[V any] interface {
+	Next() bool
+	// Seek positions the iterator at the first entry whose key is greater
+	// than or equal to key, and reports whether there is one
+	Seek(key []byte) bool
+	Key() []byte
+	Value() V
+}
+
+// node is an entry of a backend built on a library that stores interface{}
+// keys and values. Storing a single pointer to the node boxes without an
+// allocation of its own, so each entry costs one allocation.
+type node[V any] struct {
+	key   []byte
+	value V
+}
+
+// Snapshotter is implemented by backends that can take a copy-on-write
+// snapshot: a MemTableImpl holding the entries at the time it was taken,
+// which is unaffected by later writes to the backend and can be read while
+// they happen. Snapshot itself must not run concurrently with other methods.
+type Snapshotter[V any] interface {
+	Snapshot() MemTableImpl[V]
+}
+
+// Unordered is implemented by backends that do not keep their entries in key
+// order, trading ordered iteration for cheaper writes and lookups. Their
+// Iterator returns the entries in no particular order and its Seek always
+// reports no entry, so readers must sort the entries themselves.
+type Unordered interface {
+	Unordered()
+}
+
+// AppendOnly is implemented by backends whose Set never replaces an entry.
+// Setting a key again adds another entry, which Get returns from then on and
+// Iterator returns after the older ones. Writers should not look keys
+// up before setting them, which costs an AppendOnly backend far more than
+// the Set.
+type AppendOnly interface {
+	AppendOnly()
 }
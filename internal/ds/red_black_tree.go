@@ -1,28 +1,81 @@
 package ds
 
-import "github.com/emirpasic/gods/trees/redblacktree"
+import (
+	"unsafe"
 
-type RedBlackTreeMemTable struct {
+	"github.com/emirpasic/gods/trees/redblacktree"
+	"github.com/vikramcse/go-lsm/internal/kv"
+)
+
+// RedBlackTreeMemTable holds each entry as a *node[V] key with no value.
+// Overwriting a key replaces the node.
+type RedBlackTreeMemTable[V any] struct {
 	tree *redblacktree.Tree
 }
 
-// NewRedBlackTreeMemTable creates and initializes a new MemTable
-func NewRedBlackTreeMemTable() *RedBlackTreeMemTable {
-	t := redblacktree.NewWithStringComparator()
+// NewRedBlackTreeMemTable creates and initializes a new MemTable ordered by
+// cmp
+func NewRedBlackTreeMemTable[V any](cmp kv.Comparator) *RedBlackTreeMemTable[V] {
+	t := redblacktree.NewWith(func(a, b interface{}) int {
+		return cmp.Compare(a.(*node[V]).key, b.(*node[V]).key)
+	})
 
-	return &RedBlackTreeMemTable{
+	return &RedBlackTreeMemTable[V]{
 		tree: t,
 	}
 }
 
-func (r *RedBlackTreeMemTable) Set(key string, value interface{}) {
-	r.tree.Put(key, value)
+func (r *RedBlackTreeMemTable[V]) Set(key []byte, value V) {
+	r.tree.Put(&node[V]{key: key, value: value}, nil)
 }
 
-func (r *RedBlackTreeMemTable) Get(key string) (interface{}, bool) {
-	return r.tree.Get(key)
+func (r *RedBlackTreeMemTable[V]) Get(key []byte) (V, bool) {
+	n := r.tree.GetNode(&node[V]{key: key})
+	if n == nil {
+		var zero V
+		return zero, false
+	}
+	return n.Key.(*node[V]).value, true
 }
 
-func (r *RedBlackTreeMemTable) Len() int64 {
+func (r *RedBlackTreeMemTable[V]) Len() int64 {
 	return int64(r.tree.Size())
 }
+
+// EntryOverhead accounts for the tree node and the node holding the key and
+// value.
+func (r *RedBlackTreeMemTable[V]) EntryOverhead() int64 {
+	return int64(unsafe.Sizeof(redblacktree.Node{})) + int64(unsafe.Sizeof(node[V]{}))
+}
+
+func (r *RedBlackTreeMemTable[V]) Iterator() Iterator[V] {
+	it := r.tree.Iterator()
+	return &redBlackTreeIterator[V]{tree: r.tree, it: &it}
+}
+
+type redBlackTreeIterator[V any] struct {
+	tree *redblacktree.Tree
+	it   *redblacktree.Iterator
+}
+
+func (it *redBlackTreeIterator[V]) Next() bool {
+	return it.it.Next()
+}
+
+func (it *redBlackTreeIterator[V]) Seek(key []byte) bool {
+	n, ok := it.tree.Ceiling(&node[V]{key: key})
+	if !ok {
+		it.it.End()
+		return false
+	}
+	*it.it = it.tree.IteratorAt(n)
+	return true
+}
+
+func (it *redBlackTreeIterator[V]) Key() []byte {
+	return it.it.Key().(*node[V]).key
+}
+
+func (it *redBlackTreeIterator[V]) Value() V {
+	return it.it.Key().(*node[V]).value
+}
@@ -1,30 +1,90 @@
 package ds
 
 import (
+	"unsafe"
+
 	"github.com/huandu/skiplist"
+	"github.com/vikramcse/go-lsm/internal/kv"
 )
 
-type SkipListMemTable struct {
+// skipListAvgLevels is the expected number of forward pointers per element;
+// huandu/skiplist promotes an element to the next level with probability 1/2.
+const skipListAvgLevels = 2
+
+// SkipListMemTable holds each entry as a *node[V] that is both the key and
+// the value of its element. Overwriting a key replaces the value node and
+// keeps the key node.
+type SkipListMemTable[V any] struct {
 	list *skiplist.SkipList
 }
 
-// NewSkipListMemTable creates and initializes a new MemTable
-func NewSkipListMemTable() *SkipListMemTable {
-	l := skiplist.New(skiplist.String)
+// NewSkipListMemTable creates and initializes a new MemTable ordered by cmp
+func NewSkipListMemTable[V any](cmp kv.Comparator) *SkipListMemTable[V] {
+	l := skiplist.New(skiplist.GreaterThanFunc(func(lhs, rhs interface{}) int {
+		return cmp.Compare(lhs.(*node[V]).key, rhs.(*node[V]).key)
+	}))
 
-	return &SkipListMemTable{
+	return &SkipListMemTable[V]{
 		list: l,
 	}
 }
 
-func (s *SkipListMemTable) Set(key string, value interface{}) {
-	s.list.Set(key, value)
+func (s *SkipListMemTable[V]) Set(key []byte, value V) {
+	n := &node[V]{key: key, value: value}
+	s.list.Set(n, n)
 }
 
-func (s *SkipListMemTable) Get(key string) (interface{}, bool) {
-	return s.list.GetValue(key)
+func (s *SkipListMemTable[V]) Get(key []byte) (V, bool) {
+	elem := s.list.Get(&node[V]{key: key})
+	if elem == nil {
+		var zero V
+		return zero, false
+	}
+	return elem.Value.(*node[V]).value, true
 }
 
-func (s *SkipListMemTable) Len() int64 {
+func (s *SkipListMemTable[V]) Len() int64 {
 	return int64(s.list.Len())
 }
+
+// EntryOverhead accounts for the element struct, its forward pointers and
+// the node.
+func (s *SkipListMemTable[V]) EntryOverhead() int64 {
+	return int64(unsafe.Sizeof(skiplist.Element{})) +
+		skipListAvgLevels*int64(unsafe.Sizeof(uintptr(0))) +
+		int64(unsafe.Sizeof(node[V]{}))
+}
+
+func (s *SkipListMemTable[V]) Iterator() Iterator[V] {
+	return &skipListIterator[V]{list: s.list}
+}
+
+type skipListIterator[V any] struct {
+	list    *skiplist.SkipList
+	elem    *skiplist.Element
+	started bool
+}
+
+func (it *skipListIterator[V]) Next() bool {
+	if !it.started {
+		it.started = true
+		it.elem = it.list.Front()
+	} else if it.elem != nil {
+		it.elem = it.elem.Next()
+	}
+	return it.elem != nil
+}
+
+func (it *skipListIterator[V]) Seek(key []byte) bool {
+	it.started = true
+	it.elem = it.list.Find(&node[V]{key: key})
+	return it.elem != nil
+}
+
+func (it *skipListIterator[V]) Key() []byte {
+	return it.elem.Value.(*node[V]).key
+}
+
+func (it *skipListIterator[V]) Value() V {
+	return it.elem.Value.(*node[V]).value
+}
@@ -0,0 +1,35 @@
+package ds
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestUnorderedSeek(t *testing.T) {
+	for name, impl := range map[string]MemTableImpl[int]{
+		"hash":   NewHashMemTable[int](),
+		"vector": NewVectorMemTable[int](),
+	} {
+		for i := 0; i < 10; i++ {
+			impl.Set([]byte(fmt.Sprintf("key%d", i)), i)
+		}
+
+		// Seek finds nothing instead of guessing a position
+		it := impl.Iterator()
+		if it.Seek([]byte("key5")) {
+			t.Errorf("%s: expected Seek to find nothing, got key %s", name, it.Key())
+		}
+		if it.Next() {
+			t.Errorf("%s: expected the iterator to end after Seek, got key %s", name, it.Key())
+		}
+
+		it = impl.Iterator()
+		n := 0
+		for it.Next() {
+			n++
+		}
+		if n != 10 {
+			t.Errorf("%s: expected 10 entries, got %d", name, n)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package ds
+
+import "unsafe"
+
+// VectorMemTable appends every Set to a slice, without looking the key up or
+// keeping any order, which makes it the cheapest backend to fill. It is both
+// Unordered and AppendOnly: overwriting a key adds another entry, and Len
+// counts them all. Get scans the entries from the newest, so it takes linear
+// time; the backend suits bulk loads that do not read until they are done.
+// Like HashMemTable, it compares keys by their bytes for equality.
+type VectorMemTable[V any] struct {
+	entries []node[V]
+}
+
+// NewVectorMemTable creates and initializes a new MemTable
+func NewVectorMemTable[V any]() *VectorMemTable[V] {
+	return &VectorMemTable[V]{}
+}
+
+// Unordered marks VectorMemTable as an Unordered backend
+func (v *VectorMemTable[V]) Unordered() {}
+
+// AppendOnly marks VectorMemTable as an AppendOnly backend
+func (v *VectorMemTable[V]) AppendOnly() {}
+
+func (v *VectorMemTable[V]) Set(key []byte, value V) {
+	v.entries = append(v.entries, node[V]{key: key, value: value})
+}
+
+// Get returns the value of the entry for key that was set last
+func (v *VectorMemTable[V]) Get(key []byte) (V, bool) {
+	for i := len(v.entries) - 1; i >= 0; i-- {
+		if string(v.entries[i].key) == string(key) {
+			return v.entries[i].value, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+func (v *VectorMemTable[V]) Len() int64 {
+	return int64(len(v.entries))
+}
+
+// EntryOverhead accounts for the slot in the slice, which is on average a
+// quarter empty as it grows.
+func (v *VectorMemTable[V]) EntryOverhead() int64 {
+	return int64(unsafe.Sizeof(node[V]{})) * 4 / 3
+}
+
+// Iterator returns the entries in the order they were set. Its Seek always
+// reports no entry.
+func (v *VectorMemTable[V]) Iterator() Iterator[V] {
+	return &vectorIterator[V]{entries: v.entries, pos: -1}
+}
+
+type vectorIterator[V any] struct {
+	entries []node[V]
+	pos     int
+}
+
+func (it *vectorIterator[V]) Next() bool {
+	if it.pos < len(it.entries) {
+		it.pos++
+	}
+	return it.pos < len(it.entries)
+}
+
+// Seek finds nothing, as the entries have no order to seek in, and leaves
+// the iterator exhausted
+func (it *vectorIterator[V]) Seek(key []byte) bool {
+	it.pos = len(it.entries)
+	return false
+}
+
+func (it *vectorIterator[V]) Key() []byte {
+	return it.entries[it.pos].key
+}
+
+func (it *vectorIterator[V]) Value() V {
+	return it.entries[it.pos].value
+}
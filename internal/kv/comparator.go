@@ -0,0 +1,48 @@
+package kv
+
+import "bytes"
+
+// Comparator defines the order of keys in the memtables and SSTables. A DB
+// must always be opened with the comparator its tables were written with;
+// tables record the comparator's name so that a mismatch is detected when
+// they are opened.
+type Comparator interface {
+	// Compare returns -1, 0 or 1 when a is less than, equal to or greater
+	// than b
+	Compare(a, b []byte) int
+
+	// Name identifies the ordering. It is stored in every table, so it
+	// must change whenever the ordering does.
+	Name() string
+
+	// Separator returns a key k with prevLast < k <= first, preferably
+	// shorter than first. prevLast must be less than first. Index blocks
+	// store separators instead of full keys to save space; returning first
+	// is always correct.
+	Separator(prevLast, first []byte) []byte
+}
+
+// Bytewise orders keys lexicographically by their bytes
+var Bytewise Comparator = bytewiseComparator{}
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+func (bytewiseComparator) Name() string {
+	return "golsm.BytewiseComparator"
+}
+
+// Separator returns the shortest prefix of first that differs from prevLast
+func (bytewiseComparator) Separator(prevLast, first []byte) []byte {
+	n := 0
+	for n < len(prevLast) && n < len(first) && prevLast[n] == first[n] {
+		n++
+	}
+	if n >= len(first) {
+		return first
+	}
+	return first[:n+1]
+}
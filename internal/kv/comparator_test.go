@@ -0,0 +1,25 @@
+package kv
+
+import "testing"
+
+func TestBytewiseSeparator(t *testing.T) {
+	testCases := []struct {
+		prevLast string
+		first    string
+		expected string
+	}{
+		{"apple", "banana", "b"},
+		{"key00099", "key00100", "key001"},
+		{"key00100", "key00101", "key00101"},
+		{"abc", "abcd", "abcd"},
+		{"user/1234/name", "user/1240/addr", "user/124"},
+		{"", "a", "a"},
+	}
+
+	for _, tc := range testCases {
+		separator := Bytewise.Separator([]byte(tc.prevLast), []byte(tc.first))
+		if string(separator) != tc.expected {
+			t.Errorf("Separator(%q, %q): expected %q, got %q", tc.prevLast, tc.first, tc.expected, separator)
+		}
+	}
+}
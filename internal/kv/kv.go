@@ -0,0 +1,161 @@
+// Package kv defines how the engine encodes the values it stores in the
+// memtable, the write-ahead log and SSTables. Every stored value is prefixed
+// with the kind of the write and the sequence number it was assigned:
+//
+//	[kind (1 byte)][sequence number (8 bytes)][user value]
+//
+// Sequence numbers increase with every write, so when the same key is found
+// in several places the entry with the highest sequence number wins.
+//
+// Range deletions are stored separately from point entries, keyed by their
+// start key, with a KindRangeDelete value whose user value is the end key.
+//
+// A value moved out of a table into a blob file is stored as a KindBlob
+// entry whose user value is the encoded blob handle. A value that expires is
+// stored as a KindSetTTL entry whose user value is prefixed with its expiry
+// time.
+//
+// Keys are ordered by a Comparator, bytewise unless the DB is configured
+// otherwise.
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Kind identifies the operation that produced a stored value
+type Kind uint8
+
+const (
+	KindSet Kind = iota
+	KindDelete
+	KindRangeDelete
+	KindBlob   // a set whose value is in a blob file
+	KindMerge  // merge operands, combined with older entries when read
+	KindSetTTL // a set whose value starts with its expiry
+)
+
+// HeaderSize is the number of bytes EncodeValue prepends to the user value
+const HeaderSize = 9
+
+var ErrCorruptValue = errors.New("corrupt value encoding")
+
+// String returns a human readable name for the kind
+func (k Kind) String() string {
+	switch k {
+	case KindSet:
+		return "SET"
+	case KindDelete:
+		return "DEL"
+	case KindRangeDelete:
+		return "RANGEDEL"
+	case KindBlob:
+		return "BLOB"
+	case KindMerge:
+		return "MERGE"
+	case KindSetTTL:
+		return "SETTTL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// EncodeValue prefixes value with its kind and sequence number
+func EncodeValue(kind Kind, seq uint64, value []byte) []byte {
+	buf := make([]byte, HeaderSize+len(value))
+	buf[0] = byte(kind)
+	binary.LittleEndian.PutUint64(buf[1:HeaderSize], seq)
+	copy(buf[HeaderSize:], value)
+	return buf
+}
+
+// DecodeValue splits an encoded value into its kind, sequence number and user
+// value. The returned value aliases data.
+func DecodeValue(data []byte) (Kind, uint64, []byte, error) {
+	if len(data) < HeaderSize {
+		return 0, 0, nil, ErrCorruptValue
+	}
+	kind := Kind(data[0])
+	seq := binary.LittleEndian.Uint64(data[1:HeaderSize])
+	return kind, seq, data[HeaderSize:], nil
+}
+
+// Entry is a user value along with the kind and sequence number of the
+// write that produced it: the decoded form of a stored value
+type Entry struct {
+	Kind  Kind
+	Seq   uint64
+	Value []byte
+}
+
+// Encode returns the stored form of the entry
+func (e Entry) Encode() []byte {
+	return EncodeValue(e.Kind, e.Seq, e.Value)
+}
+
+// DecodeEntry decodes a stored value. The entry's value aliases data.
+func DecodeEntry(data []byte) (Entry, error) {
+	kind, seq, value, err := DecodeValue(data)
+	return Entry{Kind: kind, Seq: seq, Value: value}, err
+}
+
+// ExpirySize is the number of bytes EncodeExpiring prepends to the value
+const ExpirySize = 8
+
+// EncodeExpiring prefixes value with its expiry, in Unix nanoseconds, to
+// form the user value of a KindSetTTL entry
+func EncodeExpiring(expiry int64, value []byte) []byte {
+	buf := make([]byte, ExpirySize+len(value))
+	binary.LittleEndian.PutUint64(buf, uint64(expiry))
+	copy(buf[ExpirySize:], value)
+	return buf
+}
+
+// DecodeExpiring splits the user value of a KindSetTTL entry into its expiry
+// and value. The returned value aliases data.
+func DecodeExpiring(data []byte) (int64, []byte, error) {
+	if len(data) < ExpirySize {
+		return 0, nil, ErrCorruptValue
+	}
+	return int64(binary.LittleEndian.Uint64(data)), data[ExpirySize:], nil
+}
+
+// RangeTombstone deletes every key in [Start, End) that was written with a
+// sequence number below Seq
+type RangeTombstone struct {
+	Start []byte
+	End   []byte
+	Seq   uint64
+}
+
+// Contains reports whether key falls within the tombstone's range in the
+// order of cmp
+func (t RangeTombstone) Contains(cmp Comparator, key []byte) bool {
+	return cmp.Compare(key, t.Start) >= 0 && cmp.Compare(key, t.End) < 0
+}
+
+// Covers reports whether the tombstone deletes the entry for key written at
+// sequence number seq
+func (t RangeTombstone) Covers(cmp Comparator, key []byte, seq uint64) bool {
+	return seq < t.Seq && t.Contains(cmp, key)
+}
+
+// EncodeRangeTombstone returns the value a range tombstone is stored with
+// under its start key
+func EncodeRangeTombstone(t RangeTombstone) []byte {
+	return EncodeValue(KindRangeDelete, t.Seq, t.End)
+}
+
+// DecodeRangeTombstone rebuilds a range tombstone from its start key and
+// stored value
+func DecodeRangeTombstone(start, value []byte) (RangeTombstone, error) {
+	kind, seq, end, err := DecodeValue(value)
+	if err != nil {
+		return RangeTombstone{}, err
+	}
+	if kind != KindRangeDelete {
+		return RangeTombstone{}, ErrCorruptValue
+	}
+	return RangeTombstone{Start: start, End: end, Seq: seq}, nil
+}
@@ -3,6 +3,8 @@ package sstable
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"io"
 )
 
 // Entry is a key-value pair in a block
@@ -49,6 +51,11 @@ func (b *Block) KeyCount() int {
 	return len(b.entries)
 }
 
+// Entries returns the entries of the block in key order
+func (b *Block) Entries() []Entry {
+	return b.entries
+}
+
 // Encode serializes the Block into a byte buffer. The serialized format includes:
 // - The number of entries in the block (as a uint32).
 // - For each entry:
@@ -95,3 +102,71 @@ func (b *Block) Encode() []byte {
 
 	return buf.Bytes()
 }
+
+// decodeBlockEntries decodes the entries of an encoded data or range
+// deletion block, checking every length against the data left. The keys and
+// values of the entries point into data rather than being copied.
+func decodeBlockEntries(data []byte) ([]Entry, error) {
+	// Read number of entries
+	if len(data) < 4 {
+		return nil, errors.New("block too short")
+	}
+	numEntries := binary.LittleEndian.Uint32(data)
+	rest := data[4:]
+
+	// Every entry takes at least its two lengths
+	if uint64(numEntries)*8 > uint64(len(rest)) {
+		return nil, errors.New("block entry count exceeds block size")
+	}
+	entries := make([]Entry, 0, numEntries)
+
+	// Read each entry
+	for i := uint32(0); i < numEntries; i++ {
+		var key, value []byte
+		var err error
+		if key, rest, err = cutLengthPrefixed(rest); err != nil {
+			return nil, err
+		}
+		if value, rest, err = cutLengthPrefixed(rest); err != nil {
+			return nil, err
+		}
+		entries = append(entries, Entry{Key: key, Value: value})
+	}
+
+	if len(rest) != 0 {
+		return nil, errors.New("trailing bytes after block entries")
+	}
+	return entries, nil
+}
+
+// cutLengthPrefixed splits a uint32 length followed by that many bytes off
+// the front of data. The bytes are capped so that appending to them cannot
+// overwrite what follows.
+func cutLengthPrefixed(data []byte) ([]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, errors.New("block entry truncated")
+	}
+	n := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	if uint64(n) > uint64(len(data)) {
+		return nil, nil, errors.New("block entry exceeds block size")
+	}
+	return data[:n:n], data[n:], nil
+}
+
+// readLengthPrefixed reads a uint32 length followed by that many bytes
+func readLengthPrefixed(buf *bytes.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(buf, binary.LittleEndian, &n); err != nil {
+		return nil, errors.New("block entry truncated")
+	}
+	if uint64(n) > uint64(buf.Len()) {
+		return nil, errors.New("block entry exceeds block size")
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(buf, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,387 @@
+package sstable
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/vikramcse/go-lsm/internal/kv"
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+// Default limits of a Builder
+const (
+	DefaultBuilderMemoryLimit = 64 << 20
+	builderEntryOverhead      = 64 // Slice headers and sequence number of a buffered pair
+)
+
+// BuilderOptions configures a Builder
+type BuilderOptions struct {
+	// MemoryLimit is the approximate number of bytes of pairs buffered
+	// before they are sorted and spilled to a run file.
+	// DefaultBuilderMemoryLimit if zero.
+	MemoryLimit int64
+
+	// TargetFileSize, when positive, starts a new table once the current
+	// one holds that many bytes of keys and values. Zero writes a single
+	// table.
+	TargetFileSize int64
+
+	// TempDir holds a directory of the run files, unique to each Builder.
+	// The directory of the output tables if empty.
+	TempDir string
+
+	// Writer configures the output tables. Its comparator also orders the
+	// pairs.
+	Writer WriterOptions
+}
+
+// Builder creates SSTables from pairs added in any order, more of them than
+// fit in memory. Pairs are buffered up to the memory limit, then sorted and
+// spilled to a run file. Finish merges the runs into tables, or Abort drops
+// them. When a key is added more than once, the pair added last wins.
+type Builder struct {
+	fs     vfs.FS
+	prefix string
+	opts   BuilderOptions
+	cmp    kv.Comparator
+
+	pairs []builderPair // buffered since the last spill
+	size  int64         // approximate memory held by pairs
+	seq   uint64        // number of pairs added
+	dir   string        // holds the runs, created by the first spill
+	runs  []string      // run files, oldest first
+}
+
+type builderPair struct {
+	key   []byte
+	value []byte
+	seq   uint64
+}
+
+// NewBuilder creates a Builder writing tables named pathPrefix followed by a
+// six digit number and ".sst", numbered from 1
+func NewBuilder(pathPrefix string, opts BuilderOptions) *Builder {
+	return NewBuilderFS(vfs.Default, pathPrefix, opts)
+}
+
+// NewBuilderFS is like NewBuilder, writing the tables and runs to fs
+func NewBuilderFS(fs vfs.FS, pathPrefix string, opts BuilderOptions) *Builder {
+	if opts.MemoryLimit <= 0 {
+		opts.MemoryLimit = DefaultBuilderMemoryLimit
+	}
+	if opts.TempDir == "" {
+		opts.TempDir = filepath.Dir(pathPrefix)
+	}
+	cmp := opts.Writer.Comparator
+	if cmp == nil {
+		cmp = kv.Bytewise
+	}
+	return &Builder{fs: fs, prefix: pathPrefix, opts: opts, cmp: cmp}
+}
+
+// Add adds a pair, replacing any pair with the same key added before. The
+// key and value are copied. If it fails, the run files are removed and the
+// Builder must not be used afterwards.
+func (b *Builder) Add(key, value []byte) error {
+	buf := make([]byte, len(key)+len(value))
+	copy(buf, key)
+	copy(buf[len(key):], value)
+
+	b.seq++
+	b.pairs = append(b.pairs, builderPair{key: buf[:len(key):len(key)], value: buf[len(key):], seq: b.seq})
+	b.size += int64(len(buf)) + builderEntryOverhead
+	if b.size >= b.opts.MemoryLimit {
+		if err := b.spill(); err != nil {
+			b.Abort()
+			return err
+		}
+	}
+	return nil
+}
+
+// sortPairs sorts the buffered pairs by key and drops all but the newest
+// pair of each key
+func (b *Builder) sortPairs() {
+	sort.Slice(b.pairs, func(i, j int) bool {
+		if c := b.cmp.Compare(b.pairs[i].key, b.pairs[j].key); c != 0 {
+			return c < 0
+		}
+		return b.pairs[i].seq > b.pairs[j].seq
+	})
+
+	out := b.pairs[:0]
+	for _, p := range b.pairs {
+		if len(out) > 0 && b.cmp.Compare(out[len(out)-1].key, p.key) == 0 {
+			continue
+		}
+		out = append(out, p)
+	}
+	clear(b.pairs[len(out):])
+	b.pairs = out
+}
+
+// spill writes the buffered pairs to a new run file as a sequence of
+// [key length (uvarint)][key][value length (uvarint)][value]
+func (b *Builder) spill() error {
+	b.sortPairs()
+
+	if b.dir == "" {
+		if err := b.makeDir(); err != nil {
+			return err
+		}
+	}
+	name := filepath.Join(b.dir, fmt.Sprintf("run%06d", len(b.runs)+1))
+	file, err := b.fs.Create(name)
+	if err != nil {
+		return err
+	}
+	b.runs = append(b.runs, name)
+
+	w := bufio.NewWriter(file)
+	var lenBuf [binary.MaxVarintLen64]byte
+	for _, p := range b.pairs {
+		for _, data := range [][]byte{p.key, p.value} {
+			n := binary.PutUvarint(lenBuf[:], uint64(len(data)))
+			w.Write(lenBuf[:n])
+			w.Write(data)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	b.pairs, b.size = nil, 0
+	return nil
+}
+
+// makeDir creates a directory for the runs with a random name, so that
+// builders sharing TempDir and a prefix do not use each other's runs
+func (b *Builder) makeDir() error {
+	for {
+		dir := filepath.Join(b.opts.TempDir, fmt.Sprintf("%s.tmp%016x", filepath.Base(b.prefix), rand.Uint64()))
+		if _, err := b.fs.Stat(dir); err == nil {
+			continue
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := b.fs.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		b.dir = dir
+		return nil
+	}
+}
+
+// Abort removes the run files without writing any table. The Builder must
+// not be used afterwards.
+func (b *Builder) Abort() {
+	for _, name := range b.runs {
+		b.fs.Remove(name)
+	}
+	if b.dir != "" {
+		b.fs.Remove(b.dir)
+	}
+	b.pairs, b.runs, b.dir = nil, nil, ""
+}
+
+// Finish merges the runs and the buffered pairs into tables and returns
+// their names in key order. The run files are removed whether or not it
+// succeeds, and so are the tables if it fails. The Builder must not be used
+// afterwards.
+func (b *Builder) Finish() ([]string, error) {
+	defer b.Abort()
+
+	// Sources are ordered from the newest, which wins ties: the buffered
+	// pairs, then the runs from the last spilled
+	b.sortPairs()
+	sources := []builderSource{&pairSource{pairs: b.pairs, pos: -1}}
+	for i := len(b.runs) - 1; i >= 0; i-- {
+		file, err := b.fs.Open(b.runs[i])
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		sources = append(sources, &runSource{r: bufio.NewReader(file)})
+	}
+
+	m := &builderMerge{cmp: b.cmp}
+	for i, s := range sources {
+		ok, err := s.next()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			m.sources = append(m.sources, mergeItem{source: s, rank: i})
+		}
+	}
+	heap.Init(m)
+
+	var outputs []string
+	var w *Writer
+	var written int64
+	fail := func(err error) ([]string, error) {
+		if w != nil {
+			w.Close()
+		}
+		for _, name := range outputs {
+			b.fs.Remove(name)
+		}
+		return nil, err
+	}
+
+	var prevKey []byte
+	for m.Len() > 0 {
+		top := m.sources[0].source
+		key, value := top.key(), top.value()
+
+		// Of equal keys the newest source comes first
+		if len(outputs) == 0 || b.cmp.Compare(key, prevKey) != 0 {
+			if w == nil {
+				name := fmt.Sprintf("%s%06d.sst", b.prefix, len(outputs)+1)
+				var err error
+				if w, err = NewFileWriterWithOptions(b.fs, name, b.opts.Writer); err != nil {
+					return fail(err)
+				}
+				outputs = append(outputs, name)
+			}
+			if err := w.Write(string(key), value); err != nil {
+				return fail(err)
+			}
+			written += int64(len(key) + len(value))
+			prevKey = append(prevKey[:0], key...)
+
+			if b.opts.TargetFileSize > 0 && written >= b.opts.TargetFileSize {
+				err := w.Close()
+				w, written = nil, 0
+				if err != nil {
+					return fail(err)
+				}
+			}
+		}
+
+		ok, err := top.next()
+		if err != nil {
+			return fail(err)
+		}
+		if ok {
+			heap.Fix(m, 0)
+		} else {
+			heap.Pop(m)
+		}
+	}
+
+	if w != nil {
+		err := w.Close()
+		w = nil
+		if err != nil {
+			return fail(err)
+		}
+	}
+	return outputs, nil
+}
+
+// builderSource yields sorted pairs with distinct keys. The slices returned
+// by key and value are never modified.
+type builderSource interface {
+	next() (bool, error)
+	key() []byte
+	value() []byte
+}
+
+// pairSource yields the buffered pairs
+type pairSource struct {
+	pairs []builderPair
+	pos   int
+}
+
+func (s *pairSource) next() (bool, error) {
+	if s.pos < len(s.pairs) {
+		s.pos++
+	}
+	return s.pos < len(s.pairs), nil
+}
+
+func (s *pairSource) key() []byte   { return s.pairs[s.pos].key }
+func (s *pairSource) value() []byte { return s.pairs[s.pos].value }
+
+// runSource reads the pairs of a run file
+type runSource struct {
+	r    *bufio.Reader
+	k, v []byte
+}
+
+func (s *runSource) next() (bool, error) {
+	var err error
+	if s.k, err = s.read(); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if s.v, err = s.read(); err == io.EOF {
+		return false, io.ErrUnexpectedEOF
+	}
+	return err == nil, err
+}
+
+// read reads a length-prefixed field into a new slice, as the Writer keeps
+// the slices it is given until it writes their block
+func (s *runSource) read() ([]byte, error) {
+	n, err := binary.ReadUvarint(s.r)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(s.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (s *runSource) key() []byte   { return s.k }
+func (s *runSource) value() []byte { return s.v }
+
+// builderMerge is a heap of sources ordered by their current key, and by
+// rank for equal keys so that the newest source comes first
+type builderMerge struct {
+	cmp     kv.Comparator
+	sources []mergeItem
+}
+
+type mergeItem struct {
+	source builderSource
+	rank   int // 0 for the newest source
+}
+
+func (m *builderMerge) Len() int { return len(m.sources) }
+
+func (m *builderMerge) Less(i, j int) bool {
+	if c := m.cmp.Compare(m.sources[i].source.key(), m.sources[j].source.key()); c != 0 {
+		return c < 0
+	}
+	return m.sources[i].rank < m.sources[j].rank
+}
+
+func (m *builderMerge) Swap(i, j int) { m.sources[i], m.sources[j] = m.sources[j], m.sources[i] }
+
+func (m *builderMerge) Push(x interface{}) { m.sources = append(m.sources, x.(mergeItem)) }
+
+func (m *builderMerge) Pop() interface{} {
+	last := m.sources[len(m.sources)-1]
+	m.sources = m.sources[:len(m.sources)-1]
+	return last
+}
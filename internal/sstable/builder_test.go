@@ -0,0 +1,163 @@
+package sstable
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+func TestBuilder(t *testing.T) {
+	fs := vfs.NewMem()
+	fs.MkdirAll("/out", 0755)
+	fs.MkdirAll("/tmp", 0755)
+	builder := NewBuilderFS(fs, "/out/part-", BuilderOptions{
+		MemoryLimit:    16 * 1024,
+		TargetFileSize: 32 * 1024,
+		TempDir:        "/tmp",
+	})
+
+	// Every key is added three times in random order; the last value wins
+	expected := make(map[string]string)
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 3; round++ {
+		for _, i := range rng.Perm(2000) {
+			key := fmt.Sprintf("key%05d", i)
+			value := fmt.Sprintf("value%d-%d", i, round)
+			if round == 2 && i%2 == 0 {
+				continue
+			}
+			if err := builder.Add([]byte(key), []byte(value)); err != nil {
+				t.Fatalf("Add failed: %v", err)
+			}
+			expected[key] = value
+		}
+	}
+	if runs, _ := fs.List(builder.dir); len(runs) < 3 {
+		t.Fatalf("Expected several spilled runs, got %d", len(runs))
+	}
+
+	outputs, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+	if len(outputs) < 2 {
+		t.Fatalf("Expected several tables, got %d", len(outputs))
+	}
+	if runs, _ := fs.List("/tmp"); len(runs) != 0 {
+		t.Errorf("Expected the runs to be removed, got %v", runs)
+	}
+
+	// The tables hold every key once, in order across the tables
+	var keys []string
+	for _, name := range outputs {
+		report, err := VerifyFS(fs, name)
+		if err != nil || !report.OK() {
+			t.Fatalf("Expected %s to verify, got %v (err %v)", name, report.Err(), err)
+		}
+
+		reader, err := NewReaderFS(fs, name)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", name, err)
+		}
+		it := reader.NewIterator()
+		for it.First(); it.Valid(); it.Next() {
+			key := string(it.Key())
+			if string(it.Value()) != expected[key] {
+				t.Errorf("Expected %s for %s, got %s", expected[key], key, it.Value())
+			}
+			keys = append(keys, key)
+		}
+		reader.Close()
+	}
+	if len(keys) != len(expected) {
+		t.Fatalf("Expected %d keys, got %d", len(expected), len(keys))
+	}
+	for i := 1; i < len(keys); i++ {
+		if strings.Compare(keys[i-1], keys[i]) >= 0 {
+			t.Fatalf("Expected increasing keys, got %s before %s", keys[i-1], keys[i])
+		}
+	}
+}
+
+func TestBuilderInMemory(t *testing.T) {
+	fs := vfs.NewMem()
+	builder := NewBuilderFS(fs, "/part-", BuilderOptions{})
+	builder.Add([]byte("b"), []byte("1"))
+	builder.Add([]byte("a"), []byte("1"))
+	builder.Add([]byte("b"), []byte("2"))
+
+	// Without a spill the pairs are written straight to a single table
+	outputs, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+	if len(outputs) != 1 || outputs[0] != "/part-000001.sst" {
+		t.Fatalf("Expected /part-000001.sst, got %v", outputs)
+	}
+	reader, err := NewReaderFS(fs, outputs[0])
+	if err != nil {
+		t.Fatalf("Failed to open table: %v", err)
+	}
+	defer reader.Close()
+	if value, err := reader.Get([]byte("b")); err != nil || string(value) != "2" {
+		t.Errorf("Expected b=2, got %q (err %v)", value, err)
+	}
+	if reader.Properties().NumEntries != 2 {
+		t.Errorf("Expected 2 entries, got %d", reader.Properties().NumEntries)
+	}
+}
+
+func TestBuilderRunFiles(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.NewMem())
+	fs.MkdirAll("/out", 0755)
+	opts := BuilderOptions{MemoryLimit: 1024, TempDir: "/out"}
+
+	// Builders with the same prefix keep their runs apart
+	first := NewBuilderFS(fs, "/out/part-", opts)
+	second := NewBuilderFS(fs, "/out/part-", opts)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		first.Add(key, []byte("first"))
+		second.Add(key, []byte("second"))
+	}
+	if first.dir == second.dir {
+		t.Fatalf("Expected separate run directories, got %s", first.dir)
+	}
+	second.Abort()
+	outputs, err := first.Finish()
+	if err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+	reader, err := NewReaderFS(fs, outputs[0])
+	if err != nil {
+		t.Fatalf("Failed to open table: %v", err)
+	}
+	if value, err := reader.Get([]byte("key042")); err != nil || string(value) != "first" {
+		t.Errorf("Expected key042=first, got %q (err %v)", value, err)
+	}
+	if n := reader.Properties().NumEntries; n != 100 {
+		t.Errorf("Expected 100 entries, got %d", n)
+	}
+	reader.Close()
+	if names, _ := fs.List("/out"); len(names) != 1 {
+		t.Errorf("Expected only the table to be left, got %v", names)
+	}
+
+	// A failed spill removes the runs written before it
+	builder := NewBuilderFS(fs, "/out/failed-", opts)
+	fs.Inject(vfs.Fault{Op: vfs.OpCreate, Path: "run", After: 2})
+	var addErr error
+	for i := 0; i < 100 && addErr == nil; i++ {
+		addErr = builder.Add([]byte(fmt.Sprintf("key%03d", i)), []byte("value"))
+	}
+	if !errors.Is(addErr, vfs.ErrInjected) {
+		t.Fatalf("Expected the injected error, got %v", addErr)
+	}
+	if names, _ := fs.List("/out"); len(names) != 1 {
+		t.Errorf("Expected the runs to be removed, got %v", names)
+	}
+}
@@ -0,0 +1,92 @@
+package sstable
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// Cache is a block cache that Readers share to keep decoded blocks in
+// memory between reads: data blocks and the partitions of partitioned
+// indexes. It is bounded by the total size of the encoded blocks it holds,
+// evicting the least recently used first. It is safe for concurrent use.
+//
+// Blocks of a closed Reader are never read again and age out like any
+// other.
+type Cache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List // most recently used first
+	items    map[cacheKey]*list.Element
+}
+
+// cacheKey identifies a block by the Reader it belongs to and its offset
+type cacheKey struct {
+	reader uint64
+	offset uint64
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	value interface{}
+	size  int64
+}
+
+// readerIDs hands out the ids that key the blocks of each Reader in a Cache
+var readerIDs atomic.Uint64
+
+// NewCache returns a cache holding blocks of up to capacity bytes in total
+func NewCache(capacity int64) *Cache {
+	return &Cache{
+		capacity: capacity,
+		lru:      list.New(),
+		items:    make(map[cacheKey]*list.Element),
+	}
+}
+
+// Size returns the total size of the blocks held by the cache
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+func (c *Cache) get(key cacheKey) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).value, true
+}
+
+// set adds a block of size bytes, evicting older blocks to make room. Blocks
+// larger than the whole cache are not kept.
+func (c *Cache) set(key cacheKey, value interface{}, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if size > c.capacity {
+		return
+	}
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+	}
+	for c.size+size > c.capacity {
+		c.remove(c.lru.Back())
+	}
+
+	c.items[key] = c.lru.PushFront(&cacheEntry{key: key, value: value, size: size})
+	c.size += size
+}
+
+// remove drops the block of elem. c.mu must be held.
+func (c *Cache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.items, entry.key)
+	c.size -= entry.size
+}
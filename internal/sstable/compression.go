@@ -0,0 +1,51 @@
+package sstable
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/golang/snappy"
+)
+
+// ErrUnsupportedCompression is returned by NewFileWriterWithOptions for a
+// compression type the Writer cannot produce
+var ErrUnsupportedCompression = errors.New("unsupported compression type")
+
+var errCorruptCompressedBlock = errors.New("corrupt compressed block")
+
+// checkCompression reports whether blocks can be compressed with c
+func checkCompression(c CompressionType) error {
+	switch c {
+	case NoCompression, SnappyCompression:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrUnsupportedCompression, c)
+}
+
+// compressBlock returns data compressed with c, or nil when compressing it
+// does not save at least an eighth of its size, in which case the block is
+// stored as it is
+func compressBlock(c CompressionType, data []byte) []byte {
+	if c != SnappyCompression {
+		return nil
+	}
+	compressed := snappy.Encode(nil, data)
+	if len(compressed) > len(data)-len(data)/8 {
+		return nil
+	}
+	return compressed
+}
+
+// blockPayload returns the encoded entries of a block as stored in the file,
+// decompressing them when the metadata says they are compressed. Only data
+// blocks are ever compressed, and always with Snappy.
+func blockPayload(metadata BlockMetadata, data []byte) ([]byte, error) {
+	if !metadata.Compressed {
+		return data, nil
+	}
+	decoded, err := snappy.Decode(nil, data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorruptCompressedBlock, err)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,108 @@
+package sstable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+func TestBlockCompression(t *testing.T) {
+	random := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+	repetitive := []byte(strings.Repeat("value", 2000))
+
+	// Blocks that barely shrink are stored as they are
+	if compressed := compressBlock(SnappyCompression, random); compressed != nil {
+		t.Errorf("Expected random data to be stored uncompressed, got %d bytes", len(compressed))
+	}
+	if compressed := compressBlock(NoCompression, repetitive); compressed != nil {
+		t.Errorf("Expected no compression without a compression type")
+	}
+
+	compressed := compressBlock(SnappyCompression, repetitive)
+	if compressed == nil || len(compressed) > 1000 {
+		t.Fatalf("Expected repetitive data to compress, got %d bytes", len(compressed))
+	}
+	decoded, err := blockPayload(BlockMetadata{Compressed: true}, compressed)
+	if err != nil {
+		t.Fatalf("Failed to decompress block: %v", err)
+	}
+	if !bytes.Equal(decoded, repetitive) {
+		t.Errorf("Expected the block to round trip")
+	}
+
+	// Damaged blocks are rejected rather than decoded
+	if _, err := blockPayload(BlockMetadata{Compressed: true}, compressed[:len(compressed)/2]); !errors.Is(err, errCorruptCompressedBlock) {
+		t.Errorf("Expected errCorruptCompressedBlock, got %v", err)
+	}
+}
+
+func TestWriterCompression(t *testing.T) {
+	fs := vfs.NewMem()
+	write := func(name string, compression CompressionType) int64 {
+		w, err := NewFileWriterWithOptions(fs, name, WriterOptions{Compression: compression})
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := w.Write(fmt.Sprintf("key%05d", i), []byte(strings.Repeat("v", 100))); err != nil {
+				t.Fatalf("Failed to write entry: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+		info, err := fs.Stat(name)
+		if err != nil {
+			t.Fatalf("Failed to stat table: %v", err)
+		}
+		return info.Size()
+	}
+	plain := write("/plain.sst", NoCompression)
+	compressed := write("/snappy.sst", SnappyCompression)
+	if compressed >= plain/2 {
+		t.Errorf("Expected compression to shrink the table, got %d bytes from %d", compressed, plain)
+	}
+
+	r, err := NewReaderFS(fs, "/snappy.sst")
+	if err != nil {
+		t.Fatalf("Failed to open table: %v", err)
+	}
+	defer r.Close()
+	if r.Properties().Compression != SnappyCompression || r.Footer().CompressionType != SnappyCompression {
+		t.Errorf("Expected snappy in the properties and footer")
+	}
+	value, err := r.Get([]byte("key00500"))
+	if err != nil || string(value) != strings.Repeat("v", 100) {
+		t.Errorf("Expected the value of key00500, got %q (err %v)", value, err)
+	}
+	count := 0
+	it := r.NewIterator()
+	for it.First(); it.Valid(); it.Next() {
+		count++
+	}
+	if count != 1000 {
+		t.Errorf("Expected 1000 entries, got %d", count)
+	}
+
+	report, err := VerifyFS(fs, "/snappy.sst")
+	if err != nil || !report.OK() || report.Entries != 1000 {
+		t.Errorf("Expected an intact table of 1000 entries, got %+v (err %v)", report, err)
+	}
+	count = 0
+	if _, err := SalvageFS(fs, "/snappy.sst", func(kind BlockType, entries []Entry) error {
+		count += len(entries)
+		return nil
+	}); err != nil || count != 1000 {
+		t.Errorf("Expected to salvage 1000 entries, got %d (err %v)", count, err)
+	}
+
+	if _, err := NewFileWriterWithOptions(fs, "/lz4.sst", WriterOptions{Compression: LZ4Compression}); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("Expected ErrUnsupportedCompression, got %v", err)
+	}
+}
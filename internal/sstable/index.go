@@ -3,21 +3,24 @@ package sstable
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 )
 
 // IBlock represents the index block of an SSTable.
 // The index block contains sorted entries that map keys to data block locations.
 // Each entry contains:
-// - The first key in the data block
+// - A separator key, between the last key of the previous data block and the first key of the data block
 // - The block handle (offset and size) for that data block
 type IBlock struct {
 	entries []IndexEntry
 }
 
 // IndexEntry represents a single entry in the index block.
-// It maps the first key of a data block to that block's location in the file.
+// It maps the separator key of a data block to that block's location in the
+// file. A key belongs to the block of the last entry whose separator is less
+// than or equal to it.
 type IndexEntry struct {
-	Key         []byte      // First key in the referenced data block
+	Key         []byte      // Separator key of the referenced data block
 	BlockHandle BlockHandle // Location and size of the referenced data block
 }
 
@@ -62,3 +65,44 @@ func (ib *IBlock) Encode() []byte {
 
 	return buf.Bytes()
 }
+
+// decodeIndexEntries decodes an encoded index block, checking every length
+// against the data left
+func decodeIndexEntries(data []byte) ([]IndexEntry, error) {
+	buf := bytes.NewReader(data)
+
+	// Read number of entries
+	var numEntries uint32
+	if err := binary.Read(buf, binary.LittleEndian, &numEntries); err != nil {
+		return nil, errors.New("index block too short")
+	}
+
+	// Every entry takes at least its key length and block handle
+	if uint64(numEntries)*20 > uint64(buf.Len()) {
+		return nil, errors.New("index entry count exceeds block size")
+	}
+	entries := make([]IndexEntry, 0, numEntries)
+
+	// Read each entry
+	for i := uint32(0); i < numEntries; i++ {
+		key, err := readLengthPrefixed(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		var handle BlockHandle
+		if err := binary.Read(buf, binary.LittleEndian, &handle); err != nil {
+			return nil, errors.New("index entry truncated")
+		}
+
+		entries = append(entries, IndexEntry{
+			Key:         key,
+			BlockHandle: handle,
+		})
+	}
+
+	if buf.Len() != 0 {
+		return nil, errors.New("trailing bytes after index entries")
+	}
+	return entries, nil
+}
@@ -0,0 +1,227 @@
+package sstable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+func writePartitionedTable(t *testing.T, n, partitionSize int) string {
+	t.Helper()
+
+	path := t.TempDir() + "/test.sst"
+	writer, err := NewFileWriterWithOptions(vfs.Default, path, WriterOptions{IndexPartitionSize: partitionSize})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if err := writer.Write(key, []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("Failed to write entry %s: %v", key, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+	return path
+}
+
+func TestPartitionedIndex(t *testing.T) {
+	const n = 5000
+	path := writePartitionedTable(t, n, 256)
+
+	cache := NewCache(1 << 20)
+	reader, err := NewReaderWithOptions(vfs.Default, path, ReaderOptions{Cache: cache})
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	partitions := reader.IndexPartitions()
+	if len(partitions) < 2 {
+		t.Fatalf("Expected several index partitions, got %d", len(partitions))
+	}
+	if cache.Size() != 0 {
+		t.Errorf("Expected no partition to be loaded by opening the table, cache holds %d bytes", cache.Size())
+	}
+
+	// Lookups load the partitions they need
+	for _, i := range []int{0, 1, 2500, n - 1} {
+		value, err := reader.Get([]byte(fmt.Sprintf("key%05d", i)))
+		if err != nil || string(value) != fmt.Sprintf("value%d", i) {
+			t.Errorf("Expected value%d, got %q (err %v)", i, value, err)
+		}
+	}
+	if _, err := reader.Get([]byte("key99999")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if cache.Size() == 0 {
+		t.Errorf("Expected the partitions read to be cached")
+	}
+
+	// Iteration crosses partitions
+	it := reader.NewIterator()
+	i := 0
+	for it.First(); it.Valid(); it.Next() {
+		if string(it.Key()) != fmt.Sprintf("key%05d", i) {
+			t.Fatalf("Entry %d: expected key%05d, got %s", i, i, it.Key())
+		}
+		i++
+	}
+	if it.Error() != nil || i != n {
+		t.Errorf("Expected %d entries, got %d (err %v)", n, i, it.Error())
+	}
+
+	// Partition keys are separators, SeekGE lands on the first key after one
+	it.SeekGE(partitions[1].Key)
+	if !it.Valid() || bytes.Compare(it.Key(), partitions[1].Key) < 0 {
+		t.Errorf("Expected SeekGE to land at or after %s", partitions[1].Key)
+	}
+
+	index, err := reader.IndexEntries()
+	if err != nil {
+		t.Fatalf("Failed to read index: %v", err)
+	}
+	if uint64(len(index)) != reader.Properties().NumDataBlocks {
+		t.Errorf("Expected %d index entries, got %d", reader.Properties().NumDataBlocks, len(index))
+	}
+
+	report, err := Verify(path)
+	if err != nil || !report.OK() || report.Entries != n {
+		t.Errorf("Expected an intact table of %d entries, got %d entries (err %v, corruption %v)", n, report.Entries, err, report.Err())
+	}
+}
+
+func TestPartitionedIndexCorruption(t *testing.T) {
+	path := writePartitionedTable(t, 5000, 256)
+
+	reader, err := NewReader(path)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	partition := reader.IndexPartitions()[1]
+	reader.Close()
+
+	corruptFile(t, path, func(data []byte) []byte {
+		data[partition.BlockHandle.Offset+blockMetadataSize] ^= 0xff
+		return data
+	})
+
+	report, err := Verify(path)
+	if err != nil {
+		t.Fatalf("Failed to verify table: %v", err)
+	}
+	if report.OK() || report.Corruptions[0].BlockKind != "index" || report.Corruptions[0].Offset != int64(partition.BlockHandle.Offset) {
+		t.Errorf("Expected the damaged partition to be reported, got %v", report.Err())
+	}
+
+	// The table still opens; only lookups in the damaged partition fail
+	reader, err = NewReader(path)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	if _, err := reader.Get([]byte("key00000")); err != nil {
+		t.Errorf("Expected a key of an intact partition to be found, got %v", err)
+	}
+	_, err = reader.Get(partition.Key)
+	var corruption *ErrCorruption
+	if !errors.As(err, &corruption) {
+		t.Errorf("Expected *ErrCorruption, got %v", err)
+	}
+}
+
+func TestSeparatorIndexKeys(t *testing.T) {
+	const n = 2000
+	prefix := strings.Repeat("p", 200)
+	key := func(i int) string {
+		return fmt.Sprintf("%s/%05d/%s", prefix, i, strings.Repeat("s", 100))
+	}
+
+	path := t.TempDir() + "/test.sst"
+	writer, err := NewFileWriter(path)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		if err := writer.Write(key(i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("Failed to write entry %d: %v", i, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	reader, err := NewReader(path)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	// Only the first index key is a full key, the rest stop after the digit
+	// that differs
+	index, err := reader.IndexEntries()
+	if err != nil {
+		t.Fatalf("Failed to read index: %v", err)
+	}
+	if len(index) < 2 {
+		t.Fatalf("Expected several data blocks, got %d", len(index))
+	}
+	for _, entry := range index[1:] {
+		if len(entry.Key) >= len(key(0)) {
+			t.Errorf("Expected a shortened index key, got %d bytes", len(entry.Key))
+		}
+	}
+
+	for i := 0; i < n; i += 7 {
+		value, err := reader.Get([]byte(key(i)))
+		if err != nil || string(value) != fmt.Sprintf("value%d", i) {
+			t.Errorf("Expected value%d, got %q (err %v)", i, value, err)
+		}
+	}
+
+	// Keys falling between two blocks, before a separator or right on it
+	it := reader.NewIterator()
+	for _, entry := range index[1:] {
+		it.SeekGE(entry.Key)
+		if !it.Valid() || bytes.Compare(it.Key(), entry.Key) < 0 {
+			t.Errorf("Expected SeekGE(%q) to land at or after it", entry.Key)
+		}
+		if _, err := reader.Get(entry.Key); err != ErrKeyNotFound {
+			t.Errorf("Expected ErrKeyNotFound for a separator, got %v", err)
+		}
+	}
+
+	report, err := Verify(path)
+	if err != nil || !report.OK() || report.Entries != n {
+		t.Errorf("Expected an intact table of %d entries, got %d entries (err %v, corruption %v)", n, report.Entries, err, report.Err())
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewCache(100)
+	cache.set(cacheKey{offset: 1}, "a", 40)
+	cache.set(cacheKey{offset: 2}, "b", 40)
+	cache.get(cacheKey{offset: 1})
+	cache.set(cacheKey{offset: 3}, "c", 40)
+
+	if _, ok := cache.get(cacheKey{offset: 2}); ok {
+		t.Errorf("Expected the least recently used block to be evicted")
+	}
+	if _, ok := cache.get(cacheKey{offset: 1}); !ok {
+		t.Errorf("Expected a recently used block to stay")
+	}
+	if cache.Size() != 80 {
+		t.Errorf("Expected 80 bytes cached, got %d", cache.Size())
+	}
+
+	cache.set(cacheKey{offset: 4}, "d", 200)
+	if _, ok := cache.get(cacheKey{offset: 4}); ok {
+		t.Errorf("Expected a block larger than the cache not to be kept")
+	}
+}
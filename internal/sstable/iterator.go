@@ -0,0 +1,130 @@
+package sstable
+
+// Iterator walks the key-value pairs of an SSTable in key order. Data blocks
+// are read from disk one at a time as the iterator reaches them.
+//
+// A new Iterator is unpositioned; call First or SeekGE before reading.
+type Iterator struct {
+	reader   *Reader
+	partIdx  int          // index partition of the current data block
+	index    []IndexEntry // entries of that partition
+	blockIdx int          // index entry of the current data block
+	block    *Block       // current data block, nil when exhausted
+	entryIdx int          // position within the current data block
+	err      error
+}
+
+// NewIterator returns an iterator over the whole table
+func (r *Reader) NewIterator() *Iterator {
+	return &Iterator{reader: r}
+}
+
+// First positions the iterator at the first key in the table
+func (it *Iterator) First() {
+	it.index = nil
+	it.loadBlock(0, 0)
+	it.entryIdx = 0
+	it.skipEmptyBlocks()
+}
+
+// SeekGE positions the iterator at the first key that is greater than or
+// equal to key
+func (it *Iterator) SeekGE(key []byte) {
+	part, index, idx, err := it.reader.findBlock(key)
+	if err != nil {
+		if err != ErrKeyNotFound {
+			it.err = err
+		}
+		it.block = nil
+		return
+	}
+
+	it.partIdx, it.index = part, index
+	it.loadBlock(part, idx)
+	if it.block == nil {
+		return
+	}
+
+	// Binary search for the first entry >= key within the block
+	entries := it.block.entries
+	left, right := 0, len(entries)
+	for left < right {
+		mid := (left + right) / 2
+		if it.reader.cmp.Compare(entries[mid].Key, key) < 0 {
+			left = mid + 1
+		} else {
+			right = mid
+		}
+	}
+	it.entryIdx = left
+	it.skipEmptyBlocks()
+}
+
+// Next moves the iterator to the next key
+func (it *Iterator) Next() {
+	if it.block == nil {
+		return
+	}
+	it.entryIdx++
+	it.skipEmptyBlocks()
+}
+
+// Valid reports whether the iterator is positioned at a key
+func (it *Iterator) Valid() bool {
+	return it.block != nil && it.err == nil
+}
+
+// Key returns the key at the current position
+func (it *Iterator) Key() []byte {
+	return it.block.entries[it.entryIdx].Key
+}
+
+// Value returns the value at the current position
+func (it *Iterator) Value() []byte {
+	return it.block.entries[it.entryIdx].Value
+}
+
+// Error returns the first error hit while reading blocks
+func (it *Iterator) Error() error {
+	return it.err
+}
+
+// loadBlock reads the data block referenced by entry idx of index partition
+// part, moving on to the following partitions when idx is past the end
+func (it *Iterator) loadBlock(part, idx int) {
+	it.block = nil
+	for it.err == nil && part < it.reader.numPartitions() {
+		if it.index == nil || part != it.partIdx {
+			index, err := it.reader.partition(part)
+			if err != nil {
+				it.err = err
+				return
+			}
+			it.partIdx, it.index = part, index
+		}
+		if idx < len(it.index) {
+			break
+		}
+		part, idx = part+1, 0
+	}
+	it.blockIdx = idx
+	if it.err != nil || part >= it.reader.numPartitions() {
+		return
+	}
+
+	block, err := it.reader.readBlock(it.index[idx].BlockHandle)
+	if err != nil {
+		it.err = err
+		return
+	}
+	it.block = block
+}
+
+// skipEmptyBlocks moves to the start of the following block whenever the
+// position is past the end of the current one
+func (it *Iterator) skipEmptyBlocks() {
+	for it.block != nil && it.entryIdx >= len(it.block.entries) {
+		it.loadBlock(it.partIdx, it.blockIdx+1)
+		it.entryIdx = 0
+	}
+}
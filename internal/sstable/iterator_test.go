@@ -0,0 +1,156 @@
+package sstable
+
+import (
+	"fmt"
+	"testing"
+)
+
+func writeTestTable(t *testing.T, n int) string {
+	t.Helper()
+
+	writer, err := NewFileWriter(t.TempDir() + "/test.sst")
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if err := writer.Write(key, []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("Failed to write entry %s: %v", key, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+	return writer.Filename()
+}
+
+func TestIteratorFullScan(t *testing.T) {
+	const n = 1000
+	reader, err := NewReader(writeTestTable(t, n))
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	if len(reader.indexBlock.entries) < 2 {
+		t.Fatalf("Expected several data blocks, got %d", len(reader.indexBlock.entries))
+	}
+
+	it := reader.NewIterator()
+	i := 0
+	for it.First(); it.Valid(); it.Next() {
+		if string(it.Key()) != fmt.Sprintf("key%05d", i) {
+			t.Fatalf("Entry %d: expected key%05d, got %s", i, i, it.Key())
+		}
+		if string(it.Value()) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("Entry %d: expected value%d, got %s", i, i, it.Value())
+		}
+		i++
+	}
+	if it.Error() != nil {
+		t.Fatalf("Iterator failed: %v", it.Error())
+	}
+	if i != n {
+		t.Errorf("Expected %d entries, got %d", n, i)
+	}
+}
+
+func TestIteratorSeekGE(t *testing.T) {
+	reader, err := NewReader(writeTestTable(t, 1000))
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	testCases := []struct {
+		seek     string
+		expected string // empty when the iterator should be exhausted
+	}{
+		{"", "key00000"},
+		{"key00500", "key00500"},
+		{"key00500a", "key00501"},
+		{"key00999", "key00999"},
+		{"key01000", ""},
+		{"zzz", ""},
+	}
+
+	it := reader.NewIterator()
+	for _, tc := range testCases {
+		it.SeekGE([]byte(tc.seek))
+		if tc.expected == "" {
+			if it.Valid() {
+				t.Errorf("Seek %q: expected exhausted iterator, got %s", tc.seek, it.Key())
+			}
+			continue
+		}
+		if !it.Valid() || string(it.Key()) != tc.expected {
+			t.Errorf("Seek %q: expected %s, got valid=%v", tc.seek, tc.expected, it.Valid())
+		}
+	}
+}
+
+func TestRangeDeletionBlock(t *testing.T) {
+	writer, err := NewFileWriter(t.TempDir() + "/test.sst")
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	writer.Write("key1", []byte("value1"))
+	writer.AddRangeDeletion([]byte("a"), []byte("c"))
+	writer.AddRangeDeletion([]byte("x"), []byte("z"))
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	reader, err := NewReader(writer.Filename())
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	rangeDels := reader.RangeDeletions()
+	if len(rangeDels) != 2 {
+		t.Fatalf("Expected 2 range deletions, got %d", len(rangeDels))
+	}
+	if string(rangeDels[1].Key) != "x" || string(rangeDels[1].Value) != "z" {
+		t.Errorf("Expected x -> z, got %s -> %s", rangeDels[1].Key, rangeDels[1].Value)
+	}
+	if value, err := reader.Get([]byte("key1")); err != nil || string(value) != "value1" {
+		t.Errorf("Expected value1, got %q (err %v)", value, err)
+	}
+}
+
+func TestDecodeFooterVersions(t *testing.T) {
+	v1 := &Footer{
+		IndexHandle: BlockHandle{Offset: 100, Size: 20},
+		MagicNumber: MagicNumber,
+		Version:     1,
+	}
+	data := v1.Encode()
+	if len(data) != FooterSize {
+		t.Fatalf("Expected version 1 footer of %d bytes, got %d", FooterSize, len(data))
+	}
+
+	// Readers pass the tail of the file, which may include data before a
+	// version 1 footer
+	decoded, err := DecodeFooter(append(make([]byte, FooterSize), data...))
+	if err != nil {
+		t.Fatalf("Failed to decode version 1 footer: %v", err)
+	}
+	if decoded.IndexHandle != v1.IndexHandle || decoded.RangeDelHandle != (BlockHandle{}) {
+		t.Errorf("Unexpected version 1 footer: %+v", decoded)
+	}
+
+	v2 := &Footer{
+		IndexHandle:    BlockHandle{Offset: 100, Size: 20},
+		MagicNumber:    MagicNumber,
+		Version:        2,
+		RangeDelHandle: BlockHandle{Offset: 80, Size: 20},
+	}
+	decoded, err = DecodeFooter(v2.Encode())
+	if err != nil {
+		t.Fatalf("Failed to decode version 2 footer: %v", err)
+	}
+	if decoded.IndexHandle != v2.IndexHandle || decoded.RangeDelHandle != v2.RangeDelHandle {
+		t.Errorf("Unexpected version 2 footer: %+v", decoded)
+	}
+}
@@ -0,0 +1,150 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/vikramcse/go-lsm/internal/kv"
+)
+
+// Names of the properties the Writer records itself. User-defined properties
+// must not use the "sstable." prefix.
+const (
+	propNumEntries        = "sstable.num.entries"
+	propNumRangeDeletions = "sstable.num.range-deletions"
+	propNumDataBlocks     = "sstable.num.data-blocks"
+	propRawKeySize        = "sstable.raw.key-size"
+	propRawValueSize      = "sstable.raw.value-size"
+	propDataSize          = "sstable.data-size"
+	propSmallestKey       = "sstable.smallest-key"
+	propLargestKey        = "sstable.largest-key"
+	propCompression       = "sstable.compression"
+	propBlockSize         = "sstable.block-size"
+	propComparator        = "sstable.comparator"
+
+	reservedPropertyPrefix = "sstable."
+)
+
+// Properties are statistics about a table, recorded in its properties block
+// when the table is written so they can be read without scanning data blocks
+type Properties struct {
+	NumEntries        uint64 // Entries written with Write
+	NumRangeDeletions uint64 // Entries written with AddRangeDeletion
+	NumDataBlocks     uint64
+	RawKeySize        uint64 // Total size of the keys of all entries
+	RawValueSize      uint64 // Total size of the values of all entries
+	DataSize          uint64 // Size of the data blocks, including their metadata
+	SmallestKey       []byte // First key written with Write
+	LargestKey        []byte // Last key written with Write
+	Compression       CompressionType
+	BlockSize         uint64 // Target data block size the table was written with
+	Comparator        string // Name of the comparator ordering the keys
+
+	// User holds the properties added by PropertiesCollectors
+	User map[string]string
+}
+
+// PropertiesCollector gathers user-defined properties while a table is
+// written. A collector is used for a single table.
+type PropertiesCollector interface {
+	// Name identifies the collector in errors
+	Name() string
+
+	// Add is called for every entry in the order it is added to the table.
+	// kind is DataBlock for entries added with Write and RangeDelBlock for
+	// those added with AddRangeDeletion.
+	Add(kind BlockType, key, value []byte) error
+
+	// Finish adds the collected properties to props
+	Finish(props map[string]string) error
+}
+
+// add accounts for an entry added with Write
+func (p *Properties) add(key, value []byte) {
+	if p.NumEntries == 0 {
+		p.SmallestKey = append([]byte(nil), key...)
+	}
+	p.LargestKey = append(p.LargestKey[:0], key...)
+	p.NumEntries++
+	p.RawKeySize += uint64(len(key))
+	p.RawValueSize += uint64(len(value))
+}
+
+// encode serializes the properties as a block of name/value entries sorted
+// by name
+func (p *Properties) encode() *Block {
+	props := make(map[string][]byte, len(p.User)+10)
+	for name, value := range p.User {
+		props[name] = []byte(value)
+	}
+	for name, value := range map[string]uint64{
+		propNumEntries:        p.NumEntries,
+		propNumRangeDeletions: p.NumRangeDeletions,
+		propNumDataBlocks:     p.NumDataBlocks,
+		propRawKeySize:        p.RawKeySize,
+		propRawValueSize:      p.RawValueSize,
+		propDataSize:          p.DataSize,
+		propCompression:       uint64(p.Compression),
+		propBlockSize:         p.BlockSize,
+	} {
+		props[name] = binary.LittleEndian.AppendUint64(nil, value)
+	}
+	props[propSmallestKey] = p.SmallestKey
+	props[propLargestKey] = p.LargestKey
+	props[propComparator] = []byte(p.Comparator)
+
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	block := NewBlock()
+	for _, name := range names {
+		block.AddEntry([]byte(name), props[name])
+	}
+	return block
+}
+
+// decodeProperties rebuilds Properties from the entries of a properties
+// block. Reserved properties it does not know, written by newer versions,
+// are skipped. Tables written before the comparator was recorded are
+// bytewise ordered.
+func decodeProperties(entries []Entry) (*Properties, error) {
+	p := &Properties{User: make(map[string]string), Comparator: kv.Bytewise.Name()}
+	var compression uint64
+	counters := map[string]*uint64{
+		propNumEntries:        &p.NumEntries,
+		propNumRangeDeletions: &p.NumRangeDeletions,
+		propNumDataBlocks:     &p.NumDataBlocks,
+		propRawKeySize:        &p.RawKeySize,
+		propRawValueSize:      &p.RawValueSize,
+		propDataSize:          &p.DataSize,
+		propBlockSize:         &p.BlockSize,
+		propCompression:       &compression,
+	}
+
+	for _, e := range entries {
+		name := string(e.Key)
+		switch {
+		case !strings.HasPrefix(name, reservedPropertyPrefix):
+			p.User[name] = string(e.Value)
+		case name == propSmallestKey:
+			p.SmallestKey = e.Value
+		case name == propLargestKey:
+			p.LargestKey = e.Value
+		case name == propComparator:
+			p.Comparator = string(e.Value)
+		case counters[name] != nil:
+			if len(e.Value) != 8 {
+				return nil, errors.New("invalid property " + name)
+			}
+			*counters[name] = binary.LittleEndian.Uint64(e.Value)
+		}
+	}
+
+	p.Compression = CompressionType(compression)
+	return p, nil
+}
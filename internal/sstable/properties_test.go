@@ -0,0 +1,126 @@
+package sstable
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// countingCollector counts the entries whose value starts with a prefix
+type countingCollector struct {
+	prefix string
+	count  int
+	err    error
+}
+
+func (c *countingCollector) Name() string { return "counting" }
+
+func (c *countingCollector) Add(kind BlockType, key, value []byte) error {
+	if kind == DataBlock && strings.HasPrefix(string(value), c.prefix) {
+		c.count++
+	}
+	return c.err
+}
+
+func (c *countingCollector) Finish(props map[string]string) error {
+	props["counting."+c.prefix] = strconv.Itoa(c.count)
+	return nil
+}
+
+func TestWriterRecordsProperties(t *testing.T) {
+	writer, err := NewFileWriter(t.TempDir() + "/test.sst")
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	writer.AddPropertiesCollector(&countingCollector{prefix: "value1"})
+
+	keys := []string{"apple", "banana", "cherry"}
+	for i, key := range keys {
+		if err := writer.Write(key, []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Failed to write entry: %v", err)
+		}
+	}
+	writer.AddRangeDeletion([]byte("d"), []byte("e"))
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	reader, err := NewReader(writer.Filename())
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	props := reader.Properties()
+	if props == nil {
+		t.Fatalf("Expected properties")
+	}
+
+	testCases := []struct {
+		name     string
+		got      uint64
+		expected uint64
+	}{
+		{"NumEntries", props.NumEntries, 3},
+		{"NumRangeDeletions", props.NumRangeDeletions, 1},
+		{"NumDataBlocks", props.NumDataBlocks, 1},
+		{"RawKeySize", props.RawKeySize, uint64(len("applebananacherry"))},
+		{"RawValueSize", props.RawValueSize, 18},
+		{"BlockSize", props.BlockSize, BlockSize},
+	}
+	for _, tc := range testCases {
+		if tc.got != tc.expected {
+			t.Errorf("Expected %s %d, got %d", tc.name, tc.expected, tc.got)
+		}
+	}
+
+	if string(props.SmallestKey) != "apple" || string(props.LargestKey) != "cherry" {
+		t.Errorf("Expected key range [apple, cherry], got [%s, %s]", props.SmallestKey, props.LargestKey)
+	}
+	if props.Compression != NoCompression {
+		t.Errorf("Expected no compression, got %s", props.Compression)
+	}
+	if props.User["counting.value1"] != "1" {
+		t.Errorf("Expected user property counting.value1=1, got %v", props.User)
+	}
+}
+
+func TestWriterPropertiesCollectorErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	writer, err := NewFileWriter(dir + "/failing.sst")
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	collectorErr := errors.New("collector failed")
+	writer.AddPropertiesCollector(&countingCollector{err: collectorErr})
+	if err := writer.Write("key", []byte("value")); !errors.Is(err, collectorErr) {
+		t.Errorf("Expected collector error from Write, got %v", err)
+	}
+	if err := writer.Close(); !errors.Is(err, collectorErr) {
+		t.Errorf("Expected collector error from Close, got %v", err)
+	}
+
+	writer, err = NewFileWriter(dir + "/reserved.sst")
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	writer.AddPropertiesCollector(&reservedCollector{})
+	if err := writer.Write("key", []byte("value")); err != nil {
+		t.Fatalf("Failed to write entry: %v", err)
+	}
+	if err := writer.Close(); err == nil {
+		t.Errorf("Expected an error for a reserved property name")
+	}
+}
+
+// reservedCollector adds a property with the reserved prefix
+type reservedCollector struct{}
+
+func (reservedCollector) Name() string                                { return "reserved" }
+func (reservedCollector) Add(kind BlockType, key, value []byte) error { return nil }
+func (reservedCollector) Finish(props map[string]string) error {
+	props[propNumEntries] = "0"
+	return nil
+}
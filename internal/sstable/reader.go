@@ -1,60 +1,179 @@
 package sstable
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
-	"os"
+
+	"github.com/vikramcse/go-lsm/internal/kv"
+	"github.com/vikramcse/go-lsm/vfs"
 )
 
+// ErrKeyNotFound is returned by Get when the key is not in the table
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrComparatorMismatch is returned when a table is opened with another
+// comparator than the one it was written with
+var ErrComparatorMismatch = errors.New("comparator mismatch")
+
 // Reader provides functionality to read from SSTable files.
 // It supports:
 // - Loading and validating the index block
 // - Binary search through index entries
 // - Reading and searching data blocks
 // - Key-value pair retrieval
+//
+// Blocks are read with positional reads, or straight from memory when the
+// file is mapped, so a Reader is safe for concurrent use once it has been
+// created.
 type Reader struct {
-	file       *os.File
-	indexBlock *IBlock
+	filename    string
+	file        vfs.File
+	mapped      []byte // the whole file when it is memory mapped
+	footer      *Footer
+	indexBlock  *IBlock // the index, or the top-level index when partitioned
+	partitioned bool
+	rangeDels   []Entry
+	properties  *Properties
+	cmp         kv.Comparator
+
+	id    uint64 // identifies the blocks of this Reader in the cache
+	cache *Cache
 }
 
+// NewReader opens the SSTable file filename for reading
 func NewReader(filename string) (*Reader, error) {
-	file, err := os.OpenFile(filename, os.O_RDONLY, 0644)
+	return NewReaderFS(vfs.Default, filename)
+}
+
+// NewReaderFS is like NewReader, opening the file in fs
+func NewReaderFS(fs vfs.FS, filename string) (*Reader, error) {
+	return NewReaderWithOptions(fs, filename, ReaderOptions{})
+}
+
+// ReaderOptions configures how a Reader accesses its file
+type ReaderOptions struct {
+	// Mmap maps the file into memory and decodes blocks straight from the
+	// mapping, instead of reading each block into a new buffer. The keys
+	// and values returned by the Reader and its iterators then point into
+	// the mapping and must not be used after Close. Files that cannot be
+	// mapped, such as those of an in-memory filesystem, are read with
+	// positional reads.
+	Mmap bool
+
+	// Cache, if set, keeps the data blocks and index partitions read by
+	// the Reader for later reads. Data blocks of a mapped file are not
+	// cached, as they are already in memory.
+	Cache *Cache
+
+	// Comparator must be the comparator the table was written with,
+	// kv.Bytewise if nil
+	Comparator kv.Comparator
+}
+
+// NewReaderWithOptions is like NewReaderFS, configured by opts
+func NewReaderWithOptions(fs vfs.FS, filename string, opts ReaderOptions) (*Reader, error) {
+	reader, err := openReader(fs, filename, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Searching a table with another ordering than its own would silently
+	// miss keys
+	name := kv.Bytewise.Name()
+	if reader.properties != nil {
+		name = reader.properties.Comparator
+	}
+	if name != reader.cmp.Name() {
+		reader.Close()
+		return nil, fmt.Errorf("%w: %s was written with %s, not %s", ErrComparatorMismatch, filename, name, reader.cmp.Name())
+	}
+
+	return reader, nil
+}
+
+// ReadProperties returns the properties of the table in fs at filename, or
+// nil if it has none. Unlike a Reader, it opens tables written with any
+// comparator, so tools can find out which one a table needs.
+func ReadProperties(fs vfs.FS, filename string) (*Properties, error) {
+	reader, err := openReader(fs, filename, ReaderOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return reader.properties, nil
+}
+
+// openReader opens the table at filename and loads its index, range
+// deletions and properties, without checking its comparator
+func openReader(fs vfs.FS, filename string, opts ReaderOptions) (*Reader, error) {
+	file, err := fs.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 
 	reader := &Reader{
-		file: file,
+		filename: filename,
+		file:     file,
+		cmp:      kv.Bytewise,
+		id:       readerIDs.Add(1),
+		cache:    opts.Cache,
+	}
+	if opts.Comparator != nil {
+		reader.cmp = opts.Comparator
+	}
+	if opts.Mmap {
+		// Fall back to positional reads when the file cannot be mapped
+		if mapped, err := vfs.Map(file); err == nil {
+			reader.mapped = mapped
+		}
 	}
 
 	// Read and validate the index block
 	if err := reader.loadIndexBlock(); err != nil {
-		file.Close()
+		reader.Close()
+		return nil, err
+	}
+
+	if err := reader.loadRangeDeletions(); err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	if err := reader.loadProperties(); err != nil {
+		reader.Close()
 		return nil, err
 	}
 
 	return reader, nil
 }
 
+// Mapped reports whether the Reader reads its file through a memory mapping
+func (r *Reader) Mapped() bool {
+	return r.mapped != nil
+}
+
 // loadIndexBlock reads and loads the index block from the file
 func (r *Reader) loadIndexBlock() error {
-	// First seek to end of file minus footer size to read the footer
+	// First stat the file to locate the footer at its end
 	fileInfo, err := r.file.Stat()
 	if err != nil {
 		return err
 	}
 
-	// Seek to footer position
-	_, err = r.file.Seek(fileInfo.Size()-FooterSize, 0)
-	if err != nil {
-		return err
+	// Read the tail of the file, which is large enough for the footer of
+	// any version
+	tailSize := int64(ExtendedFooterSize)
+	if fileInfo.Size() < tailSize {
+		tailSize = fileInfo.Size()
+	}
+	if tailSize < FooterSize {
+		return errors.New("invalid SSTable file: too short")
 	}
 
-	// Read footer
-	footerData := make([]byte, FooterSize)
-	if _, err := io.ReadFull(r.file, footerData); err != nil {
+	footerData := make([]byte, tailSize)
+	if _, err := r.file.ReadAt(footerData, fileInfo.Size()-tailSize); err != nil {
 		return err
 	}
 
@@ -67,82 +186,169 @@ func (r *Reader) loadIndexBlock() error {
 	if footer.MagicNumber != MagicNumber {
 		return errors.New("invalid SSTable file: wrong magic number")
 	}
+	r.footer = footer
 
-	// Seek to index block position
-	_, err = r.file.Seek(int64(footer.IndexHandle.Offset), 0)
+	// Read the index block at its position
+	metadata, data, err := r.blockAt(footer.IndexHandle.Offset)
 	if err != nil {
 		return err
 	}
 
-	// Read index block metadata
-	var metadata BlockMetadata
-	if err := binary.Read(r.file, binary.LittleEndian, &metadata); err != nil {
-		return err
-	}
-
-	if metadata.Type != IndexBlock {
+	switch metadata.Type {
+	case IndexBlock:
+	case TopIndexBlock:
+		r.partitioned = true
+	default:
 		return errors.New("invalid index block type")
 	}
 
-	// Read index block data
-	data := make([]byte, metadata.Size)
-	if _, err := io.ReadFull(r.file, data); err != nil {
-		return err
-	}
-
 	// Verify CRC
 	if calculateCRC(data) != metadata.CRC {
-		return errors.New("index block CRC mismatch")
+		return r.corruption(int64(footer.IndexHandle.Offset), metadata.Type, "index block CRC mismatch")
 	}
 
 	// Decode index block
-	r.indexBlock = &IBlock{}
-	if err := r.decodeIndexBlock(data); err != nil {
-		return err
+	entries, err := decodeIndexEntries(data)
+	if err != nil {
+		return r.corruption(int64(footer.IndexHandle.Offset), metadata.Type, err.Error())
 	}
+	r.indexBlock = &IBlock{entries: entries}
 
 	return nil
 }
 
-// decodeIndexBlock decodes the serialized index block data
-func (r *Reader) decodeIndexBlock(data []byte) error {
-	buf := bytes.NewReader(data)
+// loadRangeDeletions reads the range deletion block, if the table has one
+func (r *Reader) loadRangeDeletions() error {
+	if r.footer.RangeDelHandle.Size == 0 {
+		return nil
+	}
 
-	// Read number of entries
-	var numEntries uint32
-	if err := binary.Read(buf, binary.LittleEndian, &numEntries); err != nil {
+	// Held by the Reader, so not cached
+	_, block, err := r.ReadBlock(r.footer.RangeDelHandle)
+	if err != nil {
 		return err
 	}
+	r.rangeDels = block.entries
+	return nil
+}
 
-	r.indexBlock.entries = make([]IndexEntry, 0, numEntries)
+// loadProperties reads the properties block, if the table has one
+func (r *Reader) loadProperties() error {
+	if r.footer.PropertiesHandle.Size == 0 {
+		return nil
+	}
 
-	// Read each entry
-	for i := uint32(0); i < numEntries; i++ {
-		var keyLen uint32
-		if err := binary.Read(buf, binary.LittleEndian, &keyLen); err != nil {
-			return err
-		}
+	_, block, err := r.ReadBlock(r.footer.PropertiesHandle)
+	if err != nil {
+		return err
+	}
+	properties, err := decodeProperties(block.entries)
+	if err != nil {
+		return r.corruption(int64(r.footer.PropertiesHandle.Offset), PropertiesBlock, err.Error())
+	}
+	r.properties = properties
+	return nil
+}
 
-		key := make([]byte, keyLen)
-		if _, err := buf.Read(key); err != nil {
-			return err
-		}
+// Properties returns the properties recorded when the table was written, or
+// nil for tables written before properties blocks were introduced
+func (r *Reader) Properties() *Properties {
+	return r.properties
+}
 
-		var handle BlockHandle
-		if err := binary.Read(buf, binary.LittleEndian, &handle.Offset); err != nil {
-			return err
-		}
-		if err := binary.Read(buf, binary.LittleEndian, &handle.Size); err != nil {
-			return err
+// Footer returns the decoded footer of the table
+func (r *Reader) Footer() Footer {
+	return *r.footer
+}
+
+// IndexEntries returns the entries of the index, one per data block in file
+// order. The partitions of a partitioned index are all read.
+func (r *Reader) IndexEntries() ([]IndexEntry, error) {
+	if !r.partitioned {
+		return r.indexBlock.entries, nil
+	}
+
+	var entries []IndexEntry
+	for i := range r.indexBlock.entries {
+		partition, err := r.partition(i)
+		if err != nil {
+			return nil, err
 		}
+		entries = append(entries, partition...)
+	}
+	return entries, nil
+}
 
-		r.indexBlock.entries = append(r.indexBlock.entries, IndexEntry{
-			Key:         key,
-			BlockHandle: handle,
-		})
+// IndexPartitions returns the entries of the top-level index, one per index
+// partition, or nil when the index is not partitioned
+func (r *Reader) IndexPartitions() []IndexEntry {
+	if !r.partitioned {
+		return nil
 	}
+	return r.indexBlock.entries
+}
 
-	return nil
+// numPartitions returns the number of index partitions. An index that is
+// not partitioned is its own single partition.
+func (r *Reader) numPartitions() int {
+	if !r.partitioned {
+		return 1
+	}
+	return len(r.indexBlock.entries)
+}
+
+// partition returns the entries of index partition i, reading it on demand
+func (r *Reader) partition(i int) ([]IndexEntry, error) {
+	if !r.partitioned {
+		return r.indexBlock.entries, nil
+	}
+
+	offset := r.indexBlock.entries[i].BlockHandle.Offset
+	if cached, ok := r.cacheGet(offset); ok {
+		return cached.([]IndexEntry), nil
+	}
+
+	metadata, data, err := r.blockAt(offset)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.Type != IndexBlock {
+		return nil, r.corruption(int64(offset), IndexBlock, fmt.Sprintf("block type is %s", metadata.Type))
+	}
+	if calculateCRC(data) != metadata.CRC {
+		return nil, r.corruption(int64(offset), IndexBlock, "index block CRC mismatch")
+	}
+	entries, err := decodeIndexEntries(data)
+	if err != nil {
+		return nil, r.corruption(int64(offset), IndexBlock, err.Error())
+	}
+
+	r.cacheSet(offset, entries, int64(len(data)))
+	return entries, nil
+}
+
+func (r *Reader) cacheGet(offset uint64) (interface{}, bool) {
+	if r.cache == nil {
+		return nil, false
+	}
+	return r.cache.get(cacheKey{reader: r.id, offset: offset})
+}
+
+func (r *Reader) cacheSet(offset uint64, value interface{}, size int64) {
+	if r.cache != nil {
+		r.cache.set(cacheKey{reader: r.id, offset: offset}, value, size)
+	}
+}
+
+// RangeDeletions returns the range tombstones stored in the table, keyed by
+// their start key, in the order they were added
+func (r *Reader) RangeDeletions() []Entry {
+	return r.rangeDels
+}
+
+// corruption returns an ErrCorruption for the block of kind at offset
+func (r *Reader) corruption(offset int64, kind BlockType, reason string) error {
+	return &ErrCorruption{File: r.filename, Offset: offset, BlockKind: kind.String(), Reason: reason}
 }
 
 // Get retrieves the value for a given key using the following process:
@@ -173,20 +379,53 @@ func (r *Reader) Get(key []byte) ([]byte, error) {
 
 // findBlockHandle finds the appropriate block handle for a given key
 func (r *Reader) findBlockHandle(key []byte) (BlockHandle, error) {
-	entries := r.indexBlock.entries
+	_, entries, idx, err := r.findBlock(key)
+	if err != nil {
+		return BlockHandle{}, err
+	}
+	return entries[idx].BlockHandle, nil
+}
 
+// findBlock returns the index partition holding the entry of the data block
+// that may contain key, along with the entries of that partition and the
+// position of the entry. It returns ErrKeyNotFound for an empty table.
+func (r *Reader) findBlock(key []byte) (int, []IndexEntry, int, error) {
+	if len(r.indexBlock.entries) == 0 {
+		return 0, nil, 0, ErrKeyNotFound
+	}
+
+	part := 0
+	if r.partitioned {
+		part = searchIndex(r.cmp, r.indexBlock.entries, key)
+	}
+	entries, err := r.partition(part)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	if len(entries) == 0 {
+		return 0, nil, 0, ErrKeyNotFound
+	}
+	return part, entries, searchIndex(r.cmp, entries, key), nil
+}
+
+// searchIndex returns the position of the last entry whose key is less than
+// or equal to key, or 0 when key comes before every entry. entries must not
+// be empty. Index keys separate the blocks, so a key that falls between the
+// last key of a block and the next index key belongs to no block and is
+// looked up in the earlier one.
+func searchIndex(cmp kv.Comparator, entries []IndexEntry, key []byte) int {
 	// Binary search through index entries
 	left, right := 0, len(entries)-1
 
 	// If key is after last index entry, use last block
-	if bytes.Compare(key, entries[right].Key) >= 0 {
-		return entries[right].BlockHandle, nil
+	if cmp.Compare(key, entries[right].Key) >= 0 {
+		return right
 	}
 
 	// Binary search for the block that may contain the key
 	for left < right {
 		mid := (left + right) / 2
-		if bytes.Compare(entries[mid].Key, key) <= 0 {
+		if cmp.Compare(entries[mid].Key, key) <= 0 {
 			left = mid + 1
 		} else {
 			right = mid
@@ -197,75 +436,106 @@ func (r *Reader) findBlockHandle(key []byte) (BlockHandle, error) {
 	if left > 0 {
 		left--
 	}
-	return entries[left].BlockHandle, nil
+	return left
 }
 
-// readBlock reads a data block from the file using the block handle
+// readBlock reads a data block from the file using the block handle, or
+// takes it from the cache
 func (r *Reader) readBlock(handle BlockHandle) (*Block, error) {
-	// Seek to the block position
-	_, err := r.file.Seek(int64(handle.Offset), 0)
+	if r.mapped == nil {
+		if cached, ok := r.cacheGet(handle.Offset); ok {
+			return cached.(*Block), nil
+		}
+	}
+
+	metadata, block, err := r.ReadBlock(handle)
 	if err != nil {
 		return nil, err
 	}
+	if r.mapped == nil {
+		r.cacheSet(handle.Offset, block, int64(metadata.Size))
+	}
+	return block, nil
+}
 
-	// Read block metadata
+// BlockMetadataAt reads the metadata stored in front of the block at offset
+func (r *Reader) BlockMetadataAt(offset uint64) (BlockMetadata, error) {
 	var metadata BlockMetadata
-	if err := binary.Read(r.file, binary.LittleEndian, &metadata); err != nil {
-		return nil, err
-	}
+	section := io.NewSectionReader(r.file, int64(offset), int64(binary.Size(metadata)))
+	err := binary.Read(section, binary.LittleEndian, &metadata)
+	return metadata, err
+}
 
-	// Read block data
-	data := make([]byte, metadata.Size)
-	if _, err := io.ReadFull(r.file, data); err != nil {
-		return nil, err
+// ReadBlock reads the block at handle along with the metadata stored in
+// front of it. It decodes data and range deletion blocks; it is exported for
+// tools that inspect tables block by block.
+func (r *Reader) ReadBlock(handle BlockHandle) (BlockMetadata, *Block, error) {
+	metadata, data, err := r.blockAt(handle.Offset)
+	if err != nil {
+		return metadata, nil, err
 	}
 
 	// Verify CRC
 	if calculateCRC(data) != metadata.CRC {
-		return nil, errors.New("block CRC mismatch")
+		return metadata, nil, r.corruption(int64(handle.Offset), metadata.Type, "block CRC mismatch")
 	}
 
 	// Decode the block data
-	block := &Block{}
-	buf := bytes.NewReader(data)
-
-	// Read number of entries
-	var numEntries uint32
-	if err := binary.Read(buf, binary.LittleEndian, &numEntries); err != nil {
-		return nil, err
+	if data, err = blockPayload(metadata, data); err != nil {
+		return metadata, nil, r.corruption(int64(handle.Offset), metadata.Type, err.Error())
+	}
+	entries, err := decodeBlockEntries(data)
+	if err != nil {
+		return metadata, nil, r.corruption(int64(handle.Offset), metadata.Type, err.Error())
 	}
 
-	block.entries = make([]Entry, 0, numEntries)
-
-	// Read each entry
-	for i := uint32(0); i < numEntries; i++ {
-		var keyLen uint32
-		if err := binary.Read(buf, binary.LittleEndian, &keyLen); err != nil {
-			return nil, err
-		}
+	return metadata, &Block{entries: entries}, nil
+}
 
-		key := make([]byte, keyLen)
-		if _, err := buf.Read(key); err != nil {
-			return nil, err
+// blockAt returns the metadata and the encoded data of the block at offset.
+// The data points into the mapping when the file is mapped, and is read into
+// a new buffer otherwise.
+func (r *Reader) blockAt(offset uint64) (BlockMetadata, []byte, error) {
+	var metadata BlockMetadata
+	if r.mapped == nil {
+		// Read block metadata and data at the block position without
+		// moving the shared file offset
+		section := io.NewSectionReader(r.file, int64(offset), 1<<62)
+		if err := binary.Read(section, binary.LittleEndian, &metadata); err != nil {
+			return metadata, nil, err
 		}
 
-		var valueLen uint32
-		if err := binary.Read(buf, binary.LittleEndian, &valueLen); err != nil {
-			return nil, err
+		data := make([]byte, metadata.Size)
+		if _, err := io.ReadFull(section, data); err != nil {
+			return metadata, nil, err
 		}
+		return metadata, data, nil
+	}
 
-		value := make([]byte, valueLen)
-		if _, err := buf.Read(value); err != nil {
-			return nil, err
-		}
+	size := uint64(len(r.mapped))
+	if offset > size || size-offset < blockMetadataSize {
+		return metadata, nil, io.ErrUnexpectedEOF
+	}
+	metadata = decodeBlockMetadata(r.mapped[offset:])
 
-		block.entries = append(block.entries, Entry{
-			Key:   key,
-			Value: value,
-		})
+	start := offset + blockMetadataSize
+	end := start + uint64(metadata.Size)
+	if end > size {
+		return metadata, nil, io.ErrUnexpectedEOF
 	}
+	return metadata, r.mapped[start:end:end], nil
+}
 
-	return block, nil
+// decodeBlockMetadata decodes the metadata at the start of data, laid out as
+// binary.Write writes BlockMetadata
+func decodeBlockMetadata(data []byte) BlockMetadata {
+	return BlockMetadata{
+		Type:       BlockType(data[0]),
+		CRC:        binary.LittleEndian.Uint32(data[1:5]),
+		Size:       binary.LittleEndian.Uint32(data[5:9]),
+		KeyCount:   binary.LittleEndian.Uint32(data[9:13]),
+		Compressed: data[13] != 0,
+	}
 }
 
 // searchInBlock searches for a key within a data block
@@ -275,7 +545,7 @@ func (r *Reader) searchInBlock(block *Block, key []byte) ([]byte, error) {
 
 	for left <= right {
 		mid := (left + right) / 2
-		cmp := bytes.Compare(block.entries[mid].Key, key)
+		cmp := r.cmp.Compare(block.entries[mid].Key, key)
 
 		if cmp == 0 {
 			return block.entries[mid].Value, nil
@@ -286,13 +556,21 @@ func (r *Reader) searchInBlock(block *Block, key []byte) ([]byte, error) {
 		}
 	}
 
-	return nil, errors.New("key not found")
+	return nil, ErrKeyNotFound
 }
 
-// Close closes the reader and its underlying file
+// Close closes the reader and its underlying file, releasing the mapping
+// if there is one
 func (r *Reader) Close() error {
+	var err error
+	if r.mapped != nil {
+		err = vfs.Unmap(r.mapped)
+		r.mapped = nil
+	}
 	if r.file != nil {
-		return r.file.Close()
+		if closeErr := r.file.Close(); err == nil {
+			err = closeErr
+		}
 	}
-	return nil
+	return err
 }
@@ -0,0 +1,193 @@
+package sstable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+func TestReaderMmap(t *testing.T) {
+	path := writeTestTable(t, 1000)
+
+	memFS := vfs.NewMem()
+	data, err := vfs.ReadFile(vfs.Default, path)
+	if err != nil {
+		t.Fatalf("Failed to read table: %v", err)
+	}
+	if err := vfs.WriteFile(memFS, "/test.sst", data); err != nil {
+		t.Fatalf("Failed to copy table: %v", err)
+	}
+
+	testCases := []struct {
+		name   string
+		fs     vfs.FS
+		path   string
+		opts   ReaderOptions
+		mapped bool
+	}{
+		{"pread", vfs.Default, path, ReaderOptions{}, false},
+		{"mmap", vfs.Default, path, ReaderOptions{Mmap: true}, true},
+		{"mmap fallback", memFS, "/test.sst", ReaderOptions{Mmap: true}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reader, err := NewReaderWithOptions(tc.fs, tc.path, tc.opts)
+			if err != nil {
+				t.Fatalf("Failed to create reader: %v", err)
+			}
+			defer reader.Close()
+
+			if reader.Mapped() != tc.mapped {
+				t.Errorf("Expected Mapped() %v, got %v", tc.mapped, reader.Mapped())
+			}
+
+			for _, i := range []int{0, 499, 999} {
+				value, err := reader.Get([]byte(fmt.Sprintf("key%05d", i)))
+				if err != nil || string(value) != fmt.Sprintf("value%d", i) {
+					t.Errorf("Expected value%d, got %q (err %v)", i, value, err)
+				}
+			}
+			if _, err := reader.Get([]byte("missing")); err != ErrKeyNotFound {
+				t.Errorf("Expected ErrKeyNotFound, got %v", err)
+			}
+
+			count := 0
+			it := reader.NewIterator()
+			for it.First(); it.Valid(); it.Next() {
+				count++
+			}
+			if it.Error() != nil || count != 1000 {
+				t.Errorf("Expected 1000 entries, got %d (err %v)", count, it.Error())
+			}
+		})
+	}
+}
+
+func TestReaderMmapDetectsCorruption(t *testing.T) {
+	path := writeTestTable(t, 1000)
+	corruptFile(t, path, func(data []byte) []byte {
+		data[int(blockMetadataSize)+10] ^= 0xff
+		return data
+	})
+
+	reader, err := NewReaderWithOptions(vfs.Default, path, ReaderOptions{Mmap: true})
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	_, err = reader.Get([]byte("key00000"))
+	var corruption *ErrCorruption
+	if !errors.As(err, &corruption) {
+		t.Fatalf("Expected *ErrCorruption, got %v", err)
+	}
+}
+
+func BenchmarkReaderGet(b *testing.B) {
+	path := b.TempDir() + "/bench.sst"
+	writer, err := NewFileWriter(path)
+	if err != nil {
+		b.Fatalf("Failed to create writer: %v", err)
+	}
+	const n = 100000
+	for i := 0; i < n; i++ {
+		writer.Write(fmt.Sprintf("key%08d", i), []byte(fmt.Sprintf("value%d", i)))
+	}
+	if err := writer.Close(); err != nil {
+		b.Fatalf("Failed to close writer: %v", err)
+	}
+
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap=%v", mmap), func(b *testing.B) {
+			reader, err := NewReaderWithOptions(vfs.Default, path, ReaderOptions{Mmap: mmap})
+			if err != nil {
+				b.Fatalf("Failed to create reader: %v", err)
+			}
+			defer reader.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := reader.Get([]byte(fmt.Sprintf("key%08d", i%n))); err != nil {
+					b.Fatalf("Get failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// reverseComparator orders keys from the largest to the smallest
+type reverseComparator struct{}
+
+func (reverseComparator) Compare(a, b []byte) int                 { return bytes.Compare(b, a) }
+func (reverseComparator) Name() string                            { return "test.ReverseComparator" }
+func (reverseComparator) Separator(prevLast, first []byte) []byte { return first }
+
+func TestReaderComparator(t *testing.T) {
+	path := t.TempDir() + "/test.sst"
+	writer, err := NewFileWriterWithOptions(vfs.Default, path, WriterOptions{Comparator: reverseComparator{}})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	const n = 1000
+	for i := n - 1; i >= 0; i-- {
+		if err := writer.Write(fmt.Sprintf("key%05d", i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("Failed to write entry %d: %v", i, err)
+		}
+	}
+	if err := writer.Write("key99999", nil); err != ErrKeyOrder {
+		t.Errorf("Expected ErrKeyOrder for a key out of order, got %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	if _, err := NewReader(path); !errors.Is(err, ErrComparatorMismatch) {
+		t.Fatalf("Expected ErrComparatorMismatch opening with the default comparator, got %v", err)
+	}
+
+	reader, err := NewReaderWithOptions(vfs.Default, path, ReaderOptions{Comparator: reverseComparator{}})
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	if name := reader.Properties().Comparator; name != "test.ReverseComparator" {
+		t.Errorf("Expected the comparator name to be recorded, got %q", name)
+	}
+	for _, i := range []int{0, 500, n - 1} {
+		value, err := reader.Get([]byte(fmt.Sprintf("key%05d", i)))
+		if err != nil || string(value) != fmt.Sprintf("value%d", i) {
+			t.Errorf("Expected value%d, got %q (err %v)", i, value, err)
+		}
+	}
+
+	it := reader.NewIterator()
+	it.SeekGE([]byte("key00500x"))
+	if !it.Valid() || string(it.Key()) != "key00500" {
+		t.Errorf("Expected SeekGE to land on key00500, got %q", it.Key())
+	}
+
+	report, err := VerifyWithOptions(vfs.Default, path, VerifyOptions{Comparator: reverseComparator{}})
+	if err != nil || !report.OK() || report.Entries != n {
+		t.Errorf("Expected an intact table of %d entries, got %d entries (err %v, corruption %v)", n, report.Entries, err, report.Err())
+	}
+
+	// Without the comparator, the properties still name it and the table
+	// verifies when key order is not checked
+	props, err := ReadProperties(vfs.Default, path)
+	if err != nil || props.Comparator != "test.ReverseComparator" {
+		t.Errorf("Expected ReadProperties to return the comparator name, got %+v (err %v)", props, err)
+	}
+	if report, err := Verify(path); err != nil || report.OK() {
+		t.Errorf("Expected key order corruption with the default comparator (err %v)", err)
+	}
+	report, err = VerifyWithOptions(vfs.Default, path, VerifyOptions{SkipKeyOrder: true})
+	if err != nil || !report.OK() || report.Entries != n {
+		t.Errorf("Expected an intact table of %d entries without key order checks, got %d entries (err %v, corruption %v)", n, report.Entries, err, report.Err())
+	}
+}
@@ -0,0 +1,138 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+// SalvageReport describes what Salvage read from a table and what it had to
+// skip
+type SalvageReport struct {
+	File           string
+	Blocks         int // Intact blocks found
+	Entries        int // Entries passed on from intact data blocks
+	RangeDeletions int // Entries passed on from intact range deletion blocks
+	Lost           []*ErrCorruption
+	LostBytes      uint64
+}
+
+// OK reports whether the whole table was read
+func (r *SalvageReport) OK() bool {
+	return len(r.Lost) == 0
+}
+
+// Salvage reads the intact blocks of the table at path in file order and
+// passes the entries of every data and range deletion block to fn. It does
+// not trust the index: blocks are found through the BlockMetadata header in
+// front of each of them. When a block fails its checks, Salvage moves
+// forward byte by byte until it finds a header whose block passes them, and
+// records the skipped region as lost.
+//
+// The table is read into memory in full, so Salvage is meant for offline
+// repair rather than for serving reads.
+func Salvage(path string, fn func(kind BlockType, entries []Entry) error) (*SalvageReport, error) {
+	return SalvageFS(vfs.Default, path, fn)
+}
+
+// SalvageFS is like Salvage, reading the file from fs
+func SalvageFS(fs vfs.FS, path string, fn func(kind BlockType, entries []Entry) error) (*SalvageReport, error) {
+	data, err := vfs.ReadFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	report := &SalvageReport{File: path}
+
+	// Blocks end where the footer starts. Without a usable footer the whole
+	// file is scanned.
+	end := uint64(len(data))
+	footer, err := DecodeFooter(data)
+	if err == nil && footer.MagicNumber == MagicNumber && uint64(footer.Size()) <= end {
+		end -= uint64(footer.Size())
+	} else {
+		report.lose(path, 0, FooterKind, 0, "footer unreadable, scanning the whole file")
+	}
+
+	offset := uint64(0)
+	lostStart, lostKind, losing := uint64(0), "", false
+	for offset < end {
+		metadata, entries, ok := salvageBlock(data[:end], offset)
+		if !ok {
+			if !losing {
+				lostStart, lostKind, losing = offset, metadata.Type.String(), true
+			}
+			offset++
+			continue
+		}
+
+		if losing {
+			report.lose(path, lostStart, lostKind, offset-lostStart, fmt.Sprintf("skipped %d damaged bytes", offset-lostStart))
+			losing = false
+		}
+		report.Blocks++
+
+		switch metadata.Type {
+		case DataBlock:
+			report.Entries += len(entries)
+		case RangeDelBlock:
+			report.RangeDeletions += len(entries)
+		}
+		if metadata.Type == DataBlock || metadata.Type == RangeDelBlock {
+			if err := fn(metadata.Type, entries); err != nil {
+				return report, err
+			}
+		}
+		offset += blockMetadataSize + uint64(metadata.Size)
+	}
+
+	if losing {
+		report.lose(path, lostStart, lostKind, end-lostStart, fmt.Sprintf("skipped %d damaged bytes", end-lostStart))
+	}
+	return report, nil
+}
+
+func (r *SalvageReport) lose(file string, offset uint64, kind string, size uint64, reason string) {
+	r.Lost = append(r.Lost, &ErrCorruption{File: file, Offset: int64(offset), BlockKind: kind, Reason: reason})
+	r.LostBytes += size
+}
+
+// salvageBlock decodes the block at offset if its header is plausible and
+// its data passes the CRC and decoding checks. Index blocks are checked but
+// their entries are not returned.
+func salvageBlock(data []byte, offset uint64) (BlockMetadata, []Entry, bool) {
+	var metadata BlockMetadata
+	if offset+blockMetadataSize > uint64(len(data)) {
+		return metadata, nil, false
+	}
+	if err := binary.Read(bytes.NewReader(data[offset:offset+blockMetadataSize]), binary.LittleEndian, &metadata); err != nil {
+		return metadata, nil, false
+	}
+	if metadata.Type > TopIndexBlock {
+		return metadata, nil, false
+	}
+
+	start := offset + blockMetadataSize
+	if start+uint64(metadata.Size) > uint64(len(data)) {
+		return metadata, nil, false
+	}
+	payload := data[start : start+uint64(metadata.Size)]
+	if calculateCRC(payload) != metadata.CRC {
+		return metadata, nil, false
+	}
+
+	if metadata.Type == IndexBlock || metadata.Type == TopIndexBlock {
+		indexEntries, err := decodeIndexEntries(payload)
+		return metadata, nil, err == nil && int(metadata.KeyCount) == len(indexEntries)
+	}
+	payload, err := blockPayload(metadata, payload)
+	if err != nil {
+		return metadata, nil, false
+	}
+	entries, err := decodeBlockEntries(payload)
+	if err != nil || int(metadata.KeyCount) != len(entries) {
+		return metadata, nil, false
+	}
+	return metadata, entries, true
+}
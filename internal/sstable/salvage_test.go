@@ -0,0 +1,86 @@
+package sstable
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSalvageSkipsDamagedBlock(t *testing.T) {
+	const n = 1000
+	path := writeTestTable(t, n)
+
+	reader, err := NewReader(path)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	damaged := reader.indexBlock.entries[1].BlockHandle.Offset
+	_, block, err := reader.ReadBlock(reader.indexBlock.entries[1].BlockHandle)
+	if err != nil {
+		t.Fatalf("Failed to read block: %v", err)
+	}
+	damagedKeys := len(block.Entries())
+	reader.Close()
+
+	corruptFile(t, path, func(data []byte) []byte {
+		data[damaged+blockMetadataSize+20] ^= 0xff
+		return data
+	})
+
+	var keys []string
+	report, err := Salvage(path, func(kind BlockType, entries []Entry) error {
+		if kind != DataBlock {
+			t.Errorf("Expected only data blocks, got %s", kind)
+		}
+		for _, e := range entries {
+			keys = append(keys, string(e.Key))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to salvage table: %v", err)
+	}
+
+	if len(report.Lost) != 1 {
+		t.Fatalf("Expected 1 lost region, got %d", len(report.Lost))
+	}
+	if report.Lost[0].Offset != int64(damaged) || report.Lost[0].BlockKind != "data" {
+		t.Errorf("Expected lost data block at offset %d, got %s block at %d", damaged, report.Lost[0].BlockKind, report.Lost[0].Offset)
+	}
+	if len(keys) != n-damagedKeys || report.Entries != len(keys) {
+		t.Fatalf("Expected %d salvaged keys, got %d (reported %d)", n-damagedKeys, len(keys), report.Entries)
+	}
+
+	// The keys of the other blocks are all there, in order
+	want := 0
+	for _, key := range keys {
+		if want == 0 && key != "key00000" {
+			t.Fatalf("Expected first key key00000, got %s", key)
+		}
+		if key != fmt.Sprintf("key%05d", want) {
+			want += damagedKeys
+		}
+		if key != fmt.Sprintf("key%05d", want) {
+			t.Fatalf("Expected key%05d, got %s", want, key)
+		}
+		want++
+	}
+}
+
+func TestSalvageIntactTable(t *testing.T) {
+	path := writeTestTable(t, 100)
+
+	count := 0
+	report, err := Salvage(path, func(kind BlockType, entries []Entry) error {
+		count += len(entries)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to salvage table: %v", err)
+	}
+	if !report.OK() {
+		t.Errorf("Expected nothing lost, got %v", report.Lost[0])
+	}
+	if count != 100 {
+		t.Errorf("Expected 100 entries, got %d", count)
+	}
+}
@@ -7,20 +7,45 @@ package sstable
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"hash/crc32"
 )
 
 // BlockType represents different types of blocks in SSTable.
-// An SSTable file contains two types of blocks:
+// An SSTable file contains the following types of blocks:
 // - Data blocks: Store actual key-value pairs
 // - Index blocks: Store index entries pointing to data blocks
+// - Range deletion blocks: Store range tombstones, keyed by start key
+// - Properties blocks: Store table properties, keyed by property name
+// - Top-level index blocks: Store entries pointing to index partitions
 type BlockType uint8
 
 const (
 	DataBlock BlockType = iota
 	IndexBlock
+	RangeDelBlock
+	PropertiesBlock
+	TopIndexBlock
 )
 
+// String returns the name of the block type
+func (t BlockType) String() string {
+	switch t {
+	case DataBlock:
+		return "data"
+	case IndexBlock:
+		return "index"
+	case RangeDelBlock:
+		return "range-del"
+	case PropertiesBlock:
+		return "properties"
+	case TopIndexBlock:
+		return "top-index"
+	default:
+		return "unknown"
+	}
+}
+
 // CompressionType represents the compression algorithm used
 type CompressionType uint8
 
@@ -30,6 +55,20 @@ const (
 	LZ4Compression
 )
 
+// String returns the name of the compression algorithm
+func (c CompressionType) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case SnappyCompression:
+		return "snappy"
+	case LZ4Compression:
+		return "lz4"
+	default:
+		return "unknown"
+	}
+}
+
 // BlockMetadata contains metadata for each block in the SSTable.
 // This metadata is stored before each block in the file and includes:
 // - Type: Whether it's a data block or index block
@@ -62,6 +101,14 @@ type BlockHandle struct {
 // - Version: SSTable format version
 // - CreatedAt: Timestamp when the file was created
 // - CompressionType: Compression algorithm used (if any)
+// - RangeDelHandle: Location of the range deletion block (version 2+, if present)
+// - PropertiesHandle: Location of the properties block (version 2+, if present)
+//
+// Version 1 footers are FooterSize bytes. From version 2 on, an extension
+// holding the newer handles is placed in front of the version 1 layout, so
+// the last FooterSize bytes of every table can be decoded the same way:
+//
+//	[extension (FooterSize bytes)][base footer (FooterSize bytes)]
 type Footer struct {
 	IndexHandle     BlockHandle
 	FilterHandle    BlockHandle
@@ -69,22 +116,73 @@ type Footer struct {
 	Version         uint32
 	CreatedAt       int64 // Changed from time.Time to int64 (Unix timestamp)
 	CompressionType CompressionType
+
+	// Extension, version 2 and later. Handles added to the extension take
+	// its zero padding, so they read as absent in older tables.
+	RangeDelHandle   BlockHandle
+	PropertiesHandle BlockHandle
 }
 
-// EncodeFooter serializes the footer to bytes
+// Size returns the encoded size of the footer, which depends on its version
+func (f *Footer) Size() int {
+	if f.Version >= 2 {
+		return ExtendedFooterSize
+	}
+	return FooterSize
+}
+
+// EncodeFooter serializes the footer to bytes, padded to Size
 func (f *Footer) Encode() []byte {
 	buf := new(bytes.Buffer)
+	if f.Version >= 2 {
+		binary.Write(buf, binary.LittleEndian, f.RangeDelHandle)
+		binary.Write(buf, binary.LittleEndian, f.PropertiesHandle)
+		buf.Write(make([]byte, FooterSize-buf.Len()))
+	}
+
 	binary.Write(buf, binary.LittleEndian, f.IndexHandle)
 	binary.Write(buf, binary.LittleEndian, f.FilterHandle)
 	binary.Write(buf, binary.LittleEndian, f.MagicNumber)
 	binary.Write(buf, binary.LittleEndian, f.Version)
 	binary.Write(buf, binary.LittleEndian, f.CreatedAt)
 	binary.Write(buf, binary.LittleEndian, f.CompressionType)
+	buf.Write(make([]byte, f.Size()-buf.Len()))
 	return buf.Bytes()
 }
 
-// DecodeFooter deserializes bytes into a Footer
+// DecodeFooter deserializes the footer from the tail of a table. data must
+// hold at least the last FooterSize bytes of the file, and the last
+// ExtendedFooterSize bytes for version 2 and later tables.
 func DecodeFooter(data []byte) (*Footer, error) {
+	if len(data) < FooterSize {
+		return nil, errors.New("footer too short")
+	}
+	base := data[len(data)-FooterSize:]
+
+	footer, err := decodeBaseFooter(base)
+	if err != nil {
+		return nil, err
+	}
+	if footer.Version < 2 {
+		return footer, nil
+	}
+
+	if len(data) < ExtendedFooterSize {
+		return nil, errors.New("footer extension missing")
+	}
+	ext := bytes.NewReader(data[len(data)-ExtendedFooterSize:])
+	if err := binary.Read(ext, binary.LittleEndian, &footer.RangeDelHandle); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(ext, binary.LittleEndian, &footer.PropertiesHandle); err != nil {
+		return nil, err
+	}
+
+	return footer, nil
+}
+
+// decodeBaseFooter decodes the version 1 footer layout
+func decodeBaseFooter(data []byte) (*Footer, error) {
 	buf := bytes.NewReader(data)
 	footer := &Footer{}
 
@@ -112,10 +210,12 @@ func DecodeFooter(data []byte) (*Footer, error) {
 
 const (
 	// Various constants for SSTable
-	MagicNumber    = 0x8773537461626c65 // "SSTable" in hex
-	CurrentVersion = 1
-	BlockSize      = 4 * 1024 // 4KB default block size
-	FooterSize     = 64       // BlockHandle (16) + BlockHandle (16) + uint64 (8) + uint32 (4) + int64 (8) + uint8 (1) = 53, padded to 64
+	FilePrefix         = "sst_"             // Prefix of SSTable file names
+	MagicNumber        = 0x8773537461626c65 // "SSTable" in hex
+	CurrentVersion     = 2
+	BlockSize          = 4 * 1024       // 4KB default block size
+	FooterSize         = 64             // BlockHandle (16) + BlockHandle (16) + uint64 (8) + uint32 (4) + int64 (8) + uint8 (1) = 53, padded to 64
+	ExtendedFooterSize = 2 * FooterSize // Extension (2 BlockHandles (32), padded to 64) + base footer
 )
 
 // calculateCRC calculates CRC32 checksum for data
@@ -0,0 +1,463 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/vikramcse/go-lsm/internal/kv"
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+// FooterKind is the BlockKind of corruption found in the footer, which is
+// not a block of its own
+const FooterKind = "footer"
+
+// ErrCorruption reports damage found in an SSTable file. It is returned by
+// Reader when a block fails its checks, and collected by Verify.
+type ErrCorruption struct {
+	File      string // Path of the damaged table
+	Offset    int64  // Offset of the damaged block, or of the footer
+	BlockKind string // Name of the BlockType, or FooterKind
+	Reason    string // What is wrong
+}
+
+func (e *ErrCorruption) Error() string {
+	if e.BlockKind == FooterKind {
+		return fmt.Sprintf("sstable %s: corrupt footer at offset %d: %s", e.File, e.Offset, e.Reason)
+	}
+	return fmt.Sprintf("sstable %s: corrupt %s block at offset %d: %s", e.File, e.BlockKind, e.Offset, e.Reason)
+}
+
+// VerifyReport is the result of verifying an SSTable file
+type VerifyReport struct {
+	File           string
+	Footer         *Footer // nil when the footer could not be decoded
+	DataBlocks     int     // Number of data blocks that passed their checks
+	Entries        int     // Number of entries in those blocks
+	RangeDeletions int
+	Corruptions    []*ErrCorruption
+}
+
+// OK reports whether no corruption was found
+func (r *VerifyReport) OK() bool {
+	return len(r.Corruptions) == 0
+}
+
+// Err returns the first corruption found, or nil
+func (r *VerifyReport) Err() error {
+	if r.OK() {
+		return nil
+	}
+	return r.Corruptions[0]
+}
+
+// Verify checks every block of the SSTable at path: the footer is checked
+// for sanity, every block for its type and CRC, keys for ordering within and
+// across data blocks, and the index for pointing at consecutive data blocks
+// with keys that separate each block from the previous one, and the
+// properties for matching the blocks.
+// Damage is collected in the report rather than stopping at the first
+// problem; the returned error is only set when the file cannot be read at
+// all.
+func Verify(path string) (*VerifyReport, error) {
+	return VerifyFS(vfs.Default, path)
+}
+
+// VerifyFS is like Verify, reading the file from fs
+func VerifyFS(fs vfs.FS, path string) (*VerifyReport, error) {
+	return VerifyWithOptions(fs, path, VerifyOptions{})
+}
+
+// VerifyOptions configures Verify
+type VerifyOptions struct {
+	// Comparator is the comparator the table was written with, used to
+	// check the order of its keys. kv.Bytewise if nil.
+	Comparator kv.Comparator
+
+	// SkipKeyOrder leaves out the checks of key order, for tables whose
+	// comparator is not available
+	SkipKeyOrder bool
+}
+
+// VerifyWithOptions is like VerifyFS, configured by opts
+func VerifyWithOptions(fs vfs.FS, path string, opts VerifyOptions) (*VerifyReport, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	v := &verifier{
+		file:       file,
+		size:       uint64(info.Size()),
+		cmp:        kv.Bytewise,
+		checkOrder: !opts.SkipKeyOrder,
+		report:     &VerifyReport{File: path},
+	}
+	if opts.Comparator != nil {
+		v.cmp = opts.Comparator
+	}
+	if !v.verifyFooter() {
+		return v.report, nil
+	}
+	index, indexOK := v.verifyIndex()
+	if !v.verifyMetaHandles() {
+		return v.report, nil
+	}
+
+	footer := v.report.Footer
+	dataEnd := v.indexStart
+	if footer.PropertiesHandle.Size > 0 {
+		dataEnd = footer.PropertiesHandle.Offset
+	}
+	if footer.RangeDelHandle.Size > 0 {
+		dataEnd = footer.RangeDelHandle.Offset
+		v.verifyRangeDeletions()
+	}
+	if indexOK {
+		v.verifyDataBlocks(index, dataEnd)
+	}
+	if footer.PropertiesHandle.Size > 0 {
+		v.verifyProperties()
+	}
+
+	return v.report, nil
+}
+
+// verifier holds the state of a single Verify call
+type verifier struct {
+	file       vfs.File
+	size       uint64
+	cmp        kv.Comparator
+	checkOrder bool // whether keys are checked to be ordered by cmp
+	report     *VerifyReport
+	indexStart uint64 // offset of the first block of the index
+}
+
+var blockMetadataSize = uint64(binary.Size(BlockMetadata{}))
+
+func (v *verifier) corrupt(offset uint64, kind string, format string, args ...interface{}) {
+	v.report.Corruptions = append(v.report.Corruptions, &ErrCorruption{
+		File:      v.report.File,
+		Offset:    int64(offset),
+		BlockKind: kind,
+		Reason:    fmt.Sprintf(format, args...),
+	})
+}
+
+// verifyFooter decodes and checks the footer. It returns false when the
+// handles in the footer cannot be used to verify the rest of the file.
+func (v *verifier) verifyFooter() bool {
+	if v.size < FooterSize {
+		v.corrupt(0, FooterKind, "file too short: %d bytes", v.size)
+		return false
+	}
+
+	tailSize := uint64(ExtendedFooterSize)
+	if v.size < tailSize {
+		tailSize = v.size
+	}
+	tail := make([]byte, tailSize)
+	if _, err := v.file.ReadAt(tail, int64(v.size-tailSize)); err != nil {
+		v.corrupt(v.size-tailSize, FooterKind, "read failed: %v", err)
+		return false
+	}
+
+	footer, err := DecodeFooter(tail)
+	if err != nil {
+		v.corrupt(v.size-tailSize, FooterKind, "%v", err)
+		return false
+	}
+	footerStart := v.size - uint64(footer.Size())
+	if footer.MagicNumber != MagicNumber {
+		v.corrupt(footerStart, FooterKind, "wrong magic number %#x", footer.MagicNumber)
+		return false
+	}
+	if footer.Version == 0 || footer.Version > CurrentVersion {
+		v.corrupt(footerStart, FooterKind, "unsupported version %d", footer.Version)
+		return false
+	}
+	v.report.Footer = footer
+
+	if footer.CompressionType > LZ4Compression {
+		v.corrupt(footerStart, FooterKind, "unknown compression type %d", footer.CompressionType)
+	}
+
+	// The index block, or the top-level index of a partitioned index, is
+	// the last block
+	index := footer.IndexHandle
+	if index.Offset+blockMetadataSize+index.Size != footerStart {
+		v.corrupt(footerStart, FooterKind, "index handle (offset %d, size %d) does not end at the footer", index.Offset, index.Size)
+		return false
+	}
+	v.indexStart = index.Offset
+
+	return true
+}
+
+// verifyMetaHandles checks that the properties block and the range deletion
+// block, when present, come right before the index in that order. It returns
+// false when their handles cannot be used to verify the rest of the file.
+func (v *verifier) verifyMetaHandles() bool {
+	footer := v.report.Footer
+	footerStart := v.size - uint64(footer.Size())
+	next := v.indexStart
+	props := footer.PropertiesHandle
+	if props.Size > 0 {
+		if props.Offset+blockMetadataSize+props.Size != next {
+			v.corrupt(footerStart, FooterKind, "properties handle (offset %d, size %d) does not end at the index", props.Offset, props.Size)
+			return false
+		}
+		next = props.Offset
+	}
+	rangeDel := footer.RangeDelHandle
+	if rangeDel.Size > 0 && rangeDel.Offset+blockMetadataSize+rangeDel.Size != next {
+		v.corrupt(footerStart, FooterKind, "range deletion handle (offset %d, size %d) does not end at the next block", rangeDel.Offset, rangeDel.Size)
+		return false
+	}
+
+	return true
+}
+
+// readBlock reads the block of kind at offset, which must end at or before
+// limit, and checks its metadata and CRC
+func (v *verifier) readBlock(offset uint64, kind BlockType, limit uint64) (BlockMetadata, []byte, bool) {
+	var metadata BlockMetadata
+	if offset+blockMetadataSize > limit {
+		v.corrupt(offset, kind.String(), "block metadata exceeds its region ending at %d", limit)
+		return metadata, nil, false
+	}
+
+	section := io.NewSectionReader(v.file, int64(offset), int64(limit-offset))
+	if err := binary.Read(section, binary.LittleEndian, &metadata); err != nil {
+		v.corrupt(offset, kind.String(), "read failed: %v", err)
+		return metadata, nil, false
+	}
+	if metadata.Type != kind {
+		v.corrupt(offset, kind.String(), "block type is %s", metadata.Type)
+		return metadata, nil, false
+	}
+	if offset+blockMetadataSize+uint64(metadata.Size) > limit {
+		v.corrupt(offset, kind.String(), "block size %d exceeds its region ending at %d", metadata.Size, limit)
+		return metadata, nil, false
+	}
+
+	data := make([]byte, metadata.Size)
+	if _, err := io.ReadFull(section, data); err != nil {
+		v.corrupt(offset, kind.String(), "read failed: %v", err)
+		return metadata, nil, false
+	}
+	if calculateCRC(data) != metadata.CRC {
+		v.corrupt(offset, kind.String(), "block CRC mismatch")
+		return metadata, nil, false
+	}
+
+	return metadata, data, true
+}
+
+// verifyIndex checks the index and returns its entries, one per data block.
+// The partitions of a partitioned index must follow each other up to the
+// top-level index, and start with the keys the top-level index holds.
+func (v *verifier) verifyIndex() ([]IndexEntry, bool) {
+	footer := v.report.Footer
+	offset := footer.IndexHandle.Offset
+	kind := IndexBlock
+	var blockType [1]byte
+	if _, err := v.file.ReadAt(blockType[:], int64(offset)); err == nil && BlockType(blockType[0]) == TopIndexBlock {
+		kind = TopIndexBlock
+	}
+
+	top, ok := v.verifyIndexBlock(offset, kind, v.size-uint64(footer.Size()))
+	if !ok || kind == IndexBlock {
+		return top, ok
+	}
+	if len(top) == 0 {
+		return nil, true
+	}
+
+	var entries []IndexEntry
+	expected := top[0].BlockHandle.Offset
+	for i, partition := range top {
+		handle := partition.BlockHandle
+		if handle.Offset != expected {
+			v.corrupt(offset, kind.String(), "partition %d at offset %d, previous partition ends at %d", i, handle.Offset, expected)
+			return nil, false
+		}
+		partEntries, ok := v.verifyIndexBlock(handle.Offset, IndexBlock, offset)
+		if !ok {
+			return nil, false
+		}
+		if len(partEntries) == 0 || !bytes.Equal(partEntries[0].Key, partition.Key) {
+			v.corrupt(handle.Offset, IndexBlock.String(), "partition does not start with its top-level key %q", partition.Key)
+		}
+		if len(entries) > 0 && len(partEntries) > 0 && v.checkOrder && v.cmp.Compare(entries[len(entries)-1].Key, partEntries[0].Key) >= 0 {
+			v.corrupt(handle.Offset, IndexBlock.String(), "first key %q is not greater than the last key of the previous partition", partEntries[0].Key)
+		}
+		entries = append(entries, partEntries...)
+		expected = handle.Offset + blockMetadataSize + handle.Size
+	}
+	if expected != offset {
+		v.corrupt(expected, IndexBlock.String(), "index partitions end at offset %d, expected %d", expected, offset)
+		return nil, false
+	}
+
+	v.indexStart = top[0].BlockHandle.Offset
+	return entries, true
+}
+
+// verifyIndexBlock checks the index block of kind at offset, which must end
+// at or before limit, and returns its entries
+func (v *verifier) verifyIndexBlock(offset uint64, kind BlockType, limit uint64) ([]IndexEntry, bool) {
+	metadata, data, ok := v.readBlock(offset, kind, limit)
+	if !ok {
+		return nil, false
+	}
+
+	entries, err := decodeIndexEntries(data)
+	if err != nil {
+		v.corrupt(offset, kind.String(), "%v", err)
+		return nil, false
+	}
+	if int(metadata.KeyCount) != len(entries) {
+		v.corrupt(offset, kind.String(), "metadata key count %d, block holds %d entries", metadata.KeyCount, len(entries))
+	}
+	for i := 1; i < len(entries); i++ {
+		if v.checkOrder && v.cmp.Compare(entries[i-1].Key, entries[i].Key) >= 0 {
+			v.corrupt(offset, kind.String(), "index key %d %q is not greater than the previous key %q", i, entries[i].Key, entries[i-1].Key)
+		}
+	}
+
+	return entries, true
+}
+
+// verifyDataBlocks checks the data blocks referenced by index, which must
+// follow each other from the start of the file up to dataEnd
+func (v *verifier) verifyDataBlocks(index []IndexEntry, dataEnd uint64) {
+	var prevLast []byte
+	expected, known := uint64(0), true
+
+	for i, entry := range index {
+		offset := entry.BlockHandle.Offset
+		if known && offset != expected {
+			v.corrupt(offset, DataBlock.String(), "index entry %d points at offset %d, previous block ends at %d", i, offset, expected)
+		}
+
+		// Resynchronize on the index after a damaged block
+		metadata, data, ok := v.readBlock(offset, DataBlock, dataEnd)
+		if !ok {
+			known, prevLast = false, nil
+			continue
+		}
+		expected, known = offset+blockMetadataSize+uint64(metadata.Size), true
+
+		data, err := blockPayload(metadata, data)
+		if err != nil {
+			v.corrupt(offset, DataBlock.String(), "%v", err)
+			prevLast = nil
+			continue
+		}
+		entries, err := decodeBlockEntries(data)
+		if err != nil {
+			v.corrupt(offset, DataBlock.String(), "%v", err)
+			prevLast = nil
+			continue
+		}
+		if len(entries) == 0 {
+			v.corrupt(offset, DataBlock.String(), "empty data block")
+			continue
+		}
+		if int(metadata.KeyCount) != len(entries) {
+			v.corrupt(offset, DataBlock.String(), "metadata key count %d, block holds %d entries", metadata.KeyCount, len(entries))
+		}
+
+		first := entries[0].Key
+		if prevLast != nil && v.checkOrder && v.cmp.Compare(prevLast, first) >= 0 {
+			v.corrupt(offset, DataBlock.String(), "first key %q is not greater than the last key %q of the previous block", first, prevLast)
+		}
+		// The index key separates the block from the previous one
+		if v.checkOrder && v.cmp.Compare(entry.Key, first) > 0 {
+			v.corrupt(offset, DataBlock.String(), "index key %q is greater than the first key %q", entry.Key, first)
+		}
+		if prevLast != nil && v.checkOrder && v.cmp.Compare(entry.Key, prevLast) <= 0 {
+			v.corrupt(offset, DataBlock.String(), "index key %q is not greater than the last key %q of the previous block", entry.Key, prevLast)
+		}
+		for j := 1; j < len(entries); j++ {
+			if v.checkOrder && v.cmp.Compare(entries[j-1].Key, entries[j].Key) >= 0 {
+				v.corrupt(offset, DataBlock.String(), "key %d %q is not greater than the previous key %q", j, entries[j].Key, entries[j-1].Key)
+			}
+		}
+
+		v.report.DataBlocks++
+		v.report.Entries += len(entries)
+		prevLast = entries[len(entries)-1].Key
+	}
+
+	if known && expected != dataEnd {
+		v.corrupt(expected, DataBlock.String(), "data blocks end at offset %d, expected %d", expected, dataEnd)
+	}
+}
+
+// verifyRangeDeletions checks the range deletion block
+func (v *verifier) verifyRangeDeletions() {
+	footer := v.report.Footer
+	offset := footer.RangeDelHandle.Offset
+	limit := v.indexStart
+	if footer.PropertiesHandle.Size > 0 {
+		limit = footer.PropertiesHandle.Offset
+	}
+	metadata, data, ok := v.readBlock(offset, RangeDelBlock, limit)
+	if !ok {
+		return
+	}
+
+	entries, err := decodeBlockEntries(data)
+	if err != nil {
+		v.corrupt(offset, RangeDelBlock.String(), "%v", err)
+		return
+	}
+	if int(metadata.KeyCount) != len(entries) {
+		v.corrupt(offset, RangeDelBlock.String(), "metadata key count %d, block holds %d entries", metadata.KeyCount, len(entries))
+	}
+	v.report.RangeDeletions = len(entries)
+}
+
+// verifyProperties checks the properties block, and that its counts match
+// the blocks when those were all intact
+func (v *verifier) verifyProperties() {
+	footer := v.report.Footer
+	offset := footer.PropertiesHandle.Offset
+	_, data, ok := v.readBlock(offset, PropertiesBlock, v.indexStart)
+	if !ok {
+		return
+	}
+
+	var props *Properties
+	entries, err := decodeBlockEntries(data)
+	if err == nil {
+		props, err = decodeProperties(entries)
+	}
+	if err != nil {
+		v.corrupt(offset, PropertiesBlock.String(), "%v", err)
+		return
+	}
+	if !v.report.OK() {
+		return
+	}
+
+	if props.NumEntries != uint64(v.report.Entries) {
+		v.corrupt(offset, PropertiesBlock.String(), "%d entries recorded, data blocks hold %d", props.NumEntries, v.report.Entries)
+	}
+	if props.NumDataBlocks != uint64(v.report.DataBlocks) {
+		v.corrupt(offset, PropertiesBlock.String(), "%d data blocks recorded, index holds %d", props.NumDataBlocks, v.report.DataBlocks)
+	}
+	if props.NumRangeDeletions != uint64(v.report.RangeDeletions) {
+		v.corrupt(offset, PropertiesBlock.String(), "%d range deletions recorded, block holds %d", props.NumRangeDeletions, v.report.RangeDeletions)
+	}
+}
@@ -0,0 +1,153 @@
+package sstable
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// corruptFile applies damage to the file at path
+func corruptFile(t *testing.T, path string, damage func(data []byte) []byte) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read table: %v", err)
+	}
+	if err := os.WriteFile(path, damage(data), 0644); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
+}
+
+func TestVerifyIntactTable(t *testing.T) {
+	path := writeTestTable(t, 1000)
+
+	report, err := Verify(path)
+	if err != nil {
+		t.Fatalf("Failed to verify table: %v", err)
+	}
+	if !report.OK() {
+		t.Fatalf("Expected no corruption, got %v", report.Err())
+	}
+	if report.Entries != 1000 {
+		t.Errorf("Expected 1000 entries, got %d", report.Entries)
+	}
+	if report.DataBlocks < 2 {
+		t.Errorf("Expected several data blocks, got %d", report.DataBlocks)
+	}
+}
+
+func TestVerifyDetectsCorruption(t *testing.T) {
+	testCases := []struct {
+		name   string
+		damage func(data []byte, r *Reader) []byte
+		kind   string
+		offset func(r *Reader) int64 // nil when the offset is not checked
+	}{
+		{
+			name: "data block CRC",
+			damage: func(data []byte, r *Reader) []byte {
+				data[int(blockMetadataSize)+10] ^= 0xff
+				return data
+			},
+			kind:   "data",
+			offset: func(r *Reader) int64 { return 0 },
+		},
+		{
+			name: "data block type",
+			damage: func(data []byte, r *Reader) []byte {
+				data[r.indexBlock.entries[1].BlockHandle.Offset] = byte(IndexBlock)
+				return data
+			},
+			kind:   "data",
+			offset: func(r *Reader) int64 { return int64(r.indexBlock.entries[1].BlockHandle.Offset) },
+		},
+		{
+			name: "index block CRC",
+			damage: func(data []byte, r *Reader) []byte {
+				data[len(data)-ExtendedFooterSize-1] ^= 0xff
+				return data
+			},
+			kind:   "index",
+			offset: func(r *Reader) int64 { return int64(r.Footer().IndexHandle.Offset) },
+		},
+		{
+			name: "magic number",
+			damage: func(data []byte, r *Reader) []byte {
+				data[len(data)-FooterSize+32] ^= 0xff
+				return data
+			},
+			kind: FooterKind,
+		},
+		{
+			name: "truncated",
+			damage: func(data []byte, r *Reader) []byte {
+				return data[:len(data)-100]
+			},
+			kind: FooterKind,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeTestTable(t, 1000)
+
+			// Locate the damage using the intact table
+			reader, err := NewReader(path)
+			if err != nil {
+				t.Fatalf("Failed to create reader: %v", err)
+			}
+			var offset int64
+			if tc.offset != nil {
+				offset = tc.offset(reader)
+			}
+			corruptFile(t, path, func(data []byte) []byte { return tc.damage(data, reader) })
+			reader.Close()
+
+			report, err := Verify(path)
+			if err != nil {
+				t.Fatalf("Failed to verify table: %v", err)
+			}
+			if report.OK() {
+				t.Fatalf("Expected corruption to be reported")
+			}
+
+			var corruption *ErrCorruption
+			if !errors.As(report.Err(), &corruption) {
+				t.Fatalf("Expected *ErrCorruption, got %T", report.Err())
+			}
+			if corruption.File != path {
+				t.Errorf("Expected file %s, got %s", path, corruption.File)
+			}
+			if corruption.BlockKind != tc.kind {
+				t.Errorf("Expected %s corruption, got %s: %v", tc.kind, corruption.BlockKind, corruption)
+			}
+			if tc.offset != nil && corruption.Offset != offset {
+				t.Errorf("Expected offset %d, got %d", offset, corruption.Offset)
+			}
+		})
+	}
+}
+
+func TestReaderReturnsErrCorruption(t *testing.T) {
+	path := writeTestTable(t, 1000)
+	corruptFile(t, path, func(data []byte) []byte {
+		data[int(blockMetadataSize)+10] ^= 0xff
+		return data
+	})
+
+	reader, err := NewReader(path)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	_, err = reader.Get([]byte("key00000"))
+	var corruption *ErrCorruption
+	if !errors.As(err, &corruption) {
+		t.Fatalf("Expected *ErrCorruption, got %v", err)
+	}
+	if corruption.BlockKind != "data" || corruption.Offset != 0 {
+		t.Errorf("Expected data block at offset 0, got %s block at offset %d", corruption.BlockKind, corruption.Offset)
+	}
+}
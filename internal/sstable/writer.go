@@ -8,45 +8,134 @@ import (
 	"bufio"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
-	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
-	golsm "github.com/vikramcse/go-lsm"
+	"github.com/vikramcse/go-lsm/internal/kv"
+	"github.com/vikramcse/go-lsm/vfs"
 )
 
+// ErrKeyOrder is returned by Write for a key that is not greater than the
+// previous one
+var ErrKeyOrder = errors.New("keys must be written in increasing order")
+
 // Writer handles writing SSTable files. It manages:
 // - Creating and writing data blocks
 // - Building and writing the index block
 // - Writing the footer
 // - Managing block boundaries and file offsets
 type Writer struct {
-	file      *os.File      // The SSTable file being written
+	file      vfs.File      // The SSTable file being written
 	block     *Block        // Current data block being built
 	index     *IBlock       // Index block being built
+	rangeDels *Block        // Range tombstones, written as a block of their own
 	bufWriter *bufio.Writer // Buffered writer for better performance
 	filename  string        // Name of the SSTable file
 	offset    uint64        // Current offset in the file
+
+	prevLastKey []byte // Last key of the previous data block
+
+	props      Properties            // Statistics written to the properties block
+	collectors []PropertiesCollector // User-defined property collectors
+	err        error                 // First error returned by a collector
+
+	opts WriterOptions
+	cmp  kv.Comparator
+}
+
+// WriterOptions configures the layout of the tables a Writer creates
+type WriterOptions struct {
+	// IndexPartitionSize, when positive, splits the index into partitions
+	// of about that many bytes, found through a top-level index. Readers
+	// then only load the partitions they need, which keeps opening a
+	// large table cheap. Zero writes the whole index as a single block.
+	IndexPartitionSize int
+
+	// Comparator orders the keys of the table, kv.Bytewise if nil. Its
+	// name is recorded in the properties block, and Readers refuse to open
+	// the table with another comparator.
+	Comparator kv.Comparator
+
+	// Compression compresses the data blocks. A block is stored as it is
+	// when compressing it saves less than an eighth of its size.
+	Compression CompressionType
 }
 
 // NewWriter creates a new SSTable writer
 func NewWriter(dir string) (*Writer, error) {
-	file_name := golsm.SSTableFilePrefix + time.Now().Format("20060102150405") + ".sst"
+	return NewWriterFS(vfs.Default, dir)
+}
+
+// NewWriterFS is like NewWriter, creating the file in fs
+func NewWriterFS(fs vfs.FS, dir string) (*Writer, error) {
+	file_name := FilePrefix + time.Now().Format("20060102150405") + ".sst"
 	full_file_name := filepath.Join(dir, file_name)
 
-	file, err := os.OpenFile(full_file_name, os.O_CREATE|os.O_WRONLY, 0664)
+	return NewFileWriterFS(fs, full_file_name)
+}
+
+// NewFileWriter creates a new SSTable writer for the given file name,
+// truncating any existing file. It is used by callers that manage their own
+// file naming, such as the DB which numbers its tables.
+func NewFileWriter(filename string) (*Writer, error) {
+	return NewFileWriterFS(vfs.Default, filename)
+}
+
+// NewFileWriterFS is like NewFileWriter, creating the file in fs
+func NewFileWriterFS(fs vfs.FS, filename string) (*Writer, error) {
+	return NewFileWriterWithOptions(fs, filename, WriterOptions{})
+}
+
+// NewFileWriterWithOptions is like NewFileWriterFS, configured by opts
+func NewFileWriterWithOptions(fs vfs.FS, filename string, opts WriterOptions) (*Writer, error) {
+	if err := checkCompression(opts.Compression); err != nil {
+		return nil, err
+	}
+	file, err := fs.Create(filename)
 	if err != nil {
 		return nil, err
 	}
 
+	w := newWriter(file, filename)
+	w.opts = opts
+	w.props.Compression = opts.Compression
+	if opts.Comparator != nil {
+		w.cmp = opts.Comparator
+		w.props.Comparator = w.cmp.Name()
+	}
+	return w, nil
+}
+
+func newWriter(file vfs.File, filename string) *Writer {
 	return &Writer{
 		file:      file,
 		bufWriter: bufio.NewWriter(file),
-		filename:  full_file_name,
+		filename:  filename,
 		block:     NewBlock(),
 		index:     NewIBlock(),
-	}, nil
+		rangeDels: NewBlock(),
+		props:     Properties{Compression: NoCompression, BlockSize: BlockSize, Comparator: kv.Bytewise.Name()},
+		cmp:       kv.Bytewise,
+	}
+}
+
+// AddPropertiesCollector registers a collector that sees every entry added
+// to the table and adds its properties to the properties block. Collectors
+// must be added before the first entry.
+func (w *Writer) AddPropertiesCollector(c PropertiesCollector) {
+	w.collectors = append(w.collectors, c)
+}
+
+// collect passes an entry to the collectors, keeping the first error
+func (w *Writer) collect(kind BlockType, key, value []byte) {
+	for _, c := range w.collectors {
+		if err := c.Add(kind, key, value); err != nil && w.err == nil {
+			w.err = fmt.Errorf("properties collector %s: %w", c.Name(), err)
+		}
+	}
 }
 
 // Write adds a key-value pair to the SSTable.
@@ -54,7 +143,13 @@ func NewWriter(dir string) (*Writer, error) {
 // 1. If current block is full, flush it to disk
 // 2. Add the key-value pair to current block
 // 3. Update index when blocks are flushed
+//
+// Keys must be written in increasing order of the comparator.
 func (w *Writer) Write(key string, value []byte) error {
+	if w.props.NumEntries > 0 && w.cmp.Compare([]byte(key), w.props.LargestKey) <= 0 {
+		return ErrKeyOrder
+	}
+
 	if w.block.IsFull() {
 		if err := w.flushBlock(); err != nil {
 			return err
@@ -62,7 +157,19 @@ func (w *Writer) Write(key string, value []byte) error {
 	}
 
 	w.block.AddEntry([]byte(key), value)
-	return nil
+	w.props.add([]byte(key), value)
+	w.collect(DataBlock, []byte(key), value)
+	return w.err
+}
+
+// AddRangeDeletion records a range tombstone starting at start. The value is
+// opaque to the SSTable, like the values passed to Write; it typically holds
+// the end of the range. Range tombstones are kept apart from the data blocks
+// and written to a range deletion block by Close.
+func (w *Writer) AddRangeDeletion(start, value []byte) {
+	w.rangeDels.AddEntry(start, value)
+	w.props.NumRangeDeletions++
+	w.collect(RangeDelBlock, start, value)
 }
 
 // flushBlock writes the current block to disk
@@ -71,22 +178,33 @@ func (w *Writer) flushBlock() error {
 		return nil
 	}
 
-	firstKey := w.block.entries[0].Key
+	// The index only needs a key that separates this block from the
+	// previous one, which is often much shorter than the first key
+	indexKey := w.block.entries[0].Key
+	if w.prevLastKey != nil {
+		indexKey = w.cmp.Separator(w.prevLastKey, indexKey)
+	}
 	blockHandle := BlockHandle{
 		Offset: w.offset,
 		Size:   uint64(w.block.size),
 	}
-	w.index.AddEntry(firstKey, blockHandle)
+	w.index.AddEntry(indexKey, blockHandle)
+	w.prevLastKey = w.block.entries[len(w.block.entries)-1].Key
 
-	// Encode the data
+	// Encode the data, compressed if that pays off
 	data := w.block.Encode()
+	compressed := false
+	if c := compressBlock(w.opts.Compression, data); c != nil {
+		data, compressed = c, true
+	}
 
 	// Create a metadata for Data Block
 	metadata := &BlockMetadata{
-		Type:     DataBlock,
-		CRC:      crc32.ChecksumIEEE(data),
-		Size:     uint32(len(data)),
-		KeyCount: uint32(w.block.KeyCount()),
+		Type:       DataBlock,
+		CRC:        crc32.ChecksumIEEE(data),
+		Size:       uint32(len(data)),
+		KeyCount:   uint32(w.block.KeyCount()),
+		Compressed: compressed,
 	}
 
 	// write the metadata
@@ -101,6 +219,8 @@ func (w *Writer) flushBlock() error {
 
 	// add the new offset
 	w.offset += uint64(len(data)) + uint64(binary.Size(metadata))
+	w.props.NumDataBlocks++
+	w.props.DataSize += uint64(len(data)) + uint64(binary.Size(metadata))
 
 	// as this block is flused, create a new one
 	w.block = NewBlock()
@@ -109,47 +229,63 @@ func (w *Writer) flushBlock() error {
 
 // Close finalizes the SSTable file by:
 // 1. Flushing any remaining data in the current block
-// 2. Writing the index block
-// 3. Writing the footer
-// 4. Closing the file
+// 2. Writing the range deletion and properties blocks
+// 3. Writing the index block, or its partitions and the top-level index
+// 4. Writing the footer
+// 5. Syncing and closing the file
+//
+// The file is closed even when Close fails.
 func (w *Writer) Close() error {
+	if w.err != nil {
+		w.file.Close()
+		return w.err
+	}
+
+	if err := w.finish(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// finish writes everything that follows the data blocks and syncs the file
+func (w *Writer) finish() error {
 	// Flush any remaining data
 	if err := w.flushBlock(); err != nil {
 		return err
 	}
 
-	// Store index block offset
-	indexOffset := w.offset
-
-	// Write the index block
-	indexData := w.index.Encode()
-	indexMetadata := &BlockMetadata{
-		Type:     IndexBlock,
-		CRC:      calculateCRC(indexData),
-		Size:     uint32(len(indexData)),
-		KeyCount: uint32(len(w.index.entries)),
+	// Write the range deletion block, if any
+	var rangeDelHandle BlockHandle
+	if !w.rangeDels.IsEmpty() {
+		handle, err := w.writeMetaBlock(RangeDelBlock, w.rangeDels.Encode(), uint32(w.rangeDels.KeyCount()))
+		if err != nil {
+			return err
+		}
+		rangeDelHandle = handle
 	}
 
-	// Write index metadata
-	if err := binary.Write(w.bufWriter, binary.LittleEndian, indexMetadata); err != nil {
+	// Write the properties block
+	propertiesHandle, err := w.writeProperties()
+	if err != nil {
 		return err
 	}
 
-	// Write index data
-	if _, err := w.bufWriter.Write(indexData); err != nil {
+	// Write the index block
+	indexHandle, err := w.writeIndex()
+	if err != nil {
 		return err
 	}
 
-	// Update offset to include index block
-	w.offset += uint64(len(indexData)) + uint64(binary.Size(indexMetadata))
-
 	// Create and write footer
 	footer := &Footer{
-		IndexHandle:     BlockHandle{Offset: indexOffset, Size: uint64(len(indexData))},
-		MagicNumber:     MagicNumber,
-		Version:         CurrentVersion,
-		CreatedAt:       time.Now().Unix(),
-		CompressionType: NoCompression,
+		IndexHandle:      indexHandle,
+		MagicNumber:      MagicNumber,
+		Version:          CurrentVersion,
+		CreatedAt:        time.Now().Unix(),
+		CompressionType:  w.opts.Compression,
+		RangeDelHandle:   rangeDelHandle,
+		PropertiesHandle: propertiesHandle,
 	}
 
 	// Flush buffer before writing footer
@@ -157,22 +293,96 @@ func (w *Writer) Close() error {
 		return err
 	}
 
-	// Ensure footer is exactly FooterSize bytes
+	// Ensure footer is exactly the size readers expect for its version
 	footerData := footer.Encode()
-	if len(footerData) > FooterSize {
-		return errors.New("footer exceeds FooterSize")
-	}
-
-	// Pad footer data if necessary
-	if len(footerData) < FooterSize {
-		footerData = append(footerData, make([]byte, FooterSize-len(footerData))...)
+	if len(footerData) != footer.Size() {
+		return errors.New("footer does not match its encoded size")
 	}
 
 	if _, err := w.file.Write(footerData); err != nil {
 		return err
 	}
 
-	return w.file.Close()
+	return w.file.Sync()
+}
+
+// writeProperties finishes the collectors and writes the properties block
+func (w *Writer) writeProperties() (BlockHandle, error) {
+	w.props.User = make(map[string]string)
+	for _, c := range w.collectors {
+		if err := c.Finish(w.props.User); err != nil {
+			return BlockHandle{}, fmt.Errorf("properties collector %s: %w", c.Name(), err)
+		}
+	}
+	for name := range w.props.User {
+		if strings.HasPrefix(name, reservedPropertyPrefix) {
+			return BlockHandle{}, fmt.Errorf("property %s uses the reserved prefix %s", name, reservedPropertyPrefix)
+		}
+	}
+
+	block := w.props.encode()
+	return w.writeMetaBlock(PropertiesBlock, block.Encode(), uint32(block.KeyCount()))
+}
+
+// writeIndex writes the index block, or the index partitions followed by the
+// top-level index when the index is partitioned, and returns the handle of
+// the block the footer points at
+func (w *Writer) writeIndex() (BlockHandle, error) {
+	if w.opts.IndexPartitionSize <= 0 {
+		return w.writeMetaBlock(IndexBlock, w.index.Encode(), uint32(len(w.index.entries)))
+	}
+
+	// Each partition is found through the first key it indexes
+	top := NewIBlock()
+	partition, size := NewIBlock(), 0
+	flush := func() error {
+		handle, err := w.writeMetaBlock(IndexBlock, partition.Encode(), uint32(len(partition.entries)))
+		if err != nil {
+			return err
+		}
+		top.AddEntry(partition.entries[0].Key, handle)
+		partition, size = NewIBlock(), 0
+		return nil
+	}
+
+	for _, entry := range w.index.entries {
+		partition.AddEntry(entry.Key, entry.BlockHandle)
+		size += len(entry.Key) + 20
+		if size >= w.opts.IndexPartitionSize {
+			if err := flush(); err != nil {
+				return BlockHandle{}, err
+			}
+		}
+	}
+	if len(partition.entries) > 0 {
+		if err := flush(); err != nil {
+			return BlockHandle{}, err
+		}
+	}
+
+	return w.writeMetaBlock(TopIndexBlock, top.Encode(), uint32(len(top.entries)))
+}
+
+// writeMetaBlock writes a non-data block with its metadata at the current
+// offset and returns its handle
+func (w *Writer) writeMetaBlock(blockType BlockType, data []byte, keyCount uint32) (BlockHandle, error) {
+	handle := BlockHandle{Offset: w.offset, Size: uint64(len(data))}
+	metadata := &BlockMetadata{
+		Type:     blockType,
+		CRC:      calculateCRC(data),
+		Size:     uint32(len(data)),
+		KeyCount: keyCount,
+	}
+
+	if err := binary.Write(w.bufWriter, binary.LittleEndian, metadata); err != nil {
+		return BlockHandle{}, err
+	}
+	if _, err := w.bufWriter.Write(data); err != nil {
+		return BlockHandle{}, err
+	}
+
+	w.offset += uint64(len(data)) + uint64(binary.Size(metadata))
+	return handle, nil
 }
 
 // Filename returns the name of the SSTable file
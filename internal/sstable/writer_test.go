@@ -5,8 +5,9 @@ import (
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
-	"os"
 	"testing"
+
+	"github.com/vikramcse/go-lsm/vfs"
 )
 
 type testEntry struct {
@@ -20,13 +21,8 @@ type testEntryBytes struct {
 }
 
 func TestWriterBasic(t *testing.T) {
-	tmpDir, err := os.MkdirTemp(".", "sstable_test_*")
-	if err != nil {
-		t.Fatalf("Failed to create temp dir: %v", err)
-	}
-	defer os.RemoveAll(tmpDir)
-
-	writer, err := NewWriter(tmpDir)
+	fs := vfs.NewMem()
+	writer, err := NewWriterFS(fs, "/")
 	if err != nil {
 		t.Fatalf("Failed to create writer: %v", err)
 	}
@@ -51,7 +47,7 @@ func TestWriterBasic(t *testing.T) {
 	}
 
 	// Verify file exists
-	files, err := os.ReadDir(tmpDir)
+	files, err := fs.List("/")
 	if err != nil {
 		t.Fatalf("Failed to read directory: %v", err)
 	}
@@ -60,18 +56,13 @@ func TestWriterBasic(t *testing.T) {
 		t.Errorf("Expected 1 file, got %d", len(files))
 	}
 
-	verifyFileContent(t, writer.filename, testData)
+	verifyFileContent(t, fs, writer.filename, testData)
 
 }
 
 func TestWriterBlockBoundry(t *testing.T) {
-	tmpDir, err := os.MkdirTemp(".", "sstable_test_*")
-	if err != nil {
-		t.Fatalf("Failed to create temp dir: %v", err)
-	}
-	defer os.RemoveAll(tmpDir)
-
-	writer, err := NewWriter(tmpDir)
+	fs := vfs.NewMem()
+	writer, err := NewWriterFS(fs, "/")
 	if err != nil {
 		t.Fatalf("Failed to create writer: %v", err)
 	}
@@ -85,7 +76,7 @@ func TestWriterBlockBoundry(t *testing.T) {
 		{"key1", largeValue},
 		{"key2", []byte("small value")},
 		{"key3", largeValue},
-		{"emptyKey", []byte{}},
+		{"key4", []byte{}},
 	}
 
 	for _, tc := range testCases {
@@ -100,10 +91,10 @@ func TestWriterBlockBoundry(t *testing.T) {
 	}
 }
 
-func verifyFileContent(t *testing.T, filename string, expectedData []testEntry) {
+func verifyFileContent(t *testing.T, fs vfs.FS, filename string, expectedData []testEntry) {
 	t.Helper()
 
-	file, err := os.Open(filename)
+	file, err := fs.Open(filename)
 	if err != nil {
 		t.Fatalf("Failed to open file for verification: %v", err)
 	}
@@ -172,13 +163,7 @@ func verifyFileContent(t *testing.T, filename string, expectedData []testEntry)
 
 // Benchmark writing
 func BenchmarkWriter(b *testing.B) {
-	tmpDir, err := os.MkdirTemp(".", "sstable_bench_*")
-	if err != nil {
-		b.Fatalf("Failed to create temp dir: %v", err)
-	}
-	defer os.RemoveAll(tmpDir)
-
-	writer, err := NewWriter(tmpDir)
+	writer, err := NewWriterFS(vfs.NewMem(), "/")
 	if err != nil {
 		b.Fatalf("Failed to create writer: %v", err)
 	}
@@ -199,3 +184,52 @@ func BenchmarkWriter(b *testing.B) {
 }
 
 // TODO: add concurrent tests
+
+// openFilesFS counts the files created through it that are not closed yet
+type openFilesFS struct {
+	vfs.FS
+	open int
+}
+
+type countedFile struct {
+	vfs.File
+	fs *openFilesFS
+}
+
+func (fs *openFilesFS) Create(name string) (vfs.File, error) {
+	f, err := fs.FS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	fs.open++
+	return &countedFile{File: f, fs: fs}, nil
+}
+
+func (f *countedFile) Close() error {
+	f.fs.open--
+	return f.File.Close()
+}
+
+func TestWriterCloseFailureClosesFile(t *testing.T) {
+	for _, op := range []vfs.Op{vfs.OpWrite, vfs.OpSync} {
+		faults := vfs.NewFaultFS(vfs.NewMem())
+		faults.Inject(vfs.Fault{Op: op, Path: ".sst"})
+		fs := &openFilesFS{FS: faults}
+
+		writer, err := NewFileWriterFS(fs, "/test.sst")
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := writer.Write(fmt.Sprintf("key%02d", i), []byte("value")); err != nil {
+				t.Fatalf("Failed to write entry %d: %v", i, err)
+			}
+		}
+		if err := writer.Close(); err == nil {
+			t.Errorf("Expected Close to fail with a failing %v", op)
+		}
+		if fs.open != 0 {
+			t.Errorf("Expected the file to be closed after a failing %v, %d still open", op, fs.open)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Package wal implements the write-ahead log. Every write is appended to the
+// log before it is applied to the memtable, so that writes which have not
+// been flushed to an SSTable yet can be replayed after a crash.
+//
+// A log file is a sequence of records:
+//
+//	[CRC (uint32)][payload length (uint32)][payload]
+//
+// A record whose header or payload is incomplete, or whose CRC does not
+// match, marks the end of the usable log: it is the tail of a write that was
+// torn by a crash.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+const (
+	headerSize = 8
+
+	// maxRecordSize bounds the payload length read from a header, so that a
+	// damaged length field cannot trigger a huge allocation
+	maxRecordSize = 1 << 30
+)
+
+// ErrCorruptRecord is returned by Reader.Next when a record is truncated or
+// fails its CRC check
+var ErrCorruptRecord = errors.New("corrupt WAL record")
+
+// Writer appends records to a log file
+type Writer struct {
+	file      vfs.File
+	bufWriter *bufio.Writer
+}
+
+// NewWriter creates a new log file in fs, truncating any existing file with
+// the same name
+func NewWriter(fs vfs.FS, filename string) (*Writer, error) {
+	file, err := fs.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		file:      file,
+		bufWriter: bufio.NewWriter(file),
+	}, nil
+}
+
+// AddRecord appends a record and hands it to the operating system. The record
+// is only durable after a call to Sync.
+func (w *Writer) AddRecord(payload []byte) error {
+	var header [headerSize]byte
+	binary.LittleEndian.PutUint32(header[0:4], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(payload)))
+
+	if _, err := w.bufWriter.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.bufWriter.Write(payload); err != nil {
+		return err
+	}
+	return w.bufWriter.Flush()
+}
+
+// Sync flushes the log to stable storage
+func (w *Writer) Sync() error {
+	if err := w.bufWriter.Flush(); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// Close syncs and closes the log file
+func (w *Writer) Close() error {
+	if err := w.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// Reader reads records back from a log file
+type Reader struct {
+	file   vfs.File
+	reader *bufio.Reader
+}
+
+// NewReader opens a log file in fs for reading
+func NewReader(fs vfs.FS, filename string) (*Reader, error) {
+	file, err := fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{
+		file:   file,
+		reader: bufio.NewReader(file),
+	}, nil
+}
+
+// Next returns the payload of the next record. It returns io.EOF at the end
+// of the log and ErrCorruptRecord when the next record is torn or damaged.
+func (r *Reader) Next() ([]byte, error) {
+	var header [headerSize]byte
+	n, err := io.ReadFull(r.reader, header[:])
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil || n != headerSize {
+		return nil, ErrCorruptRecord
+	}
+
+	crc := binary.LittleEndian.Uint32(header[0:4])
+	length := binary.LittleEndian.Uint32(header[4:8])
+	if length > maxRecordSize {
+		return nil, ErrCorruptRecord
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r.reader, payload); err != nil {
+		return nil, ErrCorruptRecord
+	}
+	if crc32.ChecksumIEEE(payload) != crc {
+		return nil, ErrCorruptRecord
+	}
+
+	return payload, nil
+}
+
+// Close closes the log file
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,570 @@
+package golsm
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/vikramcse/go-lsm/internal/ds"
+	"github.com/vikramcse/go-lsm/internal/kv"
+)
+
+// internalIterator iterates over the encoded entries of a single source, a
+// memtable or an SSTable, in key order
+type internalIterator interface {
+	First()
+	SeekGE(key []byte)
+	Next()
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+}
+
+// Iterator returns the live key-value pairs of the DB in key order, merged
+// from the memtables and all SSTables. When a key is found in several sources
+// the entry with the highest sequence number wins, and keys that are deleted,
+// by a point or a range deletion, are skipped.
+//
+// A new Iterator is positioned before the first key; call Next or Seek first.
+// An Iterator is not safe for concurrent use and must be closed.
+type Iterator struct {
+	cmp       Comparator
+	state     *readState
+	release   bool // whether Close releases state
+	merged    *mergingIterator
+	rangeDels []kv.RangeTombstone
+	resolver  entryResolver // expiries are checked against the creation time
+	lower     []byte
+	upper     []byte
+	prefix    []byte
+
+	started bool
+	key     []byte
+	value   []byte
+	err     error
+}
+
+// NewIterator returns an iterator restricted by opts. Changes made to the DB
+// after the call may or may not be seen unless opts.Snapshot is set.
+//
+// Sealed memtables are read in place. If the backend of the active memtable
+// cannot take snapshots, its entries within the bounds are copied when the
+// iterator is created, so that it can keep taking writes. Without bounds that
+// is every entry of the active memtable; set LowerBound, UpperBound or Prefix
+// to copy less.
+func (db *DB) NewIterator(opts ReadOptions) (*Iterator, error) {
+	return db.def.NewIterator(opts)
+}
+
+// NewIterator returns an iterator over the column family restricted by opts
+func (cf *ColumnFamily) NewIterator(opts ReadOptions) (*Iterator, error) {
+	db := cf.db
+	it := &Iterator{
+		cmp:    cf.opts.Comparator,
+		lower:  opts.LowerBound,
+		upper:  opts.UpperBound,
+		prefix: opts.Prefix,
+	}
+	if it.prefix != nil && (it.lower == nil || it.cmp.Compare(it.prefix, it.lower) > 0) {
+		it.lower = it.prefix
+	}
+
+	if opts.Snapshot != nil {
+		if it.state = opts.Snapshot.readState(cf); it.state == nil {
+			return nil, ErrSnapshotReleased
+		}
+	} else {
+		db.mu.Lock()
+		if db.closed {
+			db.mu.Unlock()
+			return nil, ErrClosed
+		}
+		it.state = cf.currentReadState()
+		it.release = true
+		db.mu.Unlock()
+	}
+
+	// Unordered memtables are only sorted when they are flushed
+	for _, mem := range it.state.mems {
+		if !mem.Ordered() && mem.Len() > 0 {
+			it.Close()
+			return nil, ErrUnorderedMemTable
+		}
+	}
+
+	var children []internalIterator
+	for _, mem := range it.state.mems {
+		children = append(children, newMemTableIterator(mem, it.cmp, it.state.seq, it.lower, it.inBounds))
+	}
+	// Tables outside the bounds cannot hold a key to return. Bottom level
+	// tables do not overlap, so one iterator goes through them in turn.
+	var bottom []*table
+	for _, t := range it.state.tables {
+		switch {
+		case !it.overlapsBounds(t):
+		case t.meta.level == bottomLevel:
+			bottom = append(bottom, t)
+		default:
+			children = append(children, t.newIterator())
+		}
+	}
+	if len(bottom) > 0 {
+		children = append(children, newLevelIterator(it.cmp, bottom))
+	}
+	it.merged = newMergingIterator(it.cmp, children)
+	it.rangeDels = it.state.rangeTombstones(it.lower, it.upper)
+	it.resolver = it.state.resolver()
+	return it, nil
+}
+
+// Scan calls fn for every live key in [start, end) in key order until fn
+// returns false. A nil start or end leaves that side unbounded.
+func (db *DB) Scan(start, end []byte, fn func(key, value []byte) bool) error {
+	return db.def.Scan(start, end, fn)
+}
+
+// Scan calls fn for every live key of the column family in [start, end) in
+// key order until fn returns false
+func (cf *ColumnFamily) Scan(start, end []byte, fn func(key, value []byte) bool) error {
+	it, err := cf.NewIterator(ReadOptions{LowerBound: start, UpperBound: end})
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			break
+		}
+	}
+	return it.Error()
+}
+
+// Next advances to the next key and reports whether there is one
+func (it *Iterator) Next() bool {
+	if !it.started {
+		if it.lower != nil {
+			return it.Seek(it.lower)
+		}
+		it.started = true
+		it.merged.First()
+		return it.findNext()
+	}
+	it.merged.Next()
+	return it.findNext()
+}
+
+// Seek positions the iterator at the first key greater than or equal to key
+// and reports whether there is one
+func (it *Iterator) Seek(key []byte) bool {
+	if it.lower != nil && it.cmp.Compare(key, it.lower) < 0 {
+		key = it.lower
+	}
+
+	it.started = true
+	it.merged.SeekGE(key)
+	return it.findNext()
+}
+
+// Key returns the current key. It is only valid until the next call to Next
+// or Seek.
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the current value. It is only valid until the next call to
+// Next or Seek.
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Error returns the first error hit by the iterator
+func (it *Iterator) Error() error {
+	return it.err
+}
+
+// Close releases the iterator and the SSTables it was reading
+func (it *Iterator) Close() error {
+	if it.release && it.state != nil {
+		it.state.release()
+	}
+	it.state = nil
+	it.key, it.value = nil, nil
+	return it.err
+}
+
+// findNext moves the merged iterator forward to the first live key within
+// the bounds, starting at its current position
+func (it *Iterator) findNext() bool {
+	it.key, it.value = nil, nil
+
+	for ; it.merged.Valid(); it.merged.Next() {
+		key := it.merged.Key()
+		if !it.inBounds(key) {
+			return false
+		}
+
+		kind, seq, value, err := kv.DecodeValue(it.merged.Value())
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if kind == kv.KindDelete || it.coveredByRangeTombstone(key, seq) {
+			continue
+		}
+		if kind == kv.KindMerge {
+			value, err = mergeVersions(it.state.merge, it.resolver, key, it.merged.versions(), func(seq uint64) bool {
+				return it.coveredByRangeTombstone(key, seq)
+			})
+		} else {
+			var e kv.Entry
+			if e, err = it.resolver.resolve(kv.Entry{Kind: kind, Seq: seq, Value: value}); err == nil && e.Kind == kv.KindDelete {
+				continue // expired
+			}
+			value = e.Value
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		it.key, it.value = key, value
+		return true
+	}
+
+	it.err = it.merged.Error()
+	return false
+}
+
+// inBounds reports whether key is below the upper bound and has the prefix.
+// Keys are visited in order, so the first key out of bounds ends iteration.
+func (it *Iterator) inBounds(key []byte) bool {
+	if it.upper != nil && it.cmp.Compare(key, it.upper) >= 0 {
+		return false
+	}
+	return it.prefix == nil || bytes.HasPrefix(key, it.prefix)
+}
+
+// overlapsBounds reports whether the key range of t holds keys within the
+// bounds. Keys with the prefix follow each other from the prefix itself, so a
+// table starting past the prefix with a key without it holds none of them.
+func (it *Iterator) overlapsBounds(t *table) bool {
+	if it.lower != nil && it.cmp.Compare(t.meta.largest, it.lower) < 0 {
+		return false
+	}
+	if it.upper != nil && it.cmp.Compare(t.meta.smallest, it.upper) >= 0 {
+		return false
+	}
+	return it.prefix == nil || bytes.HasPrefix(t.meta.smallest, it.prefix) ||
+		it.cmp.Compare(t.meta.smallest, it.prefix) < 0
+}
+
+func (it *Iterator) coveredByRangeTombstone(key []byte, seq uint64) bool {
+	for _, t := range it.rangeDels {
+		if t.Covers(it.cmp, key, seq) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergingIterator merges the entries of several sources into one stream with
+// a single entry per key: the one with the highest sequence number. Deletions
+// are returned like any other entry. The older entries of the key remain
+// available through versions, to combine merge operands with.
+type mergingIterator struct {
+	cmp      Comparator
+	children []internalIterator
+	key      []byte
+	value    []byte
+	valid    bool
+	err      error
+	source   int // index of the child the current entry comes from
+
+	entries []versionedValue // every entry of key, as found in the children
+	sorted  bool             // whether entries are sorted from the newest
+}
+
+type versionedValue struct {
+	value []byte
+	seq   uint64
+}
+
+func newMergingIterator(cmp Comparator, children []internalIterator) *mergingIterator {
+	return &mergingIterator{cmp: cmp, children: children}
+}
+
+func (m *mergingIterator) First() {
+	for _, child := range m.children {
+		child.First()
+	}
+	m.findNext()
+}
+
+func (m *mergingIterator) SeekGE(key []byte) {
+	for _, child := range m.children {
+		child.SeekGE(key)
+	}
+	m.findNext()
+}
+
+func (m *mergingIterator) Next() {
+	if m.valid {
+		m.findNext()
+	}
+}
+
+func (m *mergingIterator) Valid() bool   { return m.valid }
+func (m *mergingIterator) Key() []byte   { return m.key }
+func (m *mergingIterator) Value() []byte { return m.value }
+func (m *mergingIterator) Error() error  { return m.err }
+
+// findNext picks the smallest key among the children, takes its newest entry
+// and moves every child holding that key past it
+func (m *mergingIterator) findNext() {
+	m.valid = false
+
+	var key []byte
+	found := false
+	for _, child := range m.children {
+		if err := child.Error(); err != nil {
+			m.err = err
+			return
+		}
+		if child.Valid() && (!found || m.cmp.Compare(child.Key(), key) < 0) {
+			key, found = child.Key(), true
+		}
+	}
+	if !found {
+		return
+	}
+
+	var newest []byte
+	var newestSeq uint64
+	key = append([]byte(nil), key...)
+	m.entries, m.sorted = m.entries[:0], false
+	for i, child := range m.children {
+		if !child.Valid() || m.cmp.Compare(child.Key(), key) != 0 {
+			continue
+		}
+		_, seq, _, err := kv.DecodeValue(child.Value())
+		if err != nil {
+			m.err = err
+			return
+		}
+		if newest == nil || seq > newestSeq {
+			newest, newestSeq, m.source = child.Value(), seq, i
+		}
+		m.entries = append(m.entries, versionedValue{value: child.Value(), seq: seq})
+		child.Next()
+	}
+
+	m.key, m.value, m.valid = key, newest, true
+}
+
+// versions returns every entry of the current key, from the newest
+func (m *mergingIterator) versions() [][]byte {
+	if !m.sorted {
+		sort.Slice(m.entries, func(i, j int) bool { return m.entries[i].seq > m.entries[j].seq })
+		m.sorted = true
+	}
+	values := make([][]byte, len(m.entries))
+	for i, e := range m.entries {
+		values[i] = e.value
+	}
+	return values
+}
+
+// levelIterator is an internalIterator over tables whose key ranges do not
+// overlap, opening the iterator of each table once the previous one is done
+type levelIterator struct {
+	cmp    Comparator
+	tables []*table // sorted by smallest key
+	pos    int
+	cur    internalIterator // iterator of tables[pos], nil past the last table
+}
+
+func newLevelIterator(cmp Comparator, tables []*table) *levelIterator {
+	sort.Slice(tables, func(i, j int) bool {
+		return cmp.Compare(tables[i].meta.smallest, tables[j].meta.smallest) < 0
+	})
+	return &levelIterator{cmp: cmp, tables: tables}
+}
+
+func (l *levelIterator) First() {
+	l.open(0)
+	if l.cur != nil {
+		l.cur.First()
+	}
+	l.skipExhausted()
+}
+
+func (l *levelIterator) SeekGE(key []byte) {
+	l.open(sort.Search(len(l.tables), func(i int) bool {
+		return l.cmp.Compare(l.tables[i].meta.largest, key) >= 0
+	}))
+	if l.cur != nil {
+		l.cur.SeekGE(key)
+	}
+	l.skipExhausted()
+}
+
+func (l *levelIterator) Next() {
+	if l.Valid() {
+		l.cur.Next()
+		l.skipExhausted()
+	}
+}
+
+func (l *levelIterator) Valid() bool   { return l.cur != nil && l.cur.Valid() }
+func (l *levelIterator) Key() []byte   { return l.cur.Key() }
+func (l *levelIterator) Value() []byte { return l.cur.Value() }
+
+func (l *levelIterator) Error() error {
+	if l.cur == nil {
+		return nil
+	}
+	return l.cur.Error()
+}
+
+// open makes the iterator of the table at pos the current one
+func (l *levelIterator) open(pos int) {
+	l.pos, l.cur = pos, nil
+	if pos < len(l.tables) {
+		l.cur = l.tables[pos].newIterator()
+	}
+}
+
+// skipExhausted moves on to the first entry of the next tables while the
+// current one has no more entries
+func (l *levelIterator) skipExhausted() {
+	for l.cur != nil && !l.cur.Valid() && l.cur.Error() == nil {
+		l.open(l.pos + 1)
+		if l.cur != nil {
+			l.cur.First()
+		}
+	}
+}
+
+// newMemTableIterator returns an iterator over the entries of mem a read at
+// seq finds. A sealed memtable no longer changes and is read in place. The
+// active one is read from a snapshot if its backend supports them, and
+// otherwise its entries from lower onwards are copied for as long as inBounds
+// accepts their keys, so it can keep taking writes while the iterator is in
+// use.
+func newMemTableIterator(mem *MemTable, cmp Comparator, seq uint64, lower []byte, inBounds func(key []byte) bool) internalIterator {
+	if mem.isSealed() {
+		return &snapshotIterator{cmp: cmp, mem: mem, data: mem.data, seq: seq}
+	}
+	if snap, ok := mem.snapshot(); ok {
+		return &snapshotIterator{cmp: cmp, mem: mem, data: snap, seq: seq}
+	}
+
+	s := &sliceIterator{cmp: cmp}
+	add := func(key []byte, e kv.Entry) bool {
+		if !inBounds(key) {
+			return false
+		}
+		if e.Seq > seq {
+			// Ascend holds the lock olderEntry needs
+			var ok bool
+			if e, ok = mem.olderEntry(key, seq); !ok {
+				return true
+			}
+		}
+		s.keys = append(s.keys, key)
+		s.values = append(s.values, e.Encode())
+		return true
+	}
+	if lower == nil {
+		mem.Ascend(add)
+	} else {
+		mem.AscendFrom(lower, add)
+	}
+	return s
+}
+
+// snapshotIterator is an internalIterator over a sealed memtable or a
+// snapshot of one. Entries written after seq are replaced by the ones they
+// replaced in mem, or skipped.
+type snapshotIterator struct {
+	cmp   Comparator
+	mem   *MemTable
+	data  ds.MemTableImpl[kv.Entry]
+	seq   uint64
+	it    ds.Iterator[kv.Entry]
+	valid bool
+	entry kv.Entry // entry at the current position
+	value []byte   // encoded entry at the current position, nil until Value is called
+}
+
+func (s *snapshotIterator) First() {
+	s.it = s.data.Iterator()
+	s.settle(s.it.Next())
+}
+
+func (s *snapshotIterator) SeekGE(key []byte) {
+	s.it = s.data.Iterator()
+	s.settle(s.it.Seek(key))
+}
+
+func (s *snapshotIterator) Next() {
+	if s.valid {
+		s.settle(s.it.Next())
+	}
+}
+
+// settle moves on from the current position, which holds an entry if ok, to
+// the first one visible at seq
+func (s *snapshotIterator) settle(ok bool) {
+	s.value = nil
+	for ; ok; ok = s.it.Next() {
+		if s.entry = s.it.Value(); s.entry.Seq <= s.seq {
+			break
+		}
+		var found bool
+		if s.entry, found = s.mem.getAt(s.cmp, s.it.Key(), s.seq); found {
+			break
+		}
+	}
+	s.valid = ok
+}
+
+func (s *snapshotIterator) Valid() bool  { return s.valid }
+func (s *snapshotIterator) Key() []byte  { return s.it.Key() }
+func (s *snapshotIterator) Error() error { return nil }
+
+func (s *snapshotIterator) Value() []byte {
+	if s.value == nil {
+		s.value = s.entry.Encode()
+	}
+	return s.value
+}
+
+// sliceIterator is an internalIterator over sorted entries held in memory
+type sliceIterator struct {
+	cmp    Comparator
+	keys   [][]byte
+	values [][]byte
+	pos    int
+}
+
+func (s *sliceIterator) SeekGE(key []byte) {
+	left, right := 0, len(s.keys)
+	for left < right {
+		mid := (left + right) / 2
+		if s.cmp.Compare(s.keys[mid], key) < 0 {
+			left = mid + 1
+		} else {
+			right = mid
+		}
+	}
+	s.pos = left
+}
+
+func (s *sliceIterator) First()        { s.pos = 0 }
+func (s *sliceIterator) Next()         { s.pos++ }
+func (s *sliceIterator) Valid() bool   { return s.pos < len(s.keys) }
+func (s *sliceIterator) Key() []byte   { return s.keys[s.pos] }
+func (s *sliceIterator) Value() []byte { return s.values[s.pos] }
+func (s *sliceIterator) Error() error  { return nil }
@@ -0,0 +1,379 @@
+package golsm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+// collect returns the key-value pairs an iterator with opts yields
+func collect(t *testing.T, db *DB, opts ReadOptions) []string {
+	t.Helper()
+
+	it, err := db.NewIterator(opts)
+	if err != nil {
+		t.Fatalf("NewIterator failed: %v", err)
+	}
+	defer it.Close()
+
+	var result []string
+	for it.Next() {
+		result = append(result, string(it.Key())+"="+string(it.Value()))
+	}
+	if err := it.Error(); err != nil {
+		t.Fatalf("Iterator failed: %v", err)
+	}
+	return result
+}
+
+func expectEntries(t *testing.T, got []string, expected ...string) {
+	t.Helper()
+
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestIteratorMergesSources(t *testing.T) {
+	db, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	// Spread the versions of the keys over two SSTables and the memtable
+	db.Put([]byte("a"), []byte("1"))
+	db.Put([]byte("b"), []byte("1"))
+	db.Put([]byte("c"), []byte("1"))
+	db.Flush()
+	db.Put([]byte("b"), []byte("2"))
+	db.Delete([]byte("c"))
+	db.Put([]byte("d"), []byte("2"))
+	db.Flush()
+	db.Put([]byte("a"), []byte("3"))
+	db.Delete([]byte("d"))
+	db.Put([]byte("e"), []byte("3"))
+
+	expectEntries(t, collect(t, db, ReadOptions{}), "a=3", "b=2", "e=3")
+
+	// A deleted key that is put again becomes visible
+	db.Put([]byte("c"), []byte("4"))
+	expectEntries(t, collect(t, db, ReadOptions{}), "a=3", "b=2", "c=4", "e=3")
+}
+
+func TestIteratorBoundsAndPrefix(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{MemTableSize: 2 * 1024})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	for _, prefix := range []string{"user", "event"} {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("%s:%03d", prefix, i)
+			if err := db.Put([]byte(key), []byte(fmt.Sprint(i))); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+	}
+
+	got := collect(t, db, ReadOptions{LowerBound: []byte("user:010"), UpperBound: []byte("user:013")})
+	expectEntries(t, got, "user:010=10", "user:011=11", "user:012=12")
+
+	got = collect(t, db, ReadOptions{Prefix: []byte("event:09")})
+	expectEntries(t, got, "event:090=90", "event:091=91", "event:092=92", "event:093=93",
+		"event:094=94", "event:095=95", "event:096=96", "event:097=97", "event:098=98", "event:099=99")
+
+	count := 0
+	err = db.Scan([]byte("event:"), []byte("user:"), func(key, value []byte) bool {
+		count++
+		return true
+	})
+	if err != nil || count != 100 {
+		t.Errorf("Expected 100 keys from Scan, got %d (err %v)", count, err)
+	}
+
+	// Stopping early
+	count = 0
+	db.Scan(nil, nil, func(key, value []byte) bool {
+		count++
+		return count < 5
+	})
+	if count != 5 {
+		t.Errorf("Expected Scan to stop after 5 keys, got %d", count)
+	}
+}
+
+func TestIteratorSeek(t *testing.T) {
+	db, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"a", "c", "e", "g"} {
+		db.Put([]byte(key), []byte(key))
+	}
+
+	it, err := db.NewIterator(ReadOptions{LowerBound: []byte("b")})
+	if err != nil {
+		t.Fatalf("NewIterator failed: %v", err)
+	}
+	defer it.Close()
+
+	if !it.Seek([]byte("d")) || string(it.Key()) != "e" {
+		t.Errorf("Expected Seek(d) to land on e")
+	}
+	// Seeking below the lower bound clamps to it
+	if !it.Seek([]byte("a")) || string(it.Key()) != "c" {
+		t.Errorf("Expected Seek(a) to land on c")
+	}
+	if !it.Next() || string(it.Key()) != "e" {
+		t.Errorf("Expected Next to move to e")
+	}
+}
+
+func TestIteratorMemTableSnapshot(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{MemTableBackend: BTreeBackend})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("1"))
+	}
+
+	it, err := db.NewIterator(ReadOptions{})
+	if err != nil {
+		t.Fatalf("NewIterator failed: %v", err)
+	}
+	defer it.Close()
+
+	// The iterator reads a snapshot of the B-tree, which later writes copy
+	// nodes away from
+	for i := 0; i < 200; i++ {
+		db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("2"))
+	}
+
+	count := 0
+	for it.Next() {
+		if string(it.Value()) != "1" {
+			t.Fatalf("Expected value 1 for %s, got %s", it.Key(), it.Value())
+		}
+		count++
+	}
+	if count != 100 {
+		t.Errorf("Expected 100 keys, got %d", count)
+	}
+	if v, err := db.Get([]byte("key150")); err != nil || string(v) != "2" {
+		t.Errorf("Expected value 2 for key150, got %q (err %v)", v, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	db, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("a"), []byte("1"))
+	db.Put([]byte("b"), []byte("1"))
+
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		t.Fatalf("NewSnapshot failed: %v", err)
+	}
+
+	db.Put([]byte("a"), []byte("2"))
+	db.Delete([]byte("b"))
+	db.Put([]byte("c"), []byte("2"))
+	db.Flush()
+
+	expectEntries(t, collect(t, db, ReadOptions{Snapshot: snap}), "a=1", "b=1")
+	expectEntries(t, collect(t, db, ReadOptions{}), "a=2", "c=2")
+
+	value, err := snap.Get([]byte("b"))
+	if err != nil || string(value) != "1" {
+		t.Errorf("Expected snapshot value 1, got %q (err %v)", value, err)
+	}
+
+	snap.Release()
+	if _, err := db.NewIterator(ReadOptions{Snapshot: snap}); err != ErrSnapshotReleased {
+		t.Errorf("Expected ErrSnapshotReleased, got %v", err)
+	}
+}
+
+// blockedTableFS holds the creation of SSTables until unblocked, which stops
+// the flusher
+type blockedTableFS struct {
+	vfs.FS
+	unblocked chan struct{}
+}
+
+func (fs *blockedTableFS) Create(name string) (vfs.File, error) {
+	if strings.HasSuffix(name, ".sst") {
+		<-fs.unblocked
+	}
+	return fs.FS.Create(name)
+}
+
+func TestSnapshotReadsActiveMemTable(t *testing.T) {
+	backends := []MemTableBackend{SkipListBackend, RedBlackTreeBackend, BTreeBackend, HashBackend, VectorBackend}
+	for _, backend := range backends {
+		fs := &blockedTableFS{FS: vfs.NewMem(), unblocked: make(chan struct{})}
+		db, err := Open("/db", &Options{FS: fs, MemTableBackend: backend, MergeOperator: NewStringAppendOperator(",")})
+		if err != nil {
+			t.Fatalf("Failed to open db: %v", err)
+		}
+
+		db.Put([]byte("a"), []byte("1"))
+		db.Put([]byte("b"), []byte("1"))
+		db.Merge([]byte("c"), []byte("1"))
+		snap, err := db.NewSnapshot()
+		if err != nil {
+			t.Fatalf("NewSnapshot failed: %v", err)
+		}
+
+		// The snapshot leaves the memtable active even with the flusher blocked
+		db.Put([]byte("a"), []byte("2"))
+		db.Delete([]byte("b"))
+		db.Merge([]byte("c"), []byte("2"))
+		db.Put([]byte("d"), []byte("2"))
+		db.DeleteRange([]byte("a"), []byte("b"))
+		db.mu.Lock()
+		imm := len(db.imm)
+		db.mu.Unlock()
+		if imm != 0 {
+			t.Errorf("Backend %d: expected no immutable memtables, got %d", backend, imm)
+		}
+
+		for key, expected := range map[string]string{"a": "1", "b": "1", "c": "1", "d": ""} {
+			value, err := snap.Get([]byte(key))
+			if expected == "" && err != ErrNotFound || expected != "" && string(value) != expected {
+				t.Errorf("Backend %d: expected snapshot value %q for %s, got %q (err %v)", backend, expected, key, value, err)
+			}
+		}
+		if value, err := db.Get([]byte("c")); err != nil || string(value) != "1,2" {
+			t.Errorf("Backend %d: expected value 1,2 for c, got %q (err %v)", backend, value, err)
+		}
+		if backend != HashBackend && backend != VectorBackend {
+			expectEntries(t, collect(t, db, ReadOptions{Snapshot: snap}), "a=1", "b=1", "c=1")
+			expectEntries(t, collect(t, db, ReadOptions{}), "c=1,2", "d=2")
+		}
+
+		snap.Release()
+		close(fs.unblocked)
+		db.Close()
+	}
+}
+
+func TestIteratorReadsSealedMemTablesInPlace(t *testing.T) {
+	fs := &blockedTableFS{FS: vfs.NewMem(), unblocked: make(chan struct{})}
+	db, err := Open("/db", &Options{FS: fs, MemTableSize: 1024})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+	defer close(fs.unblocked)
+
+	for i := 0; i < 20; i++ {
+		db.Put([]byte(fmt.Sprintf("key%03d", i)), make([]byte, 100))
+	}
+	db.mu.Lock()
+	imm := len(db.imm)
+	db.mu.Unlock()
+	if imm == 0 {
+		t.Fatalf("Expected a sealed memtable waiting for the flusher")
+	}
+
+	it, err := db.NewIterator(ReadOptions{})
+	if err != nil {
+		t.Fatalf("NewIterator failed: %v", err)
+	}
+	defer it.Close()
+
+	// The active memtable is copied, the sealed ones are not
+	for i, child := range it.merged.children {
+		_, inPlace := child.(*snapshotIterator)
+		if inPlace != (i > 0) {
+			t.Errorf("Expected only the sealed memtables to be read in place, got %T for source %d", child, i)
+		}
+	}
+	count := 0
+	for it.Next() {
+		count++
+	}
+	if count != 20 {
+		t.Errorf("Expected 20 keys, got %d", count)
+	}
+}
+
+func TestIteratorSkipsTablesOutsideBounds(t *testing.T) {
+	db, err := Open("/db", &Options{FS: vfs.NewMem(), TargetFileSize: 512})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	// Several bottom level tables, and level 0 tables at either end
+	for i := 0; i < 200; i++ {
+		db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("1"))
+	}
+	db.Flush()
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if n := len(db.def.levelTables(bottomLevel)); n < 3 {
+		t.Fatalf("Expected several bottom level tables, got %d", n)
+	}
+	db.Put([]byte("a"), []byte("2"))
+	db.Flush()
+	db.Put([]byte("z"), []byte("2"))
+	db.Flush()
+
+	children := func(opts ReadOptions) int {
+		it, err := db.NewIterator(opts)
+		if err != nil {
+			t.Fatalf("NewIterator failed: %v", err)
+		}
+		defer it.Close()
+		return len(it.merged.children)
+	}
+
+	// The memtable, both level 0 tables and the bottom level
+	if n := children(ReadOptions{}); n != 4 {
+		t.Errorf("Expected 4 sources without bounds, got %d", n)
+	}
+	if n := children(ReadOptions{LowerBound: []byte("key050"), UpperBound: []byte("key060")}); n != 2 {
+		t.Errorf("Expected the memtable and the bottom level within bounds, got %d sources", n)
+	}
+	if n := children(ReadOptions{Prefix: []byte("z")}); n != 2 {
+		t.Errorf("Expected the memtable and one level 0 table for the prefix, got %d sources", n)
+	}
+
+	got := collect(t, db, ReadOptions{LowerBound: []byte("key098"), UpperBound: []byte("key102")})
+	expectEntries(t, got, "key098=1", "key099=1", "key100=1", "key101=1")
+	if got := collect(t, db, ReadOptions{}); len(got) != 202 || got[0] != "a=2" || got[201] != "z=2" {
+		t.Errorf("Expected every key in order, got %d keys", len(got))
+	}
+
+	it, err := db.NewIterator(ReadOptions{})
+	if err != nil {
+		t.Fatalf("NewIterator failed: %v", err)
+	}
+	defer it.Close()
+	for _, key := range []string{"key150", "key1505", "b"} {
+		if !it.Seek([]byte(key)) || string(it.Key()) < key {
+			t.Errorf("Expected Seek(%q) to land on a key at or after it, got %q", key, it.Key())
+		}
+	}
+}
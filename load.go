@@ -0,0 +1,82 @@
+package golsm
+
+// LoadSession is a bulk load during which new memtables use VectorBackend,
+// whatever the MemTableBackend of their column family selects. Writes then only append to the
+// memtable, which is sorted once when it is flushed.
+//
+// While the loaded entries are still in memtables, range iteration fails
+// with ErrUnorderedMemTable and Get scans them linearly, so a session should
+// only cover writes that are not read until it ends.
+type LoadSession struct {
+	db    *DB
+	ended bool
+}
+
+// BeginLoad starts a load session. The active memtables are switched to the
+// immutable list first if they hold data, so the session's writes start in
+// fresh vector memtables. Sessions may overlap; the configured backend is used
+// again once all of them have ended.
+func (db *DB) BeginLoad() (*LoadSession, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if db.bgErr != nil {
+		return nil, db.bgErr
+	}
+
+	db.loads++
+	if err := db.switchMemTableBackend(); err != nil {
+		db.loads--
+		return nil, err
+	}
+	return &LoadSession{db: db}, nil
+}
+
+// End ends the session. If it was the last one, the memtables holding the
+// loaded entries are switched to the immutable list to be flushed, and later
+// writes go to memtables with the configured backends. Ending a session again
+// has no effect.
+func (s *LoadSession) End() error {
+	db := s.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if s.ended {
+		return nil
+	}
+	s.ended = true
+	db.loads--
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.bgErr != nil {
+		return db.bgErr
+	}
+	return db.switchMemTableBackend()
+}
+
+// switchMemTableBackend replaces the active memtables for which new
+// memtables now get another backend than they have. Memtables holding data
+// are switched to the immutable list, empty ones are dropped. db.mu must be
+// held.
+func (db *DB) switchMemTableBackend() error {
+	var full []*ColumnFamily
+	for _, cf := range db.cfs {
+		switch {
+		case cf.memTableBackend() == cf.memBackend:
+		case cf.mem.Empty():
+			cf.mem.Release()
+			cf.mem = cf.newMemTable()
+		default:
+			full = append(full, cf)
+		}
+	}
+	if len(full) == 0 {
+		return nil
+	}
+	return db.rotateMemTables(full...)
+}
@@ -0,0 +1,113 @@
+package golsm
+
+import "testing"
+
+func TestLoadSession(t *testing.T) {
+	db, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("before"), []byte("1"))
+	load, err := db.BeginLoad()
+	if err != nil {
+		t.Fatalf("BeginLoad failed: %v", err)
+	}
+	putRange(t, db, "load", 500)
+
+	// Only the session's memtable is unordered
+	if _, err := db.NewIterator(ReadOptions{}); err != ErrUnorderedMemTable {
+		t.Errorf("Expected ErrUnorderedMemTable during the load, got %v", err)
+	}
+	if err := load.End(); err != nil {
+		t.Fatalf("End failed: %v", err)
+	}
+	if err := load.End(); err != nil {
+		t.Errorf("Expected a second End to do nothing, got %v", err)
+	}
+
+	// The loaded memtable is being flushed; new writes use the skip list
+	db.Put([]byte("after"), []byte("1"))
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	db.Put([]byte("zzz"), []byte("1"))
+	if n := len(collect(t, db, ReadOptions{})); n != 503 {
+		t.Errorf("Expected 503 entries, got %d", n)
+	}
+	if db.def.memBackend != SkipListBackend {
+		t.Errorf("Expected the skip list backend after the load, got %d", db.def.memBackend)
+	}
+}
+
+func memTableBackend(db *DB) MemTableBackend {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.def.memBackend
+}
+
+func TestLoadSessionsOverlap(t *testing.T) {
+	db, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	first, err := db.BeginLoad()
+	if err != nil {
+		t.Fatalf("BeginLoad failed: %v", err)
+	}
+	putRange(t, db, "first", 100)
+	second, err := db.BeginLoad()
+	if err != nil {
+		t.Fatalf("BeginLoad failed: %v", err)
+	}
+	putRange(t, db, "second", 100)
+
+	// The backend stays in place until the last session ends, in whichever
+	// order they end
+	if err := first.End(); err != nil {
+		t.Fatalf("End failed: %v", err)
+	}
+	if backend := memTableBackend(db); backend != VectorBackend {
+		t.Errorf("Expected the vector backend while a session is open, got %d", backend)
+	}
+	if _, err := db.NewIterator(ReadOptions{}); err != ErrUnorderedMemTable {
+		t.Errorf("Expected ErrUnorderedMemTable during the load, got %v", err)
+	}
+	if err := db.Scan(nil, nil, func(key, value []byte) bool { return true }); err != ErrUnorderedMemTable {
+		t.Errorf("Expected ErrUnorderedMemTable from Scan during the load, got %v", err)
+	}
+
+	if err := second.End(); err != nil {
+		t.Fatalf("End failed: %v", err)
+	}
+	if backend := memTableBackend(db); backend != SkipListBackend {
+		t.Errorf("Expected the skip list backend after the last session, got %d", backend)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if n := len(collect(t, db, ReadOptions{})); n != 200 {
+		t.Errorf("Expected 200 entries, got %d", n)
+	}
+	n := 0
+	if err := db.Scan(nil, nil, func(key, value []byte) bool {
+		n++
+		return true
+	}); err != nil || n != 200 {
+		t.Errorf("Expected Scan to return 200 entries, got %d (err %v)", n, err)
+	}
+
+	// A new session switches the backend again
+	third, err := db.BeginLoad()
+	if err != nil {
+		t.Fatalf("BeginLoad failed: %v", err)
+	}
+	defer third.End()
+	db.Put([]byte("third"), []byte("1"))
+	if backend := memTableBackend(db); backend != VectorBackend {
+		t.Errorf("Expected the vector backend in a new session, got %d", backend)
+	}
+}
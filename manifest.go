@@ -0,0 +1,275 @@
+package golsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+var errCorruptManifest = errors.New("corrupt manifest")
+
+// tableMeta describes a live SSTable. The key range covers both the entries
+// and the range tombstones of the table.
+type tableMeta struct {
+	fileNum     uint64
+	level       int
+	size        uint64
+	smallest    []byte
+	largest     []byte
+	smallestSeq uint64
+	largestSeq  uint64
+	cf          uint32 // number of the column family the table belongs to
+
+	// globalSeq is the sequence number of every entry of a table added by
+	// IngestExternalFile, whose values are stored without one, and 0 for
+	// the tables the DB writes itself
+	globalSeq uint64
+}
+
+// columnFamilyMeta describes a column family
+type columnFamilyMeta struct {
+	id     uint32
+	name   string
+	logNum uint64 // WAL files numbered below logNum hold none of its unflushed writes
+}
+
+// manifest is the persistent state of the DB: the column families, the live
+// tables and the counters needed to continue after a restart. It is rewritten in full to a
+// temporary file that is then renamed over MANIFEST, so a crash leaves either
+// the old or the new state on disk. The encoding is:
+//
+//	[next file number (uint64)][last sequence (uint64)][log number (uint64)][table count (uint32)]
+//	for each table: [file number (uint64)][level (uint32)][size (uint64)]
+//	                [smallest length (uint32)][smallest][largest length (uint32)][largest]
+//	                [smallest sequence (uint64)][largest sequence (uint64)]
+//	for each table: [global sequence (uint64)]
+//	[column family count (uint32)]
+//	for each column family: [id (uint32)][name length (uint32)][name][log number (uint64)]
+//	for each table: [column family id (uint32)]
+//	[CRC of all of the above (uint32)]
+//
+// The global sequences and the column families were added later; a manifest
+// without them is read as having no global sequences and only the default
+// column family, which all tables belong to.
+//
+// The tables of each column family are stored in read order: level 0 from
+// the newest table to the oldest, then the tables of level 1 by key range.
+type manifest struct {
+	nextFileNum    uint64
+	lastSeq        uint64
+	logNum         uint64 // WAL files numbered below logNum have been flushed
+	columnFamilies []columnFamilyMeta
+	tables         []tableMeta
+}
+
+// newManifest returns the manifest of an empty DB
+func newManifest() *manifest {
+	return &manifest{
+		nextFileNum:    1,
+		columnFamilies: []columnFamilyMeta{{name: DefaultColumnFamilyName}},
+	}
+}
+
+// columnFamilyLogNum returns the log number of the column family numbered
+// id, or that of the manifest if it has no such column family
+func (m *manifest) columnFamilyLogNum(id uint32) uint64 {
+	for _, cf := range m.columnFamilies {
+		if cf.id == id {
+			return cf.logNum
+		}
+	}
+	return m.logNum
+}
+
+func (m *manifest) encode() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, m.nextFileNum)
+	binary.Write(buf, binary.LittleEndian, m.lastSeq)
+	binary.Write(buf, binary.LittleEndian, m.logNum)
+	binary.Write(buf, binary.LittleEndian, uint32(len(m.tables)))
+
+	for _, t := range m.tables {
+		binary.Write(buf, binary.LittleEndian, t.fileNum)
+		binary.Write(buf, binary.LittleEndian, uint32(t.level))
+		binary.Write(buf, binary.LittleEndian, t.size)
+		binary.Write(buf, binary.LittleEndian, uint32(len(t.smallest)))
+		buf.Write(t.smallest)
+		binary.Write(buf, binary.LittleEndian, uint32(len(t.largest)))
+		buf.Write(t.largest)
+		binary.Write(buf, binary.LittleEndian, t.smallestSeq)
+		binary.Write(buf, binary.LittleEndian, t.largestSeq)
+	}
+	for _, t := range m.tables {
+		binary.Write(buf, binary.LittleEndian, t.globalSeq)
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(len(m.columnFamilies)))
+	for _, cf := range m.columnFamilies {
+		binary.Write(buf, binary.LittleEndian, cf.id)
+		binary.Write(buf, binary.LittleEndian, uint32(len(cf.name)))
+		buf.WriteString(cf.name)
+		binary.Write(buf, binary.LittleEndian, cf.logNum)
+	}
+	for _, t := range m.tables {
+		binary.Write(buf, binary.LittleEndian, t.cf)
+	}
+
+	binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
+
+func decodeManifest(data []byte) (*manifest, error) {
+	if len(data) < 4 {
+		return nil, errCorruptManifest
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return nil, errCorruptManifest
+	}
+
+	buf := bytes.NewReader(body)
+	m := &manifest{}
+	var count uint32
+	for _, v := range []interface{}{&m.nextFileNum, &m.lastSeq, &m.logNum, &count} {
+		if err := binary.Read(buf, binary.LittleEndian, v); err != nil {
+			return nil, errCorruptManifest
+		}
+	}
+
+	for i := uint32(0); i < count; i++ {
+		var t tableMeta
+		var level uint32
+		if err := binary.Read(buf, binary.LittleEndian, &t.fileNum); err != nil {
+			return nil, errCorruptManifest
+		}
+		if err := binary.Read(buf, binary.LittleEndian, &level); err != nil {
+			return nil, errCorruptManifest
+		}
+		if err := binary.Read(buf, binary.LittleEndian, &t.size); err != nil {
+			return nil, errCorruptManifest
+		}
+		var err error
+		if t.smallest, err = readLengthPrefixed(buf); err != nil {
+			return nil, errCorruptManifest
+		}
+		if t.largest, err = readLengthPrefixed(buf); err != nil {
+			return nil, errCorruptManifest
+		}
+		if err := binary.Read(buf, binary.LittleEndian, &t.smallestSeq); err != nil {
+			return nil, errCorruptManifest
+		}
+		if err := binary.Read(buf, binary.LittleEndian, &t.largestSeq); err != nil {
+			return nil, errCorruptManifest
+		}
+		t.level = int(level)
+		m.tables = append(m.tables, t)
+	}
+
+	if buf.Len() > 0 {
+		for i := range m.tables {
+			if err := binary.Read(buf, binary.LittleEndian, &m.tables[i].globalSeq); err != nil {
+				return nil, errCorruptManifest
+			}
+		}
+	}
+
+	if buf.Len() == 0 {
+		m.columnFamilies = []columnFamilyMeta{{name: DefaultColumnFamilyName, logNum: m.logNum}}
+		return m, nil
+	}
+	if err := binary.Read(buf, binary.LittleEndian, &count); err != nil {
+		return nil, errCorruptManifest
+	}
+	for i := uint32(0); i < count; i++ {
+		var cf columnFamilyMeta
+		if err := binary.Read(buf, binary.LittleEndian, &cf.id); err != nil {
+			return nil, errCorruptManifest
+		}
+		name, err := readLengthPrefixed(buf)
+		if err != nil {
+			return nil, errCorruptManifest
+		}
+		cf.name = string(name)
+		if err := binary.Read(buf, binary.LittleEndian, &cf.logNum); err != nil {
+			return nil, errCorruptManifest
+		}
+		m.columnFamilies = append(m.columnFamilies, cf)
+	}
+	// The default column family comes first
+	if len(m.columnFamilies) == 0 || m.columnFamilies[0].id != 0 {
+		return nil, errCorruptManifest
+	}
+	for i := range m.tables {
+		if err := binary.Read(buf, binary.LittleEndian, &m.tables[i].cf); err != nil {
+			return nil, errCorruptManifest
+		}
+	}
+
+	return m, nil
+}
+
+// readManifest loads the manifest from dir. It returns an error satisfying
+// errors.Is(err, os.ErrNotExist) when the DB has no manifest yet.
+func readManifest(fs vfs.FS, dir string) (*manifest, error) {
+	data, err := vfs.ReadFile(fs, filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	return decodeManifest(data)
+}
+
+// writeManifest atomically replaces the manifest in dir with m
+func writeManifest(fs vfs.FS, dir string, m *manifest) error {
+	tmpName := filepath.Join(dir, ManifestFileName+".tmp")
+	if err := vfs.WriteFile(fs, tmpName, m.encode()); err != nil {
+		return err
+	}
+
+	if err := fs.Rename(tmpName, filepath.Join(dir, ManifestFileName)); err != nil {
+		return err
+	}
+	return fs.Sync(dir)
+}
+
+func tableFileName(dir string, fileNum uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%06d.sst", SSTableFilePrefix, fileNum))
+}
+
+func blobFileName(dir string, fileNum uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%06d.blob", BlobFilePrefix, fileNum))
+}
+
+func walFileName(dir string, fileNum uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%06d.log", WALFilePrefix, fileNum))
+}
+
+// listFileNums returns the sorted numbers of the files in dir named
+// prefix<number>suffix
+func listFileNums(fs vfs.FS, dir, prefix, suffix string) ([]uint64, error) {
+	names, err := fs.List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var nums []uint64
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		num, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		nums = append(nums, num)
+	}
+
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums, nil
+}
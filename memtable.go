@@ -1,62 +1,361 @@
 package golsm
 
 import (
+	"math"
+	"sort"
 	"sync"
 
 	"github.com/vikramcse/go-lsm/internal/ds"
+	"github.com/vikramcse/go-lsm/internal/kv"
 )
 
+// rangeTombstoneOverhead approximates the memory of a kv.RangeTombstone
+// beyond its start and end keys: two slice headers and the sequence number
+const rangeTombstoneOverhead = 56
+
 type MemTable struct {
-	data ds.MemTableImpl
-	mu   sync.RWMutex // this is for thread safety
-	size int64        // track the size of the memtable
+	data      ds.MemTableImpl[kv.Entry]
+	rangeDels []kv.RangeTombstone // range tombstones, in the order they were added
+	mu        sync.RWMutex        // this is for thread safety
+	size      int64               // approximate memory used by keys, values and per-entry overhead
+	wbm       *WriteBufferManager // optional manager shared with other memtables
+	sealed    bool                // whether the MemTable stopped taking writes
+	released  bool                // whether size has been returned to wbm
+	mergeOp   MergeOperator       // folds merge operands as they are added, if set
+
+	// Entries replaced while a snapshot may still read them are kept in
+	// older, oldest first, so that reads at the snapshot's sequence number
+	// find them. pinnedSeq is the newest sequence number such a read uses,
+	// if pinned.
+	older     map[string][]kv.Entry
+	pinned    bool
+	pinnedSeq uint64
 }
 
 // NewMemTable creates and initializes a new MemTable
-func NewMemTable(ds ds.MemTableImpl) *MemTable {
+func NewMemTable(ds ds.MemTableImpl[kv.Entry]) *MemTable {
 	return &MemTable{
 		data: ds,
 		size: 0,
 	}
 }
 
-// Put adds or updates a key-value pair in the MemTable
-func (m *MemTable) Put(key string, value []byte) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+// NewMemTableWithWriteBufferManager creates a MemTable whose memory usage is
+// also charged to wbm, so that the total across all memtables sharing the
+// manager can be capped.
+func NewMemTableWithWriteBufferManager(ds ds.MemTableImpl[kv.Entry], wbm *WriteBufferManager) *MemTable {
+	m := NewMemTable(ds)
+	m.wbm = wbm
+	return m
+}
+
+// Put adds or updates the entry for key in the MemTable. The key and the
+// entry's value are copied.
+func (m *MemTable) Put(key []byte, e kv.Entry) {
+	// One allocation holds both, and is never modified afterwards
+	buf := make([]byte, len(key)+len(e.Value))
+	copy(buf, key)
+	copy(buf[len(key):], e.Value)
+	key, e.Value = buf[:len(key):len(key)], buf[len(key):]
 
-	// If key exists, subtract its value length from size
-	if existing, ok := m.data.Get(key); ok {
-		m.size -= int64(len(existing.([]byte)))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// A new key costs the key, the value and the backend's node overhead.
+	// Overwriting an existing key only changes the value bytes, unless the
+	// backend is append-only or a snapshot still reads the replaced entry,
+	// and both entries are kept.
+	delta := int64(len(key)) + int64(len(e.Value)) + m.data.EntryOverhead()
+	if _, appendOnly := m.data.(ds.AppendOnly); !appendOnly {
+		if existing, ok := m.data.Get(key); ok {
+			if m.pinned && existing.Seq <= m.pinnedSeq {
+				if m.older == nil {
+					m.older = make(map[string][]kv.Entry)
+				}
+				m.older[string(key)] = append(m.older[string(key)], existing)
+			} else {
+				delta = int64(len(e.Value)) - int64(len(existing.Value))
+			}
+		}
 	}
 
-	m.data.Set(key, value)
-	m.size += int64(len(value))
+	m.data.Set(key, e)
+	m.size += delta
+	if m.wbm != nil && !m.released {
+		m.wbm.ReserveMem(delta)
+	}
 }
 
-// Get retrieves a value for a given key from the MemTable
-func (m *MemTable) Get(key string) ([]byte, bool) {
+// AddRangeTombstone records a range deletion in the MemTable. Range
+// tombstones are kept apart from the point entries, which they do not
+// modify; readers check entries against them.
+func (m *MemTable) AddRangeTombstone(t kv.RangeTombstone) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	value, ok := m.data.Get(key)
-	if !ok {
-		return nil, false
+	m.rangeDels = append(m.rangeDels, t)
+
+	delta := int64(len(t.Start)+len(t.End)) + rangeTombstoneOverhead
+	m.size += delta
+	if m.wbm != nil && !m.released {
+		m.wbm.ReserveMem(delta)
+	}
+}
+
+// RangeTombstones returns the range tombstones of the MemTable. The returned
+// slice must not be modified.
+func (m *MemTable) RangeTombstones() []kv.RangeTombstone {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.rangeDels[:len(m.rangeDels):len(m.rangeDels)]
+}
+
+// Get retrieves the entry for a given key from the MemTable, which may be a
+// deletion
+func (m *MemTable) Get(key []byte) (kv.Entry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.data.Get(key)
+}
+
+// getAt is like Get, but returns the newest entry for key written at or
+// before seq. The merge operands an append-only backend keeps as entries of
+// their own are folded into it.
+func (m *MemTable) getAt(cmp Comparator, key []byte, seq uint64) (kv.Entry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	e, ok := m.data.Get(key)
+	if ok && e.Seq > seq {
+		e, ok = m.olderEntry(key, seq)
 	}
+	if _, appendOnly := m.data.(ds.AppendOnly); appendOnly && ok && e.Kind == kv.KindMerge {
+		return m.foldVersions(cmp, key, seq)
+	}
+	return e, ok
+}
 
-	return value.([]byte), true
+// olderEntry returns the newest entry for key written at or before seq once
+// a later one replaced it. m.mu must be held.
+func (m *MemTable) olderEntry(key []byte, seq uint64) (kv.Entry, bool) {
+	if _, appendOnly := m.data.(ds.AppendOnly); appendOnly {
+		// The entries of a key are returned in the order they were set
+		var found kv.Entry
+		ok := false
+		for it := m.data.Iterator(); it.Next(); {
+			if e := it.Value(); e.Seq <= seq && string(it.Key()) == string(key) {
+				found, ok = e, true
+			}
+		}
+		return found, ok
+	}
+
+	older := m.older[string(key)]
+	for i := len(older) - 1; i >= 0; i-- {
+		if older[i].Seq <= seq {
+			return older[i], true
+		}
+	}
+	return kv.Entry{}, false
 }
 
-// Size returns the current size of the MemTable in bytes
+// pin makes the MemTable keep the entries a read at seq finds when later
+// writes replace them
+func (m *MemTable) pin(seq uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pinned, m.pinnedSeq = true, max(m.pinnedSeq, seq)
+}
+
+// Size returns the approximate memory used by the MemTable in bytes,
+// including keys and the backend's per-entry overhead
 func (m *MemTable) Size() int64 {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	return m.size
 }
 
-// Len returns the number of entries in the MemTable
+// Len returns the number of entries in the MemTable, which counts every
+// version of a key for an append-only backend
 func (m *MemTable) Len() int64 {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	return int64(m.data.Len())
 }
+
+// Empty reports whether the MemTable holds neither entries nor range
+// tombstones
+func (m *MemTable) Empty() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.Len() == 0 && len(m.rangeDels) == 0
+}
+
+// snapshot returns a copy-on-write snapshot of the entries, which can be read
+// without the MemTable's lock, if the backend supports it
+func (m *MemTable) snapshot() (ds.MemTableImpl[kv.Entry], bool) {
+	s, ok := m.data.(ds.Snapshotter[kv.Entry])
+	if !ok {
+		return nil, false
+	}
+
+	// Taking a snapshot changes which nodes the backend owns
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return s.Snapshot(), true
+}
+
+// Ordered reports whether the backend keeps the entries in key order. The
+// entries of an unordered MemTable can only be walked in order with
+// AscendSorted.
+func (m *MemTable) Ordered() bool {
+	_, unordered := m.data.(ds.Unordered)
+	return !unordered
+}
+
+// overlaps reports whether an entry or a range tombstone of the MemTable
+// falls within [smallest, largest]. It scans every entry of an unordered
+// MemTable.
+func (m *MemTable) overlaps(cmp Comparator, smallest, largest []byte) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, t := range m.rangeDels {
+		if cmp.Compare(t.Start, largest) <= 0 && cmp.Compare(smallest, t.End) < 0 {
+			return true
+		}
+	}
+
+	it := m.data.Iterator()
+	if _, unordered := m.data.(ds.Unordered); !unordered {
+		return it.Seek(smallest) && cmp.Compare(it.Key(), largest) <= 0
+	}
+	for it.Next() {
+		if cmp.Compare(it.Key(), smallest) >= 0 && cmp.Compare(it.Key(), largest) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Ascend calls fn for every entry in ascending key order until fn returns
+// false. The MemTable is read-locked for the duration of the walk. Keys and
+// values are never modified, so fn may keep them. The MemTable must be
+// Ordered.
+func (m *MemTable) Ascend(fn func(key []byte, e kv.Entry) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	it := m.data.Iterator()
+	ascend(it, it.Next(), fn)
+}
+
+// AscendFrom is like Ascend but starts at the first key greater than or equal
+// to start
+func (m *MemTable) AscendFrom(start []byte, fn func(key []byte, e kv.Entry) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	it := m.data.Iterator()
+	ascend(it, it.Seek(start), fn)
+}
+
+// AscendSorted is like Ascend, but sorts the entries by cmp first, so it also
+// works on a MemTable that is not Ordered. Several entries for a key, as an
+// append-only backend keeps, are passed to fn as the one set last, with the
+// merge operands of the others folded into it. Sorting takes O(n log n) time
+// and a copy of every entry header.
+func (m *MemTable) AscendSorted(cmp Comparator, fn func(key []byte, e kv.Entry) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	type entry struct {
+		key []byte
+		e   kv.Entry
+		pos int
+	}
+	entries := make([]entry, 0, m.data.Len())
+	for it := m.data.Iterator(); it.Next(); {
+		entries = append(entries, entry{it.Key(), it.Value(), len(entries)})
+	}
+	// Entries of the same key stay in the order they were set, which the
+	// iterator returned them in
+	sort.Slice(entries, func(i, j int) bool {
+		if c := cmp.Compare(entries[i].key, entries[j].key); c != 0 {
+			return c < 0
+		}
+		return entries[i].pos < entries[j].pos
+	})
+
+	for i := 0; i < len(entries); i++ {
+		key, e := entries[i].key, entries[i].e
+		for ; i+1 < len(entries) && cmp.Compare(key, entries[i+1].key) == 0; i++ {
+			e = m.appendVersion(cmp, key, math.MaxUint64, e, entries[i+1].e)
+		}
+		if !fn(key, e) {
+			return
+		}
+	}
+}
+
+// ascend calls fn for the entries of it from its current position, which
+// holds an entry if ok
+func ascend(it ds.Iterator[kv.Entry], ok bool, fn func(key []byte, e kv.Entry) bool) {
+	for ; ok; ok = it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			return
+		}
+	}
+}
+
+// ShouldFlush reports whether the MemTable has reached limit bytes or the
+// shared WriteBufferManager, if any, asks for a flush.
+func (m *MemTable) ShouldFlush(limit int64) bool {
+	if m.wbm != nil && m.wbm.ShouldFlush() {
+		return true
+	}
+	return limit > 0 && m.Size() >= limit
+}
+
+// Seal tells the WriteBufferManager that the MemTable no longer takes writes
+// and is waiting to be flushed, so that it stops counting towards the
+// memory that triggers flushes. Calling it again is a no-op.
+func (m *MemTable) Seal() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seal()
+}
+
+func (m *MemTable) seal() {
+	if m.sealed {
+		return
+	}
+	if m.wbm != nil {
+		m.wbm.ScheduleFreeMem(m.size)
+	}
+	m.sealed = true
+}
+
+// isSealed reports whether the MemTable stopped taking writes, after which
+// its entries can be read in place
+func (m *MemTable) isSealed() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.sealed
+}
+
+// Release returns the MemTable's memory to the WriteBufferManager. It is
+// called once the MemTable has been flushed; calling it again is a no-op.
+func (m *MemTable) Release() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.wbm == nil || m.released {
+		return
+	}
+	m.seal()
+	m.wbm.FreeMem(m.size)
+	m.released = true
+}
@@ -1,13 +1,18 @@
 package golsm
 
 import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/vikramcse/go-lsm/internal/ds"
+	"github.com/vikramcse/go-lsm/internal/kv"
 )
 
 func TestMemtableSkipList(t *testing.T) {
-	skipListDS := ds.NewSkipListMemTable()
+	skipListDS := ds.NewSkipListMemTable[kv.Entry](BytewiseComparator)
 	mt := NewMemTable(skipListDS)
 
 	testCases := []struct {
@@ -20,22 +25,22 @@ func TestMemtableSkipList(t *testing.T) {
 	}
 
 	// Test Put
-	for _, tc := range testCases {
-		mt.Put(tc.key, tc.value)
+	for i, tc := range testCases {
+		mt.Put([]byte(tc.key), kv.Entry{Kind: kv.KindSet, Seq: uint64(i + 1), Value: tc.value})
 	}
 
-	for _, tc := range testCases {
-		value, ok := mt.Get(tc.key)
+	for i, tc := range testCases {
+		e, ok := mt.Get([]byte(tc.key))
 		if !ok {
 			t.Errorf("Key %s not found", tc.key)
 		}
-		if string(value) != string(tc.value) {
-			t.Errorf("Expected value %s, got %s", string(tc.value), string(value))
+		if string(e.Value) != string(tc.value) || e.Kind != kv.KindSet || e.Seq != uint64(i+1) {
+			t.Errorf("Expected value %s at seq %d, got %s at seq %d", string(tc.value), i+1, string(e.Value), e.Seq)
 		}
 	}
 
 	// Test non-existent key
-	_, exists := mt.Get("nonexistent")
+	_, exists := mt.Get([]byte("nonexistent"))
 	if exists {
 		t.Error("Expected false for non-existent key")
 	}
@@ -47,7 +52,7 @@ func TestMemtableSkipList(t *testing.T) {
 }
 
 func TestMemtableRBT(t *testing.T) {
-	rblDS := ds.NewRedBlackTreeMemTable()
+	rblDS := ds.NewRedBlackTreeMemTable[kv.Entry](BytewiseComparator)
 	mt := NewMemTable(rblDS)
 
 	testCases := []struct {
@@ -60,22 +65,22 @@ func TestMemtableRBT(t *testing.T) {
 	}
 
 	// Test Put
-	for _, tc := range testCases {
-		mt.Put(tc.key, tc.value)
+	for i, tc := range testCases {
+		mt.Put([]byte(tc.key), kv.Entry{Kind: kv.KindSet, Seq: uint64(i + 1), Value: tc.value})
 	}
 
-	for _, tc := range testCases {
-		value, ok := mt.Get(tc.key)
+	for i, tc := range testCases {
+		e, ok := mt.Get([]byte(tc.key))
 		if !ok {
 			t.Errorf("Key %s not found", tc.key)
 		}
-		if string(value) != string(tc.value) {
-			t.Errorf("Expected value %s, got %s", string(tc.value), string(value))
+		if string(e.Value) != string(tc.value) || e.Kind != kv.KindSet || e.Seq != uint64(i+1) {
+			t.Errorf("Expected value %s at seq %d, got %s at seq %d", string(tc.value), i+1, string(e.Value), e.Seq)
 		}
 	}
 
 	// Test non-existent key
-	_, exists := mt.Get("nonexistent")
+	_, exists := mt.Get([]byte("nonexistent"))
 	if exists {
 		t.Error("Expected false for non-existent key")
 	}
@@ -85,3 +90,202 @@ func TestMemtableRBT(t *testing.T) {
 		t.Errorf("Expected length %d, got %d", len(testCases), mt.Len())
 	}
 }
+
+func TestMemtableSizeAccounting(t *testing.T) {
+	skipListDS := ds.NewSkipListMemTable[kv.Entry](BytewiseComparator)
+	mt := NewMemTable(skipListDS)
+	overhead := skipListDS.EntryOverhead()
+
+	mt.Put([]byte("key1"), kv.Entry{Value: []byte("value1")})
+	expected := int64(len("key1")+len("value1")) + overhead
+	if mt.Size() != expected {
+		t.Errorf("Expected size %d, got %d", expected, mt.Size())
+	}
+
+	// Overwriting only changes the value bytes
+	mt.Put([]byte("key1"), kv.Entry{Value: []byte("v")})
+	expected = int64(len("key1")+len("v")) + overhead
+	if mt.Size() != expected {
+		t.Errorf("Expected size %d after overwrite, got %d", expected, mt.Size())
+	}
+
+	// Empty values still cost the key and the overhead
+	mt.Put([]byte("key2"), kv.Entry{Kind: kv.KindDelete})
+	expected += int64(len("key2")) + overhead
+	if mt.Size() != expected {
+		t.Errorf("Expected size %d, got %d", expected, mt.Size())
+	}
+}
+
+func TestWriteBufferManager(t *testing.T) {
+	rblDS := ds.NewRedBlackTreeMemTable[kv.Entry](BytewiseComparator)
+	entrySize := int64(len("key1")+len("value1")) + rblDS.EntryOverhead()
+
+	wbm := NewWriteBufferManager(3 * entrySize)
+	mt1 := NewMemTableWithWriteBufferManager(rblDS, wbm)
+	mt2 := NewMemTableWithWriteBufferManager(ds.NewSkipListMemTable[kv.Entry](BytewiseComparator), wbm)
+
+	mt1.Put([]byte("key1"), kv.Entry{Value: []byte("value1")})
+	mt1.Put([]byte("key2"), kv.Entry{Value: []byte("value2")})
+	if mt1.ShouldFlush(0) || mt2.ShouldFlush(0) {
+		t.Fatal("Expected no flush below the shared budget")
+	}
+
+	mt2.Put([]byte("key3"), kv.Entry{Value: []byte("value3")})
+	if wbm.MemoryUsage() != mt1.Size()+mt2.Size() {
+		t.Errorf("Expected usage %d, got %d", mt1.Size()+mt2.Size(), wbm.MemoryUsage())
+	}
+	if !mt1.ShouldFlush(0) || !mt2.ShouldFlush(0) {
+		t.Error("Expected flush once the shared budget is exceeded")
+	}
+
+	mt1.Release()
+	mt1.Release()
+	if wbm.MemoryUsage() != mt2.Size() {
+		t.Errorf("Expected usage %d after release, got %d", mt2.Size(), wbm.MemoryUsage())
+	}
+	if wbm.ShouldFlush() {
+		t.Error("Expected no flush after releasing a memtable")
+	}
+
+	// Memtables waiting for a flush fill the budget, but switching the
+	// small active one would not free anything
+	mt3 := NewMemTableWithWriteBufferManager(ds.NewSkipListMemTable[kv.Entry](BytewiseComparator), wbm)
+	mt2.Put([]byte("key4"), kv.Entry{Value: []byte("value4")})
+	mt2.Seal()
+	mt3.Put([]byte("key5"), kv.Entry{Value: []byte("value5")})
+	if wbm.MemoryUsage() < wbm.BufferSize() {
+		t.Fatalf("Expected the budget to be used, usage %d", wbm.MemoryUsage())
+	}
+	if mt3.ShouldFlush(0) {
+		t.Error("Expected no flush while the active memtable holds little of the budget")
+	}
+	mt3.Put([]byte("key6"), kv.Entry{Value: []byte("value6")})
+	if !mt3.ShouldFlush(0) {
+		t.Error("Expected flush once the active memtable holds half of the budget")
+	}
+	mt2.Release()
+	if wbm.MutableMemoryUsage() != mt3.Size() {
+		t.Errorf("Expected mutable usage %d, got %d", mt3.Size(), wbm.MutableMemoryUsage())
+	}
+}
+
+func TestMemtableCopiesEntries(t *testing.T) {
+	mt := NewMemTable(ds.NewSkipListMemTable[kv.Entry](BytewiseComparator))
+
+	key, value := []byte("key1"), []byte("value1")
+	mt.Put(key, kv.Entry{Kind: kv.KindSet, Seq: 1, Value: value})
+	copy(key, "XXXX")
+	copy(value, "XXXXXX")
+
+	e, ok := mt.Get([]byte("key1"))
+	if !ok || string(e.Value) != "value1" {
+		t.Errorf("Expected value1 to be unaffected by changes to the caller's buffers, got %q (found %v)", e.Value, ok)
+	}
+
+	var keys []string
+	mt.Ascend(func(key []byte, e kv.Entry) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	if len(keys) != 1 || keys[0] != "key1" {
+		t.Errorf("Expected [key1], got %v", keys)
+	}
+}
+
+func TestHashBackend(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, &Options{MemTableBackend: HashBackend})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+
+	for _, i := range rand.New(rand.NewSource(1)).Perm(500) {
+		key := fmt.Sprintf("key%04d", i)
+		if err := db.Put([]byte(key), []byte(key)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	db.Delete([]byte("key0100"))
+
+	if v, err := db.Get([]byte("key0042")); err != nil || string(v) != "key0042" {
+		t.Errorf("Expected key0042, got %q (err %v)", v, err)
+	}
+	if _, err := db.Get([]byte("key0100")); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+	}
+
+	// Range iteration fails instead of returning unordered data
+	if _, err := db.NewIterator(ReadOptions{}); err != ErrUnorderedMemTable {
+		t.Errorf("Expected ErrUnorderedMemTable, got %v", err)
+	}
+	if err := db.Scan(nil, nil, func(key, value []byte) bool { return true }); err != ErrUnorderedMemTable {
+		t.Errorf("Expected ErrUnorderedMemTable from Scan, got %v", err)
+	}
+
+	// The flush sorts the entries, after which they can be scanned
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	var keys []string
+	if err := db.Scan(nil, nil, func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(keys) != 499 || !sort.StringsAreSorted(keys) {
+		t.Errorf("Expected 499 sorted keys, got %d (sorted %v)", len(keys), sort.StringsAreSorted(keys))
+	}
+
+	// Entries replayed from the WAL land in a hash memtable as well
+	db.Put([]byte("key9999"), []byte("v"))
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	db, err = Open(dir, &Options{MemTableBackend: HashBackend})
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+	if v, err := db.Get([]byte("key9999")); err != nil || string(v) != "v" {
+		t.Errorf("Expected v after reopening, got %q (err %v)", v, err)
+	}
+}
+
+func TestVectorBackend(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{MemTableBackend: VectorBackend})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	// Every version of a key is appended; the flush keeps the newest
+	for round := 0; round < 3; round++ {
+		for _, i := range rand.New(rand.NewSource(int64(round))).Perm(300) {
+			key := fmt.Sprintf("key%04d", i)
+			db.Put([]byte(key), []byte(fmt.Sprintf("%s-%d", key, round)))
+		}
+	}
+	db.Delete([]byte("key0007"))
+
+	if v, err := db.Get([]byte("key0042")); err != nil || string(v) != "key0042-2" {
+		t.Errorf("Expected key0042-2, got %q (err %v)", v, err)
+	}
+	if _, err := db.NewIterator(ReadOptions{}); err != ErrUnorderedMemTable {
+		t.Errorf("Expected ErrUnorderedMemTable, got %v", err)
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	entries := collect(t, db, ReadOptions{})
+	if len(entries) != 299 {
+		t.Fatalf("Expected 299 entries, got %d", len(entries))
+	}
+	for i, e := range entries {
+		if !strings.HasSuffix(e, "-2") || (i > 0 && e <= entries[i-1]) {
+			t.Fatalf("Expected the newest versions in order, got %s after %s", e, entries[max(i-1, 0)])
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package golsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/vikramcse/go-lsm/internal/ds"
+	"github.com/vikramcse/go-lsm/internal/kv"
+)
+
+// ErrNoMergeOperator is returned by Merge, and by reads that find merge
+// operands, when Options.MergeOperator is not set
+var ErrNoMergeOperator = errors.New("no merge operator configured")
+
+// MergeOperator combines the operands recorded by DB.Merge with the value of
+// their key. Operands are stored as they are written and only combined when
+// the key is read or compacted, so a read-modify-write does not need a read.
+type MergeOperator interface {
+	// Name identifies the operator in errors
+	Name() string
+
+	// FullMerge applies the operands, oldest first, to the existing value
+	// of key and returns the new value. existing is nil when the key has
+	// no value.
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// PartialMerger is implemented by MergeOperators that can combine two
+// operands into one without the value they apply to. The memtable then keeps
+// a single operand per key rather than every operand merged into it.
+type PartialMerger interface {
+	// PartialMerge returns the operand equivalent to applying left, then
+	// right, and false if they cannot be combined
+	PartialMerge(key, left, right []byte) ([]byte, bool)
+}
+
+// Uint64AddOperator treats values and operands as 8-byte little-endian
+// unsigned integers and adds them up. A key without a value counts as 0.
+var Uint64AddOperator MergeOperator = uint64AddOperator{}
+
+type uint64AddOperator struct{}
+
+func (uint64AddOperator) Name() string {
+	return "golsm.Uint64Add"
+}
+
+func (uint64AddOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum uint64
+	for i, v := range append([][]byte{existing}, operands...) {
+		if i == 0 && v == nil {
+			continue
+		}
+		if len(v) != 8 {
+			return nil, fmt.Errorf("value of %d bytes is not a uint64", len(v))
+		}
+		sum += binary.LittleEndian.Uint64(v)
+	}
+	return binary.LittleEndian.AppendUint64(nil, sum), nil
+}
+
+func (uint64AddOperator) PartialMerge(key, left, right []byte) ([]byte, bool) {
+	if len(left) != 8 || len(right) != 8 {
+		return nil, false
+	}
+	sum := binary.LittleEndian.Uint64(left) + binary.LittleEndian.Uint64(right)
+	return binary.LittleEndian.AppendUint64(nil, sum), true
+}
+
+// NewStringAppendOperator returns an operator that appends the operands to
+// the value, separated by delimiter. A key without a value starts out empty.
+func NewStringAppendOperator(delimiter string) MergeOperator {
+	return stringAppendOperator{delimiter: delimiter}
+}
+
+type stringAppendOperator struct {
+	delimiter string
+}
+
+func (stringAppendOperator) Name() string {
+	return "golsm.StringAppend"
+}
+
+func (o stringAppendOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	result := append([]byte(nil), existing...)
+	for i, operand := range operands {
+		if i > 0 || existing != nil {
+			result = append(result, o.delimiter...)
+		}
+		result = append(result, operand...)
+	}
+	return result, nil
+}
+
+func (o stringAppendOperator) PartialMerge(key, left, right []byte) ([]byte, bool) {
+	result := make([]byte, 0, len(left)+len(o.delimiter)+len(right))
+	result = append(result, left...)
+	result = append(result, o.delimiter...)
+	return append(result, right...), true
+}
+
+// A KindMerge entry holds the operands merged into its key since the entry
+// the memtable replaced, which it takes as its base when there was one:
+//
+//	[base (uint8)][base value length (uvarint)][base value]
+//	for each operand, oldest first: [length (uvarint)][operand]
+//
+// The base value is only present for mergeBaseValue, and mergeBaseExpiring,
+// for which it is the user value of a KindSetTTL entry. With mergeBaseNone
+// the key's older entries give the base.
+const (
+	mergeBaseNone     = 0 // the base is found in older entries
+	mergeBaseDeleted  = 1 // the key had no value
+	mergeBaseValue    = 2 // the key had the base value
+	mergeBaseExpiring = 3 // the key had the base value until its expiry
+)
+
+// mergeOperands is the decoded value of a KindMerge entry
+type mergeOperands struct {
+	base      uint8
+	baseValue []byte
+	operands  [][]byte
+}
+
+func (m *mergeOperands) encode() []byte {
+	buf := []byte{m.base}
+	if m.base >= mergeBaseValue {
+		buf = binary.AppendUvarint(buf, uint64(len(m.baseValue)))
+		buf = append(buf, m.baseValue...)
+	}
+	for _, operand := range m.operands {
+		buf = binary.AppendUvarint(buf, uint64(len(operand)))
+		buf = append(buf, operand...)
+	}
+	return buf
+}
+
+// decodeMergeOperands decodes the value of a KindMerge entry. The slices
+// returned alias data.
+func decodeMergeOperands(data []byte) (*mergeOperands, error) {
+	if len(data) == 0 || data[0] > mergeBaseExpiring {
+		return nil, kv.ErrCorruptValue
+	}
+	m := &mergeOperands{base: data[0]}
+	data = data[1:]
+
+	next := func() ([]byte, error) {
+		n, size := binary.Uvarint(data)
+		if size <= 0 || n > uint64(len(data)-size) {
+			return nil, kv.ErrCorruptValue
+		}
+		v := data[size : size+int(n) : size+int(n)]
+		data = data[size+int(n):]
+		return v, nil
+	}
+	if m.base >= mergeBaseValue {
+		v, err := next()
+		if err != nil {
+			return nil, err
+		}
+		m.baseValue = v
+	}
+	for len(data) > 0 {
+		v, err := next()
+		if err != nil {
+			return nil, err
+		}
+		m.operands = append(m.operands, v)
+	}
+	return m, nil
+}
+
+// merge records a merge operand for key written at seq. The memtable keeps
+// one entry per key, so the operand is folded into the entry it replaces.
+// When that entry gives the value of the key, a value or a deletion, the
+// MergeOperator of the memtable applies the operand right away and the key
+// gets a plain value. Otherwise the operand is combined with the last
+// operand of a KindMerge entry if the operator is a PartialMerger, or
+// appended to them, and is only applied when read.
+//
+// An append-only backend keeps every entry, and looking up the one to
+// replace would scan all of them, so the operand is added as an entry of its
+// own. It is folded into the entries before it the same way when the key is
+// read or the memtable is flushed.
+func (m *MemTable) merge(cmp Comparator, key []byte, seq uint64, operand []byte) error {
+	if _, appendOnly := m.data.(ds.AppendOnly); appendOnly {
+		ops := &mergeOperands{operands: [][]byte{operand}}
+		m.Put(key, kv.Entry{Kind: kv.KindMerge, Seq: seq, Value: ops.encode()})
+		return nil
+	}
+
+	ops := &mergeOperands{}
+	if e, ok := m.Get(key); ok {
+		var err error
+		if ops, err = replacedOperands(e, m.deletedByRangeTombstone(cmp, key, e.Seq)); err != nil {
+			return err
+		}
+	}
+	m.Put(key, m.applyOperand(key, seq, ops, operand))
+	return nil
+}
+
+// replacedOperands returns the operands an operand is merged with when it
+// replaces e, which a range tombstone deletes if deleted
+func replacedOperands(e kv.Entry, deleted bool) (*mergeOperands, error) {
+	ops := &mergeOperands{}
+	switch {
+	case deleted:
+		ops.base = mergeBaseDeleted
+	case e.Kind == kv.KindMerge:
+		return decodeMergeOperands(e.Value)
+	case e.Kind == kv.KindSet:
+		ops.base, ops.baseValue = mergeBaseValue, e.Value
+	case e.Kind == kv.KindSetTTL:
+		ops.base, ops.baseValue = mergeBaseExpiring, e.Value
+	default:
+		ops.base = mergeBaseDeleted
+	}
+	return ops, nil
+}
+
+// applyOperand returns the entry for key written at seq once operand is
+// merged with ops
+func (m *MemTable) applyOperand(key []byte, seq uint64, ops *mergeOperands, operand []byte) kv.Entry {
+	// An operand the operator rejects is kept, so that reading the key
+	// reports the error
+	if m.mergeOp != nil && (ops.base == mergeBaseDeleted || ops.base == mergeBaseValue) {
+		value, err := m.mergeOp.FullMerge(key, ops.baseValue, append(ops.operands, operand))
+		if err == nil {
+			return kv.Entry{Kind: kv.KindSet, Seq: seq, Value: value}
+		}
+	}
+
+	if pm, ok := m.mergeOp.(PartialMerger); ok && len(ops.operands) > 0 {
+		last := len(ops.operands) - 1
+		if combined, ok := pm.PartialMerge(key, ops.operands[last], operand); ok {
+			ops.operands[last] = combined
+			return kv.Entry{Kind: kv.KindMerge, Seq: seq, Value: ops.encode()}
+		}
+	}
+
+	ops.operands = append(ops.operands, operand)
+	return kv.Entry{Kind: kv.KindMerge, Seq: seq, Value: ops.encode()}
+}
+
+// appendVersion returns the entry for key once e, the next entry an
+// append-only backend holds for it, is written over cur. The operands of a
+// KindMerge entry are folded into cur as merge does for other backends, with
+// the range tombstones a read at seq sees. m.mu must be held.
+func (m *MemTable) appendVersion(cmp Comparator, key []byte, seq uint64, cur, e kv.Entry) kv.Entry {
+	if e.Kind != kv.KindMerge {
+		return e
+	}
+	added, err := decodeMergeOperands(e.Value)
+	if err != nil || added.base != mergeBaseNone {
+		return e
+	}
+
+	deleted := false
+	for _, t := range m.rangeDels {
+		deleted = deleted || t.Seq <= seq && t.Covers(cmp, key, cur.Seq)
+	}
+	for _, operand := range added.operands {
+		ops, err := replacedOperands(cur, deleted)
+		if err != nil {
+			return e
+		}
+		cur, deleted = m.applyOperand(key, e.Seq, ops, operand), false
+	}
+	return cur
+}
+
+// foldVersions returns the entry for key a read at seq finds in an
+// append-only backend, with the operands of KindMerge entries folded into
+// the entries before them. m.mu must be held.
+func (m *MemTable) foldVersions(cmp Comparator, key []byte, seq uint64) (kv.Entry, bool) {
+	var cur kv.Entry
+	found := false
+	for it := m.data.Iterator(); it.Next(); {
+		e := it.Value()
+		if e.Seq > seq || string(it.Key()) != string(key) {
+			continue
+		}
+		if found {
+			e = m.appendVersion(cmp, key, seq, cur, e)
+		}
+		cur, found = e, true
+	}
+	return cur, found
+}
+
+// deletedByRangeTombstone reports whether a range tombstone of the MemTable
+// deletes the entry for key written at seq
+func (m *MemTable) deletedByRangeTombstone(cmp Comparator, key []byte, seq uint64) bool {
+	for _, t := range m.RangeTombstones() {
+		if t.Covers(cmp, key, seq) {
+			return true
+		}
+	}
+	return false
+}
+
+// merger combines the entries of a key, visited from the newest, once the
+// newest turned out to be a KindMerge entry
+type merger struct {
+	op    MergeOperator
+	key   []byte
+	now   int64      // Unix nanoseconds against which an expiring base is checked
+	lists [][][]byte // operands of the KindMerge entries visited, newest first
+	base  []byte     // nil until a base value is found
+}
+
+func newMerger(op MergeOperator, key []byte, now int64) (*merger, error) {
+	if op == nil {
+		return nil, ErrNoMergeOperator
+	}
+	return &merger{op: op, key: key, now: now}, nil
+}
+
+// add adds the next older entry of the key and reports whether older ones
+// are still needed. Entries must have been through entryResolver.resolve,
+// and deleted ones passed as KindDelete.
+func (m *merger) add(e kv.Entry) (bool, error) {
+	switch e.Kind {
+	case kv.KindMerge:
+		ops, err := decodeMergeOperands(e.Value)
+		if err != nil {
+			return false, err
+		}
+		m.lists = append(m.lists, ops.operands)
+		switch ops.base {
+		case mergeBaseValue:
+			m.base = append([]byte{}, ops.baseValue...)
+		case mergeBaseExpiring:
+			expiry, value, err := kv.DecodeExpiring(ops.baseValue)
+			if err != nil {
+				return false, err
+			}
+			if expiry > m.now {
+				m.base = append([]byte{}, value...)
+			}
+		}
+		return ops.base == mergeBaseNone, nil
+	case kv.KindSet:
+		m.base = append([]byte{}, e.Value...)
+	}
+	return false, nil
+}
+
+// finish applies the operands to the base value
+func (m *merger) finish() ([]byte, error) {
+	var operands [][]byte
+	for i := len(m.lists) - 1; i >= 0; i-- {
+		operands = append(operands, m.lists[i]...)
+	}
+	value, err := m.op.FullMerge(m.key, m.base, operands)
+	if err != nil {
+		return nil, fmt.Errorf("merge operator %s: %w", m.op.Name(), err)
+	}
+	return value, nil
+}
+
+// unmerged returns the value of a KindMerge entry holding the base value and
+// every operand added, for when finish fails and the entries cannot be
+// combined
+func (m *merger) unmerged() []byte {
+	ops := &mergeOperands{base: mergeBaseDeleted, baseValue: m.base}
+	if m.base != nil {
+		ops.base = mergeBaseValue
+	}
+	for i := len(m.lists) - 1; i >= 0; i-- {
+		ops.operands = append(ops.operands, m.lists[i]...)
+	}
+	return ops.encode()
+}
+
+// mergeVersions combines the encoded entries of key, newest first, the first
+// of which is a KindMerge entry. covered reports whether a range tombstone
+// deletes the entry written at seq.
+func mergeVersions(op MergeOperator, r entryResolver, key []byte, versions [][]byte, covered func(seq uint64) bool) ([]byte, error) {
+	m, err := addVersions(op, r, key, versions, covered)
+	if err != nil {
+		return nil, err
+	}
+	return m.finish()
+}
+
+// addVersions adds the encoded entries of key, newest first, to a merger
+// until the base of the operands is found
+func addVersions(op MergeOperator, r entryResolver, key []byte, versions [][]byte, covered func(seq uint64) bool) (*merger, error) {
+	m, err := newMerger(op, key, r.now)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		e, err := kv.DecodeEntry(v)
+		if err != nil {
+			return nil, err
+		}
+		if covered(e.Seq) {
+			break
+		}
+		if e, err = r.resolve(e); err != nil {
+			return nil, err
+		}
+		more, err := m.add(e)
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			break
+		}
+	}
+	return m, nil
+}
+
+// Merge records operand for key. The MergeOperator of the DB combines it
+// with the value of key, and with the operands merged before it, when key is
+// read or compacted.
+func (db *DB) Merge(key, operand []byte) error {
+	return db.def.Merge(key, operand)
+}
+
+// Merge records operand for key in the column family, to be combined by the
+// MergeOperator of the column family
+func (cf *ColumnFamily) Merge(key, operand []byte) error {
+	if cf.opts.MergeOperator == nil {
+		return ErrNoMergeOperator
+	}
+
+	b := &batch{}
+	b.merge(cf.id, key, operand)
+	return cf.db.write(b)
+}
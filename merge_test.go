@@ -0,0 +1,266 @@
+package golsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/vikramcse/go-lsm/internal/kv"
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+func uint64Value(n uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, n)
+}
+
+func expectCounter(t *testing.T, db *DB, key string, expected uint64) {
+	t.Helper()
+
+	value, err := db.Get([]byte(key))
+	if err != nil || len(value) != 8 || binary.LittleEndian.Uint64(value) != expected {
+		t.Errorf("Expected %s=%d, got %v (err %v)", key, expected, value, err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := &Options{FS: fs, MergeOperator: Uint64AddOperator}
+	db, err := Open("/db", opts)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+
+	// Operands in the memtable are folded together, and on top of a value
+	// or a deletion
+	for i := 0; i < 3; i++ {
+		if err := db.Merge([]byte("a"), uint64Value(1)); err != nil {
+			t.Fatalf("Merge failed: %v", err)
+		}
+	}
+	db.Put([]byte("b"), uint64Value(10))
+	db.Merge([]byte("b"), uint64Value(5))
+	db.Delete([]byte("c"))
+	db.Merge([]byte("c"), uint64Value(7))
+	expectCounter(t, db, "a", 3)
+	expectCounter(t, db, "b", 15)
+	expectCounter(t, db, "c", 7)
+
+	// Operands spread over tables are combined with the older entries when
+	// read, and into plain values by a compaction
+	db.Flush()
+	db.Merge([]byte("a"), uint64Value(10))
+	db.Merge([]byte("b"), uint64Value(100))
+	db.Flush()
+	db.Merge([]byte("a"), uint64Value(100))
+	expectCounter(t, db, "a", 113)
+	expectCounter(t, db, "b", 115)
+	entries := collect(t, db, ReadOptions{})
+	if len(entries) != 3 || entries[0] != "a="+string(uint64Value(113)) {
+		t.Errorf("Expected the iterator to combine the operands, got %q", entries)
+	}
+
+	db.Flush()
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	expectCounter(t, db, "a", 113)
+	expectCounter(t, db, "b", 115)
+
+	// Operands survive a reopen
+	db.Merge([]byte("a"), uint64Value(1000))
+	db.Close()
+	if db, err = Open("/db", opts); err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+	expectCounter(t, db, "a", 1113)
+
+	// A malformed operand fails the read rather than being dropped
+	db.Merge([]byte("a"), []byte("x"))
+	if _, err := db.Get([]byte("a")); err == nil {
+		t.Errorf("Expected an error for a malformed operand")
+	}
+}
+
+func TestMergeStringAppend(t *testing.T) {
+	db, err := Open("/db", &Options{FS: vfs.NewMem(), MergeOperator: NewStringAppendOperator(",")})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("list"), []byte("a"))
+	db.Flush()
+	db.Merge([]byte("list"), []byte("b"))
+	db.Flush()
+	db.Merge([]byte("list"), []byte("c"))
+	expectValue(t, db, "list", "a,b,c")
+
+	// A range deletion hides the older entries from later operands
+	db.Merge([]byte("new"), []byte("x"))
+	db.Flush()
+	db.DeleteRange([]byte("a"), []byte("z"))
+	db.Merge([]byte("list"), []byte("d"))
+	expectValue(t, db, "list", "d")
+	if _, err := db.Get([]byte("new")); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	db.Flush()
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	expectEntries(t, collect(t, db, ReadOptions{}), "list=d")
+}
+
+func TestMergeAppendOnlyMemTable(t *testing.T) {
+	db, err := Open("/db", &Options{FS: vfs.NewMem(), MemTableBackend: VectorBackend, MergeOperator: NewStringAppendOperator(",")})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	// Each operand is an entry of its own, folded into the entries before it
+	// when read
+	db.Put([]byte("list"), []byte("a"))
+	db.Merge([]byte("list"), []byte("b"))
+	db.Merge([]byte("list"), []byte("c"))
+	db.Merge([]byte("new"), []byte("x"))
+	if n := db.def.mem.Len(); n != 4 {
+		t.Errorf("Expected 4 entries in the memtable, got %d", n)
+	}
+	expectValue(t, db, "list", "a,b,c")
+	expectValue(t, db, "new", "x")
+
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		t.Fatalf("NewSnapshot failed: %v", err)
+	}
+	defer snap.Release()
+
+	// A range deletion hides the entries before it from later operands
+	db.DeleteRange([]byte("a"), []byte("z"))
+	db.Merge([]byte("list"), []byte("d"))
+	db.Merge([]byte("list"), []byte("e"))
+	expectValue(t, db, "list", "d,e")
+	if value, err := snap.Get([]byte("list")); err != nil || string(value) != "a,b,c" {
+		t.Errorf("Expected snapshot value a,b,c, got %q (err %v)", value, err)
+	}
+
+	// The flush writes the folded entries
+	db.Merge([]byte("new"), []byte("y"))
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	expectValue(t, db, "list", "d,e")
+	expectValue(t, db, "new", "y")
+	expectEntries(t, collect(t, db, ReadOptions{}), "list=d,e", "new=y")
+}
+
+// appendOperator is a string append operator that cannot combine operands
+// without their base
+type appendOperator struct{}
+
+func (appendOperator) Name() string {
+	return "appendOperator"
+}
+
+func (appendOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	return NewStringAppendOperator("").FullMerge(key, existing, operands)
+}
+
+func TestMergeFoldsOperandsInMemTable(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := Open("/db", &Options{FS: fs, MergeOperator: Uint64AddOperator})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	// Operands on top of a value become a plain value, and operands without
+	// a base in the memtable are combined into one, so the memtable does
+	// not grow with the number of operands
+	db.Put([]byte("a"), uint64Value(1))
+	db.Merge([]byte("b"), uint64Value(1))
+	db.mu.Lock()
+	mem := db.def.mem
+	db.mu.Unlock()
+	size := mem.Size()
+	for i := 0; i < 1000; i++ {
+		db.Merge([]byte("a"), uint64Value(1))
+		db.Merge([]byte("b"), uint64Value(1))
+	}
+	if mem.Size() != size {
+		t.Errorf("Expected the memtable to stay at %d bytes, got %d", size, mem.Size())
+	}
+	if e, _ := mem.Get([]byte("a")); e.Kind != kv.KindSet {
+		t.Errorf("Expected a plain value for a, got kind %d", e.Kind)
+	}
+	expectCounter(t, db, "a", 1001)
+	expectCounter(t, db, "b", 1001)
+
+	// Operators without PartialMerge keep every operand until read
+	other, err := Open("/other", &Options{FS: fs, MergeOperator: appendOperator{}})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer other.Close()
+	for _, operand := range []string{"x", "y", "z"} {
+		other.Merge([]byte("list"), []byte(operand))
+	}
+	expectValue(t, other, "list", "xyz")
+}
+
+func TestMergeWithoutOperator(t *testing.T) {
+	db, err := Open("/db", &Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Merge([]byte("a"), []byte("1")); !errors.Is(err, ErrNoMergeOperator) {
+		t.Errorf("Expected ErrNoMergeOperator, got %v", err)
+	}
+}
+
+func TestMergeMalformedOperandSurvivesCompaction(t *testing.T) {
+	db, err := Open("/db", &Options{FS: vfs.NewMem(), MergeOperator: Uint64AddOperator, L0CompactionTrigger: 2})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("a"), []byte("x"))
+	db.Put([]byte("b"), uint64Value(1))
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	db.Merge([]byte("a"), []byte{1})
+	db.Merge([]byte("b"), uint64Value(2))
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	// The compaction triggered by level 0 keeps the operand it cannot apply
+	// instead of failing, so later writes are not stopped
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if err := db.Put([]byte("c"), uint64Value(3)); err != nil {
+		t.Fatalf("Put after compaction failed: %v", err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush after compaction failed: %v", err)
+	}
+	expectCounter(t, db, "b", 3)
+	if _, err := db.Get([]byte("a")); err == nil {
+		t.Errorf("Expected an error for a malformed operand")
+	}
+
+	// A value written over the operand makes the key readable again
+	db.Put([]byte("a"), uint64Value(5))
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	expectCounter(t, db, "a", 5)
+}
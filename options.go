@@ -0,0 +1,306 @@
+package golsm
+
+import (
+	"cmp"
+	"time"
+
+	"github.com/vikramcse/go-lsm/internal/ds"
+	"github.com/vikramcse/go-lsm/internal/kv"
+	"github.com/vikramcse/go-lsm/internal/sstable"
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+// MemTableBackend selects the data structure that backs each memtable
+type MemTableBackend int
+
+const (
+	SkipListBackend MemTableBackend = iota
+	RedBlackTreeBackend
+	// BTreeBackend keeps entries inline in B-tree nodes. Iterators take a
+	// copy-on-write snapshot of it instead of copying its entries.
+	BTreeBackend
+	// HashBackend keeps entries in a hash map, for constant time writes
+	// and lookups, and sorts them only when the memtable is flushed. Range
+	// iteration fails with ErrUnorderedMemTable while such a memtable holds
+	// data. Keys are compared by their bytes for equality, so it only suits
+	// comparators that consider keys equal exactly when their bytes are.
+	HashBackend
+	// VectorBackend appends entries to a slice and sorts them only when the
+	// memtable is flushed, which makes writes cheaper than with any other
+	// backend. Like HashBackend it makes range iteration fail with
+	// ErrUnorderedMemTable and only suits bytewise equality, and its Get
+	// scans every entry. It is meant for bulk loads; DB.BeginLoad selects it
+	// for the duration of a load only.
+	VectorBackend
+)
+
+// Comparator orders the keys of a DB. Compare defines the order, Name
+// identifies it in every table so that a DB cannot be opened with another
+// ordering than the one it was written with, and Separator shortens the keys
+// stored in table indexes.
+type Comparator = kv.Comparator
+
+// BytewiseComparator orders keys lexicographically by their bytes. It is the
+// default comparator.
+var BytewiseComparator = kv.Bytewise
+
+// Compression selects how the data blocks of tables are compressed
+type Compression = sstable.CompressionType
+
+const (
+	NoCompression     = sstable.NoCompression
+	SnappyCompression = sstable.SnappyCompression
+)
+
+// CompactionStyle selects how the tables of a column family are compacted
+type CompactionStyle int
+
+const (
+	// LevelCompaction merges level 0 into level 1 once it has reached
+	// L0CompactionTrigger tables, keeping one entry per key
+	LevelCompaction CompactionStyle = iota
+	// FIFOCompaction never merges tables. Flushed tables stay in level 0
+	// and the oldest ones are deleted once the tables take more than
+	// FIFOMaxTableFilesSize bytes, which suits data only kept for a while,
+	// such as events. Overwritten and deleted entries are only dropped
+	// along with their tables.
+	FIFOCompaction
+)
+
+// Options configures a DB. Zero fields are replaced by the defaults from
+// DefaultOptions when the DB is opened.
+type Options struct {
+	// FS is the filesystem holding the DB's files, vfs.Default if nil
+	FS vfs.FS
+
+	// Comparator orders the keys, BytewiseComparator if nil. A DB must
+	// always be opened with the same comparator; opening its tables with
+	// another one fails with ErrComparatorMismatch.
+	Comparator Comparator
+
+	// MemTableBackend is the data structure used for new memtables
+	MemTableBackend MemTableBackend
+
+	// Compression compresses the data blocks of the tables the DB writes
+	Compression Compression
+
+	// CompactionStyle selects how tables are compacted
+	CompactionStyle CompactionStyle
+
+	// FIFOMaxTableFilesSize is the total size in bytes of the tables
+	// beyond which FIFOCompaction deletes the oldest ones
+	FIFOMaxTableFilesSize int64
+
+	// MemTableSize is the size in bytes at which the active memtable is
+	// switched to the immutable list and scheduled for a flush
+	MemTableSize int64
+
+	// WriteBufferManager, if set, is charged for the memory of every
+	// memtable of the DB and forces a switch when its budget is exceeded.
+	// Share one manager between DBs to cap their combined memory.
+	WriteBufferManager *WriteBufferManager
+
+	// SlowdownImmutableMemTables is the number of immutable memtables
+	// waiting to be flushed at which every write is delayed by a
+	// millisecond to let the flusher catch up
+	SlowdownImmutableMemTables int
+
+	// MaxImmutableMemTables is the number of immutable memtables waiting to
+	// be flushed at which writes stop until a flush completes
+	MaxImmutableMemTables int
+
+	// SyncWrites syncs the WAL to stable storage before a write returns
+	SyncWrites bool
+
+	// L0CompactionTrigger is the number of level 0 tables at which they are
+	// compacted into level 1
+	L0CompactionTrigger int
+
+	// TargetFileSize is the size in bytes at which a compaction starts a
+	// new output table
+	TargetFileSize int64
+
+	// TablePropertiesCollectors create the collectors whose properties are
+	// recorded in every table the DB writes, one collector per table
+	TablePropertiesCollectors []func() TablePropertiesCollector
+
+	// IndexPartitionSize, when positive, partitions the index of every
+	// table the DB writes into blocks of about that many bytes, which are
+	// read on demand instead of when the table is opened. It suits DBs
+	// with very large tables.
+	IndexPartitionSize int
+
+	// BlockCacheSize is the size in bytes of the cache that keeps data
+	// blocks and index partitions in memory between reads, no cache if 0
+	BlockCacheSize int64
+
+	// MergeOperator combines the operands written by DB.Merge with the
+	// values of their keys. Merge fails when it is nil.
+	MergeOperator MergeOperator
+
+	// CompactionFilterFactory, if set, creates the CompactionFilter each
+	// compaction passes its entries to. It may return nil to leave a
+	// compaction unfiltered.
+	CompactionFilterFactory func(ctx CompactionFilterContext) CompactionFilter
+
+	// BlobThreshold, when positive, moves values of at least that many
+	// bytes out of the tables as they are flushed, into blob files the
+	// tables reference. Compactions then copy the small references rather
+	// than the values. Zero keeps every value in the tables.
+	BlobThreshold int
+
+	// BlobGCRatio is the share of a blob file that must still be
+	// referenced by live tables. Files below it are rewritten after a
+	// compaction, along with the tables referencing them, to reclaim the
+	// space of values that were overwritten or deleted.
+	BlobGCRatio float64
+
+	// ColumnFamilies holds the options of the column families other than
+	// the default one, which the fields above configure. Open creates the
+	// column families listed that do not exist yet. Column families the DB
+	// has but that are not listed are opened with the default options.
+	ColumnFamilies map[string]*ColumnFamilyOptions
+
+	blockCache *sstable.Cache   // created from BlockCacheSize when the DB is opened
+	blobs      *blobSet         // created when the DB is opened
+	now        func() time.Time // the clock TTLs are checked against, replaced by tests
+}
+
+// DefaultOptions returns the options used for zero fields
+func DefaultOptions() *Options {
+	return &Options{
+		FS:                         vfs.Default,
+		Comparator:                 BytewiseComparator,
+		MemTableBackend:            SkipListBackend,
+		MemTableSize:               4 * 1024 * 1024,
+		SlowdownImmutableMemTables: 2,
+		MaxImmutableMemTables:      4,
+		L0CompactionTrigger:        4,
+		TargetFileSize:             2 * 1024 * 1024,
+		FIFOMaxTableFilesSize:      1024 * 1024 * 1024,
+		BlobGCRatio:                0.5,
+		now:                        time.Now,
+	}
+}
+
+// withDefaults returns a copy of o with zero fields set to their defaults
+func (o *Options) withDefaults() *Options {
+	defaults := DefaultOptions()
+	if o == nil {
+		return defaults
+	}
+
+	opts := *o
+	if opts.FS == nil {
+		opts.FS = defaults.FS
+	}
+	if opts.Comparator == nil {
+		opts.Comparator = defaults.Comparator
+	}
+	if opts.MemTableSize <= 0 {
+		opts.MemTableSize = defaults.MemTableSize
+	}
+	if opts.SlowdownImmutableMemTables <= 0 {
+		opts.SlowdownImmutableMemTables = defaults.SlowdownImmutableMemTables
+	}
+	if opts.MaxImmutableMemTables <= 0 {
+		opts.MaxImmutableMemTables = defaults.MaxImmutableMemTables
+	}
+	if opts.L0CompactionTrigger <= 0 {
+		opts.L0CompactionTrigger = defaults.L0CompactionTrigger
+	}
+	if opts.TargetFileSize <= 0 {
+		opts.TargetFileSize = defaults.TargetFileSize
+	}
+	if opts.FIFOMaxTableFilesSize <= 0 {
+		opts.FIFOMaxTableFilesSize = defaults.FIFOMaxTableFilesSize
+	}
+	if opts.BlobGCRatio <= 0 {
+		opts.BlobGCRatio = defaults.BlobGCRatio
+	}
+	if opts.now == nil {
+		opts.now = time.Now
+	}
+	if opts.BlockCacheSize > 0 {
+		opts.blockCache = sstable.NewCache(opts.BlockCacheSize)
+	}
+	return &opts
+}
+
+// ColumnFamilyOptions configures a column family. Zero fields are replaced by
+// the defaults from DefaultOptions, like those of Options; the fields of
+// Options that ColumnFamilyOptions lacks apply to every column family.
+type ColumnFamilyOptions struct {
+	MemTableBackend         MemTableBackend
+	MemTableSize            int64
+	Compression             Compression
+	CompactionStyle         CompactionStyle
+	FIFOMaxTableFilesSize   int64
+	L0CompactionTrigger     int
+	TargetFileSize          int64
+	BlobThreshold           int
+	MergeOperator           MergeOperator
+	CompactionFilterFactory func(ctx CompactionFilterContext) CompactionFilter
+}
+
+// withColumnFamilyOptions returns a copy of o, which has its defaults set,
+// configured for a column family by cfOpts
+func (o *Options) withColumnFamilyOptions(cfOpts *ColumnFamilyOptions) *Options {
+	if cfOpts == nil {
+		cfOpts = &ColumnFamilyOptions{}
+	}
+	defaults := DefaultOptions()
+
+	opts := *o
+	opts.MemTableBackend = cfOpts.MemTableBackend
+	opts.MemTableSize = cmp.Or(cfOpts.MemTableSize, defaults.MemTableSize)
+	opts.Compression = cfOpts.Compression
+	opts.CompactionStyle = cfOpts.CompactionStyle
+	opts.FIFOMaxTableFilesSize = cmp.Or(cfOpts.FIFOMaxTableFilesSize, defaults.FIFOMaxTableFilesSize)
+	opts.L0CompactionTrigger = cmp.Or(cfOpts.L0CompactionTrigger, defaults.L0CompactionTrigger)
+	opts.TargetFileSize = cmp.Or(cfOpts.TargetFileSize, defaults.TargetFileSize)
+	opts.BlobThreshold = cfOpts.BlobThreshold
+	opts.MergeOperator = cfOpts.MergeOperator
+	opts.CompactionFilterFactory = cfOpts.CompactionFilterFactory
+	opts.ColumnFamilies = nil
+	return &opts
+}
+
+// newMemTable creates an empty memtable with the given backend
+func (o *Options) newMemTable(backend MemTableBackend) *MemTable {
+	var impl ds.MemTableImpl[kv.Entry]
+	switch backend {
+	case RedBlackTreeBackend:
+		impl = ds.NewRedBlackTreeMemTable[kv.Entry](o.Comparator)
+	case BTreeBackend:
+		impl = ds.NewBTreeMemTable[kv.Entry](o.Comparator)
+	case HashBackend:
+		impl = ds.NewHashMemTable[kv.Entry]()
+	case VectorBackend:
+		impl = ds.NewVectorMemTable[kv.Entry]()
+	default:
+		impl = ds.NewSkipListMemTable[kv.Entry](o.Comparator)
+	}
+
+	m := NewMemTable(impl)
+	m.wbm = o.WriteBufferManager
+	m.mergeOp = o.MergeOperator
+	return m
+}
+
+// ReadOptions controls the entries an Iterator returns
+type ReadOptions struct {
+	// LowerBound is the inclusive lower bound of the keys, nil for none
+	LowerBound []byte
+
+	// UpperBound is the exclusive upper bound of the keys, nil for none
+	UpperBound []byte
+
+	// Prefix restricts the keys to those starting with it, nil for none.
+	// The comparator must keep the keys sharing a prefix together, as
+	// BytewiseComparator does.
+	Prefix []byte
+
+	// Snapshot reads from a snapshot instead of the current state of the DB
+	Snapshot *Snapshot
+}
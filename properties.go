@@ -0,0 +1,227 @@
+package golsm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vikramcse/go-lsm/internal/blob"
+	"github.com/vikramcse/go-lsm/internal/kv"
+	"github.com/vikramcse/go-lsm/internal/sstable"
+)
+
+// EntryKind is the kind of an entry as stored in a table
+type EntryKind = kv.Kind
+
+const (
+	EntryPut         = kv.KindSet
+	EntryDelete      = kv.KindDelete
+	EntryRangeDelete = kv.KindRangeDelete
+
+	// EntryBlob is a put whose value was moved to a blob file. Collectors
+	// see the encoded reference in place of the value.
+	EntryBlob = kv.KindBlob
+
+	// EntryMerge holds merge operands not yet combined with the value of
+	// their key, in an encoding internal to the DB
+	EntryMerge = kv.KindMerge
+
+	// EntryPutWithTTL is a put written with PutWithTTL. Collectors see the
+	// value without its expiry.
+	EntryPutWithTTL = kv.KindSetTTL
+)
+
+// TablePropertiesCollector gathers user-defined properties for a table the
+// DB writes. Options.TablePropertiesCollectors creates one per table.
+type TablePropertiesCollector interface {
+	// Name identifies the collector in errors
+	Name() string
+
+	// Add is called for every entry written to the table, in key order for
+	// point entries. For range deletions key is the start and value the end
+	// of the range.
+	Add(kind EntryKind, key, value []byte, seq uint64) error
+
+	// Finish adds the collected properties to props. Names starting with
+	// "sstable." or "golsm." are reserved.
+	Finish(props map[string]string) error
+}
+
+// TableProperties are the properties of a live table
+type TableProperties struct {
+	sstable.Properties
+
+	FileNum      uint64
+	Level        int
+	NumDeletions uint64 // Point deletions; range deletions are NumRangeDeletions
+	MinSeq       uint64
+	MaxSeq       uint64
+
+	// Entries written with PutWithTTL, and the earliest and latest of their
+	// expiry times; zero if there are none
+	NumExpiring uint64
+	MinExpiry   time.Time
+	MaxExpiry   time.Time
+}
+
+// Names of the properties recorded by the DB itself
+const (
+	propNumDeletions = "golsm.num.deletions"
+	propMinSeq       = "golsm.min.seq"
+	propMaxSeq       = "golsm.max.seq"
+)
+
+// TableProperties returns the properties of the live tables of the default
+// column family in read order
+func (db *DB) TableProperties() []TableProperties {
+	return db.def.TableProperties()
+}
+
+// TableProperties returns the properties of the live tables of the column
+// family in read order
+func (cf *ColumnFamily) TableProperties() []TableProperties {
+	cf.db.mu.Lock()
+	rs := cf.currentReadState()
+	cf.db.mu.Unlock()
+	defer rs.release()
+
+	props := make([]TableProperties, 0, len(rs.tables))
+	for _, t := range rs.tables {
+		p := TableProperties{FileNum: t.meta.fileNum, Level: t.meta.level}
+		if tp := t.reader.Properties(); tp != nil {
+			p.Properties = *tp
+			p.NumDeletions, _ = strconv.ParseUint(tp.User[propNumDeletions], 10, 64)
+			p.MinSeq, _ = strconv.ParseUint(tp.User[propMinSeq], 10, 64)
+			p.MaxSeq, _ = strconv.ParseUint(tp.User[propMaxSeq], 10, 64)
+			p.NumExpiring, _ = strconv.ParseUint(tp.User[propNumExpiring], 10, 64)
+			if p.NumExpiring > 0 {
+				minExpiry, _ := strconv.ParseInt(tp.User[propMinExpiry], 10, 64)
+				maxExpiry, _ := strconv.ParseInt(tp.User[propMaxExpiry], 10, 64)
+				p.MinExpiry, p.MaxExpiry = time.Unix(0, minExpiry), time.Unix(0, maxExpiry)
+			}
+		}
+		if t.meta.globalSeq != 0 {
+			p.MinSeq, p.MaxSeq = t.meta.globalSeq, t.meta.globalSeq
+		}
+		props = append(props, p)
+	}
+	return props
+}
+
+// internalCollector records the properties that depend on the engine's
+// value encoding
+type internalCollector struct {
+	deletions      uint64
+	minSeq, maxSeq uint64
+	empty          bool
+	blobRefs       map[uint64]uint64
+
+	expiring             uint64
+	minExpiry, maxExpiry int64
+}
+
+func (c *internalCollector) Name() string {
+	return "golsm.internal"
+}
+
+func (c *internalCollector) Add(kind sstable.BlockType, key, value []byte) error {
+	kvKind, seq, userValue, err := decodeTableEntry(kind, key, value)
+	if err != nil {
+		return err
+	}
+	switch kvKind {
+	case kv.KindDelete:
+		c.deletions++
+	case kv.KindBlob:
+		h, err := blob.DecodeHandle(userValue)
+		if err != nil {
+			return err
+		}
+		if c.blobRefs == nil {
+			c.blobRefs = make(map[uint64]uint64)
+		}
+		c.blobRefs[h.FileNum] += h.Size
+	case kv.KindSetTTL:
+		expiry, _, err := kv.DecodeExpiring(userValue)
+		if err != nil {
+			return err
+		}
+		if c.expiring == 0 || expiry < c.minExpiry {
+			c.minExpiry = expiry
+		}
+		if c.expiring == 0 || expiry > c.maxExpiry {
+			c.maxExpiry = expiry
+		}
+		c.expiring++
+	}
+	if c.empty || seq < c.minSeq {
+		c.minSeq = seq
+	}
+	if c.empty || seq > c.maxSeq {
+		c.maxSeq = seq
+	}
+	c.empty = false
+	return nil
+}
+
+func (c *internalCollector) Finish(props map[string]string) error {
+	props[propNumDeletions] = strconv.FormatUint(c.deletions, 10)
+	props[propMinSeq] = strconv.FormatUint(c.minSeq, 10)
+	props[propMaxSeq] = strconv.FormatUint(c.maxSeq, 10)
+	if len(c.blobRefs) > 0 {
+		props[propBlobRefs] = encodeBlobRefs(c.blobRefs)
+	}
+	if c.expiring > 0 {
+		props[propNumExpiring] = strconv.FormatUint(c.expiring, 10)
+		props[propMinExpiry] = strconv.FormatInt(c.minExpiry, 10)
+		props[propMaxExpiry] = strconv.FormatInt(c.maxExpiry, 10)
+	}
+	return nil
+}
+
+// userCollector passes decoded entries to a TablePropertiesCollector
+type userCollector struct {
+	c TablePropertiesCollector
+}
+
+func (u userCollector) Name() string {
+	return u.c.Name()
+}
+
+func (u userCollector) Add(kind sstable.BlockType, key, value []byte) error {
+	kvKind, seq, userValue, err := decodeTableEntry(kind, key, value)
+	if err != nil {
+		return err
+	}
+	if kvKind == kv.KindSetTTL {
+		if _, userValue, err = kv.DecodeExpiring(userValue); err != nil {
+			return err
+		}
+	}
+	return u.c.Add(kvKind, key, userValue, seq)
+}
+
+func (u userCollector) Finish(props map[string]string) error {
+	user := make(map[string]string)
+	if err := u.c.Finish(user); err != nil {
+		return err
+	}
+	for name, value := range user {
+		if strings.HasPrefix(name, "golsm.") {
+			return fmt.Errorf("property %s uses the reserved prefix golsm.", name)
+		}
+		props[name] = value
+	}
+	return nil
+}
+
+// decodeTableEntry decodes an entry as written to a table: a point entry or
+// a range tombstone, whose user value is the end of the range
+func decodeTableEntry(kind sstable.BlockType, key, value []byte) (kv.Kind, uint64, []byte, error) {
+	if kind == sstable.RangeDelBlock {
+		rd, err := kv.DecodeRangeTombstone(key, value)
+		return kv.KindRangeDelete, rd.Seq, rd.End, err
+	}
+	return kv.DecodeValue(value)
+}
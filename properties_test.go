@@ -0,0 +1,82 @@
+package golsm
+
+import (
+	"strconv"
+	"testing"
+)
+
+// kindCollector counts the entries of each kind it sees
+type kindCollector struct {
+	counts map[EntryKind]int
+}
+
+func (c *kindCollector) Name() string { return "kinds" }
+
+func (c *kindCollector) Add(kind EntryKind, key, value []byte, seq uint64) error {
+	c.counts[kind]++
+	return nil
+}
+
+func (c *kindCollector) Finish(props map[string]string) error {
+	for kind, n := range c.counts {
+		props["kinds."+kind.String()] = strconv.Itoa(n)
+	}
+	return nil
+}
+
+func TestTableProperties(t *testing.T) {
+	opts := &Options{
+		TablePropertiesCollectors: []func() TablePropertiesCollector{
+			func() TablePropertiesCollector { return &kindCollector{counts: make(map[EntryKind]int)} },
+		},
+	}
+	db, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	putRange(t, db, "a", 10)
+	if err := db.Delete([]byte("b")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := db.DeleteRange([]byte("c"), []byte("d")); err != nil {
+		t.Fatalf("DeleteRange failed: %v", err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	props := db.TableProperties()
+	if len(props) != 1 {
+		t.Fatalf("Expected 1 table, got %d", len(props))
+	}
+	p := props[0]
+
+	testCases := []struct {
+		name     string
+		got      uint64
+		expected uint64
+	}{
+		{"NumEntries", p.NumEntries, 11},
+		{"NumDeletions", p.NumDeletions, 1},
+		{"NumRangeDeletions", p.NumRangeDeletions, 1},
+		{"MinSeq", p.MinSeq, 1},
+		{"MaxSeq", p.MaxSeq, 12},
+	}
+	for _, tc := range testCases {
+		if tc.got != tc.expected {
+			t.Errorf("Expected %s %d, got %d", tc.name, tc.expected, tc.got)
+		}
+	}
+	if string(p.SmallestKey) != "a0000" || string(p.LargestKey) != "b" {
+		t.Errorf("Expected key range [a0000, b], got [%s, %s]", p.SmallestKey, p.LargestKey)
+	}
+
+	expected := map[string]string{"kinds.SET": "10", "kinds.DEL": "1", "kinds.RANGEDEL": "1"}
+	for name, value := range expected {
+		if p.User[name] != value {
+			t.Errorf("Expected user property %s=%s, got %q", name, value, p.User[name])
+		}
+	}
+}
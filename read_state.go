@@ -0,0 +1,195 @@
+package golsm
+
+import (
+	"math"
+	"time"
+
+	"github.com/vikramcse/go-lsm/internal/kv"
+	"github.com/vikramcse/go-lsm/internal/sstable"
+)
+
+// readState is the set of sources a read consults, in the order in which they
+// shadow each other: memtables from the newest to the oldest, then tables.
+// It holds a reference to each table until released.
+//
+// Reads only see the memtable entries and range tombstones written at or
+// before seq. The tables of a snapshot's read state were all written before
+// it was taken, while its memtables may take later writes.
+type readState struct {
+	cmp    Comparator
+	mems   []*MemTable
+	tables []*table
+	seq    uint64
+	blobs  *blobSet
+	merge  MergeOperator
+	now    func() time.Time
+}
+
+// currentReadState captures the sources of the column family. db.mu must be
+// held.
+func (cf *ColumnFamily) currentReadState() *readState {
+	db := cf.db
+	rs := cf.emptyReadState()
+	rs.mems = append(rs.mems, cf.mem)
+	for i := len(db.imm) - 1; i >= 0; i-- {
+		if db.imm[i].cf == cf {
+			rs.mems = append(rs.mems, db.imm[i].mem)
+		}
+	}
+	rs.tables = cf.tables
+	for _, t := range rs.tables {
+		t.ref()
+	}
+	return rs
+}
+
+// emptyReadState returns a read state of the column family without sources
+func (cf *ColumnFamily) emptyReadState() *readState {
+	return &readState{
+		cmp:   cf.opts.Comparator,
+		seq:   math.MaxUint64,
+		blobs: cf.opts.blobs,
+		merge: cf.opts.MergeOperator,
+		now:   cf.opts.now,
+	}
+}
+
+// release drops the references held on the tables
+func (rs *readState) release() {
+	for _, t := range rs.tables {
+		t.unref()
+	}
+}
+
+// get returns the value for key from the newest source that has it, unless a
+// range tombstone deletes it or it has expired. Merge operands are combined
+// with the entries of older sources.
+func (rs *readState) get(key []byte) ([]byte, error) {
+	r := rs.resolver()
+	var m *merger
+	for from := 0; ; {
+		e, next, err := rs.findEntry(key, from)
+		if err == ErrNotFound && m != nil {
+			return m.finish()
+		}
+		if err != nil {
+			return nil, err
+		}
+		from = next
+
+		if rs.coveredByRangeTombstone(key, e.Seq) {
+			e.Kind = kv.KindDelete
+		} else if e, err = r.resolve(e); err != nil {
+			return nil, err
+		}
+		if e.Kind == kv.KindDelete {
+			if m == nil {
+				return nil, ErrNotFound
+			}
+			return m.finish()
+		}
+		if m == nil && e.Kind != kv.KindMerge {
+			return append([]byte(nil), e.Value...), nil
+		}
+
+		if m == nil {
+			if m, err = newMerger(rs.merge, key, r.now); err != nil {
+				return nil, err
+			}
+		}
+		more, err := m.add(e)
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			return m.finish()
+		}
+	}
+}
+
+// resolver returns the entryResolver for a read starting now
+func (rs *readState) resolver() entryResolver {
+	return entryResolver{blobs: rs.blobs, now: rs.now().UnixNano()}
+}
+
+// findEntry returns the newest entry for key, which may be a deletion, from
+// the sources starting at index from, along with the index of the source
+// after the one holding it. Sources are numbered in read order.
+func (rs *readState) findEntry(key []byte, from int) (kv.Entry, int, error) {
+	for i := from; i < len(rs.mems); i++ {
+		if e, ok := rs.mems[i].getAt(rs.cmp, key, rs.seq); ok {
+			return e, i + 1, nil
+		}
+	}
+
+	for i := max(from-len(rs.mems), 0); i < len(rs.tables); i++ {
+		t := rs.tables[i]
+		if !t.mayContain(key) {
+			continue
+		}
+		value, err := t.get(key)
+		if err == sstable.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return kv.Entry{}, 0, err
+		}
+		e, err := kv.DecodeEntry(value)
+		return e, len(rs.mems) + i + 1, err
+	}
+
+	return kv.Entry{}, 0, ErrNotFound
+}
+
+// coveredByRangeTombstone reports whether any range tombstone deletes the
+// entry for key written at seq
+func (rs *readState) coveredByRangeTombstone(key []byte, seq uint64) bool {
+	for _, mem := range rs.mems {
+		for _, t := range mem.RangeTombstones() {
+			if t.Seq <= rs.seq && t.Covers(rs.cmp, key, seq) {
+				return true
+			}
+		}
+	}
+
+	for _, tbl := range rs.tables {
+		if !tbl.mayContain(key) {
+			continue
+		}
+		for _, t := range tbl.rangeDels {
+			if t.Covers(rs.cmp, key, seq) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// rangeTombstones returns the range tombstones of all sources that overlap
+// [lower, upper); nil bounds are unbounded
+func (rs *readState) rangeTombstones(lower, upper []byte) []kv.RangeTombstone {
+	var result []kv.RangeTombstone
+	add := func(tombstones []kv.RangeTombstone) {
+		for _, t := range tombstones {
+			if t.Seq > rs.seq {
+				continue
+			}
+			if upper != nil && rs.cmp.Compare(t.Start, upper) >= 0 {
+				continue
+			}
+			if lower != nil && rs.cmp.Compare(t.End, lower) <= 0 {
+				continue
+			}
+			result = append(result, t)
+		}
+	}
+
+	for _, mem := range rs.mems {
+		add(mem.RangeTombstones())
+	}
+	for _, t := range rs.tables {
+		add(t.rangeDels)
+	}
+	return result
+}
@@ -0,0 +1,335 @@
+package golsm
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/vikramcse/go-lsm/internal/kv"
+	"github.com/vikramcse/go-lsm/internal/sstable"
+)
+
+// RepairReport describes what Repair recovered and what was lost
+type RepairReport struct {
+	Tables         int      // tables in the rebuilt manifest
+	SalvagedTables []string // damaged tables whose readable entries were rewritten
+	MissingTables  []string // tables named by the old manifest that do not exist
+	Entries        int      // entries kept from tables
+	LostEntries    int      // entries dropped because they could not be decoded
+	Lost           []*sstable.ErrCorruption
+	LostBytes      uint64   // bytes of tables skipped as damaged
+	LogRecords     int      // write batches replayed from WAL files
+	TornLogs       []string // WAL files whose replay stopped at a damaged record
+}
+
+// Repair rebuilds the DB in dir when it cannot be opened, or when some of its
+// tables are damaged. opts may be nil; its FS is used to access dir. The DB
+// must not be open while it is repaired.
+//
+// Every SSTable in dir is read block by block. Intact tables are kept as
+// they are; the readable entries of damaged ones are rewritten into new
+// tables. The intact records of all WAL files are replayed into a new table
+// per column family. A new manifest is then written for all of them, keeping
+// the column families and levels recorded by the old manifest when it can
+// still be read; without it every table belongs to the default column
+// family. Damaged tables and logs are moved to the LostDirName subdirectory
+// rather than removed.
+func Repair(dir string, opts *Options) (*RepairReport, error) {
+	opts = opts.withDefaults()
+	opts.blobs = newBlobSet(opts.FS, dir)
+	db := &DB{dir: dir, opts: opts, fs: opts.FS, nextFileNum: 1}
+	report := &RepairReport{}
+
+	lock, err := db.fs.Lock(filepath.Join(dir, LockFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	tableNums, err := listFileNums(db.fs, dir, SSTableFilePrefix, ".sst")
+	if err != nil {
+		return nil, err
+	}
+	logNums, err := listFileNums(db.fs, dir, WALFilePrefix, ".log")
+	if err != nil {
+		return nil, err
+	}
+
+	// The old manifest, if it can be read, gives the column families and
+	// levels of the tables, the global sequence numbers of ingested ones and
+	// the counters to continue from. Without it the plain values of ingested
+	// tables cannot be told from encoded entries, and are lost.
+	levels := make(map[uint64]int)
+	globalSeqs := make(map[uint64]uint64)
+	cfs := make(map[uint64]uint32)
+	columnFamilies := newManifest().columnFamilies
+	if old, err := readManifest(db.fs, dir); err == nil {
+		db.nextFileNum, db.lastSeq = old.nextFileNum, old.lastSeq
+		columnFamilies = old.columnFamilies
+		onDisk := make(map[uint64]bool, len(tableNums))
+		for _, num := range tableNums {
+			onDisk[num] = true
+		}
+		for _, meta := range old.tables {
+			levels[meta.fileNum] = meta.level
+			globalSeqs[meta.fileNum] = meta.globalSeq
+			cfs[meta.fileNum] = meta.cf
+			if !onDisk[meta.fileNum] {
+				report.MissingTables = append(report.MissingTables, tableFileName(dir, meta.fileNum))
+			}
+		}
+	}
+
+	for _, meta := range columnFamilies {
+		db.addColumnFamily(meta.id, meta.name, opts.ColumnFamilies[meta.name])
+	}
+	columnFamily := func(id uint32) *ColumnFamily {
+		if cf := db.columnFamilyByID(id); cf != nil {
+			return cf
+		}
+		return db.cfs[0]
+	}
+
+	// Never reuse a file number found on disk
+	for _, nums := range [][]uint64{tableNums, logNums} {
+		if len(nums) > 0 && nums[len(nums)-1] >= db.nextFileNum {
+			db.nextFileNum = nums[len(nums)-1] + 1
+		}
+	}
+
+	var metas []tableMeta
+	var lost []string
+	for _, fileNum := range tableNums {
+		meta, damaged, err := db.repairTable(columnFamily(cfs[fileNum]), fileNum, levels[fileNum], globalSeqs[fileNum], report)
+		if err != nil {
+			return nil, err
+		}
+		if meta != nil {
+			metas = append(metas, *meta)
+		}
+		if damaged {
+			lost = append(lost, tableFileName(dir, fileNum))
+		}
+	}
+
+	mems := make(map[*ColumnFamily]*MemTable)
+	for _, cf := range db.cfs {
+		mems[cf] = cf.opts.newMemTable(cf.opts.MemTableBackend)
+		defer mems[cf].Release()
+	}
+	replayTo := func(id uint32) *MemTable {
+		return mems[columnFamily(id)]
+	}
+	for _, logNum := range logNums {
+		records, torn, err := db.replayLog(logNum, replayTo)
+		if err != nil {
+			return nil, err
+		}
+		report.LogRecords += records
+		if torn {
+			report.TornLogs = append(report.TornLogs, walFileName(dir, logNum))
+			lost = append(lost, walFileName(dir, logNum))
+		}
+	}
+	for _, cf := range db.cfs {
+		if mems[cf].Empty() {
+			continue
+		}
+		t, err := db.writeTable(cf, mems[cf], db.allocFileNum())
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, t.meta)
+		t.unref()
+	}
+
+	m := &manifest{}
+	for _, cf := range db.cfs {
+		var cfMetas []tableMeta
+		for _, meta := range metas {
+			if meta.cf == cf.id {
+				cfMetas = append(cfMetas, meta)
+			}
+		}
+		m.tables = append(m.tables, repairedTableOrder(db.opts.Comparator, cfMetas)...)
+	}
+	for _, meta := range m.tables {
+		if meta.largestSeq > db.lastSeq {
+			db.lastSeq = meta.largestSeq
+		}
+	}
+	m.nextFileNum, m.lastSeq, m.logNum = db.nextFileNum, db.lastSeq, db.nextFileNum
+	for _, cf := range db.cfs {
+		m.columnFamilies = append(m.columnFamilies, columnFamilyMeta{id: cf.id, name: cf.name, logNum: m.logNum})
+	}
+	if err := writeManifest(db.fs, dir, m); err != nil {
+		return nil, err
+	}
+	report.Tables = len(m.tables)
+
+	// Only touch the old files once the new manifest no longer needs them
+	if len(lost) > 0 {
+		lostDir := filepath.Join(dir, LostDirName)
+		if err := db.fs.MkdirAll(lostDir, 0755); err != nil {
+			return nil, err
+		}
+		for _, filename := range lost {
+			if err := db.fs.Rename(filename, filepath.Join(lostDir, filepath.Base(filename))); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, logNum := range logNums {
+		db.fs.Remove(walFileName(dir, logNum))
+	}
+	return report, db.fs.Sync(dir)
+}
+
+// repairTable salvages the table of cf numbered fileNum. It returns the
+// metadata of the table to keep, which is nil when nothing could be read, and
+// whether the original file is damaged. Damaged tables are rewritten to a new
+// file, with the values of an ingested table encoded at its globalSeq.
+func (db *DB) repairTable(cf *ColumnFamily, fileNum uint64, level int, globalSeq uint64, report *RepairReport) (*tableMeta, bool, error) {
+	filename := tableFileName(db.dir, fileNum)
+
+	var entries []sstable.Entry
+	var rangeDels []kv.RangeTombstone
+	lostEntries := 0
+	salvage, err := sstable.SalvageFS(db.fs, filename, func(kind sstable.BlockType, block []sstable.Entry) error {
+		for _, e := range block {
+			if kind == sstable.RangeDelBlock {
+				rd, err := kv.DecodeRangeTombstone(e.Key, e.Value)
+				if err != nil {
+					lostEntries++
+					continue
+				}
+				rangeDels = append(rangeDels, rd)
+				continue
+			}
+
+			if globalSeq != 0 {
+				e.Value = kv.EncodeValue(kv.KindSet, globalSeq, e.Value)
+			}
+			if _, _, _, err := kv.DecodeValue(e.Value); err != nil {
+				lostEntries++
+				continue
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	report.Lost = append(report.Lost, salvage.Lost...)
+	report.LostBytes += salvage.LostBytes
+	report.LostEntries += lostEntries
+	report.Entries += len(entries)
+
+	if len(entries) == 0 && len(rangeDels) == 0 {
+		return nil, true, nil
+	}
+
+	// Intact tables are kept, only their metadata is rebuilt
+	if salvage.OK() && lostEntries == 0 {
+		info, err := db.fs.Stat(filename)
+		if err != nil {
+			return nil, false, err
+		}
+
+		b := &tableBuilder{opts: cf.opts, meta: tableMeta{fileNum: fileNum, level: level, cf: cf.id, globalSeq: globalSeq}, empty: true}
+		for _, e := range entries {
+			_, seq, _, _ := kv.DecodeValue(e.Value)
+			b.extend(e.Key, e.Key, seq)
+		}
+		for _, rd := range rangeDels {
+			b.extend(rd.Start, rd.End, rd.Seq)
+		}
+		b.meta.size = uint64(info.Size())
+		return &b.meta, false, nil
+	}
+
+	report.SalvagedTables = append(report.SalvagedTables, filename)
+	entries = newestEntries(db.opts.Comparator, entries)
+
+	builder, err := newTableBuilder(db.dir, db.allocFileNum(), level, cf)
+	if err != nil {
+		return nil, true, err
+	}
+	for _, e := range entries {
+		if err := builder.add(e.Key, e.Value); err != nil {
+			builder.abandon()
+			return nil, true, err
+		}
+	}
+	for _, rd := range rangeDels {
+		builder.addRangeTombstone(rd)
+	}
+
+	t, err := builder.finish()
+	if err != nil {
+		return nil, true, err
+	}
+	meta := t.meta
+	t.unref()
+	return &meta, true, nil
+}
+
+// newestEntries sorts salvaged entries by key, keeping only the entry with
+// the highest sequence number for each key
+func newestEntries(cmp Comparator, entries []sstable.Entry) []sstable.Entry {
+	seqOf := func(e sstable.Entry) uint64 {
+		_, seq, _, _ := kv.DecodeValue(e.Value)
+		return seq
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if c := cmp.Compare(entries[i].Key, entries[j].Key); c != 0 {
+			return c < 0
+		}
+		return seqOf(entries[i]) > seqOf(entries[j])
+	})
+
+	out := entries[:0]
+	for _, e := range entries {
+		if len(out) > 0 && cmp.Compare(out[len(out)-1].Key, e.Key) == 0 {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// repairedTableOrder returns the tables in read order. Level 1 tables whose
+// key ranges overlap another level 1 table are moved to level 0, and level 0
+// is ordered from the newest table to the oldest by sequence number.
+func repairedTableOrder(cmp Comparator, metas []tableMeta) []tableMeta {
+	var top, bottom []tableMeta
+	for _, meta := range metas {
+		if meta.level == bottomLevel {
+			bottom = append(bottom, meta)
+		} else {
+			meta.level = 0
+			top = append(top, meta)
+		}
+	}
+
+	sort.Slice(bottom, func(i, j int) bool {
+		return cmp.Compare(bottom[i].smallest, bottom[j].smallest) < 0
+	})
+	var kept []tableMeta
+	for _, meta := range bottom {
+		if len(kept) > 0 && cmp.Compare(kept[len(kept)-1].largest, meta.smallest) >= 0 {
+			meta.level = 0
+			top = append(top, meta)
+			continue
+		}
+		kept = append(kept, meta)
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].largestSeq != top[j].largestSeq {
+			return top[i].largestSeq > top[j].largestSeq
+		}
+		return top[i].fileNum > top[j].fileNum
+	})
+	return append(top, kept...)
+}
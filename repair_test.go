@@ -0,0 +1,160 @@
+package golsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vikramcse/go-lsm/internal/sstable"
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+func TestRepairSalvagesDamagedTable(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+
+	putRange(t, db, "a", 2000)
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	putRange(t, db, "b", 10)
+	crash(db)
+
+	// Damage the second data block of the flushed table
+	tableNums, err := listFileNums(vfs.Default, dir, SSTableFilePrefix, ".sst")
+	if err != nil || len(tableNums) != 1 {
+		t.Fatalf("Expected 1 table, got %v (err %v)", tableNums, err)
+	}
+	filename := tableFileName(dir, tableNums[0])
+	reader, err := sstable.NewReader(filename)
+	if err != nil {
+		t.Fatalf("Failed to open table: %v", err)
+	}
+	index, err := reader.IndexEntries()
+	if err != nil {
+		t.Fatalf("Failed to read index: %v", err)
+	}
+	offset := index[1].BlockHandle.Offset
+	reader.Close()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read table: %v", err)
+	}
+	data[offset+100] ^= 0xff
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
+
+	report, err := Repair(dir, nil)
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if len(report.SalvagedTables) != 1 || report.SalvagedTables[0] != filename {
+		t.Errorf("Expected %s to be salvaged, got %v", filename, report.SalvagedTables)
+	}
+	if len(report.Lost) != 1 || report.Lost[0].Offset != int64(offset) {
+		t.Errorf("Expected one lost region at offset %d, got %v", offset, report.Lost)
+	}
+	if report.LogRecords != 10 {
+		t.Errorf("Expected 10 replayed log records, got %d", report.LogRecords)
+	}
+	if _, err := os.Stat(filepath.Join(dir, LostDirName, filepath.Base(filename))); err != nil {
+		t.Errorf("Expected damaged table in %s: %v", LostDirName, err)
+	}
+
+	db, err = Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+
+	if n := countKeys(t, db, "a"); n != report.Entries || n == 0 || n >= 2000 {
+		t.Errorf("Expected the %d salvaged a keys, got %d", report.Entries, n)
+	}
+	if n := countKeys(t, db, "b"); n != 10 {
+		t.Errorf("Expected 10 b keys from the WAL, got %d", n)
+	}
+	if _, err := db.Get([]byte("a0000")); err != nil {
+		t.Errorf("Expected a0000 from the first block, got %v", err)
+	}
+	if _, err := db.Get([]byte("a1999")); err != nil {
+		t.Errorf("Expected a1999 from the last block, got %v", err)
+	}
+}
+
+func TestRepairRebuildsManifest(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+
+	// Newer tables shadow older ones, so their order must be rebuilt too
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			if err := db.Put([]byte(key), []byte(fmt.Sprintf("v%d", round))); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		if round == 1 {
+			if err := db.Compact(); err != nil {
+				t.Fatalf("Compact failed: %v", err)
+			}
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+	}
+	if err := db.Delete([]byte("key050")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, ManifestFileName)); err != nil {
+		t.Fatalf("Failed to remove manifest: %v", err)
+	}
+
+	report, err := Repair(dir, nil)
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if len(report.Lost) != 0 || len(report.SalvagedTables) != 0 {
+		t.Errorf("Expected nothing lost, got %v", report.Lost)
+	}
+
+	db, err = Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		value, err := db.Get([]byte(key))
+		if i == 50 {
+			if err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for %s, got %v", key, err)
+			}
+			continue
+		}
+		if err != nil || string(value) != "v2" {
+			t.Errorf("Expected v2 for %s, got %q (err %v)", key, value, err)
+		}
+	}
+
+	// Writes continue after the recovered sequence numbers
+	if err := db.Put([]byte("key000"), []byte("v3")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if value, _ := db.Get([]byte("key000")); string(value) != "v3" {
+		t.Errorf("Expected v3, got %q", value)
+	}
+}
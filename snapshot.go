@@ -0,0 +1,96 @@
+package golsm
+
+import "errors"
+
+var ErrSnapshotReleased = errors.New("snapshot released")
+
+// Snapshot is a read-only view of the DB as it was when the snapshot was
+// taken. Later writes are not visible through it. It covers every column
+// family; those created after it was taken are empty in it.
+//
+// The snapshot shares the memtables and SSTables of the DB instead of copying
+// them, and reads the memtables at its sequence number. The active memtables
+// keep taking writes; those that replace an entry the snapshot reads keep the
+// replaced entry next to the new one until the memtable is dropped.
+type Snapshot struct {
+	db     *DB
+	states map[*ColumnFamily]*readState
+	seq    uint64 // sequence number of the last write the snapshot sees
+}
+
+// NewSnapshot takes a snapshot of the current state of the DB. Release it
+// once it is no longer needed.
+func (db *DB) NewSnapshot() (*Snapshot, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	s := &Snapshot{db: db, states: make(map[*ColumnFamily]*readState, len(db.cfs)), seq: db.lastSeq}
+	for _, cf := range db.cfs {
+		state := cf.currentReadState()
+		state.seq = s.seq
+		cf.mem.pin(s.seq)
+		s.states[cf] = state
+	}
+	if db.snapshots == nil {
+		db.snapshots = make(map[*Snapshot]struct{})
+	}
+	db.snapshots[s] = struct{}{}
+	return s, nil
+}
+
+// Get returns the value key had in the default column family when the
+// snapshot was taken, or ErrNotFound
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	return s.GetFrom(s.db.def, key)
+}
+
+// GetFrom returns the value key had in cf when the snapshot was taken, or
+// ErrNotFound
+func (s *Snapshot) GetFrom(cf *ColumnFamily, key []byte) ([]byte, error) {
+	state := s.readState(cf)
+	if state == nil {
+		return nil, ErrSnapshotReleased
+	}
+	return state.get(key)
+}
+
+// readState returns the sources of cf the snapshot reads, or nil once it is
+// released
+func (s *Snapshot) readState(cf *ColumnFamily) *readState {
+	if s.states == nil {
+		return nil
+	}
+	if state, ok := s.states[cf]; ok {
+		return state
+	}
+	return cf.emptyReadState()
+}
+
+// Release releases the snapshot, letting the DB remove the SSTables that
+// only the snapshot still uses. It must not be used afterwards.
+func (s *Snapshot) Release() {
+	if s.states != nil {
+		s.db.mu.Lock()
+		delete(s.db.snapshots, s)
+		s.db.mu.Unlock()
+
+		for _, state := range s.states {
+			state.release()
+		}
+		s.states = nil
+	}
+}
+
+// pinnedSeq returns the sequence number of the newest snapshot, which reads
+// every entry up to it, or 0 without snapshots. db.mu must be held.
+func (db *DB) pinnedSeq() uint64 {
+	var seq uint64
+	for s := range db.snapshots {
+		seq = max(seq, s.seq)
+	}
+	return seq
+}
@@ -0,0 +1,275 @@
+package golsm
+
+import (
+	"sync/atomic"
+
+	"github.com/vikramcse/go-lsm/internal/blob"
+	"github.com/vikramcse/go-lsm/internal/kv"
+	"github.com/vikramcse/go-lsm/internal/sstable"
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+// table is an open SSTable. Tables are reference counted: the DB holds a
+// reference while the table is live, and reads, iterators and snapshots hold
+// one while they use it. When a compaction replaces a table it is marked
+// obsolete, and its file is removed once the last reference is dropped.
+type table struct {
+	fs        vfs.FS
+	meta      tableMeta
+	filename  string
+	reader    *sstable.Reader
+	rangeDels []kv.RangeTombstone
+	cmp       kv.Comparator
+	blobs     *blobSet
+	blobRefs  map[uint64]uint64 // bytes referenced per blob file
+	expiry    int64             // when every entry has expired, 0 if never
+
+	refs     atomic.Int32
+	obsolete atomic.Bool
+}
+
+// openTable opens the SSTable described by meta with a single reference
+func openTable(opts *Options, dir string, meta tableMeta) (*table, error) {
+	filename := tableFileName(dir, meta.fileNum)
+	reader, err := sstable.NewReaderWithOptions(opts.FS, filename, sstable.ReaderOptions{
+		Cache:      opts.blockCache,
+		Comparator: opts.Comparator,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t := &table{fs: opts.FS, meta: meta, filename: filename, reader: reader, cmp: opts.Comparator, blobs: opts.blobs}
+	for _, e := range reader.RangeDeletions() {
+		rd, err := kv.DecodeRangeTombstone(e.Key, e.Value)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+		t.rangeDels = append(t.rangeDels, rd)
+	}
+	if props := reader.Properties(); props != nil {
+		if t.blobRefs, err = decodeBlobRefs(props.User[propBlobRefs]); err != nil {
+			reader.Close()
+			return nil, err
+		}
+	}
+	for fileNum := range t.blobRefs {
+		t.blobs.ref(fileNum)
+	}
+	t.expiry = tableExpiry(t)
+
+	t.refs.Store(1)
+	return t, nil
+}
+
+func (t *table) ref() {
+	t.refs.Add(1)
+}
+
+// unref drops a reference, closing the table when it was the last one and
+// removing its file if the table is obsolete
+func (t *table) unref() error {
+	if t.refs.Add(-1) != 0 {
+		return nil
+	}
+
+	err := t.reader.Close()
+	if t.obsolete.Load() {
+		t.fs.Remove(t.filename)
+	}
+	for fileNum := range t.blobRefs {
+		if blobErr := t.blobs.unref(fileNum); err == nil {
+			err = blobErr
+		}
+	}
+	return err
+}
+
+// get returns the encoded entry for key, or sstable.ErrKeyNotFound
+func (t *table) get(key []byte) ([]byte, error) {
+	value, err := t.reader.Get(key)
+	if err != nil || t.meta.globalSeq == 0 {
+		return value, err
+	}
+	return kv.EncodeValue(kv.KindSet, t.meta.globalSeq, value), nil
+}
+
+// newIterator returns an iterator over the encoded entries of the table
+func (t *table) newIterator() internalIterator {
+	if t.meta.globalSeq == 0 {
+		return t.reader.NewIterator()
+	}
+	return &globalSeqIterator{Iterator: t.reader.NewIterator(), seq: t.meta.globalSeq}
+}
+
+// globalSeqIterator encodes the plain values of an ingested table as entries
+// put at the table's global sequence number
+type globalSeqIterator struct {
+	*sstable.Iterator
+	seq uint64
+}
+
+func (it *globalSeqIterator) Value() []byte {
+	return kv.EncodeValue(kv.KindSet, it.seq, it.Iterator.Value())
+}
+
+// mayContain reports whether key falls within the table's key range, which
+// includes the ranges of its range tombstones
+func (t *table) mayContain(key []byte) bool {
+	return t.cmp.Compare(key, t.meta.smallest) >= 0 && t.cmp.Compare(key, t.meta.largest) <= 0
+}
+
+// overlaps reports whether the table's key range intersects [smallest, largest]
+func (t *table) overlaps(smallest, largest []byte) bool {
+	return t.cmp.Compare(t.meta.smallest, largest) <= 0 && t.cmp.Compare(smallest, t.meta.largest) <= 0
+}
+
+// tableBuilder writes entries to a new SSTable, tracking the key range and
+// sequence numbers recorded for it in the manifest
+type tableBuilder struct {
+	opts     *Options
+	fs       vfs.FS
+	dir      string
+	filename string
+	writer   *sstable.Writer
+	meta     tableMeta
+	empty    bool
+	dataSize uint64 // bytes of keys and values added so far
+
+	blob         *blob.Writer // created for the first value moved to a blob file
+	blobFilename string
+}
+
+// newTableBuilder creates the table numbered fileNum at level of cf, written
+// with the options of the column family
+func newTableBuilder(dir string, fileNum uint64, level int, cf *ColumnFamily) (*tableBuilder, error) {
+	opts := cf.opts
+	filename := tableFileName(dir, fileNum)
+	writer, err := sstable.NewFileWriterWithOptions(opts.FS, filename, sstable.WriterOptions{
+		IndexPartitionSize: opts.IndexPartitionSize,
+		Comparator:         opts.Comparator,
+		Compression:        opts.Compression,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	writer.AddPropertiesCollector(&internalCollector{empty: true})
+	for _, newCollector := range opts.TablePropertiesCollectors {
+		writer.AddPropertiesCollector(userCollector{newCollector()})
+	}
+
+	return &tableBuilder{
+		opts:     opts,
+		fs:       opts.FS,
+		dir:      dir,
+		filename: filename,
+		writer:   writer,
+		meta:     tableMeta{fileNum: fileNum, level: level, cf: cf.id},
+		empty:    true,
+	}, nil
+}
+
+// add appends an encoded entry. Keys must be added in increasing order.
+// Values of at least Options.BlobThreshold bytes are moved to the table's
+// blob file.
+func (b *tableBuilder) add(key, value []byte) error {
+	kind, seq, userValue, err := kv.DecodeValue(value)
+	if err != nil {
+		return err
+	}
+	if kind == kv.KindSet && b.opts.BlobThreshold > 0 && len(userValue) >= b.opts.BlobThreshold {
+		if value, err = b.addBlob(seq, userValue); err != nil {
+			return err
+		}
+	}
+	if err := b.writer.Write(string(key), value); err != nil {
+		return err
+	}
+
+	b.extend(key, key, seq)
+	b.dataSize += uint64(len(key) + len(value))
+	return nil
+}
+
+// addBlob writes value to the blob file, which is numbered like the table,
+// and returns the entry referencing it
+func (b *tableBuilder) addBlob(seq uint64, value []byte) ([]byte, error) {
+	if b.blob == nil {
+		b.blobFilename = blobFileName(b.dir, b.meta.fileNum)
+		w, err := blob.NewWriter(b.fs, b.blobFilename, b.meta.fileNum)
+		if err != nil {
+			return nil, err
+		}
+		b.blob = w
+	}
+
+	h, err := b.blob.Add(value)
+	if err != nil {
+		return nil, err
+	}
+	return kv.EncodeValue(kv.KindBlob, seq, h.Encode()), nil
+}
+
+// addRangeTombstone stores a range tombstone in the table
+func (b *tableBuilder) addRangeTombstone(t kv.RangeTombstone) {
+	b.writer.AddRangeDeletion(t.Start, kv.EncodeRangeTombstone(t))
+	b.extend(t.Start, t.End, t.Seq)
+}
+
+// extend widens the table's key and sequence number ranges
+func (b *tableBuilder) extend(smallest, largest []byte, seq uint64) {
+	if b.empty || b.opts.Comparator.Compare(smallest, b.meta.smallest) < 0 {
+		b.meta.smallest = append([]byte(nil), smallest...)
+	}
+	if b.empty || b.opts.Comparator.Compare(largest, b.meta.largest) > 0 {
+		b.meta.largest = append([]byte(nil), largest...)
+	}
+	if b.empty || seq < b.meta.smallestSeq {
+		b.meta.smallestSeq = seq
+	}
+	if b.empty || seq > b.meta.largestSeq {
+		b.meta.largestSeq = seq
+	}
+	b.empty = false
+}
+
+// finish completes the SSTable and opens it. The blob file is made durable
+// first, as the table references it.
+func (b *tableBuilder) finish() (*table, error) {
+	if b.blob != nil {
+		if err := b.blob.Close(); err != nil {
+			b.blob = nil
+			b.abandon()
+			return nil, err
+		}
+	}
+	if err := b.writer.Close(); err != nil {
+		b.fs.Remove(b.filename)
+		if b.blob != nil {
+			b.fs.Remove(b.blobFilename)
+		}
+		return nil, err
+	}
+
+	info, err := b.fs.Stat(b.filename)
+	if err != nil {
+		return nil, err
+	}
+	b.meta.size = uint64(info.Size())
+
+	return openTable(b.opts, b.dir, b.meta)
+}
+
+// abandon discards the partially written SSTable and its blob file
+func (b *tableBuilder) abandon() {
+	b.writer.Close()
+	b.fs.Remove(b.filename)
+	if b.blobFilename != "" {
+		if b.blob != nil {
+			b.blob.Close()
+		}
+		b.fs.Remove(b.blobFilename)
+	}
+}
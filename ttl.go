@@ -0,0 +1,133 @@
+package golsm
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/vikramcse/go-lsm/internal/kv"
+)
+
+// ErrInvalidTTL is returned by PutWithTTL for a TTL that is not positive
+var ErrInvalidTTL = errors.New("ttl must be positive")
+
+// PutWithTTL sets the value for key until ttl has passed. The entry records
+// its expiry time; once that is reached reads no longer see the key, as if
+// it was deleted, and compactions drop it.
+func (db *DB) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	return db.def.PutWithTTL(key, value, ttl)
+}
+
+// PutWithTTL sets the value for key in the column family until ttl has
+// passed
+func (cf *ColumnFamily) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+
+	b := &batch{}
+	b.putWithExpiry(cf.id, key, value, cf.opts.now().Add(ttl).UnixNano())
+	return cf.db.write(b)
+}
+
+// entryResolver turns the entries read from memtables and tables into plain
+// sets and deletions, for the kinds whose value needs more than decoding
+type entryResolver struct {
+	blobs *blobSet
+	now   int64 // Unix nanoseconds against which expiries are checked
+}
+
+// resolve returns a KindBlob entry as a KindSet entry holding the value read
+// from its blob file, and a KindSetTTL entry as a KindSet entry, or as a
+// KindDelete entry once it has expired. Other entries are returned as they
+// are.
+func (r entryResolver) resolve(e kv.Entry) (kv.Entry, error) {
+	switch e.Kind {
+	case kv.KindBlob:
+		value, err := r.blobs.read(e.Value)
+		if err != nil {
+			return kv.Entry{}, err
+		}
+		return kv.Entry{Kind: kv.KindSet, Seq: e.Seq, Value: value}, nil
+	case kv.KindSetTTL:
+		expiry, value, err := kv.DecodeExpiring(e.Value)
+		if err != nil {
+			return kv.Entry{}, err
+		}
+		if expiry <= r.now {
+			return kv.Entry{Kind: kv.KindDelete, Seq: e.Seq}, nil
+		}
+		return kv.Entry{Kind: kv.KindSet, Seq: e.Seq, Value: value}, nil
+	}
+	return e, nil
+}
+
+// Names of the expiry properties. Expiries are Unix nanoseconds, over the
+// KindSetTTL entries of the table.
+const (
+	propNumExpiring = "golsm.num.expiring"
+	propMinExpiry   = "golsm.min.expiry"
+	propMaxExpiry   = "golsm.max.expiry"
+)
+
+// tableExpiry returns the time at which every entry of the table has
+// expired, from its properties, or 0 if some entries never expire. A table
+// with range deletions never expires as a whole, since they delete entries
+// of older tables.
+func tableExpiry(t *table) int64 {
+	props := t.reader.Properties()
+	if props == nil || props.NumEntries == 0 || props.NumRangeDeletions > 0 {
+		return 0
+	}
+	if n, _ := strconv.ParseUint(props.User[propNumExpiring], 10, 64); n != props.NumEntries {
+		return 0
+	}
+	expiry, _ := strconv.ParseInt(props.User[propMaxExpiry], 10, 64)
+	return expiry
+}
+
+// dropExpiredTables removes the tables of cf whose entries have all expired
+// without compacting them. A table is only dropped when no older table
+// overlaps it, as its entries shadow the older entries of their keys.
+// db.compactMu must be held.
+func (db *DB) dropExpiredTables(cf *ColumnFamily) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := cf.opts.now().UnixNano()
+	var kept, dropped []*table
+	for i, t := range cf.tables {
+		if t.expiry == 0 || t.expiry > now || cf.overlapsOlder(i) {
+			kept = append(kept, t)
+			continue
+		}
+		dropped = append(dropped, t)
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+
+	prevTables := cf.tables
+	cf.tables = kept
+	if err := db.saveManifest(); err != nil {
+		cf.tables = prevTables
+		return err
+	}
+	for _, t := range dropped {
+		t.obsolete.Store(true)
+		t.unref()
+	}
+	return nil
+}
+
+// overlapsOlder reports whether a table after cf.tables[i] in read order,
+// which holds older entries, overlaps it. db.mu must be held.
+func (cf *ColumnFamily) overlapsOlder(i int) bool {
+	t := cf.tables[i]
+	for _, older := range cf.tables[i+1:] {
+		if older.overlaps(t.meta.smallest, t.meta.largest) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package golsm
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/vikramcse/go-lsm/vfs"
+)
+
+// fakeClock is a clock for Options.now that only moves when advanced
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestPutWithTTL(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	db, err := Open("/db", &Options{FS: vfs.NewMem(), now: clock.now})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.PutWithTTL([]byte("a"), []byte("1"), 0); err != ErrInvalidTTL {
+		t.Errorf("Expected ErrInvalidTTL, got %v", err)
+	}
+
+	db.Put([]byte("a"), []byte("old"))
+	db.Flush()
+	if err := db.PutWithTTL([]byte("a"), []byte("short"), time.Minute); err != nil {
+		t.Fatalf("PutWithTTL failed: %v", err)
+	}
+	db.PutWithTTL([]byte("b"), []byte("long"), time.Hour)
+	db.Put([]byte("c"), []byte("forever"))
+	expectValue(t, db, "a", "short")
+	expectEntries(t, collect(t, db, ReadOptions{}), "a=short", "b=long", "c=forever")
+
+	// An expired entry hides the older ones, in the memtable and in tables
+	check := func() {
+		t.Helper()
+		if _, err := db.Get([]byte("a")); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for an expired key, got %v", err)
+		}
+		expectValue(t, db, "b", "long")
+		expectEntries(t, collect(t, db, ReadOptions{}), "b=long", "c=forever")
+	}
+	clock.t = clock.t.Add(2 * time.Minute)
+	check()
+	db.Flush()
+	check()
+
+	props := db.TableProperties()
+	if props[0].NumExpiring != 2 || !props[0].MinExpiry.Equal(time.Unix(1060, 0)) || !props[0].MaxExpiry.Equal(time.Unix(4600, 0)) {
+		t.Errorf("Expected 2 expiring entries from 1060 to 4600, got %d from %v to %v",
+			props[0].NumExpiring, props[0].MinExpiry.Unix(), props[0].MaxExpiry.Unix())
+	}
+
+	// The compaction drops the expired entry along with the value it hid,
+	// and keeps the expiry of the other one
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	check()
+	if props := db.TableProperties(); len(props) != 1 || props[0].NumEntries != 2 || props[0].NumExpiring != 1 {
+		t.Errorf("Expected one table with 2 entries, 1 expiring, got %+v", props)
+	}
+	clock.t = clock.t.Add(time.Hour)
+	if _, err := db.Get([]byte("b")); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound once b expired, got %v", err)
+	}
+}
+
+func TestExpiredTablesDropped(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	db, err := Open("/db", &Options{FS: vfs.NewMem(), now: clock.now})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("a"), []byte("kept"))
+	db.Flush()
+	db.Compact()
+	for i := 0; i < 10; i++ {
+		db.PutWithTTL([]byte(fmt.Sprintf("t%02d", i)), []byte("v"), time.Duration(i+1)*time.Minute)
+	}
+	db.Flush()
+	db.PutWithTTL([]byte("a"), []byte("shadow"), time.Minute)
+	db.Flush()
+
+	// A compaction drops the fully expired tables before picking its inputs
+	dropExpired := func() error {
+		db.compactMu.Lock()
+		defer db.compactMu.Unlock()
+		return db.dropExpiredTables(db.def)
+	}
+
+	// The table of expiring keys only goes once all of them expired, and
+	// the one overlapping an older table is left to the compaction
+	clock.t = clock.t.Add(5 * time.Minute)
+	if err := dropExpired(); err != nil {
+		t.Fatalf("Dropping expired tables failed: %v", err)
+	}
+	if n := len(db.TableProperties()); n != 3 {
+		t.Errorf("Expected 3 tables while entries are live, got %d", n)
+	}
+	clock.t = clock.t.Add(5 * time.Minute)
+	if err := dropExpired(); err != nil {
+		t.Fatalf("Dropping expired tables failed: %v", err)
+	}
+	props := db.TableProperties()
+	if len(props) != 2 || props[0].NumExpiring != 1 || props[1].NumExpiring != 0 {
+		t.Errorf("Expected the fully expired table to be dropped, got %+v", props)
+	}
+	if _, err := db.Get([]byte("a")); err != ErrNotFound {
+		t.Errorf("Expected the expired entry to hide a, got %v", err)
+	}
+	expectEntries(t, collect(t, db, ReadOptions{}))
+}
+
+func TestMergeOntoExpiringValue(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	db, err := Open("/db", &Options{FS: vfs.NewMem(), MergeOperator: NewStringAppendOperator(","), now: clock.now})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	db.PutWithTTL([]byte("mem"), []byte("a"), time.Minute)
+	db.Merge([]byte("mem"), []byte("b"))
+	db.PutWithTTL([]byte("table"), []byte("a"), time.Minute)
+	db.Flush()
+	db.Merge([]byte("table"), []byte("b"))
+	expectValue(t, db, "mem", "a,b")
+	expectValue(t, db, "table", "a,b")
+
+	// The operands outlive the value they were merged onto
+	clock.t = clock.t.Add(time.Hour)
+	expectValue(t, db, "mem", "b")
+	expectValue(t, db, "table", "b")
+	expectEntries(t, collect(t, db, ReadOptions{}), "mem=b", "table=b")
+}
@@ -0,0 +1,527 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Op identifies the filesystem calls a Fault applies to
+type Op int
+
+const (
+	OpCreate Op = iota
+	OpOpen
+	OpRead
+	OpWrite
+	OpSync
+	OpClose
+	OpRename
+	OpRemove
+	OpList
+	OpMkdirAll
+	OpStat
+	OpLock
+	OpSyncDir
+)
+
+var opNames = [...]string{"create", "open", "read", "write", "sync", "close", "rename", "remove", "list", "mkdir", "stat", "lock", "syncdir"}
+
+func (op Op) String() string {
+	if int(op) < len(opNames) {
+		return opNames[op]
+	}
+	return "unknown"
+}
+
+var (
+	// ErrInjected is returned by a call failed by a Fault without an Err
+	ErrInjected = errors.New("injected fault")
+
+	// ErrCrashed is returned by every call made after a crash until the
+	// filesystem is restarted, and by files opened before the crash
+	ErrCrashed = errors.New("filesystem crashed")
+)
+
+// Fault describes a failure to inject into a FaultFS
+type Fault struct {
+	// Op is the call that fails
+	Op Op
+
+	// Path restricts the fault to files whose name contains it. An empty
+	// Path matches every file.
+	Path string
+
+	// After is the number of matching calls that succeed before the fault
+	// fires. A fault fires once.
+	After int
+
+	// Err is returned by the failing call, ErrInjected if nil
+	Err error
+
+	// Torn makes a failing write store the first half of its data before
+	// it returns the error. With Crash set, that half survives the crash.
+	Torn bool
+
+	// Crash crashes the filesystem when the fault fires. The failing call
+	// and every later one return ErrCrashed until Restart is called.
+	Crash bool
+}
+
+// FaultFS wraps an FS to test how its user copes with failures and power
+// loss. Calls fail as described by the injected faults, and a crash loses
+// everything that was not made durable:
+//   - data written to a file since its last Sync
+//   - files created, renamed and removed since the last Sync of their
+//     directory
+//
+// Files written outside of the FaultFS and directories are always durable.
+// It is safe for concurrent use; calls are serialized.
+type FaultFS struct {
+	fs FS
+
+	mu      sync.Mutex
+	faults  []*faultState
+	files   map[string]*faultNode // files written since the last crash
+	pending []dirChange           // directory changes not synced yet, oldest first
+	locks   []*faultLock
+	epoch   int // incremented by each crash, invalidating older files
+	crashed bool
+}
+
+// NewFaultFS returns a FaultFS on top of fs, typically a MemFS
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{fs: fs, files: make(map[string]*faultNode)}
+}
+
+// faultState is an injected fault along with the matching calls it has seen
+type faultState struct {
+	Fault
+	calls int
+}
+
+// faultNode tracks the durability of a file written through the FaultFS
+type faultNode struct {
+	synced int64 // length of the data made durable by Sync
+}
+
+// dirChange is a change to a directory, undone by a crash unless the
+// directory is synced first
+type dirChange struct {
+	dir  string
+	undo func()
+}
+
+// Inject adds a fault. Faults are checked in the order they were injected.
+func (fs *FaultFS) Inject(f Fault) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.faults = append(fs.faults, &faultState{Fault: f})
+}
+
+// Crash simulates a power loss: the changes that were not made durable are
+// lost, files opened so far stop working and locks are released. Every call
+// fails with ErrCrashed until Restart is called.
+func (fs *FaultFS) Crash() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.crash()
+}
+
+// Restart makes the filesystem usable again after a crash, like a reboot.
+// Pending faults are kept.
+func (fs *FaultFS) Restart() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.crashed = false
+}
+
+// crash implements Crash. fs.mu must be held.
+func (fs *FaultFS) crash() {
+	if fs.crashed {
+		return
+	}
+	fs.crashed = true
+	fs.epoch++
+
+	for name, node := range fs.files {
+		fs.truncate(name, node.synced)
+	}
+	fs.files = make(map[string]*faultNode)
+
+	// Newest first, so that each change finds the directory as it left it
+	for i := len(fs.pending) - 1; i >= 0; i-- {
+		fs.pending[i].undo()
+	}
+	fs.pending = nil
+
+	for _, l := range fs.locks {
+		l.release()
+	}
+	fs.locks = nil
+}
+
+// truncate cuts the named file down to size. fs.mu must be held.
+func (fs *FaultFS) truncate(name string, size int64) {
+	data, err := ReadFile(fs.fs, name)
+	if err != nil || int64(len(data)) <= size {
+		return
+	}
+	WriteFile(fs.fs, name, data[:size])
+}
+
+// durableContent returns the part of the named file that survives a crash.
+// fs.mu must be held.
+func (fs *FaultFS) durableContent(name string) ([]byte, error) {
+	data, err := ReadFile(fs.fs, name)
+	if err != nil {
+		return nil, err
+	}
+	if node, ok := fs.files[name]; ok && int64(len(data)) > node.synced {
+		data = data[:node.synced]
+	}
+	return data, nil
+}
+
+// fire returns the fault that fails a call of op on the named files, if
+// any, and removes it. fs.mu must be held.
+func (fs *FaultFS) fire(op Op, names ...string) *Fault {
+	for i, f := range fs.faults {
+		if f.Op != op || !f.matches(names) {
+			continue
+		}
+		if f.calls < f.After {
+			f.calls++
+			continue
+		}
+		fs.faults = append(fs.faults[:i], fs.faults[i+1:]...)
+		return &f.Fault
+	}
+	return nil
+}
+
+func (f *faultState) matches(names []string) bool {
+	for _, name := range names {
+		if strings.Contains(name, f.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns the error a call of op on the named files fails with, if
+// any, crashing the filesystem if the fault asks for it. fs.mu must be held.
+func (fs *FaultFS) check(op Op, names ...string) error {
+	if fs.crashed {
+		return &os.PathError{Op: op.String(), Path: names[0], Err: ErrCrashed}
+	}
+	f := fs.fire(op, names...)
+	if f == nil {
+		return nil
+	}
+	return fs.failWith(op, names[0], f)
+}
+
+// failWith returns the error of a fired fault. fs.mu must be held.
+func (fs *FaultFS) failWith(op Op, name string, f *Fault) error {
+	err := f.Err
+	switch {
+	case f.Crash:
+		fs.crash()
+		err = ErrCrashed
+	case err == nil:
+		err = ErrInjected
+	}
+	return &os.PathError{Op: op.String(), Path: name, Err: err}
+}
+
+func (fs *FaultFS) Create(name string) (File, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.check(OpCreate, name); err != nil {
+		return nil, err
+	}
+	_, statErr := fs.fs.Stat(name)
+	file, err := fs.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if statErr != nil {
+		fs.pending = append(fs.pending, dirChange{
+			dir:  filepath.Dir(name),
+			undo: func() { fs.fs.Remove(name) },
+		})
+	}
+	node := &faultNode{}
+	fs.files[name] = node
+	return &faultFile{fs: fs, file: file, name: name, node: node, epoch: fs.epoch}, nil
+}
+
+func (fs *FaultFS) Open(name string) (File, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.check(OpOpen, name); err != nil {
+		return nil, err
+	}
+	file, err := fs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{fs: fs, file: file, name: name, epoch: fs.epoch}, nil
+}
+
+func (fs *FaultFS) Rename(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.check(OpRename, oldname, newname); err != nil {
+		return err
+	}
+	replaced, replacedErr := fs.durableContent(newname)
+	if err := fs.fs.Rename(oldname, newname); err != nil {
+		return err
+	}
+
+	delete(fs.files, newname)
+	if node, ok := fs.files[oldname]; ok {
+		fs.files[newname] = node
+		delete(fs.files, oldname)
+	}
+	fs.pending = append(fs.pending, dirChange{
+		dir: filepath.Dir(newname),
+		undo: func() {
+			fs.fs.Rename(newname, oldname)
+			if replacedErr == nil {
+				WriteFile(fs.fs, newname, replaced)
+			}
+		},
+	})
+	return nil
+}
+
+func (fs *FaultFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.check(OpRemove, name); err != nil {
+		return err
+	}
+	removed, removedErr := fs.durableContent(name)
+	if err := fs.fs.Remove(name); err != nil {
+		return err
+	}
+
+	delete(fs.files, name)
+	if removedErr == nil {
+		fs.pending = append(fs.pending, dirChange{
+			dir:  filepath.Dir(name),
+			undo: func() { WriteFile(fs.fs, name, removed) },
+		})
+	}
+	return nil
+}
+
+func (fs *FaultFS) List(dir string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.check(OpList, dir); err != nil {
+		return nil, err
+	}
+	return fs.fs.List(dir)
+}
+
+func (fs *FaultFS) MkdirAll(dir string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.check(OpMkdirAll, dir); err != nil {
+		return err
+	}
+	return fs.fs.MkdirAll(dir, perm)
+}
+
+func (fs *FaultFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.check(OpStat, name); err != nil {
+		return nil, err
+	}
+	return fs.fs.Stat(name)
+}
+
+func (fs *FaultFS) Lock(name string) (io.Closer, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.check(OpLock, name); err != nil {
+		return nil, err
+	}
+	closer, err := fs.fs.Lock(name)
+	if err != nil {
+		return nil, err
+	}
+	l := &faultLock{closer: closer}
+	fs.locks = append(fs.locks, l)
+	return l, nil
+}
+
+func (fs *FaultFS) Sync(dir string) error {
+	dir = filepath.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.check(OpSyncDir, dir); err != nil {
+		return err
+	}
+	if err := fs.fs.Sync(dir); err != nil {
+		return err
+	}
+
+	pending := fs.pending[:0]
+	for _, c := range fs.pending {
+		if c.dir != dir {
+			pending = append(pending, c)
+		}
+	}
+	fs.pending = pending
+	return nil
+}
+
+// faultLock is a lock taken through a FaultFS, released by a crash
+type faultLock struct {
+	closer io.Closer
+	once   sync.Once
+	err    error
+}
+
+func (l *faultLock) release() error {
+	l.once.Do(func() { l.err = l.closer.Close() })
+	return l.err
+}
+
+func (l *faultLock) Close() error {
+	return l.release()
+}
+
+// faultFile is a file opened through a FaultFS
+type faultFile struct {
+	fs    *FaultFS
+	file  File
+	name  string
+	node  *faultNode // nil for files opened for reading
+	epoch int
+}
+
+// check is like FaultFS.check, also failing files opened before a crash.
+// f.fs.mu must be held.
+func (f *faultFile) check(op Op) error {
+	if f.epoch != f.fs.epoch {
+		return &os.PathError{Op: op.String(), Path: f.name, Err: ErrCrashed}
+	}
+	return f.fs.check(op, f.name)
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(OpRead); err != nil {
+		return 0, err
+	}
+	return f.file.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(OpRead); err != nil {
+		return 0, err
+	}
+	return f.file.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.epoch != f.fs.epoch || f.fs.crashed {
+		return 0, &os.PathError{Op: OpWrite.String(), Path: f.name, Err: ErrCrashed}
+	}
+	fault := f.fs.fire(OpWrite, f.name)
+	if fault == nil {
+		return f.file.Write(p)
+	}
+
+	var n int
+	if fault.Torn {
+		n, _ = f.file.Write(p[:len(p)/2])
+		if fault.Crash {
+			// The torn write reached the disk before the power went out
+			f.markSynced()
+		}
+	}
+	return n, f.fs.failWith(OpWrite, f.name, fault)
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(OpSync); err != nil {
+		return err
+	}
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+	return f.markSynced()
+}
+
+// markSynced records that the data written so far is durable. f.fs.mu must
+// be held.
+func (f *faultFile) markSynced() error {
+	if f.node == nil {
+		return nil
+	}
+	info, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	f.node.synced = info.Size()
+	return nil
+}
+
+func (f *faultFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	// The underlying file is closed even when the call fails, so that it
+	// does not leak
+	err := f.check(OpClose)
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(OpStat); err != nil {
+		return nil, err
+	}
+	return f.file.Stat()
+}
@@ -0,0 +1,130 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFaultFSCrashLosesUnsyncedChanges(t *testing.T) {
+	fs := NewFaultFS(NewMem())
+	fs.MkdirAll("/db", 0755)
+
+	// A synced file in a synced directory survives
+	if err := WriteFile(fs, "/db/durable", []byte("durable")); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := WriteFile(fs, "/db/old", []byte("old")); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := fs.Sync("/db"); err != nil {
+		t.Fatalf("Failed to sync dir: %v", err)
+	}
+
+	// Only the synced prefix of a file survives
+	file, err := fs.Create("/db/partial")
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	file.Write([]byte("synced"))
+	file.Sync()
+	fs.Sync("/db")
+	file.Write([]byte(" unsynced"))
+
+	// Directory changes that were not synced are undone
+	WriteFile(fs, "/db/new", []byte("new"))
+	fs.Rename("/db/durable", "/db/old")
+
+	fs.Crash()
+	if _, err := file.Write([]byte("x")); !errors.Is(err, ErrCrashed) {
+		t.Errorf("Expected ErrCrashed writing after the crash, got %v", err)
+	}
+	if _, err := fs.List("/db"); !errors.Is(err, ErrCrashed) {
+		t.Errorf("Expected ErrCrashed before Restart, got %v", err)
+	}
+	fs.Restart()
+
+	names, err := fs.List("/db")
+	if err != nil || !reflect.DeepEqual(names, []string{"durable", "old", "partial"}) {
+		t.Errorf("Expected [durable old partial], got %v (err %v)", names, err)
+	}
+	for name, expected := range map[string]string{
+		"/db/durable": "durable",
+		"/db/old":     "old",
+		"/db/partial": "synced",
+	} {
+		if data, err := ReadFile(fs, name); err != nil || string(data) != expected {
+			t.Errorf("Expected %s to hold %q, got %q (err %v)", name, expected, data, err)
+		}
+	}
+}
+
+func TestFaultFSInjectsFaults(t *testing.T) {
+	fs := NewFaultFS(NewMem())
+	fs.MkdirAll("/db", 0755)
+
+	// The second create of a matching file fails
+	errFull := errors.New("disk full")
+	fs.Inject(Fault{Op: OpCreate, Path: ".log", After: 1, Err: errFull})
+	if _, err := fs.Create("/db/a.log"); err != nil {
+		t.Fatalf("Expected the first create to succeed, got %v", err)
+	}
+	if _, err := fs.Create("/db/b.sst"); err != nil {
+		t.Fatalf("Expected a create of another file to succeed, got %v", err)
+	}
+	if _, err := fs.Create("/db/c.log"); !errors.Is(err, errFull) {
+		t.Errorf("Expected the injected error, got %v", err)
+	}
+	if _, err := fs.Create("/db/d.log"); err != nil {
+		t.Errorf("Expected the fault to fire once, got %v", err)
+	}
+
+	// A torn write stores half of its data
+	fs.Inject(Fault{Op: OpWrite, Torn: true})
+	file, _ := fs.Create("/db/torn")
+	if n, err := file.Write([]byte("abcdef")); n != 3 || !errors.Is(err, ErrInjected) {
+		t.Errorf("Expected 3 bytes and ErrInjected, got %d (err %v)", n, err)
+	}
+	if data, _ := ReadFile(fs, "/db/torn"); string(data) != "abc" {
+		t.Errorf("Expected abc, got %q", data)
+	}
+	file.Close()
+
+	// A crash point keeps the torn part of the write and drops the rest
+	fs.Inject(Fault{Op: OpWrite, Path: "crash", After: 1, Torn: true, Crash: true})
+	file, _ = fs.Create("/db/crash")
+	fs.Sync("/db")
+	file.Write([]byte("one"))
+	if err := file.Sync(); err != nil {
+		t.Fatalf("Expected the first sync to succeed, got %v", err)
+	}
+	if _, err := file.Write([]byte("twotwo")); !errors.Is(err, ErrCrashed) {
+		t.Errorf("Expected ErrCrashed, got %v", err)
+	}
+	if err := file.Sync(); !errors.Is(err, ErrCrashed) {
+		t.Errorf("Expected ErrCrashed after the crash point, got %v", err)
+	}
+	fs.Restart()
+	if data, _ := ReadFile(fs, "/db/crash"); string(data) != "onetwo" {
+		t.Errorf("Expected onetwo, got %q", data)
+	}
+
+	// A crash releases locks
+	if _, err := fs.Lock("/db/LOCK"); err != nil {
+		t.Fatalf("Failed to lock: %v", err)
+	}
+	fs.Crash()
+	fs.Restart()
+	lock, err := fs.Lock("/db/LOCK")
+	if err != nil {
+		t.Fatalf("Expected the lock to be released by the crash, got %v", err)
+	}
+	lock.Close()
+
+	var pathErr *os.PathError
+	fs.Inject(Fault{Op: OpRemove})
+	if err := fs.Remove("/db/torn"); !errors.As(err, &pathErr) || pathErr.Op != "remove" {
+		t.Errorf("Expected a remove PathError, got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+//go:build !unix
+
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	lockedMu sync.Mutex
+	locked   = make(map[string]bool)
+)
+
+// processLock releases a lock taken by lockFile
+type processLock struct {
+	name string
+	file *os.File
+}
+
+func (l *processLock) Close() error {
+	lockedMu.Lock()
+	delete(locked, l.name)
+	lockedMu.Unlock()
+	return l.file.Close()
+}
+
+// lockFile creates the named file and locks it within this process only, on
+// platforms without flock
+func lockFile(name string) (io.Closer, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+
+	lockedMu.Lock()
+	defer lockedMu.Unlock()
+	if locked[abs] {
+		return nil, &os.PathError{Op: "lock", Path: name, Err: errors.New("already locked")}
+	}
+
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0664)
+	if err != nil {
+		return nil, err
+	}
+	locked[abs] = true
+	return &processLock{name: abs, file: file}, nil
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package vfs
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on the named file. The lock is tied to
+// the open file, so it is released when the process exits.
+func lockFile(name string) (io.Closer, error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0664)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return nil, &os.PathError{Op: "lock", Path: name, Err: err}
+	}
+	return file, nil
+}
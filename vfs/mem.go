@@ -0,0 +1,340 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errLocked = errors.New("already locked")
+
+// MemFS is an FS kept entirely in memory. Files behave like files on disk
+// that are never lost: data is visible to readers as soon as it is written,
+// and Sync does nothing. It is safe for concurrent use.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]bool
+	locks map[string]bool
+}
+
+// NewMem returns an empty in-memory filesystem holding only the root
+// directory
+func NewMem() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memNode),
+		dirs:  map[string]bool{"/": true, ".": true},
+		locks: make(map[string]bool),
+	}
+}
+
+// memNode is the content of a file, shared by its open handles
+type memNode struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// checkParent returns an error if the directory of name does not exist.
+// fs.mu must be held.
+func (fs *MemFS) checkParent(op, name string) error {
+	if !fs.dirs[filepath.Dir(name)] {
+		return notExist(op, name)
+	}
+	return nil
+}
+
+func (fs *MemFS) Create(name string) (File, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.checkParent("create", name); err != nil {
+		return nil, err
+	}
+	if fs.dirs[name] {
+		return nil, &os.PathError{Op: "create", Path: name, Err: errors.New("is a directory")}
+	}
+
+	// Like O_TRUNC, existing handles see the file emptied
+	node, ok := fs.files[name]
+	if !ok {
+		node = &memNode{}
+		fs.files[name] = node
+	}
+	node.mu.Lock()
+	node.data = node.data[:0]
+	node.modTime = time.Now()
+	node.mu.Unlock()
+
+	return &memFile{name: name, node: node, writable: true}, nil
+}
+
+func (fs *MemFS) Open(name string) (File, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	node, ok := fs.files[name]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	return &memFile{name: name, node: node}, nil
+}
+
+func (fs *MemFS) Rename(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	node, ok := fs.files[oldname]
+	if !ok {
+		return notExist("rename", oldname)
+	}
+	if err := fs.checkParent("rename", newname); err != nil {
+		return err
+	}
+	delete(fs.files, oldname)
+	fs.files[newname] = node
+	return nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+	if fs.dirs[name] {
+		if len(fs.children(name)) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+		delete(fs.dirs, name)
+		return nil
+	}
+	return notExist("remove", name)
+}
+
+// children returns the names of the entries of dir. fs.mu must be held.
+func (fs *MemFS) children(dir string) []string {
+	var names []string
+	for name := range fs.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	for name := range fs.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	return names
+}
+
+func (fs *MemFS) List(dir string) ([]string, error) {
+	dir = filepath.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.dirs[dir] {
+		return nil, notExist("list", dir)
+	}
+	names := fs.children(dir)
+	sort.Strings(names)
+	return names, nil
+}
+
+func (fs *MemFS) MkdirAll(dir string, perm os.FileMode) error {
+	dir = filepath.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for d := dir; !fs.dirs[d]; d = filepath.Dir(d) {
+		if _, ok := fs.files[d]; ok {
+			return &os.PathError{Op: "mkdir", Path: d, Err: errors.New("not a directory")}
+		}
+		fs.dirs[d] = true
+	}
+	return nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if node, ok := fs.files[name]; ok {
+		return node.stat(name), nil
+	}
+	if fs.dirs[name] {
+		return &memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	return nil, notExist("stat", name)
+}
+
+func (fs *MemFS) Lock(name string) (io.Closer, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.checkParent("lock", name); err != nil {
+		return nil, err
+	}
+	if fs.locks[name] {
+		return nil, &os.PathError{Op: "lock", Path: name, Err: errLocked}
+	}
+	if _, ok := fs.files[name]; !ok {
+		fs.files[name] = &memNode{modTime: time.Now()}
+	}
+	fs.locks[name] = true
+	return &memLock{fs: fs, name: name}, nil
+}
+
+func (fs *MemFS) Sync(dir string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.dirs[filepath.Clean(dir)] {
+		return notExist("sync", dir)
+	}
+	return nil
+}
+
+// memLock releases a lock taken with MemFS.Lock
+type memLock struct {
+	fs   *MemFS
+	name string
+	once sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.fs.mu.Lock()
+		delete(l.fs.locks, l.name)
+		l.fs.mu.Unlock()
+	})
+	return nil
+}
+
+// memFile is an open handle on a memNode
+type memFile struct {
+	name     string
+	node     *memNode
+	offset   int64
+	writable bool
+	closed   bool
+}
+
+var errClosed = errors.New("file already closed")
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, errClosed
+	}
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, errClosed
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, errClosed
+	}
+	if !f.writable {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: errors.New("file opened read only")}
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset = end
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return errClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return errClosed
+	}
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, errClosed
+	}
+	return f.node.stat(f.name), nil
+}
+
+func (n *memNode) stat(name string) os.FileInfo {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return &memFileInfo{name: filepath.Base(name), size: int64(len(n.data)), modTime: n.modTime}
+}
+
+// memFileInfo implements os.FileInfo for MemFS entries
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.dir }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+func (fi *memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0664
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package vfs
+
+// Map maps the whole of file into memory. Memory mapping is not supported
+// on this platform, so it always fails.
+func Map(file File) ([]byte, error) {
+	return nil, errMapUnsupported
+}
+
+// Unmap releases a mapping returned by Map
+func Unmap(data []byte) error {
+	return errMapUnsupported
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package vfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Map maps the whole of file into memory, read only. It fails for files
+// that are not backed by the operating system, such as MemFS files, and for
+// empty files.
+func Map(file File) ([]byte, error) {
+	f, ok := file.(interface{ Fd() uintptr })
+	if !ok {
+		return nil, errMapUnsupported
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 || int64(int(info.Size())) != info.Size() {
+		return nil, errors.New("cannot map a file of this size")
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, &os.PathError{Op: "mmap", Path: info.Name(), Err: err}
+	}
+	return data, nil
+}
+
+// Unmap releases a mapping returned by Map
+func Unmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,89 @@
+// Package vfs defines the filesystem interface through which the DB and its
+// SSTable and WAL code do all file I/O, along with an implementation backed
+// by the operating system and one kept entirely in memory for tests.
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+var errMapUnsupported = errors.New("file cannot be memory mapped")
+
+// File is an open file. Files opened with FS.Open are read only; files
+// opened with FS.Create are written sequentially.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+
+	// Sync makes the data written so far durable
+	Sync() error
+
+	// Stat returns information about the file, including its size
+	Stat() (os.FileInfo, error)
+}
+
+// FS is a filesystem. Errors for missing files satisfy
+// errors.Is(err, os.ErrNotExist).
+type FS interface {
+	// Create creates the named file for writing, truncating it if it exists
+	Create(name string) (File, error)
+
+	// Open opens the named file for reading
+	Open(name string) (File, error)
+
+	// Rename renames a file, replacing newname if it exists
+	Rename(oldname, newname string) error
+
+	// Remove removes the named file
+	Remove(name string) error
+
+	// List returns the names of the entries of dir, sorted
+	List(dir string) ([]string, error)
+
+	// MkdirAll creates dir along with any missing parents
+	MkdirAll(dir string, perm os.FileMode) error
+
+	// Stat returns information about the named file
+	Stat(name string) (os.FileInfo, error)
+
+	// Lock acquires an exclusive lock on the named file, creating it if
+	// needed, so that a single process at a time uses what it guards.
+	// Closing the returned Closer releases the lock.
+	Lock(name string) (io.Closer, error)
+
+	// Sync makes the changes to the entries of dir (creates, renames and
+	// removes) durable
+	Sync(dir string) error
+}
+
+// ReadFile reads the whole named file
+func ReadFile(fs FS, name string) ([]byte, error) {
+	file, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// WriteFile writes data to the named file and syncs it, replacing any
+// previous content
+func WriteFile(fs FS, name string, data []byte) error {
+	file, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
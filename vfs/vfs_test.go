@@ -0,0 +1,128 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFS(t *testing.T) {
+	testCases := []struct {
+		name string
+		fs   FS
+		dir  func(t *testing.T) string
+	}{
+		{"os", Default, func(t *testing.T) string { return t.TempDir() }},
+		{"mem", NewMem(), func(t *testing.T) string { return "/db" }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, dir := tc.fs, tc.dir(t)
+			if err := fs.MkdirAll(dir, 0755); err != nil {
+				t.Fatalf("Failed to create dir: %v", err)
+			}
+
+			// Write, then read back sequentially and at an offset
+			name := filepath.Join(dir, "a")
+			if err := WriteFile(fs, name, []byte("hello world")); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+			data, err := ReadFile(fs, name)
+			if err != nil || string(data) != "hello world" {
+				t.Fatalf("Expected hello world, got %q (err %v)", data, err)
+			}
+
+			file, err := fs.Open(name)
+			if err != nil {
+				t.Fatalf("Failed to open file: %v", err)
+			}
+			buf := make([]byte, 5)
+			if n, err := file.ReadAt(buf, 6); n != 5 || string(buf) != "world" {
+				t.Errorf("Expected world at offset 6, got %q (err %v)", buf[:n], err)
+			}
+			if _, err := file.ReadAt(buf, 8); err != io.EOF {
+				t.Errorf("Expected io.EOF reading past the end, got %v", err)
+			}
+			if info, err := file.Stat(); err != nil || info.Size() != 11 {
+				t.Errorf("Expected size 11, got %v (err %v)", info, err)
+			}
+			file.Close()
+
+			// Create truncates
+			if err := WriteFile(fs, name, []byte("hi")); err != nil {
+				t.Fatalf("Failed to rewrite file: %v", err)
+			}
+			if info, err := fs.Stat(name); err != nil || info.Size() != 2 {
+				t.Errorf("Expected size 2 after truncation, got %v (err %v)", info, err)
+			}
+
+			if err := fs.Rename(name, filepath.Join(dir, "b")); err != nil {
+				t.Fatalf("Failed to rename: %v", err)
+			}
+			if _, err := fs.Open(name); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Expected os.ErrNotExist for renamed file, got %v", err)
+			}
+			if err := WriteFile(fs, filepath.Join(dir, "c"), nil); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+			if err := fs.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+				t.Fatalf("Failed to create subdir: %v", err)
+			}
+
+			names, err := fs.List(dir)
+			if err != nil || !reflect.DeepEqual(names, []string{"b", "c", "sub"}) {
+				t.Errorf("Expected [b c sub], got %v (err %v)", names, err)
+			}
+
+			if err := fs.Remove(filepath.Join(dir, "b")); err != nil {
+				t.Fatalf("Failed to remove: %v", err)
+			}
+			if err := fs.Remove(filepath.Join(dir, "b")); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Expected os.ErrNotExist removing twice, got %v", err)
+			}
+			if err := fs.Sync(dir); err != nil {
+				t.Errorf("Failed to sync dir: %v", err)
+			}
+			if _, err := fs.Create(filepath.Join(dir, "missing", "x")); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Expected os.ErrNotExist creating in a missing dir, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFSLock(t *testing.T) {
+	testCases := []struct {
+		name string
+		fs   FS
+		dir  func(t *testing.T) string
+	}{
+		{"os", Default, func(t *testing.T) string { return t.TempDir() }},
+		{"mem", NewMem(), func(t *testing.T) string { return "/" }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			name := filepath.Join(tc.dir(t), "LOCK")
+			lock, err := tc.fs.Lock(name)
+			if err != nil {
+				t.Fatalf("Failed to lock: %v", err)
+			}
+			if _, err := tc.fs.Lock(name); err == nil {
+				t.Fatalf("Expected the second lock to fail")
+			}
+
+			if err := lock.Close(); err != nil {
+				t.Fatalf("Failed to unlock: %v", err)
+			}
+			lock, err = tc.fs.Lock(name)
+			if err != nil {
+				t.Fatalf("Failed to lock again: %v", err)
+			}
+			lock.Close()
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package golsm
+
+import "sync/atomic"
+
+// WriteBufferManager tracks the memory used by every MemTable that shares it
+// and caps the total. A single manager is normally created per process and
+// handed to all memtables, so that flushes are driven by the global total
+// rather than by each memtable's size in isolation.
+type WriteBufferManager struct {
+	bufferSize int64        // memory budget shared by all memtables, 0 disables the cap
+	usage      atomic.Int64 // bytes currently reserved by live memtables
+	mutable    atomic.Int64 // part of usage reserved by memtables still taking writes
+}
+
+// NewWriteBufferManager creates a manager with the given memory budget in
+// bytes. A bufferSize of 0 only tracks usage and never asks for a flush.
+func NewWriteBufferManager(bufferSize int64) *WriteBufferManager {
+	return &WriteBufferManager{
+		bufferSize: bufferSize,
+	}
+}
+
+// ReserveMem records n more bytes as used by a memtable. Negative values are
+// allowed and shrink the reservation, e.g. when a value is overwritten by a
+// smaller one.
+func (w *WriteBufferManager) ReserveMem(n int64) {
+	w.usage.Add(n)
+	w.mutable.Add(n)
+}
+
+// ScheduleFreeMem records that a memtable holding n bytes stopped taking
+// writes and is waiting to be flushed. The bytes stay reserved until FreeMem.
+func (w *WriteBufferManager) ScheduleFreeMem(n int64) {
+	w.mutable.Add(-n)
+}
+
+// FreeMem returns n bytes to the budget, typically once a memtable has been
+// flushed and dropped.
+func (w *WriteBufferManager) FreeMem(n int64) {
+	w.usage.Add(-n)
+}
+
+// MutableMemoryUsage returns the number of bytes reserved by memtables that
+// still take writes
+func (w *WriteBufferManager) MutableMemoryUsage() int64 {
+	return w.mutable.Load()
+}
+
+// MemoryUsage returns the number of bytes currently reserved
+func (w *WriteBufferManager) MemoryUsage() int64 {
+	return w.usage.Load()
+}
+
+// BufferSize returns the memory budget of the manager
+func (w *WriteBufferManager) BufferSize() int64 {
+	return w.bufferSize
+}
+
+// ShouldFlush reports whether a memtable sharing this manager has to be
+// flushed: when the memtables taking writes use 7/8 of the budget, or when
+// the whole budget is used and they hold at least half of it. Memory of
+// memtables already waiting for a flush is only freed by the flush, so
+// switching more small memtables would not help.
+func (w *WriteBufferManager) ShouldFlush() bool {
+	if w.bufferSize <= 0 {
+		return false
+	}
+	mutable := w.mutable.Load()
+	if mutable >= w.bufferSize-w.bufferSize/8 {
+		return true
+	}
+	return w.usage.Load() >= w.bufferSize && mutable >= w.bufferSize/2
+}